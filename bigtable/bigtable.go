@@ -26,6 +26,7 @@ import (
 
 	btopt "github.com/smyte/google-cloud-go/bigtable/internal/option"
 	"github.com/smyte/google-cloud-go/internal/trace"
+	"github.com/smyte/google-cloud-go/internal/unknownfields"
 	"github.com/smyte/google-cloud-go/internal/version"
 	"github.com/golang/protobuf/proto"
 	gax "github.com/googleapis/gax-go/v2"
@@ -48,6 +49,7 @@ type Client struct {
 	client            btpb.BigtableClient
 	project, instance string
 	appProfile        string
+	interceptor       func(context.Context, *AttemptInfo)
 }
 
 // ClientConfig has configurations for the client.
@@ -55,6 +57,12 @@ type ClientConfig struct {
 	// The id of the app profile to associate with all data operations sent from this client.
 	// If unspecified, the default app profile for the instance will be used.
 	AppProfile string
+
+	// Interceptor, if non-nil, is called after every RPC attempt made by a
+	// data operation, including attempts that are retried by the client
+	// and so are otherwise invisible to the caller. It is called synchronously
+	// and must be safe for concurrent use.
+	Interceptor func(ctx context.Context, info *AttemptInfo)
 }
 
 // NewClient creates a new Client for a given project and instance.
@@ -84,11 +92,12 @@ func NewClientWithConfig(ctx context.Context, project, instance string, config C
 	}
 
 	return &Client{
-		conn:       conn,
-		client:     btpb.NewBigtableClient(conn),
-		project:    project,
-		instance:   instance,
-		appProfile: config.AppProfile,
+		conn:        conn,
+		client:      btpb.NewBigtableClient(conn),
+		project:     project,
+		instance:    instance,
+		appProfile:  config.AppProfile,
+		interceptor: config.Interceptor,
 	}, nil
 }
 
@@ -172,15 +181,19 @@ func (c *Client) Open(table string) *Table {
 // f owns its argument, and f is called serially in order by row key.
 //
 // By default, the yielded rows will contain all values in all cells.
-// Use RowFilter to limit the cells returned.
+// Use RowFilter to limit the cells returned. With the ReverseScan option,
+// f is called in descending order by row key instead.
 func (t *Table) ReadRows(ctx context.Context, arg RowSet, f func(Row) bool, opts ...ReadOption) (err error) {
 	ctx = mergeOutgoingMetadata(ctx, withGoogleClientInfo(), t.md)
 	ctx = trace.StartSpan(ctx, "github.com/smyte/google-cloud-go/bigtable.ReadRows")
 	defer func() { trace.EndSpan(ctx, err) }()
+	op := t.startOperation(ctx, "ReadRows")
+	defer func() { op.end(err) }()
 
 	var prevRowKey string
+	reversed := isReverseScan(opts)
 	attrMap := make(map[string]interface{})
-	err = gax.Invoke(ctx, func(ctx context.Context, _ gax.CallSettings) error {
+	err = gax.Invoke(ctx, func(ctx context.Context, _ gax.CallSettings) (err error) {
 		if !arg.valid() {
 			// Empty row set, no need to make an API call.
 			// NOTE: we must return early if arg == RowList{} because reading
@@ -198,20 +211,33 @@ func (t *Table) ReadRows(ctx context.Context, arg RowSet, f func(Row) bool, opts
 		ctx, cancel := context.WithCancel(ctx) // for aborting the stream
 		defer cancel()
 
+		endAttempt := op.startAttempt()
+		defer func() { endAttempt(err, 0) }()
 		startTime := time.Now()
 		stream, err := t.c.client.ReadRows(ctx, req)
 		if err != nil {
 			return err
 		}
 		cr := newChunkReader()
+		cr.reversed = reversed
 		for {
 			res, err := stream.Recv()
 			if err == io.EOF {
+				// A row may span responses, so the stream must end on a
+				// row boundary but a response need not.
+				if err := cr.Close(); err != nil {
+					// No need to prepare for a retry, this is an unretryable error.
+					return err
+				}
 				break
 			}
 			if err != nil {
 				// Reset arg for next Invoke call.
-				arg = arg.retainRowsAfter(prevRowKey)
+				if reversed {
+					arg = arg.retainRowsBefore(prevRowKey)
+				} else {
+					arg = arg.retainRowsAfter(prevRowKey)
+				}
 				attrMap["rowKey"] = prevRowKey
 				attrMap["error"] = err.Error()
 				attrMap["time_secs"] = time.Since(startTime).Seconds()
@@ -232,6 +258,7 @@ func (t *Table) ReadRows(ctx context.Context, arg RowSet, f func(Row) bool, opts
 					continue
 				}
 				prevRowKey = row.Key()
+				op.record(RowsReturned.M(1), BytesReturned.M(row.valueSize()))
 				if !f(row) {
 					// Cancel and drain stream.
 					cancel()
@@ -244,10 +271,6 @@ func (t *Table) ReadRows(ctx context.Context, arg RowSet, f func(Row) bool, opts
 					}
 				}
 			}
-			if err := cr.Close(); err != nil {
-				// No need to prepare for a retry, this is an unretryable error.
-				return err
-			}
 		}
 		return err
 	}, retryOptions...)
@@ -291,6 +314,11 @@ type RowSet interface {
 	// given row key or any row key lexicographically less than it.
 	retainRowsAfter(lastRowKey string) RowSet
 
+	// retainRowsBefore returns a new RowSet that does not include the
+	// given row key or any row key lexicographically greater than it.
+	// It is used to resume reverse scans.
+	retainRowsBefore(lastRowKey string) RowSet
+
 	// Valid reports whether this set can cover at least one row.
 	valid() bool
 }
@@ -316,6 +344,16 @@ func (r RowList) retainRowsAfter(lastRowKey string) RowSet {
 	return retryKeys
 }
 
+func (r RowList) retainRowsBefore(lastRowKey string) RowSet {
+	var retryKeys RowList
+	for _, key := range r {
+		if key < lastRowKey {
+			retryKeys = append(retryKeys, key)
+		}
+	}
+	return retryKeys
+}
+
 func (r RowList) valid() bool {
 	return len(r) > 0
 }
@@ -378,6 +416,14 @@ func (r RowRange) retainRowsAfter(lastRowKey string) RowSet {
 	return NewRange(start, r.limit)
 }
 
+func (r RowRange) retainRowsBefore(lastRowKey string) RowSet {
+	if lastRowKey == "" || (!r.Unbounded() && lastRowKey >= r.limit) {
+		return r
+	}
+	// Set the end of the range to the last row scanned, which is excluded.
+	return NewRange(r.start, lastRowKey)
+}
+
 func (r RowRange) valid() bool {
 	return r.Unbounded() || r.start < r.limit
 }
@@ -409,6 +455,21 @@ func (r RowRangeList) retainRowsAfter(lastRowKey string) RowSet {
 	return ranges
 }
 
+func (r RowRangeList) retainRowsBefore(lastRowKey string) RowSet {
+	if lastRowKey == "" {
+		return r
+	}
+	// Return a list of any range that has not yet been completely processed
+	var ranges RowRangeList
+	for _, rr := range r {
+		retained := rr.retainRowsBefore(lastRowKey)
+		if retained.valid() {
+			ranges = append(ranges, retained.(RowRange))
+		}
+	}
+	return ranges
+}
+
 func (r RowRangeList) valid() bool {
 	for _, rr := range r {
 		if rr.valid() {
@@ -480,6 +541,64 @@ type limitRows struct{ limit int64 }
 
 func (lr limitRows) set(req *btpb.ReadRowsRequest) { req.RowsLimit = lr.limit }
 
+// ReverseScan returns a ReadOption that makes ReadRows return rows in
+// descending order by row key. Combined with LimitRows, it reads the last N
+// rows of a range, such as the latest events under a key prefix.
+func ReverseScan() ReadOption { return reverseScan{} }
+
+type reverseScan struct{}
+
+// reversedFieldNumber is the number of the field `bool reversed` of
+// ReadRowsRequest. The field is newer than the generated ReadRowsRequest, so
+// it is sent as an unrecognized field.
+const reversedFieldNumber = 7
+
+func (reverseScan) set(req *btpb.ReadRowsRequest) {
+	req.XXX_unrecognized = unknownfields.AppendVarint(req.XXX_unrecognized, reversedFieldNumber, 1)
+}
+
+// isReverseScan reports whether opts include ReverseScan.
+func isReverseScan(opts []ReadOption) bool {
+	for _, opt := range opts {
+		if _, ok := opt.(reverseScan); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadPage reads a page of at most pageSize rows from arg, in the order
+// ReadRows would return them. It returns the rows and a cursor to pass to
+// the next call to resume after the last returned row. Pass an empty cursor
+// to read the first page. The returned cursor is empty once arg is exhausted.
+//
+// The same arg and opts should be passed for every page; opts must not
+// include LimitRows.
+func (t *Table) ReadPage(ctx context.Context, arg RowSet, cursor string, pageSize int, opts ...ReadOption) (rows []Row, next string, err error) {
+	if pageSize <= 0 {
+		return nil, "", errors.New("bigtable: ReadPage needs a positive page size")
+	}
+	if cursor != "" {
+		if isReverseScan(opts) {
+			arg = arg.retainRowsBefore(cursor)
+		} else {
+			arg = arg.retainRowsAfter(cursor)
+		}
+	}
+	opts = append(opts[:len(opts):len(opts)], LimitRows(int64(pageSize)))
+	err = t.ReadRows(ctx, arg, func(r Row) bool {
+		rows = append(rows, r)
+		return len(rows) < pageSize
+	}, opts...)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(rows) == pageSize {
+		next = rows[len(rows)-1].Key()
+	}
+	return rows, next, nil
+}
+
 // mutationsAreRetryable returns true if all mutations are idempotent
 // and therefore retryable. A mutation is idempotent iff all cell timestamps
 // have an explicit timestamp set and do not rely on the timestamp being set on the server.
@@ -502,6 +621,12 @@ func (t *Table) Apply(ctx context.Context, row string, m *Mutation, opts ...Appl
 	ctx = mergeOutgoingMetadata(ctx, withGoogleClientInfo(), t.md)
 	ctx = trace.StartSpan(ctx, "github.com/smyte/google-cloud-go/bigtable/Apply")
 	defer func() { trace.EndSpan(ctx, err) }()
+	var op *operation
+	defer func() {
+		if op != nil {
+			op.end(err)
+		}
+	}()
 
 	after := func(res proto.Message) {
 		for _, o := range opts {
@@ -521,9 +646,12 @@ func (t *Table) Apply(ctx context.Context, row string, m *Mutation, opts ...Appl
 			callOptions = retryOptions
 		}
 		var res *btpb.MutateRowResponse
+		op = t.startOperation(ctx, "MutateRow")
 		err := gax.Invoke(ctx, func(ctx context.Context, _ gax.CallSettings) error {
 			var err error
+			endAttempt := op.startAttempt()
 			res, err = t.c.client.MutateRow(ctx, req)
+			endAttempt(err, 0)
 			return err
 		}, callOptions...)
 		if err == nil {
@@ -554,9 +682,12 @@ func (t *Table) Apply(ctx context.Context, row string, m *Mutation, opts ...Appl
 		callOptions = retryOptions
 	}
 	var cmRes *btpb.CheckAndMutateRowResponse
+	op = t.startOperation(ctx, "CheckAndMutateRow")
 	err = gax.Invoke(ctx, func(ctx context.Context, _ gax.CallSettings) error {
 		var err error
+		endAttempt := op.startAttempt()
 		cmRes, err = t.c.client.CheckAndMutateRow(ctx, req)
+		endAttempt(err, 0)
 		return err
 	}, callOptions...)
 	if err == nil {
@@ -678,6 +809,8 @@ func (t *Table) ApplyBulk(ctx context.Context, rowKeys []string, muts []*Mutatio
 	ctx = mergeOutgoingMetadata(ctx, withGoogleClientInfo(), t.md)
 	ctx = trace.StartSpan(ctx, "github.com/smyte/google-cloud-go/bigtable/ApplyBulk")
 	defer func() { trace.EndSpan(ctx, err) }()
+	op := t.startOperation(ctx, "MutateRows")
+	defer func() { op.end(err) }()
 
 	if len(rowKeys) != len(muts) {
 		return nil, fmt.Errorf("mismatched rowKeys and mutation array lengths: %d, %d", len(rowKeys), len(muts))
@@ -693,11 +826,15 @@ func (t *Table) ApplyBulk(ctx context.Context, rowKeys []string, muts []*Mutatio
 	}
 
 	for _, group := range groupEntries(origEntries, maxMutations) {
+		// The first attempt for each group is not a retry.
+		op.restartAttempts()
 		attrMap := make(map[string]interface{})
 		err = gax.Invoke(ctx, func(ctx context.Context, _ gax.CallSettings) error {
 			attrMap["rowCount"] = len(group)
 			trace.TracePrintf(ctx, attrMap, "Row count in ApplyBulk")
+			endAttempt := op.startAttempt()
 			err := t.doApplyBulk(ctx, group, opts...)
+			endAttempt(err, countEntryErrs(group))
 			if err != nil {
 				// We want to retry the entire request with the current group
 				return err
@@ -725,11 +862,23 @@ func (t *Table) ApplyBulk(ctx context.Context, rowKeys []string, muts []*Mutatio
 		errs = append(errs, entry.Err)
 	}
 	if foundErr {
+		op.record(FailedMutations.M(int64(countEntryErrs(origEntries))))
 		return errs, nil
 	}
 	return nil, nil
 }
 
+// countEntryErrs returns the number of entries that have an error.
+func countEntryErrs(entries []*entryErr) int {
+	n := 0
+	for _, entry := range entries {
+		if entry.Err != nil {
+			n++
+		}
+	}
+	return n
+}
+
 // getApplyBulkRetries returns the entries that need to be retried
 func (t *Table) getApplyBulkRetries(entries []*entryErr) []*entryErr {
 	var retryEntries []*entryErr
@@ -839,15 +988,19 @@ func (ts Timestamp) TruncateToMilliseconds() Timestamp {
 
 // ApplyReadModifyWrite applies a ReadModifyWrite to a specific row.
 // It returns the newly written cells.
-func (t *Table) ApplyReadModifyWrite(ctx context.Context, row string, m *ReadModifyWrite) (Row, error) {
+func (t *Table) ApplyReadModifyWrite(ctx context.Context, row string, m *ReadModifyWrite) (_ Row, err error) {
 	ctx = mergeOutgoingMetadata(ctx, withGoogleClientInfo(), t.md)
+	op := t.startOperation(ctx, "ReadModifyWriteRow")
+	defer func() { op.end(err) }()
 	req := &btpb.ReadModifyWriteRowRequest{
 		TableName:    t.c.fullTableName(t.table),
 		AppProfileId: t.c.appProfile,
 		RowKey:       []byte(row),
 		Rules:        m.ops,
 	}
+	endAttempt := op.startAttempt()
 	res, err := t.c.client.ReadModifyWriteRow(ctx, req)
+	endAttempt(err, 0)
 	if err != nil {
 		return nil, err
 	}
@@ -900,10 +1053,14 @@ func (m *ReadModifyWrite) Increment(family, column string, delta int64) {
 
 // SampleRowKeys returns a sample of row keys in the table. The returned row keys will delimit contiguous sections of
 // the table of approximately equal size, which can be used to break up the data for distributed tasks like mapreduces.
-func (t *Table) SampleRowKeys(ctx context.Context) ([]string, error) {
+func (t *Table) SampleRowKeys(ctx context.Context) (_ []string, err error) {
 	ctx = mergeOutgoingMetadata(ctx, withGoogleClientInfo(), t.md)
+	op := t.startOperation(ctx, "SampleRowKeys")
+	defer func() { op.end(err) }()
 	var sampledRowKeys []string
-	err := gax.Invoke(ctx, func(ctx context.Context, _ gax.CallSettings) error {
+	err = gax.Invoke(ctx, func(ctx context.Context, _ gax.CallSettings) (err error) {
+		endAttempt := op.startAttempt()
+		defer func() { endAttempt(err, 0) }()
 		sampledRowKeys = nil
 		req := &btpb.SampleRowKeysRequest{
 			TableName:    t.c.fullTableName(t.table),
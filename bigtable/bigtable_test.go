@@ -248,3 +248,52 @@ func TestReadRowsInvalidRowSet(t *testing.T) {
 		}
 	}
 }
+
+func TestReadPage(t *testing.T) {
+	ctx := context.Background()
+	tbl, cleanup, err := setupFakeServer()
+	if err != nil {
+		t.Fatalf("fake server setup: %v", err)
+	}
+	defer cleanup()
+
+	keys := []string{"user#1", "user#2", "user#3", "user#4", "user#5", "zzz"}
+	for _, key := range keys {
+		mut := NewMutation()
+		mut.Set("cf", "col", 1000, []byte("v"))
+		if err := tbl.Apply(ctx, key, mut); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	readAll := func(opts ...ReadOption) [][]string {
+		var pages [][]string
+		cursor := ""
+		for {
+			rows, next, err := tbl.ReadPage(ctx, PrefixRange("user#"), cursor, 2, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var page []string
+			for _, r := range rows {
+				page = append(page, r.Key())
+			}
+			pages = append(pages, page)
+			if next == "" {
+				return pages
+			}
+			cursor = next
+		}
+	}
+
+	got := readAll()
+	want := [][]string{{"user#1", "user#2"}, {"user#3", "user#4"}, {"user#5"}}
+	if !cmp.Equal(got, want) {
+		t.Errorf("forward pages: got %v, want %v", got, want)
+	}
+	got = readAll(ReverseScan())
+	want = [][]string{{"user#5", "user#4"}, {"user#3", "user#2"}, {"user#1"}}
+	if !cmp.Equal(got, want) {
+		t.Errorf("reverse pages: got %v, want %v", got, want)
+	}
+}
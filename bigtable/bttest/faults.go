@@ -0,0 +1,196 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bttest
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	btpb "google.golang.org/genproto/googleapis/bigtable/v2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// A Fault describes errors that a Server injects into calls of a data
+// method, such as ReadRows or MutateRows, to test how clients handle them.
+type Fault struct {
+	// Method is the name of the method whose calls fail: one of "ReadRows",
+	// "SampleRowKeys", "MutateRow", "MutateRows", "CheckAndMutateRow" and
+	// "ReadModifyWriteRow".
+	Method string
+
+	// If Nth is positive, only the Nth call of Method after the fault is
+	// injected fails, counting from 1. Otherwise each call fails with
+	// probability Probability.
+	Nth         int
+	Probability float64
+
+	// Code is the code of the injected error. The default is Unavailable.
+	Code codes.Code
+
+	// AfterChunks applies to ReadRows. If positive, the call sends this many
+	// cell chunks before failing, so the stream may break in the middle of a
+	// row. A call that would send fewer chunks succeeds.
+	AfterChunks int
+
+	// FailEntries applies to MutateRows. If non-empty, the call succeeds but
+	// the entries with these indexes fail with Code without being applied.
+	FailEntries []int
+}
+
+func (f *Fault) err() error {
+	code := f.Code
+	if code == codes.OK {
+		code = codes.Unavailable
+	}
+	return status.Errorf(code, "bttest: injected %s fault", f.Method)
+}
+
+// InjectFault adds a fault to the server. Faults stay in effect until they
+// are cleared with ClearFaults, except that a fault with a positive Nth is
+// removed once it has been triggered. If several faults affect a call, the
+// one injected first applies.
+func (s *Server) InjectFault(f Fault) {
+	s.s.faults.mu.Lock()
+	defer s.s.faults.mu.Unlock()
+	s.s.faults.faults = append(s.s.faults.faults, &injectedFault{Fault: f})
+}
+
+// SetLatency adds an artificial delay of d to every call of the named data
+// method. A zero d removes the delay. A call whose context ends during the
+// delay fails with the context's error.
+func (s *Server) SetLatency(method string, d time.Duration) {
+	s.s.faults.mu.Lock()
+	defer s.s.faults.mu.Unlock()
+	if d == 0 {
+		delete(s.s.faults.latency, method)
+	} else {
+		s.s.faults.latency[method] = d
+	}
+}
+
+// ClearFaults removes all faults and latencies from the server.
+func (s *Server) ClearFaults() {
+	s.s.faults.mu.Lock()
+	defer s.s.faults.mu.Unlock()
+	s.s.faults.faults = nil
+	s.s.faults.latency = make(map[string]time.Duration)
+}
+
+type injectedFault struct {
+	Fault
+	calls int // calls of Method so far
+}
+
+// faultInjector holds the faults and latencies of a server.
+type faultInjector struct {
+	mu      sync.Mutex
+	faults  []*injectedFault
+	latency map[string]time.Duration // keyed by method
+}
+
+func newFaultInjector() *faultInjector {
+	return &faultInjector{latency: make(map[string]time.Duration)}
+}
+
+// start is called at the start of each call of a data method. It waits for
+// the method's latency and returns the fault that the call should suffer,
+// or nil. It returns an error if ctx ends while waiting.
+// A nil faultInjector injects nothing.
+func (fi *faultInjector) start(ctx context.Context, method string) (*Fault, error) {
+	if fi == nil {
+		return nil, nil
+	}
+	fi.mu.Lock()
+	d := fi.latency[method]
+	var fault *Fault
+	for i, f := range fi.faults {
+		if f.Method != method {
+			continue
+		}
+		f.calls++
+		if fault != nil {
+			continue
+		}
+		if f.Nth > 0 {
+			if f.calls == f.Nth {
+				fault = &f.Fault
+				fi.faults = append(fi.faults[:i:i], fi.faults[i+1:]...)
+			}
+		} else if rand.Float64() < f.Probability {
+			fault = &f.Fault
+		}
+	}
+	fi.mu.Unlock()
+
+	if d > 0 {
+		t := time.NewTimer(d)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded {
+				return nil, status.Error(codes.DeadlineExceeded, ctx.Err().Error())
+			}
+			return nil, status.Error(codes.Canceled, ctx.Err().Error())
+		}
+	}
+	return fault, nil
+}
+
+// startStream is like start for streaming methods. It does not use the
+// stream if the server has no fault injector.
+func (fi *faultInjector) startStream(stream grpc.ServerStream, method string) (*Fault, error) {
+	if fi == nil {
+		return nil, nil
+	}
+	return fi.start(stream.Context(), method)
+}
+
+// failEntries returns the indexes of the MutateRows entries that fail.
+func (f *Fault) failEntries() map[int]bool {
+	m := make(map[int]bool)
+	for _, i := range f.FailEntries {
+		m[i] = true
+	}
+	return m
+}
+
+// brokenReadRowsServer is a ReadRows stream that fails after sending a
+// number of chunks.
+type brokenReadRowsServer struct {
+	btpb.Bigtable_ReadRowsServer
+	left int // chunks left to send
+	err  error
+}
+
+func (s *brokenReadRowsServer) Send(res *btpb.ReadRowsResponse) error {
+	if len(res.Chunks) < s.left {
+		s.left -= len(res.Chunks)
+		return s.Bigtable_ReadRowsServer.Send(res)
+	}
+	if s.left > 0 {
+		if err := s.Bigtable_ReadRowsServer.Send(&btpb.ReadRowsResponse{Chunks: res.Chunks[:s.left]}); err != nil {
+			return err
+		}
+		s.left = 0
+	}
+	return s.err
+}
@@ -0,0 +1,178 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bttest_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/smyte/google-cloud-go/bigtable"
+	"github.com/smyte/google-cloud-go/bigtable/bttest"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func newFaultTestTable(t *testing.T) (*bttest.Server, *bigtable.Table, func()) {
+	t.Helper()
+	ctx := context.Background()
+	srv, err := bttest.NewServer("localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := grpc.Dial(srv.Addr, grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	adminClient, err := bigtable.NewAdminClient(ctx, "proj", "instance", option.WithGRPCConn(conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := adminClient.CreateTable(ctx, "t"); err != nil {
+		t.Fatal(err)
+	}
+	if err := adminClient.CreateColumnFamily(ctx, "t", "cf"); err != nil {
+		t.Fatal(err)
+	}
+	client, err := bigtable.NewClient(ctx, "proj", "instance", option.WithGRPCConn(conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return srv, client.Open("t"), func() {
+		client.Close()
+		adminClient.Close()
+		srv.Close()
+	}
+}
+
+func TestFaultReadRowsMidRow(t *testing.T) {
+	ctx := context.Background()
+	srv, tbl, cleanup := newFaultTestTable(t)
+	defer cleanup()
+
+	for i := 0; i < 3; i++ {
+		mut := bigtable.NewMutation()
+		mut.Set("cf", "a", 1000, []byte("1"))
+		mut.Set("cf", "b", 1000, []byte("2"))
+		if err := tbl.Apply(ctx, fmt.Sprintf("row%d", i), mut); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Break the stream in the middle of the second row. The client retries
+	// from the first row it has not read in full.
+	srv.InjectFault(bttest.Fault{Method: "ReadRows", Nth: 1, AfterChunks: 3})
+	var keys []string
+	err := tbl.ReadRows(ctx, bigtable.InfiniteRange(""), func(r bigtable.Row) bool {
+		if len(r["cf"]) != 2 {
+			t.Errorf("row %q has %d cells, want 2", r.Key(), len(r["cf"]))
+		}
+		keys = append(keys, r.Key())
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fmt.Sprint(keys), "[row0 row1 row2]"; got != want {
+		t.Errorf("read rows %s, want %s", got, want)
+	}
+
+	srv.InjectFault(bttest.Fault{Method: "ReadRows", Probability: 1, Code: codes.PermissionDenied})
+	_, err = tbl.ReadRow(ctx, "row0")
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("ReadRow with fault: got %v, want PermissionDenied", err)
+	}
+	srv.ClearFaults()
+	if _, err := tbl.ReadRow(ctx, "row0"); err != nil {
+		t.Errorf("ReadRow after ClearFaults: %v", err)
+	}
+}
+
+func TestFaultMutateRowsEntries(t *testing.T) {
+	ctx := context.Background()
+	srv, tbl, cleanup := newFaultTestTable(t)
+	defer cleanup()
+
+	var keys []string
+	var muts []*bigtable.Mutation
+	for i := 0; i < 4; i++ {
+		mut := bigtable.NewMutation()
+		mut.Set("cf", "a", 1000, []byte("v"))
+		keys = append(keys, fmt.Sprintf("row%d", i))
+		muts = append(muts, mut)
+	}
+
+	// The client retries the failed entries.
+	srv.InjectFault(bttest.Fault{Method: "MutateRows", Nth: 1, FailEntries: []int{1, 3}})
+	errs, err := tbl.ApplyBulk(ctx, keys, muts)
+	if err != nil || errs != nil {
+		t.Fatalf("ApplyBulk: %v, %v", errs, err)
+	}
+	n := 0
+	if err := tbl.ReadRows(ctx, bigtable.InfiniteRange(""), func(bigtable.Row) bool { n++; return true }); err != nil {
+		t.Fatal(err)
+	}
+	if n != 4 {
+		t.Errorf("read %d rows, want 4", n)
+	}
+
+	// Entries failing with a code that is not retried are reported.
+	srv.InjectFault(bttest.Fault{Method: "MutateRows", Probability: 1, FailEntries: []int{2}, Code: codes.FailedPrecondition})
+	errs, err = tbl.ApplyBulk(ctx, keys, muts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, err := range errs {
+		if (i == 2) != (status.Code(err) == codes.FailedPrecondition) {
+			t.Errorf("entry %d: got error %v", i, err)
+		}
+	}
+}
+
+func TestFaultNthAndLatency(t *testing.T) {
+	ctx := context.Background()
+	srv, tbl, cleanup := newFaultTestTable(t)
+	defer cleanup()
+
+	srv.InjectFault(bttest.Fault{Method: "CheckAndMutateRow", Nth: 2, Code: codes.FailedPrecondition})
+	cond := bigtable.NewCondMutation(bigtable.PassAllFilter(), nil, bigtable.NewMutation())
+	for i, want := range []codes.Code{codes.OK, codes.FailedPrecondition, codes.OK} {
+		if err := tbl.Apply(ctx, "row", cond); status.Code(err) != want {
+			t.Errorf("call %d: got %v, want %v", i+1, err, want)
+		}
+	}
+
+	srv.SetLatency("ReadModifyWriteRow", 50*time.Millisecond)
+	rmw := bigtable.NewReadModifyWrite()
+	rmw.Increment("cf", "n", 1)
+	start := time.Now()
+	if _, err := tbl.ApplyReadModifyWrite(ctx, "row", rmw); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Errorf("call took %v, want at least 50ms", d)
+	}
+
+	ctx2, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if _, err := tbl.ApplyReadModifyWrite(ctx2, "row", rmw); status.Code(err) != codes.DeadlineExceeded {
+		t.Errorf("call with short deadline: got %v, want DeadlineExceeded", err)
+	}
+}
@@ -26,6 +26,15 @@ To use a Server, create it, and then connect to it with no security:
 	client, err := bigtable.NewClient(ctx, proj, instance,
 	        option.WithGRPCConn(conn))
 	...
+
+To test code that depends on replication, such as app profile routing or
+AdminClient.WaitForReplication, create the Server with
+NewServerWithReplication instead.
+
+To test how code handles errors and slow responses, inject faults into the
+Server's data methods with InjectFault and slow them down with SetLatency.
+For example, to break every fifth ReadRows stream after ten cells:
+	srv.InjectFault(bttest.Fault{Method: "ReadRows", Nth: 5, AfterChunks: 10})
 */
 package bttest // import "github.com/smyte/google-cloud-go/bigtable/bttest"
 
@@ -43,6 +52,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/smyte/google-cloud-go/internal/unknownfields"
 	emptypb "github.com/golang/protobuf/ptypes/empty"
 	"github.com/golang/protobuf/ptypes/wrappers"
 	"github.com/google/btree"
@@ -86,6 +96,8 @@ type server struct {
 	tables    map[string]*table          // keyed by fully qualified name
 	instances map[string]*btapb.Instance // keyed by fully qualified name
 	gcc       chan int                   // set when gcloop starts, closed when server shuts down
+	repl      *ReplicationConfig         // nil unless replication is simulated
+	faults    *faultInjector
 
 	// Any unimplemented methods will cause a panic.
 	btapb.BigtableTableAdminServer
@@ -97,6 +109,10 @@ type server struct {
 // The Server will be listening for gRPC connections, without TLS,
 // on the provided address. The resolved address is named by the Addr field.
 func NewServer(laddr string, opt ...grpc.ServerOption) (*Server, error) {
+	return newServer(laddr, nil, opt...)
+}
+
+func newServer(laddr string, repl *ReplicationConfig, opt ...grpc.ServerOption) (*Server, error) {
 	l, err := net.Listen("tcp", laddr)
 	if err != nil {
 		return nil, err
@@ -109,6 +125,8 @@ func NewServer(laddr string, opt ...grpc.ServerOption) (*Server, error) {
 		s: &server{
 			tables:    make(map[string]*table),
 			instances: make(map[string]*btapb.Instance),
+			repl:      repl,
+			faults:    newFaultInjector(),
 		},
 	}
 	btapb.RegisterBigtableInstanceAdminServer(s.srv, s.s)
@@ -140,7 +158,11 @@ func (s *server) CreateTable(ctx context.Context, req *btapb.CreateTableRequest)
 		s.mu.Unlock()
 		return nil, status.Errorf(codes.AlreadyExists, "table %q already exists", tbl)
 	}
-	s.tables[tbl] = newTable(req)
+	if s.repl != nil {
+		s.tables[tbl] = newReplicatedTable(s.repl, func() *table { return newTable(req) })
+	} else {
+		s.tables[tbl] = newTable(req)
+	}
 	s.mu.Unlock()
 
 	ct := &btapb.Table{
@@ -209,6 +231,7 @@ func (s *server) ModifyColumnFamilies(ctx context.Context, req *btapb.ModifyColu
 
 	tbl.mu.Lock()
 	defer tbl.mu.Unlock()
+	defer tbl.syncReplicaSchemas()
 
 	for _, mod := range req.Modifications {
 		if create := mod.GetCreate(); create != nil {
@@ -257,42 +280,62 @@ func (s *server) DropRowRange(ctx context.Context, req *btapb.DropRowRangeReques
 		return nil, status.Errorf(codes.NotFound, "table %q not found", req.Name)
 	}
 
-	if req.GetDeleteAllDataFromTable() {
-		tbl.rows = btree.New(btreeDegree)
-	} else {
-		// Delete rows by prefix.
-		prefixBytes := req.GetRowKeyPrefix()
-		if prefixBytes == nil {
-			return nil, fmt.Errorf("missing row key prefix")
-		}
-		prefix := string(prefixBytes)
-
-		// The BTree does not specify what happens if rows are deleted during
-		// iteration, and it provides no "delete range" method.
-		// So we collect the rows first, then delete them one by one.
-		var rowsToDelete []*row
-		tbl.rows.AscendGreaterOrEqual(btreeKey(prefix), func(i btree.Item) bool {
-			r := i.(*row)
-			if strings.HasPrefix(r.key, prefix) {
-				rowsToDelete = append(rowsToDelete, r)
-				return true
-			}
-			return false // stop iteration
+	if !req.GetDeleteAllDataFromTable() && req.GetRowKeyPrefix() == nil {
+		return nil, fmt.Errorf("missing row key prefix")
+	}
+	for _, t := range tbl.copies() {
+		t.dropRowRange(req)
+	}
+	if tbl.replicas != nil {
+		// Writes to dropped rows that have not yet been replicated are
+		// dropped too.
+		prefix := string(req.GetRowKeyPrefix())
+		tbl.replicas.discard(func(row string) bool {
+			return req.GetDeleteAllDataFromTable() || strings.HasPrefix(row, prefix)
 		})
-		for _, r := range rowsToDelete {
-			tbl.rows.Delete(r)
-		}
 	}
 	return &emptypb.Empty{}, nil
 }
 
+// dropRowRange deletes the rows of t selected by req.
+func (t *table) dropRowRange(req *btapb.DropRowRangeRequest) {
+	if req.GetDeleteAllDataFromTable() {
+		t.rows = btree.New(btreeDegree)
+		return
+	}
+	prefix := string(req.GetRowKeyPrefix())
+
+	// The BTree does not specify what happens if rows are deleted during
+	// iteration, and it provides no "delete range" method.
+	// So we collect the rows first, then delete them one by one.
+	var rowsToDelete []*row
+	t.rows.AscendGreaterOrEqual(btreeKey(prefix), func(i btree.Item) bool {
+		r := i.(*row)
+		if strings.HasPrefix(r.key, prefix) {
+			rowsToDelete = append(rowsToDelete, r)
+			return true
+		}
+		return false // stop iteration
+	})
+	for _, r := range rowsToDelete {
+		t.rows.Delete(r)
+	}
+}
+
 func (s *server) GenerateConsistencyToken(ctx context.Context, req *btapb.GenerateConsistencyTokenRequest) (*btapb.GenerateConsistencyTokenResponse, error) {
 	// Check that the table exists.
-	_, ok := s.tables[req.Name]
+	s.mu.Lock()
+	tbl, ok := s.tables[req.Name]
+	s.mu.Unlock()
 	if !ok {
 		return nil, status.Errorf(codes.NotFound, "table %q not found", req.Name)
 	}
 
+	if tbl.replicas != nil {
+		return &btapb.GenerateConsistencyTokenResponse{
+			ConsistencyToken: tbl.replicas.token(req.Name),
+		}, nil
+	}
 	return &btapb.GenerateConsistencyTokenResponse{
 		ConsistencyToken: "TokenFor-" + req.Name,
 	}, nil
@@ -300,11 +343,21 @@ func (s *server) GenerateConsistencyToken(ctx context.Context, req *btapb.Genera
 
 func (s *server) CheckConsistency(ctx context.Context, req *btapb.CheckConsistencyRequest) (*btapb.CheckConsistencyResponse, error) {
 	// Check that the table exists.
-	_, ok := s.tables[req.Name]
+	s.mu.Lock()
+	tbl, ok := s.tables[req.Name]
+	s.mu.Unlock()
 	if !ok {
 		return nil, status.Errorf(codes.NotFound, "table %q not found", req.Name)
 	}
 
+	if tbl.replicas != nil {
+		consistent, err := tbl.replicas.consistent(req.Name, req.ConsistencyToken)
+		if err != nil {
+			return nil, err
+		}
+		return &btapb.CheckConsistencyResponse{Consistent: consistent}, nil
+	}
+
 	// Check this is the right token.
 	if req.ConsistencyToken != "TokenFor-"+req.Name {
 		return nil, status.Errorf(codes.InvalidArgument, "token %q not valid", req.ConsistencyToken)
@@ -331,11 +384,19 @@ func (s *server) DeleteSnapshot(context.Context, *btapb.DeleteSnapshotRequest) (
 }
 
 func (s *server) ReadRows(req *btpb.ReadRowsRequest, stream btpb.Bigtable_ReadRowsServer) error {
-	s.mu.Lock()
-	tbl, ok := s.tables[req.TableName]
-	s.mu.Unlock()
-	if !ok {
-		return status.Errorf(codes.NotFound, "table %q not found", req.TableName)
+	fault, err := s.faults.startStream(stream, "ReadRows")
+	if err != nil {
+		return err
+	}
+	if fault != nil {
+		if fault.AfterChunks <= 0 {
+			return fault.err()
+		}
+		stream = &brokenReadRowsServer{Bigtable_ReadRowsServer: stream, left: fault.AfterChunks, err: fault.err()}
+	}
+	tbl, err := s.dataTable(req.TableName, req.AppProfileId)
+	if err != nil {
+		return err
 	}
 
 	if err := validateRowRanges(req); err != nil {
@@ -405,7 +466,11 @@ func (s *server) ReadRows(req *btpb.ReadRowsRequest, stream btpb.Bigtable_ReadRo
 			rows = append(rows, r)
 		}
 	}
-	sort.Sort(byRowKey(rows))
+	if readReversed(req) {
+		sort.Sort(sort.Reverse(byRowKey(rows)))
+	} else {
+		sort.Sort(byRowKey(rows))
+	}
 
 	limit := int(req.RowsLimit)
 	count := 0
@@ -424,6 +489,14 @@ func (s *server) ReadRows(req *btpb.ReadRowsRequest, stream btpb.Bigtable_ReadRo
 	return nil
 }
 
+// readReversed reports whether req asks for a reverse scan. The reversed
+// field (number 7) is newer than the generated ReadRowsRequest, so clients
+// send it as an unrecognized field.
+func readReversed(req *btpb.ReadRowsRequest) bool {
+	reversed, _ := unknownfields.Varint(req.XXX_unrecognized, 7)
+	return reversed != 0
+}
+
 // streamRow filters the given row and sends it via the given stream.
 // Returns true if at least one cell matched the filter and was streamed, false otherwise.
 func streamRow(stream btpb.Bigtable_ReadRowsServer, r *row, f *btpb.RowFilter) (bool, error) {
@@ -749,40 +822,71 @@ func newRegexp(pat []byte) (*binaryregexp.Regexp, error) {
 }
 
 func (s *server) MutateRow(ctx context.Context, req *btpb.MutateRowRequest) (*btpb.MutateRowResponse, error) {
-	s.mu.Lock()
-	tbl, ok := s.tables[req.TableName]
-	s.mu.Unlock()
-	if !ok {
-		return nil, status.Errorf(codes.NotFound, "table %q not found", req.TableName)
+	if fault, err := s.faults.start(ctx, "MutateRow"); err != nil {
+		return nil, err
+	} else if fault != nil {
+		return nil, fault.err()
+	}
+	tbl, err := s.dataTable(req.TableName, req.AppProfileId)
+	if err != nil {
+		return nil, err
 	}
 	fs := tbl.columnFamilies()
+	muts := req.Mutations
+	if tbl.replicas != nil {
+		muts = resolveServerTime(muts)
+	}
 	r := tbl.mutableRow(string(req.RowKey))
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	if err := applyMutations(tbl, r, req.Mutations, fs); err != nil {
+	if err := applyMutations(tbl, r, muts, fs); err != nil {
 		return nil, err
 	}
+	tbl.replicate(r.key, muts)
 	return &btpb.MutateRowResponse{}, nil
 }
 
 func (s *server) MutateRows(req *btpb.MutateRowsRequest, stream btpb.Bigtable_MutateRowsServer) error {
-	s.mu.Lock()
-	tbl, ok := s.tables[req.TableName]
-	s.mu.Unlock()
-	if !ok {
-		return status.Errorf(codes.NotFound, "table %q not found", req.TableName)
+	fault, err := s.faults.startStream(stream, "MutateRows")
+	if err != nil {
+		return err
+	}
+	var failed map[int]bool
+	if fault != nil {
+		if len(fault.FailEntries) == 0 {
+			return fault.err()
+		}
+		failed = fault.failEntries()
+	}
+	tbl, err := s.dataTable(req.TableName, req.AppProfileId)
+	if err != nil {
+		return err
 	}
 	res := &btpb.MutateRowsResponse{Entries: make([]*btpb.MutateRowsResponse_Entry, len(req.Entries))}
 
 	fs := tbl.columnFamilies()
 
 	for i, entry := range req.Entries {
+		if failed[i] {
+			st := status.Convert(fault.err())
+			res.Entries[i] = &btpb.MutateRowsResponse_Entry{
+				Index:  int64(i),
+				Status: &statpb.Status{Code: int32(st.Code()), Message: st.Message()},
+			}
+			continue
+		}
+		muts := entry.Mutations
+		if tbl.replicas != nil {
+			muts = resolveServerTime(muts)
+		}
 		r := tbl.mutableRow(string(entry.RowKey))
 		r.mu.Lock()
 		code, msg := int32(codes.OK), ""
-		if err := applyMutations(tbl, r, entry.Mutations, fs); err != nil {
+		if err := applyMutations(tbl, r, muts, fs); err != nil {
 			code = int32(codes.Internal)
 			msg = err.Error()
+		} else {
+			tbl.replicate(r.key, muts)
 		}
 		res.Entries[i] = &btpb.MutateRowsResponse_Entry{
 			Index:  int64(i),
@@ -794,11 +898,14 @@ func (s *server) MutateRows(req *btpb.MutateRowsRequest, stream btpb.Bigtable_Mu
 }
 
 func (s *server) CheckAndMutateRow(ctx context.Context, req *btpb.CheckAndMutateRowRequest) (*btpb.CheckAndMutateRowResponse, error) {
-	s.mu.Lock()
-	tbl, ok := s.tables[req.TableName]
-	s.mu.Unlock()
-	if !ok {
-		return nil, status.Errorf(codes.NotFound, "table %q not found", req.TableName)
+	if fault, err := s.faults.start(ctx, "CheckAndMutateRow"); err != nil {
+		return nil, err
+	} else if fault != nil {
+		return nil, fault.err()
+	}
+	tbl, err := s.dataTable(req.TableName, req.AppProfileId)
+	if err != nil {
+		return nil, err
 	}
 	res := &btpb.CheckAndMutateRowResponse{}
 
@@ -829,10 +936,14 @@ func (s *server) CheckAndMutateRow(ctx context.Context, req *btpb.CheckAndMutate
 	if whichMut {
 		muts = req.TrueMutations
 	}
+	if tbl.replicas != nil {
+		muts = resolveServerTime(muts)
+	}
 
 	if err := applyMutations(tbl, r, muts, fs); err != nil {
 		return nil, err
 	}
+	tbl.replicate(r.key, muts)
 	return res, nil
 }
 
@@ -954,11 +1065,14 @@ func appendOrReplaceCell(cs []cell, newCell cell) []cell {
 }
 
 func (s *server) ReadModifyWriteRow(ctx context.Context, req *btpb.ReadModifyWriteRowRequest) (*btpb.ReadModifyWriteRowResponse, error) {
-	s.mu.Lock()
-	tbl, ok := s.tables[req.TableName]
-	s.mu.Unlock()
-	if !ok {
-		return nil, status.Errorf(codes.NotFound, "table %q not found", req.TableName)
+	if fault, err := s.faults.start(ctx, "ReadModifyWriteRow"); err != nil {
+		return nil, err
+	} else if fault != nil {
+		return nil, fault.err()
+	}
+	tbl, err := s.dataTable(req.TableName, req.AppProfileId)
+	if err != nil {
+		return nil, err
 	}
 
 	fs := tbl.columnFamilies()
@@ -1024,6 +1138,21 @@ func (s *server) ReadModifyWriteRow(ctx context.Context, req *btpb.ReadModifyWri
 		resultFamily.cells[col] = []cell{newCell} // overwrite the cells
 	}
 
+	// Replicate the new cells.
+	var muts []*btpb.Mutation
+	for _, family := range resultRow.sortedFamilies() {
+		for _, colName := range family.colNames {
+			c := family.cells[colName][0]
+			muts = append(muts, &btpb.Mutation{Mutation: &btpb.Mutation_SetCell_{SetCell: &btpb.Mutation_SetCell{
+				FamilyName:      family.name,
+				ColumnQualifier: []byte(colName),
+				TimestampMicros: c.ts,
+				Value:           c.value,
+			}}})
+		}
+	}
+	tbl.replicate(r.key, muts)
+
 	// Build the response using the result row
 	res := &btpb.Row{
 		Key:      req.RowKey,
@@ -1050,11 +1179,14 @@ func (s *server) ReadModifyWriteRow(ctx context.Context, req *btpb.ReadModifyWri
 }
 
 func (s *server) SampleRowKeys(req *btpb.SampleRowKeysRequest, stream btpb.Bigtable_SampleRowKeysServer) error {
-	s.mu.Lock()
-	tbl, ok := s.tables[req.TableName]
-	s.mu.Unlock()
-	if !ok {
-		return status.Errorf(codes.NotFound, "table %q not found", req.TableName)
+	if fault, err := s.faults.startStream(stream, "SampleRowKeys"); err != nil {
+		return err
+	} else if fault != nil {
+		return fault.err()
+	}
+	tbl, err := s.dataTable(req.TableName, req.AppProfileId)
+	if err != nil {
+		return err
 	}
 
 	tbl.mu.RLock()
@@ -1063,7 +1195,6 @@ func (s *server) SampleRowKeys(req *btpb.SampleRowKeysRequest, stream btpb.Bigta
 	// The return value of SampleRowKeys is very loosely defined. Return at least the
 	// final row key in the table and choose other row keys randomly.
 	var offset int64
-	var err error
 	i := 0
 	tbl.rows.Ascend(func(it btree.Item) bool {
 		row := it.(*row)
@@ -1117,7 +1248,9 @@ func (s *server) gcloop(done <-chan int) {
 		}
 		s.mu.Unlock()
 		for _, tbl := range tables {
-			tbl.gc()
+			for _, t := range tbl.copies() {
+				t.gc()
+			}
 		}
 	}
 }
@@ -1127,6 +1260,11 @@ type table struct {
 	counter  uint64                   // increment by 1 when a new family is created
 	families map[string]*columnFamily // keyed by plain family name
 	rows     *btree.BTree             // indexed by row key
+
+	// If replication is simulated, cluster is the ID of the cluster that
+	// holds this copy of the table, and replicas holds every copy.
+	cluster  string
+	replicas *replicaSet
 }
 
 const btreeDegree = 16
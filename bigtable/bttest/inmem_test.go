@@ -461,6 +461,64 @@ func TestReadRows(t *testing.T) {
 	}
 }
 
+func TestReadRowsReversed(t *testing.T) {
+	ctx := context.Background()
+	s := &server{
+		tables: make(map[string]*table),
+	}
+	newTbl := btapb.Table{
+		ColumnFamilies: map[string]*btapb.ColumnFamily{
+			"cf0": {GcRule: &btapb.GcRule{Rule: &btapb.GcRule_MaxNumVersions{MaxNumVersions: 1}}},
+		},
+	}
+	tblInfo, err := s.CreateTable(ctx, &btapb.CreateTableRequest{Parent: "cluster", TableId: "t", Table: &newTbl})
+	if err != nil {
+		t.Fatalf("Creating table: %v", err)
+	}
+	for _, key := range []string{"a", "b", "c", "d"} {
+		mreq := &btpb.MutateRowRequest{
+			TableName: tblInfo.Name,
+			RowKey:    []byte(key),
+			Mutations: []*btpb.Mutation{{
+				Mutation: &btpb.Mutation_SetCell_{SetCell: &btpb.Mutation_SetCell{
+					FamilyName:      "cf0",
+					ColumnQualifier: []byte("col"),
+					TimestampMicros: 1000,
+					Value:           []byte{},
+				}},
+			}},
+		}
+		if _, err := s.MutateRow(ctx, mreq); err != nil {
+			t.Fatalf("Populating table: %v", err)
+		}
+	}
+
+	mock := &MockReadRowsServer{}
+	req := &btpb.ReadRowsRequest{
+		TableName: tblInfo.Name,
+		Rows: &btpb.RowSet{RowRanges: []*btpb.RowRange{{
+			StartKey: &btpb.RowRange_StartKeyClosed{StartKeyClosed: []byte("b")},
+		}}},
+		RowsLimit: 2,
+		// The reversed field is not in the generated proto; see readReversed.
+		XXX_unrecognized: []byte{7<<3 | proto.WireVarint, 1},
+	}
+	if err = s.ReadRows(req, mock); err != nil {
+		t.Fatalf("ReadRows error: %v", err)
+	}
+	var got []string
+	for _, res := range mock.responses {
+		for _, cc := range res.Chunks {
+			if cc.RowKey != nil {
+				got = append(got, string(cc.RowKey))
+			}
+		}
+	}
+	if want := []string{"d", "c"}; !testutil.Equal(got, want) {
+		t.Errorf("reversed rows: got %q, want %q", got, want)
+	}
+}
+
 func TestReadRowsError(t *testing.T) {
 	ctx := context.Background()
 	s := &server{
@@ -0,0 +1,299 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bttest
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	btpb "google.golang.org/genproto/googleapis/bigtable/v2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ReplicationConfig configures a Server to simulate an instance whose tables
+// are replicated between several clusters.
+type ReplicationConfig struct {
+	// Clusters are the IDs of the simulated clusters. There must be at least
+	// one. Requests that use multi-cluster routing are served by the first.
+	Clusters []string
+
+	// Lag is how long a write to one cluster takes to be applied to the
+	// others.
+	Lag time.Duration
+
+	// AppProfiles maps the IDs of app profiles to the clusters that serve
+	// their requests. A profile mapped to "" uses multi-cluster routing, as
+	// does the default app profile unless it is mapped. Requests with other
+	// app profiles fail with NotFound.
+	AppProfiles map[string]string
+}
+
+// NewServerWithReplication creates a new Server, like NewServer, that
+// simulates replication between the clusters of config. Each table has a copy
+// in every cluster, and data requests are routed to a copy by their app
+// profiles. Writes are replicated to the other copies after config.Lag, and
+// consistency tokens report that a table is consistent only when the writes
+// made before the token was generated have been replicated.
+//
+// Schema changes and DropRowRange apply to every copy at once.
+func NewServerWithReplication(laddr string, config ReplicationConfig, opt ...grpc.ServerOption) (*Server, error) {
+	if len(config.Clusters) == 0 {
+		return nil, errors.New("bttest: ReplicationConfig needs at least one cluster")
+	}
+	clusters := make(map[string]bool)
+	for _, c := range config.Clusters {
+		if c == "" || clusters[c] {
+			return nil, fmt.Errorf("bttest: bad or duplicate cluster ID %q", c)
+		}
+		clusters[c] = true
+	}
+	for p, c := range config.AppProfiles {
+		if c != "" && !clusters[c] {
+			return nil, fmt.Errorf("bttest: app profile %q routes to unknown cluster %q", p, c)
+		}
+	}
+	return newServer(laddr, &config, opt...)
+}
+
+// cluster returns the cluster that serves requests with appProfile.
+func (s *server) cluster(appProfile string) (string, error) {
+	c, ok := s.repl.AppProfiles[appProfile]
+	if !ok && appProfile != "" {
+		return "", status.Errorf(codes.NotFound, "app profile %q not found", appProfile)
+	}
+	if c == "" {
+		c = s.repl.Clusters[0]
+	}
+	return c, nil
+}
+
+// dataTable returns the copy of the named table that serves data requests
+// with appProfile, after applying the writes that are due to be replicated
+// to it.
+func (s *server) dataTable(name, appProfile string) (*table, error) {
+	s.mu.Lock()
+	tbl, ok := s.tables[name]
+	s.mu.Unlock()
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "table %q not found", name)
+	}
+	if tbl.replicas == nil {
+		return tbl, nil
+	}
+	c, err := s.cluster(appProfile)
+	if err != nil {
+		return nil, err
+	}
+	tbl.replicas.catchUp(time.Now())
+	return tbl.replicas.clusters[c], nil
+}
+
+// newReplicatedTable returns a table with a copy in each of the clusters of
+// config. The copy in the first cluster is returned.
+func newReplicatedTable(config *ReplicationConfig, newTable func() *table) *table {
+	rs := &replicaSet{
+		lag:      config.Lag,
+		clusters: make(map[string]*table),
+	}
+	for _, c := range config.Clusters {
+		t := newTable()
+		t.cluster = c
+		t.replicas = rs
+		rs.clusters[c] = t
+	}
+	return rs.clusters[config.Clusters[0]]
+}
+
+// A replicaSet holds the copies of a table and the writes waiting to be
+// replicated between them.
+type replicaSet struct {
+	lag      time.Duration
+	clusters map[string]*table // keyed by cluster ID
+
+	// applyMu serializes applying writes to copies. It is held while
+	// locking rows, so it must not be acquired while a row is locked.
+	applyMu sync.Mutex
+
+	mu      sync.Mutex
+	seq     uint64             // sequence number of the latest write
+	pending []*replicatedWrite // in sequence order
+}
+
+// replicatedWrite is a write to one copy of a table that has not yet been
+// applied to the others.
+type replicatedWrite struct {
+	seq  uint64
+	from string // the cluster that was written
+	row  string
+	muts []*btpb.Mutation
+	due  time.Time
+}
+
+// copies returns every copy of t, including t.
+func (t *table) copies() []*table {
+	if t.replicas == nil {
+		return []*table{t}
+	}
+	var ts []*table
+	for _, c := range t.replicas.clusters {
+		ts = append(ts, c)
+	}
+	return ts
+}
+
+// replicate records that muts were applied to row in t, so that they are
+// applied to the other copies of t after the replication lag. It must be
+// called with the row locked so that writes to a row are replicated in the
+// order they were made.
+func (t *table) replicate(row string, muts []*btpb.Mutation) {
+	if t.replicas == nil || len(muts) == 0 {
+		return
+	}
+	rs := t.replicas
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.seq++
+	rs.pending = append(rs.pending, &replicatedWrite{
+		seq:  rs.seq,
+		from: t.cluster,
+		row:  row,
+		muts: muts,
+		due:  time.Now().Add(rs.lag),
+	})
+}
+
+// syncReplicaSchemas copies the column families of t to its other copies.
+// It assumes t.mu is held.
+func (t *table) syncReplicaSchemas() {
+	for _, c := range t.copies() {
+		if c == t {
+			continue
+		}
+		c.mu.Lock()
+		c.families = make(map[string]*columnFamily)
+		for fam, cf := range t.families {
+			c.families[fam] = cf
+		}
+		c.counter = t.counter
+		c.mu.Unlock()
+	}
+}
+
+// catchUp applies the writes that are due by now to the copies that have
+// not yet seen them.
+func (rs *replicaSet) catchUp(now time.Time) {
+	rs.applyMu.Lock()
+	defer rs.applyMu.Unlock()
+
+	rs.mu.Lock()
+	var due []*replicatedWrite
+	i := 0
+	for _, w := range rs.pending {
+		if !w.due.After(now) {
+			due = append(due, w)
+		} else {
+			rs.pending[i] = w
+			i++
+		}
+	}
+	rs.pending = rs.pending[:i]
+	rs.mu.Unlock()
+
+	for _, w := range due {
+		for c, t := range rs.clusters {
+			if c == w.from {
+				continue
+			}
+			fs := t.columnFamilies()
+			r := t.mutableRow(w.row)
+			r.mu.Lock()
+			// The mutations succeeded on the original copy, so they can
+			// only fail here if a family has since been dropped.
+			applyMutations(t, r, w.muts, fs)
+			r.mu.Unlock()
+		}
+	}
+}
+
+// discard drops the pending writes to rows for which drop returns true.
+func (rs *replicaSet) discard(drop func(row string) bool) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	i := 0
+	for _, w := range rs.pending {
+		if !drop(w.row) {
+			rs.pending[i] = w
+			i++
+		}
+	}
+	rs.pending = rs.pending[:i]
+}
+
+// token returns a consistency token for the writes made so far.
+func (rs *replicaSet) token(table string) string {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return fmt.Sprintf("TokenFor-%s@%d", table, rs.seq)
+}
+
+// consistent reports whether the writes covered by token have been
+// replicated to every copy.
+func (rs *replicaSet) consistent(table, token string) (bool, error) {
+	prefix := "TokenFor-" + table + "@"
+	if !strings.HasPrefix(token, prefix) {
+		return false, status.Errorf(codes.InvalidArgument, "token %q not valid", token)
+	}
+	seq, err := strconv.ParseUint(strings.TrimPrefix(token, prefix), 10, 64)
+	if err != nil {
+		return false, status.Errorf(codes.InvalidArgument, "token %q not valid", token)
+	}
+	rs.catchUp(time.Now())
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return len(rs.pending) == 0 || rs.pending[0].seq > seq, nil
+}
+
+// resolveServerTime returns muts with server timestamps replaced by the
+// current time, so that every copy of a cell has the same timestamp.
+func resolveServerTime(muts []*btpb.Mutation) []*btpb.Mutation {
+	var resolved []*btpb.Mutation
+	for i, mut := range muts {
+		set := mut.GetSetCell()
+		if set == nil || set.TimestampMicros != -1 {
+			if resolved != nil {
+				resolved = append(resolved, mut)
+			}
+			continue
+		}
+		if resolved == nil {
+			resolved = append([]*btpb.Mutation(nil), muts[:i]...)
+		}
+		sc := *set
+		sc.TimestampMicros = newTimestamp()
+		resolved = append(resolved, &btpb.Mutation{Mutation: &btpb.Mutation_SetCell_{SetCell: &sc}})
+	}
+	if resolved == nil {
+		return muts
+	}
+	return resolved
+}
@@ -0,0 +1,193 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bttest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	btapb "google.golang.org/genproto/googleapis/bigtable/admin/v2"
+	btpb "google.golang.org/genproto/googleapis/bigtable/v2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func newReplicatedServer(t *testing.T, lag time.Duration) (*server, string) {
+	t.Helper()
+	s := &server{
+		tables: make(map[string]*table),
+		repl: &ReplicationConfig{
+			Clusters:    []string{"east", "west"},
+			Lag:         lag,
+			AppProfiles: map[string]string{"east-only": "east", "west-only": "west", "any": ""},
+		},
+	}
+	tbl, err := s.CreateTable(context.Background(), &btapb.CreateTableRequest{
+		Parent:  "cluster",
+		TableId: "t",
+		Table: &btapb.Table{ColumnFamilies: map[string]*btapb.ColumnFamily{
+			"cf": {},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, tbl.Name
+}
+
+func setCell(tbl, appProfile, row string, ts int64) *btpb.MutateRowRequest {
+	return &btpb.MutateRowRequest{
+		TableName:    tbl,
+		AppProfileId: appProfile,
+		RowKey:       []byte(row),
+		Mutations: []*btpb.Mutation{{
+			Mutation: &btpb.Mutation_SetCell_{SetCell: &btpb.Mutation_SetCell{
+				FamilyName:      "cf",
+				ColumnQualifier: []byte("col"),
+				TimestampMicros: ts,
+				Value:           []byte("v"),
+			}},
+		}},
+	}
+}
+
+// readCells returns the timestamps of the cells read from tbl with appProfile.
+func readCells(t *testing.T, s *server, tbl, appProfile string) []int64 {
+	t.Helper()
+	mock := &MockReadRowsServer{}
+	if err := s.ReadRows(&btpb.ReadRowsRequest{TableName: tbl, AppProfileId: appProfile}, mock); err != nil {
+		t.Fatal(err)
+	}
+	var ts []int64
+	for _, res := range mock.responses {
+		for _, c := range res.Chunks {
+			ts = append(ts, c.TimestampMicros)
+		}
+	}
+	return ts
+}
+
+func TestReplication(t *testing.T) {
+	ctx := context.Background()
+	s, tbl := newReplicatedServer(t, 100*time.Millisecond)
+
+	if _, err := s.MutateRow(ctx, setCell(tbl, "east-only", "row", -1)); err != nil {
+		t.Fatal(err)
+	}
+	east := readCells(t, s, tbl, "east-only")
+	if len(east) != 1 {
+		t.Fatalf("east has cells %v, want one cell", east)
+	}
+	if got := readCells(t, s, tbl, "any"); len(got) != 1 {
+		t.Errorf("multi-cluster routing read cells %v, want the cell in the first cluster", got)
+	}
+	if got := readCells(t, s, tbl, "west-only"); len(got) != 0 {
+		t.Errorf("west has cells %v before replication", got)
+	}
+
+	tok, err := s.GenerateConsistencyToken(ctx, &btapb.GenerateConsistencyTokenRequest{Name: tbl})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func() bool {
+		res, err := s.CheckConsistency(ctx, &btapb.CheckConsistencyRequest{Name: tbl, ConsistencyToken: tok.ConsistencyToken})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res.Consistent
+	}
+	if check() {
+		t.Error("consistent before replication")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !check() {
+		if time.Now().After(deadline) {
+			t.Fatal("not consistent after 5s")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	west := readCells(t, s, tbl, "west-only")
+	if len(west) != 1 || west[0] != east[0] {
+		t.Errorf("west has cells %v after replication, want %v", west, east)
+	}
+
+	// A later write does not affect an earlier token.
+	if _, err := s.MutateRow(ctx, setCell(tbl, "west-only", "row2", 1000)); err != nil {
+		t.Fatal(err)
+	}
+	if !check() {
+		t.Error("earlier token is inconsistent after a later write")
+	}
+}
+
+func TestReplicationErrors(t *testing.T) {
+	ctx := context.Background()
+	s, tbl := newReplicatedServer(t, time.Hour)
+
+	_, err := s.MutateRow(ctx, setCell(tbl, "nope", "row", 1000))
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("write with unknown app profile: got %v, want NotFound", err)
+	}
+	_, err = s.CheckConsistency(ctx, &btapb.CheckConsistencyRequest{Name: tbl, ConsistencyToken: "TokenFor-" + tbl})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("check with bad token: got %v, want InvalidArgument", err)
+	}
+
+	// Dropping rows discards their pending writes.
+	if _, err := s.MutateRow(ctx, setCell(tbl, "", "row", 1000)); err != nil {
+		t.Fatal(err)
+	}
+	tok, err := s.GenerateConsistencyToken(ctx, &btapb.GenerateConsistencyTokenRequest{Name: tbl})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.DropRowRange(ctx, &btapb.DropRowRangeRequest{
+		Name:   tbl,
+		Target: &btapb.DropRowRangeRequest_RowKeyPrefix{RowKeyPrefix: []byte("r")},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	res, err := s.CheckConsistency(ctx, &btapb.CheckConsistencyRequest{Name: tbl, ConsistencyToken: tok.ConsistencyToken})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Consistent {
+		t.Error("inconsistent after dropping the only pending write")
+	}
+	for _, p := range []string{"east-only", "west-only"} {
+		if got := readCells(t, s, tbl, p); len(got) != 0 {
+			t.Errorf("%s has cells %v after DropRowRange", p, got)
+		}
+	}
+
+	// Schema changes apply to every copy.
+	if _, err := s.ModifyColumnFamilies(ctx, &btapb.ModifyColumnFamiliesRequest{
+		Name: tbl,
+		Modifications: []*btapb.ModifyColumnFamiliesRequest_Modification{{
+			Id:  "cf2",
+			Mod: &btapb.ModifyColumnFamiliesRequest_Modification_Create{Create: &btapb.ColumnFamily{}},
+		}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	req := setCell(tbl, "west-only", "row", 1000)
+	req.Mutations[0].GetSetCell().FamilyName = "cf2"
+	if _, err := s.MutateRow(ctx, req); err != nil {
+		t.Errorf("writing new family to second cluster: %v", err)
+	}
+}
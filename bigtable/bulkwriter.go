@@ -0,0 +1,230 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bigtable
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/api/support/bundler"
+	btpb "google.golang.org/genproto/googleapis/bigtable/v2"
+)
+
+// BulkWriterSettings control the batching and flow control of a BulkWriter.
+type BulkWriterSettings struct {
+	// Send a non-empty batch after this delay has passed.
+	DelayThreshold time.Duration
+
+	// Send a batch when it has this many rows.
+	CountThreshold int
+
+	// Send a batch when its size in bytes reaches this value.
+	ByteThreshold int
+
+	// The maximum number of bytes of mutations that may be buffered or in
+	// flight. Once it is reached, Apply blocks until earlier batches finish.
+	//
+	// Defaults to DefaultBulkWriterSettings.MaxOutstandingBytes.
+	MaxOutstandingBytes int
+
+	// The maximum number of MutateRows requests that may be in flight.
+	//
+	// Defaults to DefaultBulkWriterSettings.MaxOutstandingRequests.
+	MaxOutstandingRequests int
+
+	// The maximum time that the writer will attempt to apply a batch,
+	// including retries of failed rows.
+	Timeout time.Duration
+}
+
+// DefaultBulkWriterSettings holds the default values for BulkWriterSettings.
+var DefaultBulkWriterSettings = BulkWriterSettings{
+	DelayThreshold:         10 * time.Millisecond,
+	CountThreshold:         100,
+	ByteThreshold:          1e6,
+	MaxOutstandingBytes:    100e6,
+	MaxOutstandingRequests: 10,
+	Timeout:                60 * time.Second,
+}
+
+var errBulkWriterClosed = errors.New("bigtable: BulkWriter has been closed")
+
+// A BulkWriter batches mutations of single rows into ApplyBulk calls.
+// Create one with Table.NewBulkWriter.
+//
+// A BulkWriter is safe to use concurrently, except for its Close method.
+type BulkWriter struct {
+	t       *Table
+	bundler *bundler.Bundler
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+// NewBulkWriter returns a BulkWriter that applies mutations to t in batches
+// according to settings. Zero fields of settings take their values from
+// DefaultBulkWriterSettings.
+//
+// The BulkWriter creates goroutines for batching and sending mutations,
+// which must be stopped by calling Close.
+func (t *Table) NewBulkWriter(settings BulkWriterSettings) *BulkWriter {
+	d := DefaultBulkWriterSettings
+	if settings.DelayThreshold == 0 {
+		settings.DelayThreshold = d.DelayThreshold
+	}
+	if settings.CountThreshold == 0 {
+		settings.CountThreshold = d.CountThreshold
+	}
+	if settings.ByteThreshold == 0 {
+		settings.ByteThreshold = d.ByteThreshold
+	}
+	if settings.MaxOutstandingBytes == 0 {
+		settings.MaxOutstandingBytes = d.MaxOutstandingBytes
+	}
+	if settings.MaxOutstandingRequests == 0 {
+		settings.MaxOutstandingRequests = d.MaxOutstandingRequests
+	}
+	if settings.Timeout == 0 {
+		settings.Timeout = d.Timeout
+	}
+
+	w := &BulkWriter{t: t}
+	timeout := settings.Timeout
+	w.bundler = bundler.NewBundler(&bulkEntry{}, func(items interface{}) {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		w.applyBatch(ctx, items.([]*bulkEntry))
+	})
+	w.bundler.DelayThreshold = settings.DelayThreshold
+	w.bundler.BundleCountThreshold = settings.CountThreshold
+	w.bundler.BundleByteThreshold = settings.ByteThreshold
+	w.bundler.BufferedByteLimit = settings.MaxOutstandingBytes
+	w.bundler.HandlerLimit = settings.MaxOutstandingRequests
+	return w
+}
+
+// bulkEntry is a mutation waiting to be applied by a BulkWriter.
+type bulkEntry struct {
+	row string
+	mut *Mutation
+	res *ApplyResult
+}
+
+// Apply adds a mutation of row to the writer's current batch. The mutation
+// must not be conditional.
+//
+// Apply returns a non-nil ApplyResult which will be ready when the mutation
+// has been applied (or has failed to be applied). If the writer's
+// MaxOutstandingBytes has been reached, Apply blocks until there is room for
+// the mutation or ctx is done.
+func (w *BulkWriter) Apply(ctx context.Context, row string, m *Mutation) *ApplyResult {
+	r := &ApplyResult{ready: make(chan struct{})}
+	if m.cond != nil {
+		r.set(errors.New("bigtable: conditional mutations cannot be applied in bulk"))
+		return r
+	}
+	size := proto.Size(&btpb.MutateRowsRequest_Entry{RowKey: []byte(row), Mutations: m.ops})
+
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if w.closed {
+		r.set(errBulkWriterClosed)
+		return r
+	}
+	if err := w.bundler.AddWait(ctx, &bulkEntry{row, m, r}, size); err != nil {
+		r.set(err)
+	}
+	return r
+}
+
+// Flush sends all buffered mutations and returns once they have been
+// applied or have failed to be applied.
+func (w *BulkWriter) Flush() {
+	w.bundler.Flush()
+}
+
+// Close sends all buffered mutations and stops the writer's goroutines.
+// It returns once every mutation has been applied or has failed to be
+// applied. Once closed, calls to Apply return an ApplyResult with an error.
+func (w *BulkWriter) Close() {
+	w.mu.Lock()
+	noop := w.closed
+	w.closed = true
+	w.mu.Unlock()
+	if noop {
+		return
+	}
+	w.bundler.Flush()
+}
+
+// applyBatch applies a batch of entries with ApplyBulk, which retries the
+// entries that fail with retryable errors.
+func (w *BulkWriter) applyBatch(ctx context.Context, entries []*bulkEntry) {
+	rowKeys := make([]string, len(entries))
+	muts := make([]*Mutation, len(entries))
+	for i, e := range entries {
+		rowKeys[i] = e.row
+		muts[i] = e.mut
+	}
+	errs, err := w.t.ApplyBulk(ctx, rowKeys, muts)
+	for i, e := range entries {
+		switch {
+		case err != nil:
+			e.res.set(err)
+		case errs != nil:
+			e.res.set(errs[i])
+		default:
+			e.res.set(nil)
+		}
+	}
+}
+
+// An ApplyResult holds the result of a call to BulkWriter.Apply.
+type ApplyResult struct {
+	ready chan struct{}
+	err   error
+}
+
+// Ready returns a channel that is closed when the result is ready.
+// When the Ready channel is closed, Get is guaranteed not to block.
+func (r *ApplyResult) Ready() <-chan struct{} { return r.ready }
+
+// Get returns the error result of an Apply call, or nil if the mutation was
+// applied. Get blocks until the mutation has been applied or has failed,
+// or the context is done.
+func (r *ApplyResult) Get(ctx context.Context) error {
+	// If the result is already ready, return it even if the context is done.
+	select {
+	case <-r.Ready():
+		return r.err
+	default:
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-r.Ready():
+		return r.err
+	}
+}
+
+func (r *ApplyResult) set(err error) {
+	r.err = err
+	close(r.ready)
+}
@@ -0,0 +1,138 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bigtable
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	btpb "google.golang.org/genproto/googleapis/bigtable/v2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+func TestBulkWriter(t *testing.T) {
+	ctx := context.Background()
+
+	var (
+		mu       sync.Mutex
+		requests int
+	)
+	counter := func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if strings.HasSuffix(info.FullMethod, "MutateRows") {
+			mu.Lock()
+			requests++
+			mu.Unlock()
+		}
+		return handler(srv, ss)
+	}
+	tbl, cleanup, err := setupFakeServer(grpc.StreamInterceptor(counter))
+	if err != nil {
+		t.Fatalf("fake server setup: %v", err)
+	}
+	defer cleanup()
+
+	w := tbl.NewBulkWriter(BulkWriterSettings{CountThreshold: 10, DelayThreshold: 1e9})
+	var results []*ApplyResult
+	for i := 0; i < 25; i++ {
+		mut := NewMutation()
+		mut.Set("cf", "col", 1000, []byte("v"))
+		results = append(results, w.Apply(ctx, fmt.Sprintf("row%02d", i), mut))
+	}
+	w.Close()
+	for i, r := range results {
+		select {
+		case <-r.Ready():
+		default:
+			t.Fatalf("result %d not ready after Close", i)
+		}
+		if err := r.Get(ctx); err != nil {
+			t.Errorf("result %d: %v", i, err)
+		}
+	}
+	mu.Lock()
+	if got, want := requests, 3; got != want {
+		t.Errorf("got %d MutateRows requests, want %d", got, want)
+	}
+	mu.Unlock()
+
+	n := 0
+	if err := tbl.ReadRows(ctx, RowRange{}, func(Row) bool { n++; return true }); err != nil {
+		t.Fatal(err)
+	}
+	if n != 25 {
+		t.Errorf("got %d rows, want 25", n)
+	}
+
+	mut := NewMutation()
+	mut.DeleteRow()
+	if err := w.Apply(ctx, "row00", mut).Get(ctx); err != errBulkWriterClosed {
+		t.Errorf("Apply after Close: got %v, want %v", err, errBulkWriterClosed)
+	}
+}
+
+func TestBulkWriterRetriesFailedRows(t *testing.T) {
+	ctx := context.Background()
+
+	attempt := 0
+	errInjector := func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if strings.HasSuffix(info.FullMethod, "MutateRows") {
+			req := new(btpb.MutateRowsRequest)
+			must(ss.RecvMsg(req))
+			switch attempt {
+			case 0:
+				must(writeMutateRowsResponse(ss, codes.OK, codes.Unavailable, codes.InvalidArgument))
+			case 1:
+				if got, want := len(req.Entries), 1; got != want {
+					t.Errorf("retry: got %d entries, want %d", got, want)
+				}
+				must(writeMutateRowsResponse(ss, codes.OK))
+			}
+			attempt++
+			return nil
+		}
+		return handler(ctx, ss)
+	}
+	tbl, cleanup, err := setupFakeServer(grpc.StreamInterceptor(errInjector))
+	if err != nil {
+		t.Fatalf("fake server setup: %v", err)
+	}
+	defer cleanup()
+
+	w := tbl.NewBulkWriter(BulkWriterSettings{})
+	var results []*ApplyResult
+	for _, row := range []string{"a", "b", "c"} {
+		mut := NewMutation()
+		mut.Set("cf", "col", 1000, []byte("v"))
+		results = append(results, w.Apply(ctx, row, mut))
+	}
+	w.Flush()
+	for i, wantErr := range []bool{false, false, true} {
+		if err := results[i].Get(ctx); (err != nil) != wantErr {
+			t.Errorf("row %d: got error %v, want error: %t", i, err, wantErr)
+		}
+	}
+	w.Close()
+
+	cond := NewCondMutation(ColumnFilter("col"), NewMutation(), nil)
+	if err := w.Apply(ctx, "x", cond).Get(ctx); err == nil {
+		t.Error("conditional mutation: got nil, want error")
+	}
+}
@@ -0,0 +1,316 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+// A minimal reader and writer for Avro object container files holding rows
+// with a fixed schema. Only the null codec is supported.
+// See https://avro.apache.org/docs/1.8.2/spec.html#Object+Container+Files.
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+)
+
+// avroRowSchema is the schema of the rows in exported Avro files.
+const avroRowSchema = `{"type":"record","name":"Row","namespace":"com.google.cloud.bigtable.cbt","fields":[` +
+	`{"name":"key","type":"bytes"},` +
+	`{"name":"cells","type":{"type":"array","items":{"type":"record","name":"Cell","fields":[` +
+	`{"name":"family","type":"string"},` +
+	`{"name":"qualifier","type":"bytes"},` +
+	`{"name":"timestamp","type":"long"},` +
+	`{"name":"value","type":"bytes"}]}}}]}`
+
+var avroMagic = []byte{'O', 'b', 'j', 1}
+
+// avroBlockRows is the number of rows the writer puts in each block.
+const avroBlockRows = 1000
+
+const avroSyncSize = 16
+
+// avroMaxBytes is the longest bytes or string value that the reader accepts.
+// It is larger than any Bigtable row key, qualifier or cell value.
+const avroMaxBytes = 256 << 20
+
+// avroWriter writes rows to an Avro object container file.
+type avroWriter struct {
+	w     io.Writer
+	sync  [avroSyncSize]byte
+	block bytes.Buffer
+	n     int // number of rows in block
+	err   error
+}
+
+func newAvroWriter(w io.Writer) (*avroWriter, error) {
+	aw := &avroWriter{w: w}
+	if _, err := rand.Read(aw.sync[:]); err != nil {
+		return nil, err
+	}
+	var hdr bytes.Buffer
+	hdr.Write(avroMagic)
+	// File metadata is a map with a single block of two entries.
+	avroPutLong(&hdr, 2)
+	avroPutBytes(&hdr, []byte("avro.schema"))
+	avroPutBytes(&hdr, []byte(avroRowSchema))
+	avroPutBytes(&hdr, []byte("avro.codec"))
+	avroPutBytes(&hdr, []byte("null"))
+	avroPutLong(&hdr, 0)
+	hdr.Write(aw.sync[:])
+	if _, err := w.Write(hdr.Bytes()); err != nil {
+		return nil, err
+	}
+	return aw, nil
+}
+
+func (aw *avroWriter) Write(r exportRow) error {
+	if aw.err != nil {
+		return aw.err
+	}
+	avroPutBytes(&aw.block, []byte(r.Key))
+	if len(r.Cells) > 0 {
+		avroPutLong(&aw.block, int64(len(r.Cells)))
+		for _, c := range r.Cells {
+			avroPutBytes(&aw.block, []byte(c.Family))
+			avroPutBytes(&aw.block, []byte(c.Qualifier))
+			avroPutLong(&aw.block, c.Timestamp)
+			avroPutBytes(&aw.block, c.Value)
+		}
+	}
+	avroPutLong(&aw.block, 0)
+	aw.n++
+	if aw.n >= avroBlockRows {
+		aw.err = aw.flush()
+	}
+	return aw.err
+}
+
+// Close writes any buffered rows. It does not close the underlying writer.
+func (aw *avroWriter) Close() error {
+	if aw.err != nil {
+		return aw.err
+	}
+	aw.err = aw.flush()
+	return aw.err
+}
+
+func (aw *avroWriter) flush() error {
+	if aw.n == 0 {
+		return nil
+	}
+	var hdr bytes.Buffer
+	avroPutLong(&hdr, int64(aw.n))
+	avroPutLong(&hdr, int64(aw.block.Len()))
+	aw.block.Write(aw.sync[:])
+	if _, err := aw.w.Write(hdr.Bytes()); err != nil {
+		return err
+	}
+	if _, err := aw.w.Write(aw.block.Bytes()); err != nil {
+		return err
+	}
+	aw.block.Reset()
+	aw.n = 0
+	return nil
+}
+
+func avroPutLong(b *bytes.Buffer, n int64) {
+	// Avro longs are zig-zag encoded varints, as are Go's signed varints.
+	var buf [binary.MaxVarintLen64]byte
+	b.Write(buf[:binary.PutVarint(buf[:], n)])
+}
+
+func avroPutBytes(b *bytes.Buffer, p []byte) {
+	avroPutLong(b, int64(len(p)))
+	b.Write(p)
+}
+
+// avroReader reads rows from an Avro object container file written with
+// avroRowSchema.
+type avroReader struct {
+	r    *bufio.Reader
+	sync [avroSyncSize]byte
+	left int64 // rows left in the current block
+}
+
+func newAvroReader(r io.Reader) (*avroReader, error) {
+	ar := &avroReader{r: bufio.NewReader(r)}
+	magic := make([]byte, len(avroMagic))
+	if _, err := io.ReadFull(ar.r, magic); err != nil {
+		return nil, fmt.Errorf("reading Avro header: %v", err)
+	}
+	if !bytes.Equal(magic, avroMagic) {
+		return nil, errors.New("not an Avro object container file")
+	}
+	meta := make(map[string][]byte)
+	for {
+		n, err := ar.long()
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			break
+		}
+		if n < 0 {
+			// A negative count is followed by the size of the block in bytes.
+			n = -n
+			if _, err := ar.long(); err != nil {
+				return nil, err
+			}
+		}
+		for ; n > 0; n-- {
+			k, err := ar.bytes()
+			if err != nil {
+				return nil, err
+			}
+			v, err := ar.bytes()
+			if err != nil {
+				return nil, err
+			}
+			meta[string(k)] = v
+		}
+	}
+	if codec := string(meta["avro.codec"]); codec != "" && codec != "null" {
+		return nil, fmt.Errorf("unsupported Avro codec %q", codec)
+	}
+	if err := checkAvroSchema(meta["avro.schema"]); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(ar.r, ar.sync[:]); err != nil {
+		return nil, fmt.Errorf("reading Avro header: %v", err)
+	}
+	return ar, nil
+}
+
+// checkAvroSchema reports whether schema is equivalent to avroRowSchema.
+func checkAvroSchema(schema []byte) error {
+	var got, want interface{}
+	if err := json.Unmarshal(schema, &got); err != nil {
+		return fmt.Errorf("bad Avro schema: %v", err)
+	}
+	if err := json.Unmarshal([]byte(avroRowSchema), &want); err != nil {
+		panic(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		return fmt.Errorf("unsupported Avro schema %s; want %s", schema, avroRowSchema)
+	}
+	return nil
+}
+
+// Read returns the next row, or io.EOF if there are no more rows.
+func (ar *avroReader) Read() (exportRow, error) {
+	var r exportRow
+	for ar.left == 0 {
+		n, err := ar.long()
+		if err == io.EOF {
+			return r, io.EOF
+		}
+		if err != nil {
+			return r, err
+		}
+		size, err := ar.long()
+		if err != nil {
+			return r, unexpectedEOF(err)
+		}
+		if n <= 0 || size < 0 {
+			return r, fmt.Errorf("corrupt Avro file: block of %d rows in %d bytes", n, size)
+		}
+		ar.left = n
+	}
+	key, err := ar.bytes()
+	if err != nil {
+		return r, unexpectedEOF(err)
+	}
+	r.Key = string(key)
+	for {
+		n, err := ar.long()
+		if err != nil {
+			return r, unexpectedEOF(err)
+		}
+		if n == 0 {
+			break
+		}
+		if n < 0 {
+			n = -n
+			if _, err := ar.long(); err != nil {
+				return r, unexpectedEOF(err)
+			}
+		}
+		for ; n > 0; n-- {
+			var c exportCell
+			fam, err := ar.bytes()
+			if err != nil {
+				return r, unexpectedEOF(err)
+			}
+			qual, err := ar.bytes()
+			if err != nil {
+				return r, unexpectedEOF(err)
+			}
+			if c.Timestamp, err = ar.long(); err != nil {
+				return r, unexpectedEOF(err)
+			}
+			if c.Value, err = ar.bytes(); err != nil {
+				return r, unexpectedEOF(err)
+			}
+			c.Family, c.Qualifier = string(fam), string(qual)
+			r.Cells = append(r.Cells, c)
+		}
+	}
+	ar.left--
+	if ar.left == 0 {
+		var sync [avroSyncSize]byte
+		if _, err := io.ReadFull(ar.r, sync[:]); err != nil {
+			return r, unexpectedEOF(err)
+		}
+		if sync != ar.sync {
+			return r, errors.New("corrupt Avro file: sync marker mismatch")
+		}
+	}
+	return r, nil
+}
+
+func (ar *avroReader) long() (int64, error) {
+	return binary.ReadVarint(ar.r)
+}
+
+func (ar *avroReader) bytes() ([]byte, error) {
+	n, err := ar.long()
+	if err != nil {
+		return nil, err
+	}
+	if n < 0 || n > avroMaxBytes {
+		return nil, fmt.Errorf("corrupt Avro file: bad length %d", n)
+	}
+	// Read rather than allocate n bytes up front, so that a corrupt length
+	// in a short file fails without using much memory.
+	var b bytes.Buffer
+	if _, err := io.CopyN(&b, ar.r, n); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
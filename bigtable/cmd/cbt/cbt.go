@@ -367,6 +367,34 @@ var commands = []struct {
 		Usage:    "cbt doc",
 		Required: cbtconfig.NoneRequired,
 	},
+	{
+		Name: "export",
+		Desc: "Export rows to a CSV, JSON lines or Avro file",
+		do:   doExport,
+		Usage: "cbt export <table-id> <file> [format=csv|json|avro] [start=<row-key>] [end=<row-key>]" +
+			" [prefix=<row-key-prefix>] [regex=<regex>] [columns=<family>:<qualifier>,...] [cells-per-column=<n>]" +
+			" [start-ts=<timestamp>] [end-ts=<timestamp>] [parallelism=<n>] [app-profile=<app-profile-id>]\n" +
+			"  <file>                              The file to write, or - for standard output\n" +
+			"  format=csv|json|avro                The file format; by default inferred from the file extension\n" +
+			"  start=<row-key>                     Start exporting at this row\n" +
+			"  end=<row-key>                       Stop exporting before this row\n" +
+			"  prefix=<row-key-prefix>             Export rows with this prefix\n" +
+			"  regex=<regex>                       Export rows with keys matching this regex\n" +
+			"  columns=<family>:<qualifier>,...    Export only these columns, comma-separated\n" +
+			"  cells-per-column=<n>                Export only this many cells per column\n" +
+			"  start-ts=<timestamp>                Export only cells at or after this timestamp\n" +
+			"  end-ts=<timestamp>                  Export only cells before this timestamp\n" +
+			"  parallelism=<n>                     Read this many ranges of the table at once (default 1)\n" +
+			"  app-profile=<app-profile-id>        The app profile ID to use for the request\n\n" +
+			"    CSV files have a row_key column followed by a <family>:<qualifier> column for each exported\n" +
+			"    column, holding its latest value. JSON lines and Avro files hold every exported cell, with\n" +
+			"    its timestamp. Timestamps are in microseconds since 1970-01-01 00:00:00 UTC.\n" +
+			"    With a parallelism greater than 1, rows are not written in row key order.\n\n" +
+			"    Examples:\n" +
+			"      cbt export mobile-time-series rows.csv prefix=phone columns=stats_summary:os_build,stats_summary:os_name\n" +
+			"      cbt export mobile-time-series rows.avro parallelism=8",
+		Required: cbtconfig.ProjectAndInstanceRequired,
+	},
 	{
 		Name: "help",
 		Desc: "Print help text",
@@ -375,6 +403,23 @@ var commands = []struct {
 			"    Example: cbt help createtable",
 		Required: cbtconfig.NoneRequired,
 	},
+	{
+		Name: "import",
+		Desc: "Import rows from a CSV, JSON lines or Avro file",
+		do:   doImport,
+		Usage: "cbt import <table-id> <file> [format=csv|json|avro] [timestamp=<timestamp>] [parallelism=<n>]" +
+			" [app-profile=<app-profile-id>]\n" +
+			"  <file>                              The file to read, or - for standard input\n" +
+			"  format=csv|json|avro                The file format; by default inferred from the file extension\n" +
+			"  timestamp=<timestamp>               Write all cells with this timestamp\n" +
+			"  parallelism=<n>                     Send this many write requests at once (default 1)\n" +
+			"  app-profile=<app-profile-id>        The app profile ID to use for the request\n\n" +
+			"    Files are in the formats written by 'cbt export'. Cells from JSON lines and Avro files keep\n" +
+			"    their timestamps unless timestamp is given; cells from CSV files are written with timestamp,\n" +
+			"    or the current time. Empty CSV fields are skipped.\n\n" +
+			"    Example: cbt import mobile-time-series rows.avro parallelism=8",
+		Required: cbtconfig.ProjectAndInstanceRequired,
+	},
 	{
 		Name:     "listinstances",
 		Desc:     "List instances in a project",
@@ -394,9 +439,12 @@ var commands = []struct {
 		Desc: "Read from a single row",
 		do:   doLookup,
 		Usage: "cbt lookup <table-id> <row-key> [columns=<family>:<qualifier>,...] [cells-per-column=<n>] " +
-			" [app-profile=<app profile id>]\n" +
+			" [filter=<filter>] [format=text|json|csv|hex] [decode=<decoder>,...] [app-profile=<app profile id>]\n" +
 			"  columns=<family>:<qualifier>,...    Read only these columns, comma-separated\n" +
 			"  cells-per-column=<n>                Read only this number of cells per column\n" +
+			"  filter=<filter>                     Read only the cells matched by this filter (see 'cbt help read')\n" +
+			"  format=text|json|csv|hex            Print the row in this format (see 'cbt help read')\n" +
+			"  decode=<decoder>,...                Decode values for printing (see 'cbt help read')\n" +
 			"  app-profile=<app-profile-id>        The app profile ID to use for the request\n\n" +
 			" Example: cbt lookup mobile-time-series phone#4c410523#20190501 columns=stats_summary:os_build,os_name cells-per-column=1",
 		Required: cbtconfig.ProjectAndInstanceRequired,
@@ -423,7 +471,7 @@ var commands = []struct {
 		do:   doRead,
 		Usage: "cbt read <table-id> [start=<row-key>] [end=<row-key>] [prefix=<row-key-prefix>]" +
 			" [regex=<regex>] [columns=<family>:<qualifier>,...] [count=<n>] [cells-per-column=<n>]" +
-			" [app-profile=<app-profile-id>]\n" +
+			" [filter=<filter>] [format=text|json|csv|hex] [decode=<decoder>,...] [app-profile=<app-profile-id>]\n" +
 			"  start=<row-key>                     Start reading at this row\n" +
 			"  end=<row-row>                       Stop reading before this row\n" +
 			"  prefix=<row-key-prefix>             Read rows with this prefix\n" +
@@ -431,11 +479,26 @@ var commands = []struct {
 			"  columns=<family>:<qualifier>,...    Read only these columns, comma-separated\n" +
 			"  count=<n>                           Read only this many rows\n" +
 			"  cells-per-column=<n>                Read only this many cells per column\n" +
+			"  filter=<filter>                     Read only the cells matched by this filter expression\n" +
+			"  format=text|json|csv|hex            Print rows in this format (default text)\n" +
+			"  decode=<decoder>,...                Decode values for printing with these decoders\n" +
 			"  app-profile=<app-profile-id>        The app profile ID to use for the request\n\n" +
+			"    A filter is a combination of these functions:\n" +
+			filterUsage + "\n" +
+			"    String arguments may be unquoted words, or quoted like Go strings.\n\n" +
+			"    The json format prints a line per row, with the cells of the JSON lines files written by\n" +
+			"    'cbt export'; the csv format prints a record per cell. The hex format prints values as hex\n" +
+			"    dumps and ignores decoders.\n\n" +
+			"    A decoder is one of string, int64 (an 8-byte big-endian integer), hex or proto:<type>, where\n" +
+			"    <type> is a fully-qualified protocol buffer message type compiled into cbt. A decoder may be\n" +
+			"    given for every column, or for a column or family as <family>:<qualifier>=<decoder> or\n" +
+			"    <family>=<decoder>. Values that cannot be decoded are printed as raw bytes.\n\n" +
 			"    Examples: (see 'set' examples to create data to read)\n" +
 			"      cbt read mobile-time-series prefix=phone columns=stats_summary:os_build,os_name count=10\n" +
 			"      cbt read mobile-time-series start=phone#4c410523#20190501 end=phone#4c410523#20190601\n" +
-			"      cbt read mobile-time-series regex=\"phone.*\" cells-per-column=1\n\n" +
+			"      cbt read mobile-time-series regex=\"phone.*\" cells-per-column=1\n" +
+			"      cbt read mobile-time-series 'filter=family(stats_summary) && (column(os_build) || latest(1))'\n" +
+			"      cbt read mobile-time-series format=json decode=stats_summary:connected_cell=int64\n\n" +
 			"   Note: Using a regex without also specifying start, end, prefix, or count results in a full\n" +
 			"   table scan, which can be slow.\n",
 		Required: cbtconfig.ProjectAndInstanceRequired,
@@ -876,7 +939,7 @@ var docTemplate = template.Must(template.New("doc").Funcs(template.FuncMap{
 
 // DO NOT EDIT. THIS IS AUTOMATICALLY GENERATED.
 // Run "go generate" to regenerate.
-//go:generate go run cbt.go gcpolicy.go -o cbtdoc.go doc
+//go:generate go run cbt.go gcpolicy.go importexport.go avro.go filterexpr.go rowformat.go -o cbtdoc.go doc
 
 /*
 ` + docIntroTemplate + `
@@ -948,10 +1011,11 @@ func doLookup(ctx context.Context, args ...string) {
 			"[app-profile=<app profile id>]")
 	}
 
-	parsed, err := parseArgs(args[2:], []string{"columns", "cells-per-column", "app-profile"})
+	parsed, err := parseArgs(args[2:], []string{"columns", "cells-per-column", "filter", "format", "decode", "app-profile"})
 	if err != nil {
 		log.Fatal(err)
 	}
+	printer := parsePrinter(parsed)
 	var opts []bigtable.ReadOption
 	var filters []bigtable.Filter
 	if cellsPerColumn := parsed["cells-per-column"]; cellsPerColumn != "" {
@@ -968,6 +1032,13 @@ func doLookup(ctx context.Context, args ...string) {
 		}
 		filters = append(filters, columnFilters)
 	}
+	if filter := parsed["filter"]; filter != "" {
+		f, err := parseFilter(filter)
+		if err != nil {
+			log.Fatal(err)
+		}
+		filters = append(filters, f)
+	}
 
 	if len(filters) > 1 {
 		opts = append(opts, bigtable.RowFilter(bigtable.ChainFilters(filters...)))
@@ -981,27 +1052,26 @@ func doLookup(ctx context.Context, args ...string) {
 	if err != nil {
 		log.Fatalf("Reading row: %v", err)
 	}
-	printRow(r)
+	if err := printer.printRow(r); err != nil {
+		log.Fatalf("Printing row: %v", err)
+	}
+	if err := printer.flush(); err != nil {
+		log.Fatalf("Printing row: %v", err)
+	}
 }
 
-func printRow(r bigtable.Row) {
-	fmt.Println(strings.Repeat("-", 40))
-	fmt.Println(r.Key())
-
-	var fams []string
-	for fam := range r {
-		fams = append(fams, fam)
-	}
-	sort.Strings(fams)
-	for _, fam := range fams {
-		ris := r[fam]
-		sort.Sort(byColumn(ris))
-		for _, ri := range ris {
-			ts := time.Unix(0, int64(ri.Timestamp)*1e3)
-			fmt.Printf("  %-40s @ %s\n", ri.Column, ts.Format("2006/01/02-15:04:05.000000"))
-			fmt.Printf("    %q\n", ri.Value)
-		}
+// parsePrinter returns a printer of rows in the format given by the format
+// and decode arguments.
+func parsePrinter(parsed map[string]string) rowPrinter {
+	dec, err := parseDecoders(parsed["decode"])
+	if err != nil {
+		log.Fatal(err)
+	}
+	printer, err := newRowPrinter(os.Stdout, parsed["format"], dec)
+	if err != nil {
+		log.Fatal(err)
 	}
+	return printer
 }
 
 type byColumn []bigtable.ReadItem
@@ -1081,7 +1151,8 @@ func doRead(ctx context.Context, args ...string) {
 	}
 
 	parsed, err := parseArgs(args[1:], []string{
-		"start", "end", "prefix", "columns", "count", "cells-per-column", "regex", "app-profile", "limit",
+		"start", "end", "prefix", "columns", "count", "cells-per-column", "regex", "filter", "format", "decode",
+		"app-profile", "limit",
 	})
 	if err != nil {
 		log.Fatal(err)
@@ -1093,6 +1164,7 @@ func doRead(ctx context.Context, args ...string) {
 	if (parsed["start"] != "" || parsed["end"] != "") && parsed["prefix"] != "" {
 		log.Fatal(`"start"/"end" may not be mixed with "prefix"`)
 	}
+	printer := parsePrinter(parsed)
 
 	var rr bigtable.RowRange
 	if start, end := parsed["start"], parsed["end"]; end != "" {
@@ -1131,6 +1203,13 @@ func doRead(ctx context.Context, args ...string) {
 		}
 		filters = append(filters, columnFilters)
 	}
+	if filter := parsed["filter"]; filter != "" {
+		f, err := parseFilter(filter)
+		if err != nil {
+			log.Fatal(err)
+		}
+		filters = append(filters, f)
+	}
 
 	if len(filters) > 1 {
 		opts = append(opts, bigtable.RowFilter(bigtable.ChainFilters(filters...)))
@@ -1138,15 +1217,21 @@ func doRead(ctx context.Context, args ...string) {
 		opts = append(opts, bigtable.RowFilter(filters[0]))
 	}
 
-	// TODO(dsymonds): Support filters.
 	tbl := getClient(bigtable.ClientConfig{AppProfile: parsed["app-profile"]}).Open(args[0])
+	var printErr error
 	err = tbl.ReadRows(ctx, rr, func(r bigtable.Row) bool {
-		printRow(r)
-		return true
+		printErr = printer.printRow(r)
+		return printErr == nil
 	}, opts...)
 	if err != nil {
 		log.Fatalf("Reading rows: %v", err)
 	}
+	if printErr == nil {
+		printErr = printer.flush()
+	}
+	if printErr != nil {
+		log.Fatalf("Printing rows: %v", printErr)
+	}
 }
 
 var setArg = regexp.MustCompile(`([^:]+):([^=]*)=(.*)`)
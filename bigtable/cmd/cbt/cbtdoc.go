@@ -14,7 +14,7 @@
 
 // DO NOT EDIT. THIS IS AUTOMATICALLY GENERATED.
 // Run "go generate" to regenerate.
-//go:generate go run cbt.go gcpolicy.go -o cbtdoc.go doc
+//go:generate go run cbt.go gcpolicy.go importexport.go avro.go filterexpr.go rowformat.go -o cbtdoc.go doc
 
 /*
 The `cbt` tool is a command-line tool that allows you to interact with Cloud Bigtable.
@@ -40,7 +40,9 @@ The commands are:
     deleterow                 Delete a row
     deletetable               Delete a table
     doc                       Print godoc-suitable documentation for cbt
+    export                    Export rows to a CSV, JSON lines or Avro file
     help                      Print help text
+    import                    Import rows from a CSV, JSON lines or Avro file
     listinstances             List instances in a project
     listclusters              List clusters in an instance
     lookup                    Read from a single row
@@ -250,6 +252,35 @@ Usage:
 
 
 
+Export rows to a CSV, JSON lines or Avro file
+
+Usage:
+	cbt export <table-id> <file> [format=csv|json|avro] [start=<row-key>] [end=<row-key>] [prefix=<row-key-prefix>] [regex=<regex>] [columns=<family>:<qualifier>,...] [cells-per-column=<n>] [start-ts=<timestamp>] [end-ts=<timestamp>] [parallelism=<n>] [app-profile=<app-profile-id>]
+	  <file>                              The file to write, or - for standard output
+	  format=csv|json|avro                The file format; by default inferred from the file extension
+	  start=<row-key>                     Start exporting at this row
+	  end=<row-key>                       Stop exporting before this row
+	  prefix=<row-key-prefix>             Export rows with this prefix
+	  regex=<regex>                       Export rows with keys matching this regex
+	  columns=<family>:<qualifier>,...    Export only these columns, comma-separated
+	  cells-per-column=<n>                Export only this many cells per column
+	  start-ts=<timestamp>                Export only cells at or after this timestamp
+	  end-ts=<timestamp>                  Export only cells before this timestamp
+	  parallelism=<n>                     Read this many ranges of the table at once (default 1)
+	  app-profile=<app-profile-id>        The app profile ID to use for the request
+
+	    CSV files have a row_key column followed by a <family>:<qualifier> column for each exported
+	    column, holding its latest value. JSON lines and Avro files hold every exported cell, with
+	    its timestamp. Timestamps are in microseconds since 1970-01-01 00:00:00 UTC.
+	    With a parallelism greater than 1, rows are not written in row key order.
+
+	    Examples:
+	      cbt export mobile-time-series rows.csv prefix=phone columns=stats_summary:os_build,stats_summary:os_name
+	      cbt export mobile-time-series rows.avro parallelism=8
+
+
+
+
 Print help text
 
 Usage:
@@ -260,6 +291,25 @@ Usage:
 
 
 
+Import rows from a CSV, JSON lines or Avro file
+
+Usage:
+	cbt import <table-id> <file> [format=csv|json|avro] [timestamp=<timestamp>] [parallelism=<n>] [app-profile=<app-profile-id>]
+	  <file>                              The file to read, or - for standard input
+	  format=csv|json|avro                The file format; by default inferred from the file extension
+	  timestamp=<timestamp>               Write all cells with this timestamp
+	  parallelism=<n>                     Send this many write requests at once (default 1)
+	  app-profile=<app-profile-id>        The app profile ID to use for the request
+
+	    Files are in the formats written by 'cbt export'. Cells from JSON lines and Avro files keep
+	    their timestamps unless timestamp is given; cells from CSV files are written with timestamp,
+	    or the current time. Empty CSV fields are skipped.
+
+	    Example: cbt import mobile-time-series rows.avro parallelism=8
+
+
+
+
 List instances in a project
 
 Usage:
@@ -279,9 +329,12 @@ Usage:
 Read from a single row
 
 Usage:
-	cbt lookup <table-id> <row-key> [columns=<family>:<qualifier>,...] [cells-per-column=<n>]  [app-profile=<app profile id>]
+	cbt lookup <table-id> <row-key> [columns=<family>:<qualifier>,...] [cells-per-column=<n>]  [filter=<filter>] [format=text|json|csv|hex] [decode=<decoder>,...] [app-profile=<app profile id>]
 	  columns=<family>:<qualifier>,...    Read only these columns, comma-separated
 	  cells-per-column=<n>                Read only this number of cells per column
+	  filter=<filter>                     Read only the cells matched by this filter (see 'cbt help read')
+	  format=text|json|csv|hex            Print the row in this format (see 'cbt help read')
+	  decode=<decoder>,...                Decode values for printing (see 'cbt help read')
 	  app-profile=<app-profile-id>        The app profile ID to use for the request
 
 	 Example: cbt lookup mobile-time-series phone#4c410523#20190501 columns=stats_summary:os_build,os_name cells-per-column=1
@@ -311,7 +364,7 @@ Usage:
 Read rows
 
 Usage:
-	cbt read <table-id> [start=<row-key>] [end=<row-key>] [prefix=<row-key-prefix>] [regex=<regex>] [columns=<family>:<qualifier>,...] [count=<n>] [cells-per-column=<n>] [app-profile=<app-profile-id>]
+	cbt read <table-id> [start=<row-key>] [end=<row-key>] [prefix=<row-key-prefix>] [regex=<regex>] [columns=<family>:<qualifier>,...] [count=<n>] [cells-per-column=<n>] [filter=<filter>] [format=text|json|csv|hex] [decode=<decoder>,...] [app-profile=<app-profile-id>]
 	  start=<row-key>                     Start reading at this row
 	  end=<row-row>                       Stop reading before this row
 	  prefix=<row-key-prefix>             Read rows with this prefix
@@ -319,12 +372,47 @@ Usage:
 	  columns=<family>:<qualifier>,...    Read only these columns, comma-separated
 	  count=<n>                           Read only this many rows
 	  cells-per-column=<n>                Read only this many cells per column
+	  filter=<filter>                     Read only the cells matched by this filter expression
+	  format=text|json|csv|hex            Print rows in this format (default text)
+	  decode=<decoder>,...                Decode values for printing with these decoders
 	  app-profile=<app-profile-id>        The app profile ID to use for the request
 
+	    A filter is a combination of these functions:
+	      chain(<filter>, ...)                    Cells matched by each filter in turn; also <filter> && <filter>
+	      interleave(<filter>, ...)               Cells matched by any of the filters; also <filter> || <filter>
+	      cond(<pred>, <true>[, <false>])         Cells matched by <true> if <pred> matches a cell in the row,
+	                                              otherwise by <false>, or none
+	      row(<regex>)                            Rows with keys matching the regex
+	      family(<regex>)                         Cells in families matching the regex
+	      column(<regex>)                         Cells in columns with qualifiers matching the regex
+	      value(<regex>)                          Cells with values matching the regex
+	      column_range(<family>, <start>, <end>)  Cells in columns of the family from <start> to before <end>
+	      value_range(<start>, <end>)             Cells with values from <start> to before <end>
+	      timestamp_range(<start>, <end>)         Cells with timestamps from <start> to before <end>
+	      latest(<n>)                             The latest n cells of each column
+	      cells_per_row(<n>)                      The first n cells of each row
+	      cells_per_row_offset(<n>)               All but the first n cells of each row
+	      sample(<p>)                             Rows sampled with probability p
+	      strip_value()                           Cells with their values replaced by empty values
+	      pass_all(), block_all()                 All cells, or none
+	    Empty range bounds are unbounded, as is a zero end timestamp.
+	    String arguments may be unquoted words, or quoted like Go strings.
+
+	    The json format prints a line per row, with the cells of the JSON lines files written by
+	    'cbt export'; the csv format prints a record per cell. The hex format prints values as hex
+	    dumps and ignores decoders.
+
+	    A decoder is one of string, int64 (an 8-byte big-endian integer), hex or proto:<type>, where
+	    <type> is a fully-qualified protocol buffer message type compiled into cbt. A decoder may be
+	    given for every column, or for a column or family as <family>:<qualifier>=<decoder> or
+	    <family>=<decoder>. Values that cannot be decoded are printed as raw bytes.
+
 	    Examples: (see 'set' examples to create data to read)
 	      cbt read mobile-time-series prefix=phone columns=stats_summary:os_build,os_name count=10
 	      cbt read mobile-time-series start=phone#4c410523#20190501 end=phone#4c410523#20190601
 	      cbt read mobile-time-series regex="phone.*" cells-per-column=1
+	      cbt read mobile-time-series 'filter=family(stats_summary) && (column(os_build) || latest(1))'
+	      cbt read mobile-time-series format=json decode=stats_summary:connected_cell=int64
 
 	   Note: Using a regex without also specifying start, end, prefix, or count results in a full
 	   table scan, which can be slow.
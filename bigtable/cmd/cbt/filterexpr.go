@@ -0,0 +1,340 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/smyte/google-cloud-go/bigtable"
+)
+
+// Parse a filter expression. Valid filters include
+//     family(stats)
+//     family(stats) && column("os_.*") && latest(1)
+//     chain(row(`phone#.*`), sample(0.1))
+//     column(a) || column(b)
+//     cond(column(flag), strip_value(), pass_all())
+//     timestamp_range(1570000000000000, 0) && value_range("a", "n")
+//
+// expr ::= and ("||" and)*
+// and ::= term ("&&" term)*
+// term ::= "(" expr ")" | name "(" args ")"
+//
+// "&&" chains filters and "||" interleaves them; "&&" binds more tightly.
+// String arguments may be double-quoted with Go escapes, back-quoted, or,
+// if they contain only letters, digits, '_', '-' and '.', unquoted.
+func parseFilter(s string) (bigtable.Filter, error) {
+	p := &filterParser{s: s}
+	f := p.expr()
+	if tok := p.next(); p.err == nil && tok.kind != tokEOF {
+		p.fail("want end of input, got %s", tok)
+	}
+	if p.err != nil {
+		return nil, fmt.Errorf("invalid filter: %v", p.err)
+	}
+	return f, nil
+}
+
+// filterUsage describes the filter functions, for the help text.
+const filterUsage = "" +
+	"      chain(<filter>, ...)                    Cells matched by each filter in turn; also <filter> && <filter>\n" +
+	"      interleave(<filter>, ...)               Cells matched by any of the filters; also <filter> || <filter>\n" +
+	"      cond(<pred>, <true>[, <false>])         Cells matched by <true> if <pred> matches a cell in the row,\n" +
+	"                                              otherwise by <false>, or none\n" +
+	"      row(<regex>)                            Rows with keys matching the regex\n" +
+	"      family(<regex>)                         Cells in families matching the regex\n" +
+	"      column(<regex>)                         Cells in columns with qualifiers matching the regex\n" +
+	"      value(<regex>)                          Cells with values matching the regex\n" +
+	"      column_range(<family>, <start>, <end>)  Cells in columns of the family from <start> to before <end>\n" +
+	"      value_range(<start>, <end>)             Cells with values from <start> to before <end>\n" +
+	"      timestamp_range(<start>, <end>)         Cells with timestamps from <start> to before <end>\n" +
+	"      latest(<n>)                             The latest n cells of each column\n" +
+	"      cells_per_row(<n>)                      The first n cells of each row\n" +
+	"      cells_per_row_offset(<n>)               All but the first n cells of each row\n" +
+	"      sample(<p>)                             Rows sampled with probability p\n" +
+	"      strip_value()                           Cells with their values replaced by empty values\n" +
+	"      pass_all(), block_all()                 All cells, or none\n" +
+	"    Empty range bounds are unbounded, as is a zero end timestamp."
+
+type filterTokenKind int
+
+const (
+	tokEOF    filterTokenKind = iota
+	tokWord                   // bare word or number
+	tokString                 // quoted string
+	tokSymbol                 // one of ( ) , && ||
+)
+
+type filterToken struct {
+	kind filterTokenKind
+	text string // the unquoted text of strings
+}
+
+func (t filterToken) String() string {
+	switch t.kind {
+	case tokEOF:
+		return "end of input"
+	case tokString:
+		return strconv.Quote(t.text)
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+// filterParser is a recursive-descent parser of filter expressions. Once it
+// fails, it records the first error and the results of its methods are
+// meaningless.
+type filterParser struct {
+	s      string
+	pos    int
+	peeked *filterToken
+	err    error
+}
+
+func (p *filterParser) fail(format string, args ...interface{}) {
+	if p.err == nil {
+		p.err = fmt.Errorf(format, args...)
+	}
+}
+
+// next returns the next token, or an EOF token after a failure.
+func (p *filterParser) next() filterToken {
+	if p.peeked != nil {
+		t := *p.peeked
+		p.peeked = nil
+		return t
+	}
+	if p.err != nil {
+		return filterToken{kind: tokEOF}
+	}
+	for p.pos < len(p.s) {
+		r, n := utf8.DecodeRuneInString(p.s[p.pos:])
+		if !unicode.IsSpace(r) {
+			break
+		}
+		p.pos += n
+	}
+	if p.pos == len(p.s) {
+		return filterToken{kind: tokEOF}
+	}
+	rest := p.s[p.pos:]
+	switch c := rest[0]; {
+	case c == '(' || c == ')' || c == ',':
+		p.pos++
+		return filterToken{tokSymbol, rest[:1]}
+
+	case strings.HasPrefix(rest, "&&") || strings.HasPrefix(rest, "||"):
+		p.pos += 2
+		return filterToken{tokSymbol, rest[:2]}
+
+	case c == '"' || c == '`':
+		end := 1
+		for end < len(rest) && rest[end] != c {
+			if c == '"' && rest[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(rest) {
+			p.fail("unterminated string %s", rest)
+			return filterToken{kind: tokEOF}
+		}
+		s, err := strconv.Unquote(rest[:end+1])
+		if err != nil {
+			p.fail("bad string %s: %v", rest[:end+1], err)
+			return filterToken{kind: tokEOF}
+		}
+		p.pos += end + 1
+		return filterToken{tokString, s}
+
+	case isWordByte(c):
+		end := 1
+		for end < len(rest) && isWordByte(rest[end]) {
+			end++
+		}
+		p.pos += end
+		return filterToken{tokWord, rest[:end]}
+
+	default:
+		r, _ := utf8.DecodeRuneInString(rest)
+		p.fail("bad character %q", r)
+		return filterToken{kind: tokEOF}
+	}
+}
+
+func isWordByte(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+		c == '_' || c == '-' || c == '.' || c == '+'
+}
+
+func (p *filterParser) peek() filterToken {
+	if p.peeked == nil {
+		t := p.next()
+		p.peeked = &t
+	}
+	return *p.peeked
+}
+
+// accept consumes the next token if it is the symbol sym.
+func (p *filterParser) accept(sym string) bool {
+	if t := p.peek(); t.kind == tokSymbol && t.text == sym {
+		p.next()
+		return true
+	}
+	return false
+}
+
+func (p *filterParser) expect(sym string) {
+	if t := p.next(); t.kind != tokSymbol || t.text != sym {
+		p.fail("want %q, got %s", sym, t)
+	}
+}
+
+func (p *filterParser) expr() bigtable.Filter {
+	fs := []bigtable.Filter{p.and()}
+	for p.accept("||") {
+		fs = append(fs, p.and())
+	}
+	if len(fs) == 1 {
+		return fs[0]
+	}
+	return bigtable.InterleaveFilters(fs...)
+}
+
+func (p *filterParser) and() bigtable.Filter {
+	fs := []bigtable.Filter{p.term()}
+	for p.accept("&&") {
+		fs = append(fs, p.term())
+	}
+	if len(fs) == 1 {
+		return fs[0]
+	}
+	return bigtable.ChainFilters(fs...)
+}
+
+func (p *filterParser) term() bigtable.Filter {
+	if p.accept("(") {
+		f := p.expr()
+		p.expect(")")
+		return f
+	}
+	t := p.next()
+	if t.kind != tokWord {
+		p.fail("want a filter, got %s", t)
+		return nil
+	}
+	p.expect("(")
+	f := p.call(t.text)
+	p.expect(")")
+	return f
+}
+
+// call parses the arguments of the named filter function, up to but not
+// including the closing parenthesis.
+func (p *filterParser) call(name string) bigtable.Filter {
+	switch name {
+	case "chain", "interleave":
+		var fs []bigtable.Filter
+		for len(fs) == 0 || p.accept(",") {
+			fs = append(fs, p.expr())
+		}
+		if name == "chain" {
+			return bigtable.ChainFilters(fs...)
+		}
+		return bigtable.InterleaveFilters(fs...)
+	case "cond":
+		pred := p.expr()
+		p.expect(",")
+		tf := p.expr()
+		var ff bigtable.Filter
+		if p.accept(",") {
+			ff = p.expr()
+		}
+		return bigtable.ConditionFilter(pred, tf, ff)
+	case "row":
+		return bigtable.RowKeyFilter(p.str())
+	case "family":
+		return bigtable.FamilyFilter(p.str())
+	case "column":
+		return bigtable.ColumnFilter(p.str())
+	case "value":
+		return bigtable.ValueFilter(p.str())
+	case "column_range":
+		fam := p.str()
+		p.expect(",")
+		start := p.str()
+		p.expect(",")
+		return bigtable.ColumnRangeFilter(fam, start, p.str())
+	case "value_range":
+		var start, end []byte
+		if s := p.str(); s != "" {
+			start = []byte(s)
+		}
+		p.expect(",")
+		if s := p.str(); s != "" {
+			end = []byte(s)
+		}
+		return bigtable.ValueRangeFilter(start, end)
+	case "timestamp_range":
+		start := p.int(64)
+		p.expect(",")
+		return bigtable.TimestampRangeFilterMicros(bigtable.Timestamp(start), bigtable.Timestamp(p.int(64)))
+	case "latest":
+		return bigtable.LatestNFilter(int(p.int(32)))
+	case "cells_per_row":
+		return bigtable.CellsPerRowLimitFilter(int(p.int(32)))
+	case "cells_per_row_offset":
+		return bigtable.CellsPerRowOffsetFilter(int(p.int(32)))
+	case "sample":
+		s := p.str()
+		prob, err := strconv.ParseFloat(s, 64)
+		if p.err == nil && (err != nil || prob <= 0 || prob >= 1) {
+			p.fail("bad sample probability %q; want a number between 0 and 1", s)
+		}
+		return bigtable.RowSampleFilter(prob)
+	case "strip_value":
+		return bigtable.StripValueFilter()
+	case "pass_all":
+		return bigtable.PassAllFilter()
+	case "block_all":
+		return bigtable.BlockAllFilter()
+	}
+	p.fail("unknown filter %q", name)
+	return nil
+}
+
+// str parses a string argument.
+func (p *filterParser) str() string {
+	t := p.next()
+	if t.kind != tokWord && t.kind != tokString {
+		p.fail("want a string, got %s", t)
+	}
+	return t.text
+}
+
+// int parses a non-negative integer argument of the given bit size.
+func (p *filterParser) int(bitSize int) int64 {
+	s := p.str()
+	n, err := strconv.ParseInt(s, 0, bitSize)
+	if p.err == nil && (err != nil || n < 0) {
+		p.fail("bad number %q; want a non-negative integer", s)
+	}
+	return n
+}
@@ -0,0 +1,115 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/smyte/google-cloud-go/bigtable"
+)
+
+func TestParseFilter(t *testing.T) {
+	for _, test := range []struct {
+		in   string
+		want bigtable.Filter
+	}{
+		{
+			"family(stats)",
+			bigtable.FamilyFilter("stats"),
+		},
+		{
+			`family(stats) && column("os_.*") && latest(1)`,
+			bigtable.ChainFilters(bigtable.FamilyFilter("stats"), bigtable.ColumnFilter("os_.*"), bigtable.LatestNFilter(1)),
+		},
+		{
+			"column(a) || column(b) && value(x)",
+			bigtable.InterleaveFilters(
+				bigtable.ColumnFilter("a"),
+				bigtable.ChainFilters(bigtable.ColumnFilter("b"), bigtable.ValueFilter("x"))),
+		},
+		{
+			"(column(a) || column(b)) && value(x)",
+			bigtable.ChainFilters(
+				bigtable.InterleaveFilters(bigtable.ColumnFilter("a"), bigtable.ColumnFilter("b")),
+				bigtable.ValueFilter("x")),
+		},
+		{
+			"chain(row(`phone#.*`), sample(0.25))",
+			bigtable.ChainFilters(bigtable.RowKeyFilter("phone#.*"), bigtable.RowSampleFilter(0.25)),
+		},
+		{
+			"interleave(strip_value(), pass_all() && block_all())",
+			bigtable.InterleaveFilters(
+				bigtable.StripValueFilter(),
+				bigtable.ChainFilters(bigtable.PassAllFilter(), bigtable.BlockAllFilter())),
+		},
+		{
+			"cond(column(flag), strip_value())",
+			bigtable.ConditionFilter(bigtable.ColumnFilter("flag"), bigtable.StripValueFilter(), nil),
+		},
+		{
+			"cond(column(flag), strip_value(), latest(2))",
+			bigtable.ConditionFilter(bigtable.ColumnFilter("flag"), bigtable.StripValueFilter(), bigtable.LatestNFilter(2)),
+		},
+		{
+			`value_range("a\x00", "") && column_range(f, "", z)`,
+			bigtable.ChainFilters(bigtable.ValueRangeFilter([]byte("a\x00"), nil), bigtable.ColumnRangeFilter("f", "", "z")),
+		},
+		{
+			"timestamp_range(1000, 0x7d0) && cells_per_row(3) && cells_per_row_offset(1)",
+			bigtable.ChainFilters(
+				bigtable.TimestampRangeFilterMicros(1000, 2000),
+				bigtable.CellsPerRowLimitFilter(3),
+				bigtable.CellsPerRowOffsetFilter(1)),
+		},
+	} {
+		got, err := parseFilter(test.in)
+		if err != nil {
+			t.Errorf("%s: %v", test.in, err)
+			continue
+		}
+		if got.String() != test.want.String() {
+			t.Errorf("%s: got %s, want %s", test.in, got, test.want)
+		}
+	}
+}
+
+func TestParseFilterErrors(t *testing.T) {
+	for _, test := range []struct {
+		in, want string
+	}{
+		{"", "want a filter"},
+		{"family", `want "("`},
+		{"family(a", `want ")"`},
+		{"family(a) b", "want end of input"},
+		{"family(a) & column(b)", "bad character"},
+		{"nope(a)", "unknown filter"},
+		{`column("a)`, "unterminated string"},
+		{"latest(-1)", "bad number"},
+		{"latest(x)", "bad number"},
+		{"sample(1.5)", "bad sample probability"},
+		{"cond(column(a))", `want ","`},
+		{"chain()", "want a filter"},
+		{"family(column(a))", `want ")"`},
+	} {
+		_, err := parseFilter(test.in)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%q: got error %v, want it to contain %q", test.in, err, test.want)
+		}
+	}
+}
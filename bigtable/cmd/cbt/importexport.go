@@ -0,0 +1,596 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/smyte/google-cloud-go/bigtable"
+)
+
+// The file formats supported by import and export.
+const (
+	formatCSV  = "csv"
+	formatJSON = "json"
+	formatAvro = "avro"
+)
+
+// fileFormat returns the format of the named file, which is given
+// explicitly or inferred from the file's extension.
+func fileFormat(name, format string) (string, error) {
+	if format == "" {
+		switch strings.ToLower(filepath.Ext(name)) {
+		case ".csv":
+			format = formatCSV
+		case ".json", ".jsonl", ".ndjson":
+			format = formatJSON
+		case ".avro":
+			format = formatAvro
+		default:
+			return "", fmt.Errorf("cannot infer the format of %q; use format=csv|json|avro", name)
+		}
+	}
+	switch format {
+	case formatCSV, formatJSON, formatAvro:
+		return format, nil
+	}
+	return "", fmt.Errorf("unknown format %q; want csv, json or avro", format)
+}
+
+// exportRow is a row as it is stored in JSON lines and Avro files.
+type exportRow struct {
+	Key   string       `json:"key"`
+	Cells []exportCell `json:"cells"`
+}
+
+type exportCell struct {
+	Family    string `json:"family"`
+	Qualifier string `json:"qualifier"`
+	Timestamp int64  `json:"timestamp"`
+	Value     []byte `json:"value"`
+}
+
+func newExportRow(r bigtable.Row) exportRow {
+	er := exportRow{Key: r.Key()}
+	for _, fam := range sortedFamilies(r) {
+		for _, item := range r[fam] {
+			er.Cells = append(er.Cells, exportCell{
+				Family:    fam,
+				Qualifier: strings.TrimPrefix(item.Column, fam+":"),
+				Timestamp: int64(item.Timestamp),
+				Value:     item.Value,
+			})
+		}
+	}
+	return er
+}
+
+func sortedFamilies(r bigtable.Row) []string {
+	var fams []string
+	for fam := range r {
+		fams = append(fams, fam)
+	}
+	sort.Strings(fams)
+	return fams
+}
+
+// A rowWriter writes rows to a file in one of the export formats.
+type rowWriter interface {
+	Write(exportRow) error
+	// Close flushes buffered rows. It does not close the underlying file.
+	Close() error
+}
+
+// A rowReader reads rows from a file in one of the export formats.
+// Read returns io.EOF when there are no more rows.
+type rowReader interface {
+	Read() (exportRow, error)
+}
+
+type jsonRowWriter struct {
+	w   *bufio.Writer
+	enc *json.Encoder
+}
+
+func newJSONRowWriter(w io.Writer) *jsonRowWriter {
+	bw := bufio.NewWriter(w)
+	return &jsonRowWriter{w: bw, enc: json.NewEncoder(bw)}
+}
+
+func (jw *jsonRowWriter) Write(r exportRow) error { return jw.enc.Encode(r) }
+func (jw *jsonRowWriter) Close() error            { return jw.w.Flush() }
+
+type jsonRowReader struct {
+	dec *json.Decoder
+}
+
+func (jr *jsonRowReader) Read() (exportRow, error) {
+	var r exportRow
+	err := jr.dec.Decode(&r)
+	return r, err
+}
+
+// csvRowWriter writes the latest cell of each of a fixed set of columns.
+// The first record is a header of "row_key" followed by the columns, in
+// family:qualifier form.
+type csvRowWriter struct {
+	w       *csv.Writer
+	columns []string
+	index   map[string]int
+	started bool
+}
+
+func newCSVRowWriter(w io.Writer, columns []string) *csvRowWriter {
+	cw := &csvRowWriter{w: csv.NewWriter(w), columns: columns, index: make(map[string]int)}
+	for i, col := range columns {
+		cw.index[col] = i + 1
+	}
+	return cw
+}
+
+func (cw *csvRowWriter) Write(r exportRow) error {
+	if !cw.started {
+		cw.started = true
+		if err := cw.w.Write(append([]string{"row_key"}, cw.columns...)); err != nil {
+			return err
+		}
+	}
+	rec := make([]string, len(cw.columns)+1)
+	rec[0] = r.Key
+	seen := make([]bool, len(rec))
+	for _, c := range r.Cells {
+		// Cells of a column are ordered newest first; keep the first.
+		i, ok := cw.index[c.Family+":"+c.Qualifier]
+		if !ok || seen[i] {
+			continue
+		}
+		seen[i] = true
+		rec[i] = string(c.Value)
+	}
+	return cw.w.Write(rec)
+}
+
+func (cw *csvRowWriter) Close() error {
+	cw.w.Flush()
+	return cw.w.Error()
+}
+
+// csvRowReader reads files written by csvRowWriter. Empty fields are
+// skipped, and all cells are given the same timestamp.
+type csvRowReader struct {
+	r         *csv.Reader
+	columns   [][2]string // family and qualifier of each field after the key
+	timestamp int64
+}
+
+func newCSVRowReader(r io.Reader, timestamp int64) (*csvRowReader, error) {
+	cr := &csvRowReader{r: csv.NewReader(r), timestamp: timestamp}
+	header, err := cr.r.Read()
+	if err == io.EOF {
+		return nil, fmt.Errorf("missing CSV header")
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, col := range header[1:] {
+		i := strings.Index(col, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("bad CSV header column %q; want <family>:<qualifier>", col)
+		}
+		cr.columns = append(cr.columns, [2]string{col[:i], col[i+1:]})
+	}
+	return cr, nil
+}
+
+func (cr *csvRowReader) Read() (exportRow, error) {
+	rec, err := cr.r.Read()
+	if err != nil {
+		return exportRow{}, err
+	}
+	r := exportRow{Key: rec[0]}
+	for i, val := range rec[1:] {
+		if val == "" {
+			continue
+		}
+		r.Cells = append(r.Cells, exportCell{
+			Family:    cr.columns[i][0],
+			Qualifier: cr.columns[i][1],
+			Timestamp: cr.timestamp,
+			Value:     []byte(val),
+		})
+	}
+	return r, nil
+}
+
+// openOutput returns the named file for writing, or stdout if name is "-".
+func openOutput(name string) (io.WriteCloser, error) {
+	if name == "-" {
+		return nopWriteCloser{os.Stdout}, nil
+	}
+	return os.Create(name)
+}
+
+// openInput returns the named file for reading, or stdin if name is "-".
+func openInput(name string) (io.ReadCloser, error) {
+	if name == "-" {
+		return os.Stdin, nil
+	}
+	return os.Open(name)
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+// rangeBounds returns the start and end row keys described by the start,
+// end and prefix arguments. An empty end means the range is unbounded.
+func rangeBounds(parsed map[string]string) (start, end string, err error) {
+	if prefix := parsed["prefix"]; prefix != "" {
+		if parsed["start"] != "" || parsed["end"] != "" {
+			return "", "", fmt.Errorf(`"start"/"end" may not be mixed with "prefix"`)
+		}
+		return prefix, prefixEnd(prefix), nil
+	}
+	return parsed["start"], parsed["end"], nil
+}
+
+// prefixEnd returns the first key greater than every key with prefix, or
+// "" if there is no such key.
+func prefixEnd(prefix string) string {
+	n := len(prefix)
+	for n > 0 && prefix[n-1] == 0xff {
+		n--
+	}
+	if n == 0 {
+		return ""
+	}
+	return prefix[:n-1] + string([]byte{prefix[n-1] + 1})
+}
+
+// splitRange divides the range [start, end) at the split keys that fall
+// within it. The keys must be sorted.
+func splitRange(start, end string, keys []string) []bigtable.RowRange {
+	var ranges []bigtable.RowRange
+	for _, k := range keys {
+		if k <= start || (end != "" && k >= end) {
+			continue
+		}
+		ranges = append(ranges, bigtable.NewRange(start, k))
+		start = k
+	}
+	if end == "" {
+		return append(ranges, bigtable.InfiniteRange(start))
+	}
+	return append(ranges, bigtable.NewRange(start, end))
+}
+
+func parseParallelism(s string) int {
+	if s == "" {
+		return 1
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 {
+		log.Fatalf("Bad parallelism %q; want a positive integer", s)
+	}
+	return n
+}
+
+func doExport(ctx context.Context, args ...string) {
+	if len(args) < 2 {
+		log.Fatalf("usage: cbt export <table> <file> [args ...]")
+	}
+	table, file := args[0], args[1]
+	parsed, err := parseArgs(args[2:], []string{
+		"format", "start", "end", "prefix", "regex", "columns", "cells-per-column",
+		"start-ts", "end-ts", "parallelism", "app-profile",
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	format, err := fileFormat(file, parsed["format"])
+	if err != nil {
+		log.Fatal(err)
+	}
+	start, end, err := rangeBounds(parsed)
+	if err != nil {
+		log.Fatal(err)
+	}
+	parallelism := parseParallelism(parsed["parallelism"])
+
+	var filters []bigtable.Filter
+	if cellsPerColumn := parsed["cells-per-column"]; cellsPerColumn != "" {
+		n, err := strconv.Atoi(cellsPerColumn)
+		if err != nil {
+			log.Fatalf("Bad number of cells per column %q: %v", cellsPerColumn, err)
+		}
+		filters = append(filters, bigtable.LatestNFilter(n))
+	}
+	if regex := parsed["regex"]; regex != "" {
+		filters = append(filters, bigtable.RowKeyFilter(regex))
+	}
+	if columns := parsed["columns"]; columns != "" {
+		columnFilters, err := parseColumnsFilter(columns)
+		if err != nil {
+			log.Fatal(err)
+		}
+		filters = append(filters, columnFilters)
+	}
+	if parsed["start-ts"] != "" || parsed["end-ts"] != "" {
+		var startTS, endTS int64
+		if s := parsed["start-ts"]; s != "" {
+			if startTS, err = strconv.ParseInt(s, 0, 64); err != nil {
+				log.Fatalf("Bad start-ts %q: %v", s, err)
+			}
+		}
+		if s := parsed["end-ts"]; s != "" {
+			if endTS, err = strconv.ParseInt(s, 0, 64); err != nil {
+				log.Fatalf("Bad end-ts %q: %v", s, err)
+			}
+		}
+		filters = append(filters, bigtable.TimestampRangeFilterMicros(bigtable.Timestamp(startTS), bigtable.Timestamp(endTS)))
+	}
+
+	tbl := getClient(bigtable.ClientConfig{AppProfile: parsed["app-profile"]}).Open(table)
+	ranges := []bigtable.RowRange{splitRange(start, end, nil)[0]}
+	if parallelism > 1 {
+		keys, err := tbl.SampleRowKeys(ctx)
+		if err != nil {
+			log.Fatalf("Sampling row keys: %v", err)
+		}
+		ranges = splitRange(start, end, keys)
+	}
+
+	out, err := openOutput(file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var w rowWriter
+	switch format {
+	case formatCSV:
+		columns, ok := qualifiedColumns(parsed["columns"])
+		if !ok {
+			// Find the columns present in the exported rows with a
+			// first pass that strips the values.
+			log.Printf("Scanning %s for columns", table)
+			columns, err = exportColumns(ctx, tbl, ranges, parallelism,
+				append(filters, bigtable.StripValueFilter()))
+			if err != nil {
+				log.Fatalf("Scanning columns: %v", err)
+			}
+		}
+		w = newCSVRowWriter(out, columns)
+	case formatJSON:
+		w = newJSONRowWriter(out)
+	case formatAvro:
+		if w, err = newAvroWriter(out); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var n int
+	err = readRanges(ctx, tbl, ranges, parallelism, filters, func(r bigtable.Row) error {
+		n++
+		return w.Write(newExportRow(r))
+	})
+	if err != nil {
+		log.Fatalf("Exporting rows: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		log.Fatalf("Writing %s: %v", file, err)
+	}
+	if err := out.Close(); err != nil {
+		log.Fatalf("Writing %s: %v", file, err)
+	}
+	log.Printf("Exported %d rows", n)
+}
+
+// qualifiedColumns returns the columns of a columns argument if each is
+// given in full family:qualifier form.
+func qualifiedColumns(arg string) ([]string, bool) {
+	if arg == "" {
+		return nil, false
+	}
+	columns := strings.Split(arg, ",")
+	for _, col := range columns {
+		i := strings.Index(col, ":")
+		if i <= 0 || i == len(col)-1 {
+			return nil, false
+		}
+	}
+	return columns, true
+}
+
+// exportColumns returns the sorted columns, in family:qualifier form, of the
+// rows in ranges.
+func exportColumns(ctx context.Context, tbl *bigtable.Table, ranges []bigtable.RowRange, parallelism int, filters []bigtable.Filter) ([]string, error) {
+	seen := make(map[string]bool)
+	err := readRanges(ctx, tbl, ranges, parallelism, filters, func(r bigtable.Row) error {
+		for _, items := range r {
+			for _, item := range items {
+				seen[item.Column] = true
+			}
+		}
+		return nil
+	})
+	var columns []string
+	for col := range seen {
+		columns = append(columns, col)
+	}
+	sort.Strings(columns)
+	return columns, err
+}
+
+// readRanges reads ranges with up to parallelism concurrent ReadRows calls,
+// calling f for each row. The calls of f are not concurrent; they are in row
+// key order only if parallelism is 1.
+func readRanges(ctx context.Context, tbl *bigtable.Table, ranges []bigtable.RowRange, parallelism int, filters []bigtable.Filter, f func(bigtable.Row) error) error {
+	var opts []bigtable.ReadOption
+	if len(filters) > 1 {
+		opts = append(opts, bigtable.RowFilter(bigtable.ChainFilters(filters...)))
+	} else if len(filters) == 1 {
+		opts = append(opts, bigtable.RowFilter(filters[0]))
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		mu       sync.Mutex
+		firstErr error
+		wg       sync.WaitGroup
+	)
+	fail := func(err error) {
+		mu.Lock()
+		if firstErr == nil {
+			firstErr = err
+		}
+		mu.Unlock()
+		cancel()
+	}
+	work := make(chan bigtable.RowRange, len(ranges))
+	for _, rr := range ranges {
+		work <- rr
+	}
+	close(work)
+	for i := 0; i < parallelism && i < len(ranges); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for rr := range work {
+				err := tbl.ReadRows(ctx, rr, func(r bigtable.Row) bool {
+					mu.Lock()
+					defer mu.Unlock()
+					if firstErr != nil {
+						return false
+					}
+					if err := f(r); err != nil {
+						firstErr = err
+						cancel()
+						return false
+					}
+					return true
+				}, opts...)
+				if err != nil {
+					fail(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return firstErr
+}
+
+func doImport(ctx context.Context, args ...string) {
+	if len(args) < 2 {
+		log.Fatalf("usage: cbt import <table> <file> [args ...]")
+	}
+	table, file := args[0], args[1]
+	parsed, err := parseArgs(args[2:], []string{"format", "timestamp", "parallelism", "app-profile"})
+	if err != nil {
+		log.Fatal(err)
+	}
+	format, err := fileFormat(file, parsed["format"])
+	if err != nil {
+		log.Fatal(err)
+	}
+	var ts int64 = -1 // keep the timestamps in the file
+	if s := parsed["timestamp"]; s != "" {
+		if ts, err = strconv.ParseInt(s, 0, 64); err != nil {
+			log.Fatalf("Bad timestamp %q: %v", s, err)
+		}
+	} else if format == formatCSV {
+		ts = int64(bigtable.Now())
+	}
+	parallelism := parseParallelism(parsed["parallelism"])
+
+	in, err := openInput(file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer in.Close()
+	var r rowReader
+	switch format {
+	case formatCSV:
+		if r, err = newCSVRowReader(in, ts); err != nil {
+			log.Fatalf("Reading %s: %v", file, err)
+		}
+	case formatJSON:
+		r = &jsonRowReader{dec: json.NewDecoder(bufio.NewReader(in))}
+	case formatAvro:
+		if r, err = newAvroReader(in); err != nil {
+			log.Fatalf("Reading %s: %v", file, err)
+		}
+	}
+
+	tbl := getClient(bigtable.ClientConfig{AppProfile: parsed["app-profile"]}).Open(table)
+	w := tbl.NewBulkWriter(bigtable.BulkWriterSettings{MaxOutstandingRequests: parallelism})
+
+	// Check the results as they become ready so they need not all be kept.
+	results := make(chan *bigtable.ApplyResult, 1000)
+	errc := make(chan error, 1)
+	go func() {
+		var firstErr error
+		for res := range results {
+			if err := res.Get(ctx); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		errc <- firstErr
+	}()
+
+	var n int
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Fatalf("Reading %s: %v", file, err)
+		}
+		if len(row.Cells) == 0 {
+			continue
+		}
+		mut := bigtable.NewMutation()
+		for _, c := range row.Cells {
+			t := c.Timestamp
+			if ts >= 0 {
+				t = ts
+			}
+			mut.Set(c.Family, c.Qualifier, bigtable.Timestamp(t), c.Value)
+		}
+		results <- w.Apply(ctx, row.Key, mut)
+		n++
+	}
+	w.Close()
+	close(results)
+	if err := <-errc; err != nil {
+		log.Fatalf("Importing rows: %v", err)
+	}
+	log.Printf("Imported %d rows", n)
+}
@@ -0,0 +1,248 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/smyte/google-cloud-go/bigtable"
+	"github.com/smyte/google-cloud-go/internal/testutil"
+)
+
+var testExportRows = []exportRow{
+	{Key: "r1", Cells: []exportCell{
+		{Family: "f", Qualifier: "a", Timestamp: 2000, Value: []byte("new")},
+		{Family: "f", Qualifier: "a", Timestamp: 1000, Value: []byte("old")},
+		{Family: "g", Qualifier: "b,c", Timestamp: 1000, Value: []byte{0, 0xff}},
+	}},
+	{Key: "r2\x00", Cells: []exportCell{
+		{Family: "g", Qualifier: "b,c", Timestamp: -1, Value: []byte{}},
+	}},
+}
+
+func readAll(t *testing.T, r rowReader) []exportRow {
+	t.Helper()
+	var rows []exportRow
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			return rows
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows = append(rows, row)
+	}
+}
+
+func TestAvroRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := newAvroWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want []exportRow
+	// Write enough rows to fill more than one block.
+	for i := 0; i < avroBlockRows+1; i++ {
+		row := testExportRows[i%len(testExportRows)]
+		row.Key = fmt.Sprintf("%s-%d", row.Key, i)
+		want = append(want, row)
+		if err := w.Write(row); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := newAvroReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, r); !testutil.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestAvroReaderErrors(t *testing.T) {
+	if _, err := newAvroReader(strings.NewReader("not avro")); err == nil {
+		t.Error("reading non-Avro input: got nil, want error")
+	}
+	var buf bytes.Buffer
+	w, err := newAvroWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write(testExportRows[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	truncated := buf.Bytes()[:buf.Len()-1]
+	r, err := newAvroReader(bytes.NewReader(truncated))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Read(); err != io.ErrUnexpectedEOF {
+		t.Errorf("reading truncated file: got %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+
+	// A header with one metadata entry, whose value claims to be 1TB long.
+	var huge bytes.Buffer
+	huge.Write(avroMagic)
+	varint := func(n int64) []byte {
+		b := make([]byte, binary.MaxVarintLen64)
+		return b[:binary.PutVarint(b, n)]
+	}
+	huge.Write(varint(1))
+	huge.Write(varint(1))
+	huge.WriteString("k")
+	huge.Write(varint(1 << 40))
+	if _, err := newAvroReader(&huge); err == nil {
+		t.Error("reading a huge length: got nil, want error")
+	}
+
+	// Blocks with no rows, a negative number of rows or a negative size.
+	buf.Reset()
+	if _, err := newAvroWriter(&buf); err != nil {
+		t.Fatal(err)
+	}
+	header := buf.Bytes()
+	for _, block := range [][2]int64{{0, 0}, {-1, 10}, {1, -1}} {
+		in := append(append(header[:len(header):len(header)], varint(block[0])...), varint(block[1])...)
+		r, err := newAvroReader(bytes.NewReader(in))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.Read(); err == nil || !strings.Contains(err.Error(), "corrupt") {
+			t.Errorf("reading a block of %d rows in %d bytes: got %v, want a corrupt file error", block[0], block[1], err)
+		}
+	}
+}
+
+func TestJSONRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	w := newJSONRowWriter(&buf)
+	for _, row := range testExportRows {
+		if err := w.Write(row); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Count(buf.String(), "\n"), len(testExportRows); got != want {
+		t.Errorf("wrote %d lines, want %d", got, want)
+	}
+	got := readAll(t, &jsonRowReader{dec: json.NewDecoder(&buf)})
+	if !testutil.Equal(got, testExportRows) {
+		t.Errorf("got %v, want %v", got, testExportRows)
+	}
+}
+
+func TestCSVRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	w := newCSVRowWriter(&buf, []string{"f:a", "g:b,c"})
+	for _, row := range testExportRows {
+		if err := w.Write(row); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	wantCSV := "row_key,f:a,\"g:b,c\"\n" +
+		"r1,new,\x00\xff\n" +
+		"r2\x00,,\n"
+	if got := buf.String(); got != wantCSV {
+		t.Errorf("wrote %q, want %q", got, wantCSV)
+	}
+
+	r, err := newCSVRowReader(&buf, 5000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []exportRow{
+		{Key: "r1", Cells: []exportCell{
+			{Family: "f", Qualifier: "a", Timestamp: 5000, Value: []byte("new")},
+			{Family: "g", Qualifier: "b,c", Timestamp: 5000, Value: []byte{0, 0xff}},
+		}},
+		{Key: "r2\x00"},
+	}
+	if got := readAll(t, r); !testutil.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestFileFormat(t *testing.T) {
+	for _, test := range []struct {
+		name, format, want string
+	}{
+		{"rows.csv", "", formatCSV},
+		{"rows.JSONL", "", formatJSON},
+		{"rows.ndjson", "", formatJSON},
+		{"rows.avro", "", formatAvro},
+		{"-", "json", formatJSON},
+		{"rows.csv", "avro", formatAvro},
+		{"-", "", ""},
+		{"rows.txt", "", ""},
+		{"rows.csv", "xml", ""},
+	} {
+		got, err := fileFormat(test.name, test.format)
+		if (err != nil) != (test.want == "") || got != test.want {
+			t.Errorf("fileFormat(%q, %q) = %q, %v; want %q", test.name, test.format, got, err, test.want)
+		}
+	}
+}
+
+func TestSplitRange(t *testing.T) {
+	keys := []string{"b", "d", "f"}
+	for _, test := range []struct {
+		start, end string
+		want       []bigtable.RowRange
+	}{
+		{"", "", []bigtable.RowRange{
+			bigtable.NewRange("", "b"), bigtable.NewRange("b", "d"),
+			bigtable.NewRange("d", "f"), bigtable.InfiniteRange("f"),
+		}},
+		{"c", "e", []bigtable.RowRange{bigtable.NewRange("c", "d"), bigtable.NewRange("d", "e")}},
+		{"d", "f", []bigtable.RowRange{bigtable.NewRange("d", "f")}},
+		{"g", "", []bigtable.RowRange{bigtable.InfiniteRange("g")}},
+	} {
+		got := splitRange(test.start, test.end, keys)
+		if !testutil.Equal(fmt.Sprint(got), fmt.Sprint(test.want)) {
+			t.Errorf("splitRange(%q, %q) = %v, want %v", test.start, test.end, got, test.want)
+		}
+	}
+}
+
+func TestPrefixEnd(t *testing.T) {
+	for in, want := range map[string]string{
+		"abc":      "abd",
+		"a\xff":    "b",
+		"\x7f":     "\x80",
+		"\xff\xff": "",
+	} {
+		if got := prefixEnd(in); got != want {
+			t.Errorf("prefixEnd(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,293 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/smyte/google-cloud-go/bigtable"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+
+	// Register the well-known types for the proto decoder.
+	_ "github.com/golang/protobuf/ptypes/any"
+	_ "github.com/golang/protobuf/ptypes/duration"
+	_ "github.com/golang/protobuf/ptypes/struct"
+	_ "github.com/golang/protobuf/ptypes/timestamp"
+	_ "github.com/golang/protobuf/ptypes/wrappers"
+)
+
+// A valueDecoder converts a cell value to an int64, string or proto.Message
+// for printing.
+type valueDecoder func([]byte) (interface{}, error)
+
+// parseDecoder returns the named decoder, which is one of
+//     string
+//     int64               an 8-byte big-endian integer
+//     hex
+//     proto:<type>        a protocol buffer message of the fully-qualified type
+func parseDecoder(name string) (valueDecoder, error) {
+	switch name {
+	case "string":
+		return func(v []byte) (interface{}, error) { return string(v), nil }, nil
+	case "int64":
+		return func(v []byte) (interface{}, error) {
+			if len(v) != 8 {
+				return nil, fmt.Errorf("value has %d bytes, want 8", len(v))
+			}
+			return int64(binary.BigEndian.Uint64(v)), nil
+		}, nil
+	case "hex":
+		return func(v []byte) (interface{}, error) { return hex.EncodeToString(v), nil }, nil
+	}
+	if strings.HasPrefix(name, "proto:") {
+		typ := proto.MessageType(strings.TrimPrefix(name, "proto:"))
+		if typ == nil || typ.Kind() != reflect.Ptr {
+			return nil, fmt.Errorf("unknown proto message type %q", strings.TrimPrefix(name, "proto:"))
+		}
+		return func(v []byte) (interface{}, error) {
+			m := reflect.New(typ.Elem()).Interface().(proto.Message)
+			if err := proto.Unmarshal(v, m); err != nil {
+				return nil, err
+			}
+			return m, nil
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown value decoder %q; want string, int64, hex or proto:<type>", name)
+}
+
+// valueDecoders choose the decoder for each column.
+type valueDecoders struct {
+	all     valueDecoder
+	columns map[string]valueDecoder // by family:qualifier or family
+}
+
+// parseDecoders parses a decode argument, which is a decoder name to apply to
+// every column, or a comma-separated list of <family>:<qualifier>=<decoder>
+// and <family>=<decoder> items, optionally with one decoder name for the
+// remaining columns.
+func parseDecoders(arg string) (*valueDecoders, error) {
+	d := &valueDecoders{columns: make(map[string]valueDecoder)}
+	if arg == "" {
+		return d, nil
+	}
+	for _, item := range strings.Split(arg, ",") {
+		i := strings.Index(item, "=")
+		dec, err := parseDecoder(item[i+1:])
+		if err != nil {
+			return nil, err
+		}
+		if i < 0 {
+			if d.all != nil {
+				return nil, fmt.Errorf("more than one default decoder in %q", arg)
+			}
+			d.all = dec
+			continue
+		}
+		d.columns[item[:i]] = dec
+	}
+	return d, nil
+}
+
+// decode returns the decoded value of a cell in column, or the value itself
+// if there is no decoder for the column or the value cannot be decoded.
+func (d *valueDecoders) decode(column string, v []byte) interface{} {
+	dec := d.columns[column]
+	if dec == nil {
+		dec = d.columns[column[:strings.Index(column, ":")]]
+	}
+	if dec == nil {
+		dec = d.all
+	}
+	if dec == nil {
+		return v
+	}
+	dv, err := dec(v)
+	if err != nil {
+		return v
+	}
+	return dv
+}
+
+// The formats in which rows are printed.
+const (
+	printText = "text"
+	printJSON = "json"
+	printCSV  = "csv"
+	printHex  = "hex"
+)
+
+// A rowPrinter prints rows in one of the print formats.
+type rowPrinter interface {
+	printRow(bigtable.Row) error
+	flush() error
+}
+
+func newRowPrinter(w io.Writer, format string, dec *valueDecoders) (rowPrinter, error) {
+	switch format {
+	case "", printText:
+		return &textPrinter{w: w, dec: dec}, nil
+	case printHex:
+		return &textPrinter{w: w, hex: true}, nil
+	case printJSON:
+		return &jsonPrinter{enc: json.NewEncoder(w), dec: dec}, nil
+	case printCSV:
+		return &csvPrinter{w: csv.NewWriter(w), dec: dec}, nil
+	}
+	return nil, fmt.Errorf("unknown format %q; want text, json, csv or hex", format)
+}
+
+// sortedItems returns the cells of r ordered by family and column.
+func sortedItems(r bigtable.Row) []bigtable.ReadItem {
+	var items []bigtable.ReadItem
+	for _, fam := range sortedFamilies(r) {
+		ris := r[fam]
+		sort.Sort(byColumn(ris))
+		items = append(items, ris...)
+	}
+	return items
+}
+
+// textPrinter prints rows in the format of cbt read. If hex is set, values
+// are printed as hex dumps rather than being decoded.
+type textPrinter struct {
+	w   io.Writer
+	dec *valueDecoders
+	hex bool
+}
+
+func (p *textPrinter) printRow(r bigtable.Row) error {
+	var b bytes.Buffer
+	fmt.Fprintln(&b, strings.Repeat("-", 40))
+	fmt.Fprintln(&b, r.Key())
+	for _, ri := range sortedItems(r) {
+		ts := time.Unix(0, int64(ri.Timestamp)*1e3)
+		fmt.Fprintf(&b, "  %-40s @ %s\n", ri.Column, ts.Format("2006/01/02-15:04:05.000000"))
+		if p.hex {
+			fmt.Fprint(&b, indentLines(strings.TrimSuffix(hex.Dump(ri.Value), "\n"), "    "), "\n")
+			continue
+		}
+		switch v := p.dec.decode(ri.Column, ri.Value).(type) {
+		case int64:
+			fmt.Fprintf(&b, "    %d\n", v)
+		case proto.Message:
+			fmt.Fprintf(&b, "    %s\n", proto.CompactTextString(v))
+		default:
+			fmt.Fprintf(&b, "    %q\n", v)
+		}
+	}
+	_, err := p.w.Write(b.Bytes())
+	return err
+}
+
+func (p *textPrinter) flush() error { return nil }
+
+// jsonPrinter prints each row as a line of JSON with the fields of the JSON
+// lines files written by cbt export. Values without a decoder are base64
+// encoded; decoded protocol buffers are objects in their JSON mapping.
+type jsonPrinter struct {
+	enc *json.Encoder
+	dec *valueDecoders
+}
+
+type jsonCell struct {
+	Family    string      `json:"family"`
+	Qualifier string      `json:"qualifier"`
+	Timestamp int64       `json:"timestamp"`
+	Value     interface{} `json:"value"`
+}
+
+func (p *jsonPrinter) printRow(r bigtable.Row) error {
+	row := struct {
+		Key   string     `json:"key"`
+		Cells []jsonCell `json:"cells"`
+	}{Key: r.Key(), Cells: []jsonCell{}}
+	for _, ri := range sortedItems(r) {
+		fam := ri.Column[:strings.Index(ri.Column, ":")]
+		v := p.dec.decode(ri.Column, ri.Value)
+		if m, ok := v.(proto.Message); ok {
+			var b bytes.Buffer
+			if err := (&jsonpb.Marshaler{}).Marshal(&b, m); err != nil {
+				return err
+			}
+			v = json.RawMessage(b.Bytes())
+		}
+		row.Cells = append(row.Cells, jsonCell{
+			Family:    fam,
+			Qualifier: ri.Column[len(fam)+1:],
+			Timestamp: int64(ri.Timestamp),
+			Value:     v,
+		})
+	}
+	return p.enc.Encode(row)
+}
+
+func (p *jsonPrinter) flush() error { return nil }
+
+// csvPrinter prints a record for each cell, after a header record.
+type csvPrinter struct {
+	w       *csv.Writer
+	dec     *valueDecoders
+	started bool
+}
+
+func (p *csvPrinter) printRow(r bigtable.Row) error {
+	if !p.started {
+		p.started = true
+		if err := p.w.Write([]string{"row_key", "family", "qualifier", "timestamp", "value"}); err != nil {
+			return err
+		}
+	}
+	for _, ri := range sortedItems(r) {
+		fam := ri.Column[:strings.Index(ri.Column, ":")]
+		var val string
+		switch v := p.dec.decode(ri.Column, ri.Value).(type) {
+		case int64:
+			val = strconv.FormatInt(v, 10)
+		case string:
+			val = v
+		case proto.Message:
+			val = proto.CompactTextString(v)
+		case []byte:
+			val = string(v)
+		default:
+			return errors.New("internal error: unexpected decoded value type")
+		}
+		err := p.w.Write([]string{r.Key(), fam, ri.Column[len(fam)+1:], strconv.FormatInt(int64(ri.Timestamp), 10), val})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *csvPrinter) flush() error {
+	p.w.Flush()
+	return p.w.Error()
+}
@@ -0,0 +1,144 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/smyte/google-cloud-go/bigtable"
+	"github.com/smyte/google-cloud-go/internal/testutil"
+	"github.com/golang/protobuf/proto"
+	btpb "google.golang.org/genproto/googleapis/bigtable/v2"
+)
+
+func testPrintRow(t *testing.T) bigtable.Row {
+	t.Helper()
+	cell, err := proto.Marshal(&btpb.Cell{TimestampMicros: 7, Labels: []string{"x"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bigtable.Row{
+		"stats": {
+			{Row: "r1", Column: "stats:count", Timestamp: 2000, Value: []byte{0, 0, 0, 0, 0, 0, 1, 0}},
+			{Row: "r1", Column: "stats:bad", Timestamp: 1000, Value: []byte{1, 2}},
+		},
+		"meta": {
+			{Row: "r1", Column: "meta:cell", Timestamp: 1000, Value: cell},
+			{Row: "r1", Column: "meta:name", Timestamp: 0, Value: []byte("a,b")},
+		},
+	}
+}
+
+func printWith(t *testing.T, r bigtable.Row, format, decode string) string {
+	t.Helper()
+	dec, err := parseDecoders(decode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	p, err := newRowPrinter(&buf, format, dec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.printRow(r); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.flush(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestPrintFormats(t *testing.T) {
+	r := testPrintRow(t)
+	const decode = "stats=int64,meta:cell=proto:google.bigtable.v2.Cell,string"
+	for _, test := range []struct {
+		format, decode, want string
+	}{
+		{
+			"json", decode,
+			`{"key":"r1","cells":[` +
+				`{"family":"meta","qualifier":"cell","timestamp":1000,"value":{"timestampMicros":"7","labels":["x"]}},` +
+				`{"family":"meta","qualifier":"name","timestamp":0,"value":"a,b"},` +
+				`{"family":"stats","qualifier":"bad","timestamp":1000,"value":"AQI="},` +
+				`{"family":"stats","qualifier":"count","timestamp":2000,"value":256}]}` + "\n",
+		},
+		{
+			"json", "",
+			`{"key":"r1","cells":[` +
+				`{"family":"meta","qualifier":"cell","timestamp":1000,"value":"CAcaAXg="},` +
+				`{"family":"meta","qualifier":"name","timestamp":0,"value":"YSxi"},` +
+				`{"family":"stats","qualifier":"bad","timestamp":1000,"value":"AQI="},` +
+				`{"family":"stats","qualifier":"count","timestamp":2000,"value":"AAAAAAAAAQA="}]}` + "\n",
+		},
+		{
+			"csv", decode,
+			"row_key,family,qualifier,timestamp,value\n" +
+				"r1,meta,cell,1000,\"timestamp_micros:7 labels:\"\"x\"\" \"\n" +
+				"r1,meta,name,0,\"a,b\"\n" +
+				"r1,stats,bad,1000,\x01\x02\n" +
+				"r1,stats,count,2000,256\n",
+		},
+	} {
+		if got := printWith(t, r, test.format, test.decode); got != test.want {
+			t.Errorf("format=%s decode=%q:\ngot  %q\nwant %q", test.format, test.decode, got, test.want)
+		}
+	}
+
+	// The text formats print timestamps in the local time zone, so check
+	// only the values.
+	for _, test := range []struct {
+		format, want string
+	}{
+		{"text", "    256\n"},
+		{"text", "    timestamp_micros:7 labels:\"x\" \n"},
+		{"text", "    \"\\x01\\x02\"\n"},
+		{"hex", "    00000000  00 00 00 00 00 00 01 00                           |........|\n"},
+		{"hex", "    00000000  61 2c 62                                          |a,b|\n"},
+	} {
+		if got := printWith(t, r, test.format, decode); !strings.Contains(got, test.want) {
+			t.Errorf("format=%s: got %q, want it to contain %q", test.format, got, test.want)
+		}
+	}
+}
+
+func TestParseDecoders(t *testing.T) {
+	for _, bad := range []string{"int32", "proto:no.such.Type", "string,hex", "f:c=nope"} {
+		if _, err := parseDecoders(bad); err == nil {
+			t.Errorf("parseDecoders(%q): got nil, want error", bad)
+		}
+	}
+	d, err := parseDecoders("f=hex,f:c=int64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		column string
+		want   interface{}
+	}{
+		{"f:c", int64(1)},
+		{"f:d", "0000000000000001"},
+		{"g:c", []byte{0, 0, 0, 0, 0, 0, 0, 1}},
+	} {
+		got := d.decode(test.column, []byte{0, 0, 0, 0, 0, 0, 0, 1})
+		if !testutil.Equal(got, test.want) {
+			t.Errorf("decode(%q) = %#v, want %#v", test.column, got, test.want)
+		}
+	}
+}
@@ -49,6 +49,31 @@ To read a single row, use the ReadRow helper method:
 	}
 	// TODO: use r.
 
+The ReverseScan option returns rows in descending order by row key. Combined
+with LimitRows, it reads the last rows of a range, such as the latest events
+for a user:
+
+	err := tbl.ReadRows(ctx, bigtable.PrefixRange("user#1234#"), func(r Row) bool {
+		// TODO: do something with r.
+		return true
+	}, bigtable.ReverseScan(), bigtable.LimitRows(10))
+
+To read a range a page at a time, use ReadPage. It returns a cursor that
+resumes the read after the last row of the page:
+
+	cursor := ""
+	for {
+		rows, next, err := tbl.ReadPage(ctx, bigtable.PrefixRange("user#"), cursor, 100)
+		if err != nil {
+			// TODO: handle err.
+		}
+		// TODO: use rows.
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+
 
 Writing
 
@@ -88,6 +113,71 @@ To increment an encoded value in one cell:
 	}
 	// TODO: use r.
 
+To write many rows without assembling ApplyBulk calls yourself, use a
+BulkWriter. It batches single-row mutations, limits the bytes and requests
+outstanding, and reports the result of each row:
+
+	w := tbl.NewBulkWriter(bigtable.DefaultBulkWriterSettings)
+	defer w.Close()
+	res := w.Apply(ctx, "com.google.cloud", mut)
+	// ...
+	if err := res.Get(ctx); err != nil {
+		// TODO: handle err.
+	}
+
+
+Mapping structs
+
+Rather than building mutations cell by cell, the tagged fields of a struct can
+be written with Mutation.SetStruct and read back with Row.DecodeStruct. A field
+is mapped to a column with a tag of the form
+
+	`bigtable:"family:column[,codec][,versions][,omitempty]"`
+
+where codec is one of
+
+	int     an 8-byte big-endian integer, the encoding used by
+	        ReadModifyWrite.Increment. The default for integer fields.
+	string  the raw bytes of a string. The default for string fields.
+	bytes   the value itself. The default for []byte fields.
+	proto   the wire encoding of a protocol buffer. The default for fields
+	        whose type implements proto.Message.
+	json    the JSON encoding of the field, for any other type.
+
+For example:
+
+	type User struct {
+		Name   string            `bigtable:"profile:name"`
+		Visits int64             `bigtable:"stats:visits"`
+		Prefs  map[string]string `bigtable:"profile:prefs,json"`
+		Emails []string          `bigtable:"profile:email,versions"`
+	}
+
+	mut := bigtable.NewMutation()
+	if err := mut.SetStruct(bigtable.Now(), &User{Name: "gopher"}); err != nil {
+		// TODO: handle err.
+	}
+
+	r, err := tbl.ReadRow(ctx, "user#gopher")
+	if err != nil {
+		// TODO: handle err.
+	}
+	var u User
+	if err := r.DecodeStruct(&u); err != nil {
+		// TODO: handle err.
+	}
+
+By default a field receives only the latest version of its cell. A field with
+the versions option must be a slice, and receives every version returned by the
+read, newest first; such fields are ignored by SetStruct. Each column may be
+mapped by at most one field; SetStruct and DecodeStruct report an error for a
+struct that maps a column twice. A field with the omitempty option is not
+written when it has its zero value. A pointer field, such as *int64, uses the
+codec of the type it points to: a nil pointer is not written, and a column
+that is present is decoded into a newly allocated value. Untagged fields are
+ignored, except that the fields of untagged embedded structs are mapped as if
+they belonged to the outer struct.
+
 
 Retries
 
@@ -96,6 +186,15 @@ until a successful response, an unretryable error or the context deadline is
 reached. Non-idempotent writes (where the timestamp is set to ServerTime) will
 not be retried. In the case of ReadRows, retried calls will not re-scan rows
 that have already been processed.
+
+
+Metrics
+
+Data operations record OpenCensus measurements of their latency, RPC attempts
+and retries, rows and bytes read, and failed ApplyBulk entries. Register the
+views in DefaultViews to export them; each is tagged with the method, table and
+app profile. To observe every RPC attempt directly, including those retried
+internally, set ClientConfig.Interceptor.
 */
 package bigtable // import "github.com/smyte/google-cloud-go/bigtable"
 
@@ -9,6 +9,7 @@ require (
 	github.com/google/btree v1.0.0
 	github.com/google/go-cmp v0.3.0
 	github.com/googleapis/gax-go/v2 v2.0.5
+	go.opencensus.io v0.22.0
 	golang.org/x/exp v0.0.0-20190912063710-ac5d2bfcbfe0 // indirect
 	golang.org/x/oauth2 v0.0.0-20190604053449-0f29369cfe45
 	golang.org/x/tools v0.0.0-20190917162342-3b4f30a44f3b // indirect
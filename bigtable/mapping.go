@@ -0,0 +1,438 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bigtable
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/smyte/google-cloud-go/internal/fields"
+	"github.com/golang/protobuf/proto"
+)
+
+// Codecs for struct fields.
+const (
+	codecInt    = "int"
+	codecString = "string"
+	codecBytes  = "bytes"
+	codecProto  = "proto"
+	codecJSON   = "json"
+)
+
+// columnTag holds the parsed bigtable tag of a struct field.
+type columnTag struct {
+	family, column string
+	codec          string // empty means to infer from the field type
+	versions       bool
+	omitEmpty      bool
+}
+
+// parseColumnTag interprets bigtable struct field tags.
+func parseColumnTag(t reflect.StructTag) (name string, keep bool, other interface{}, err error) {
+	s, ok := t.Lookup("bigtable")
+	if !ok || s == "" {
+		// Keep untagged fields so embedded structs are visited; they are
+		// skipped later because they have no columnTag.
+		return "", true, nil, nil
+	}
+	if s == "-" {
+		return "", false, nil, nil
+	}
+	parts := strings.Split(s, ",")
+	name = parts[0]
+	i := strings.Index(name, ":")
+	if i <= 0 || i == len(name)-1 {
+		return "", false, nil, fmt.Errorf("bigtable: struct tag %q: column must be of the form family:column", s)
+	}
+	tag := &columnTag{family: name[:i], column: name[i+1:]}
+	for _, opt := range parts[1:] {
+		switch opt {
+		case codecInt, codecString, codecBytes, codecProto, codecJSON:
+			if tag.codec != "" {
+				return "", false, nil, fmt.Errorf("bigtable: struct tag %q: more than one codec", s)
+			}
+			tag.codec = opt
+		case "versions":
+			tag.versions = true
+		case "omitempty":
+			tag.omitEmpty = true
+		default:
+			return "", false, nil, fmt.Errorf("bigtable: struct tag %q: unknown option %q", s, opt)
+		}
+	}
+	return name, true, tag, nil
+}
+
+// structCache records the mapped fields of struct types.
+var structCache = fields.NewCache(parseColumnTag, validateColumns, nil)
+
+// validateColumns reports an error if more than one field of the struct type
+// t, including the fields of its embedded structs, maps to the same column.
+// Left to the Go rules for embedded fields, such fields would hide each other
+// without notice.
+func validateColumns(t reflect.Type) error {
+	seen := map[string]string{} // field names by column
+	visiting := map[reflect.Type]bool{} // embedded pointers can form cycles
+	var visit func(t reflect.Type, prefix string) error
+	visit = func(t reflect.Type, prefix string) error {
+		if visiting[t] {
+			return nil
+		}
+		visiting[t] = true
+		defer delete(visiting, t)
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" && !f.Anonymous {
+				continue
+			}
+			col, keep, _, err := parseColumnTag(f.Tag)
+			if err != nil {
+				return err
+			}
+			if !keep {
+				continue
+			}
+			if col != "" {
+				if other, ok := seen[col]; ok {
+					return fmt.Errorf("bigtable: fields %s and %s of %s both map to column %q", other, prefix+f.Name, t, col)
+				}
+				seen[col] = prefix + f.Name
+				continue
+			}
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if f.Anonymous && ft.Kind() == reflect.Struct {
+				if err := visit(ft, prefix+f.Name+"."); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	return visit(t, "")
+}
+
+var typeOfProtoMessage = reflect.TypeOf((*proto.Message)(nil)).Elem()
+
+// structFields returns the value of the struct pointed to by p, and its
+// fields that are mapped to columns.
+func structFields(p interface{}) (reflect.Value, fields.List, error) {
+	v := reflect.ValueOf(p)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return reflect.Value{}, nil, fmt.Errorf("bigtable: want a non-nil struct pointer, got %T", p)
+	}
+	v = v.Elem()
+	all, err := structCache.Fields(v.Type())
+	if err != nil {
+		return reflect.Value{}, nil, err
+	}
+	var fl fields.List
+	for _, f := range all {
+		if _, ok := f.ParsedTag.(*columnTag); ok {
+			fl = append(fl, f)
+		}
+	}
+	return v, fl, nil
+}
+
+// fieldByIndex is like reflect.Value.FieldByIndex, but allocates nil
+// embedded struct pointers along the way when alloc is true. It reports
+// false if a nil embedded pointer prevented reaching the field.
+func fieldByIndex(v reflect.Value, index []int, alloc bool) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				if !alloc {
+					return reflect.Value{}, false
+				}
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, true
+}
+
+// inferCodec returns the codec to use for values of type t when the tag
+// does not name one. Pointers other than protocol buffers get the codec of
+// the type they point to.
+func inferCodec(t reflect.Type) (string, error) {
+	switch {
+	case t.Implements(typeOfProtoMessage):
+		return codecProto, nil
+	case t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8:
+		return codecBytes, nil
+	case t.Kind() == reflect.Ptr:
+		return inferCodec(t.Elem())
+	}
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return codecInt, nil
+	case reflect.String:
+		return codecString, nil
+	}
+	return "", fmt.Errorf("bigtable: no default codec for type %s; use the json codec", t)
+}
+
+// codecFor returns the codec for values of type t under tag.
+func codecFor(tag *columnTag, t reflect.Type) (string, error) {
+	if tag.codec != "" {
+		return tag.codec, nil
+	}
+	return inferCodec(t)
+}
+
+// encodeValue encodes v with the named codec. Unless the codec is proto or
+// json, a non-nil pointer is encoded as the value it points to.
+func encodeValue(codec string, v reflect.Value) ([]byte, error) {
+	if v.Kind() == reflect.Ptr && !v.IsNil() && codec != codecProto && codec != codecJSON {
+		v = v.Elem()
+	}
+	switch codec {
+	case codecInt:
+		var n uint64
+		switch v.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			n = uint64(v.Int())
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			n = v.Uint()
+		default:
+			return nil, fmt.Errorf("bigtable: int codec cannot encode %s", v.Type())
+		}
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint64(b, n)
+		return b, nil
+	case codecString:
+		if v.Kind() != reflect.String {
+			return nil, fmt.Errorf("bigtable: string codec cannot encode %s", v.Type())
+		}
+		return []byte(v.String()), nil
+	case codecBytes:
+		if v.Kind() != reflect.Slice || v.Type().Elem().Kind() != reflect.Uint8 {
+			return nil, fmt.Errorf("bigtable: bytes codec cannot encode %s", v.Type())
+		}
+		return v.Bytes(), nil
+	case codecProto:
+		m, ok := v.Interface().(proto.Message)
+		if !ok {
+			return nil, fmt.Errorf("bigtable: proto codec cannot encode %s", v.Type())
+		}
+		return proto.Marshal(m)
+	case codecJSON:
+		return json.Marshal(v.Interface())
+	}
+	return nil, fmt.Errorf("bigtable: unknown codec %q", codec)
+}
+
+// decodeValue decodes b with the named codec into v, which must be settable.
+// Unless the codec is proto or json, a pointer v is set to a new value
+// holding the decoded one.
+func decodeValue(codec string, b []byte, v reflect.Value) error {
+	if v.Kind() == reflect.Ptr && codec != codecProto && codec != codecJSON {
+		p := reflect.New(v.Type().Elem())
+		if err := decodeValue(codec, b, p.Elem()); err != nil {
+			return err
+		}
+		v.Set(p)
+		return nil
+	}
+	switch codec {
+	case codecInt:
+		if len(b) != 8 {
+			return fmt.Errorf("bigtable: int codec needs an 8-byte value, got %d bytes", len(b))
+		}
+		n := binary.BigEndian.Uint64(b)
+		switch v.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			if v.OverflowInt(int64(n)) {
+				return fmt.Errorf("bigtable: value %d overflows %s", int64(n), v.Type())
+			}
+			v.SetInt(int64(n))
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			if v.OverflowUint(n) {
+				return fmt.Errorf("bigtable: value %d overflows %s", n, v.Type())
+			}
+			v.SetUint(n)
+		default:
+			return fmt.Errorf("bigtable: int codec cannot decode into %s", v.Type())
+		}
+		return nil
+	case codecString:
+		if v.Kind() != reflect.String {
+			return fmt.Errorf("bigtable: string codec cannot decode into %s", v.Type())
+		}
+		v.SetString(string(b))
+		return nil
+	case codecBytes:
+		if v.Kind() != reflect.Slice || v.Type().Elem().Kind() != reflect.Uint8 {
+			return fmt.Errorf("bigtable: bytes codec cannot decode into %s", v.Type())
+		}
+		v.SetBytes(append([]byte(nil), b...))
+		return nil
+	case codecProto:
+		if !v.Type().Implements(typeOfProtoMessage) || v.Kind() != reflect.Ptr {
+			return fmt.Errorf("bigtable: proto codec cannot decode into %s", v.Type())
+		}
+		m := reflect.New(v.Type().Elem())
+		if err := proto.Unmarshal(b, m.Interface().(proto.Message)); err != nil {
+			return err
+		}
+		v.Set(m)
+		return nil
+	case codecJSON:
+		return json.Unmarshal(b, v.Addr().Interface())
+	}
+	return fmt.Errorf("bigtable: unknown codec %q", codec)
+}
+
+// SetStruct adds a Set operation to m for each field of the struct pointed
+// to by src that is mapped to a column, with the given timestamp. See the
+// "Mapping structs" section of the package documentation for how fields are
+// mapped.
+func (m *Mutation) SetStruct(ts Timestamp, src interface{}) error {
+	if m.cond != nil {
+		return errors.New("bigtable: SetStruct called on a conditional mutation")
+	}
+	v, fl, err := structFields(src)
+	if err != nil {
+		return err
+	}
+	type cell struct {
+		family, column string
+		value          []byte
+	}
+	var cells []cell
+	for _, f := range fl {
+		tag := f.ParsedTag.(*columnTag)
+		if tag.versions {
+			continue
+		}
+		fv, ok := fieldByIndex(v, f.Index, false)
+		if !ok {
+			continue
+		}
+		if fv.Kind() == reflect.Ptr && fv.IsNil() {
+			continue
+		}
+		if tag.omitEmpty && isEmptyValue(fv) {
+			continue
+		}
+		codec, err := codecFor(tag, fv.Type())
+		if err != nil {
+			return err
+		}
+		b, err := encodeValue(codec, fv)
+		if err != nil {
+			return fmt.Errorf("bigtable: field %s: %v", f.Name, err)
+		}
+		cells = append(cells, cell{tag.family, tag.column, b})
+	}
+	// Only modify m once every field has been encoded successfully.
+	for _, c := range cells {
+		m.Set(c.family, c.column, ts, c.value)
+	}
+	return nil
+}
+
+// DecodeStruct sets the fields of the struct pointed to by dst from the
+// cells of r. See the "Mapping structs" section of the package documentation
+// for how fields are mapped.
+//
+// Fields whose column is absent from r are left unmodified. Fields with the
+// "versions" option are replaced with a new slice holding every version in r.
+func (r Row) DecodeStruct(dst interface{}) error {
+	v, fl, err := structFields(dst)
+	if err != nil {
+		return err
+	}
+	for _, f := range fl {
+		tag := f.ParsedTag.(*columnTag)
+		col := tag.family + ":" + tag.column
+		var values [][]byte
+		for _, item := range r[tag.family] {
+			if item.Column == col {
+				values = append(values, item.Value)
+				if !tag.versions {
+					break
+				}
+			}
+		}
+		if len(values) == 0 {
+			continue
+		}
+		fv, _ := fieldByIndex(v, f.Index, true)
+		if err := decodeField(tag, values, fv); err != nil {
+			return fmt.Errorf("bigtable: field %s: %v", f.Name, err)
+		}
+	}
+	return nil
+}
+
+// decodeField decodes the values of a column into the field fv. values is
+// ordered newest first and holds a single value unless tag.versions is set.
+func decodeField(tag *columnTag, values [][]byte, fv reflect.Value) error {
+	if !tag.versions {
+		codec, err := codecFor(tag, fv.Type())
+		if err != nil {
+			return err
+		}
+		return decodeValue(codec, values[0], fv)
+	}
+	if fv.Kind() != reflect.Slice {
+		return fmt.Errorf("versions option needs a slice, got %s", fv.Type())
+	}
+	codec, err := codecFor(tag, fv.Type().Elem())
+	if err != nil {
+		return err
+	}
+	s := reflect.MakeSlice(fv.Type(), len(values), len(values))
+	for i, b := range values {
+		if err := decodeValue(codec, b, s.Index(i)); err != nil {
+			return err
+		}
+	}
+	fv.Set(s)
+	return nil
+}
+
+// isEmptyValue reports whether v is the zero value for its type, in the same
+// sense as encoding/json's omitempty.
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
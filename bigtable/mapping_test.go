@@ -0,0 +1,196 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bigtable
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/smyte/google-cloud-go/internal/testutil"
+	"github.com/google/go-cmp/cmp"
+	btpb "google.golang.org/genproto/googleapis/bigtable/v2"
+)
+
+type mappedEmbedded struct {
+	Note string `bigtable:"meta:note"`
+}
+
+type mappedRow struct {
+	mappedEmbedded
+	Name    string            `bigtable:"profile:name"`
+	Count   int64             `bigtable:"stats:count"`
+	Small   uint8             `bigtable:"stats:small"`
+	Raw     []byte            `bigtable:"profile:raw"`
+	Cell    *btpb.Cell        `bigtable:"profile:cell"`
+	Attrs   map[string]string `bigtable:"profile:attrs,json"`
+	Empty   string            `bigtable:"profile:empty,omitempty"`
+	History []int64           `bigtable:"stats:visits,versions"`
+	Ignored string            `bigtable:"-"`
+	Untyped string
+}
+
+func mutationRow(t *testing.T, key string, m *Mutation) Row {
+	t.Helper()
+	r := Row{}
+	for _, op := range m.ops {
+		sc := op.GetSetCell()
+		if sc == nil {
+			t.Fatalf("unexpected mutation %v", op)
+		}
+		r[sc.FamilyName] = append(r[sc.FamilyName], ReadItem{
+			Row:       key,
+			Column:    sc.FamilyName + ":" + string(sc.ColumnQualifier),
+			Timestamp: Timestamp(sc.TimestampMicros),
+			Value:     sc.Value,
+		})
+	}
+	return r
+}
+
+func TestStructRoundTrip(t *testing.T) {
+	in := &mappedRow{
+		mappedEmbedded: mappedEmbedded{Note: "hi"},
+		Name:           "gopher",
+		Count:          -3,
+		Small:          7,
+		Raw:            []byte{0, 1, 2},
+		Cell:           &btpb.Cell{TimestampMicros: 42, Value: []byte("v")},
+		Attrs:          map[string]string{"a": "b"},
+		History:        []int64{1, 2},
+		Ignored:        "x",
+		Untyped:        "y",
+	}
+	m := NewMutation()
+	if err := m.SetStruct(1000, in); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(m.ops), 7; got != want {
+		t.Fatalf("got %d mutations, want %d", got, want)
+	}
+	r := mutationRow(t, "row", m)
+	count := r["stats"][0].Value
+	if want := []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xfd}; !bytes.Equal(count, want) {
+		t.Errorf("count encoded as %x, want %x", count, want)
+	}
+
+	var out mappedRow
+	if err := r.DecodeStruct(&out); err != nil {
+		t.Fatal(err)
+	}
+	want := *in
+	want.Ignored, want.Untyped = "", ""
+	want.History = nil // versions fields are not written
+	if !testutil.Equal(out, want, cmp.AllowUnexported(mappedRow{})) {
+		t.Errorf("got %+v, want %+v", out, want)
+	}
+}
+
+func TestDecodeStructVersions(t *testing.T) {
+	enc := func(n int64) []byte {
+		b, err := encodeValue(codecInt, reflect.ValueOf(n))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	r := Row{"stats": {
+		{Row: "r", Column: "stats:count", Timestamp: 3000, Value: enc(3)},
+		{Row: "r", Column: "stats:count", Timestamp: 2000, Value: enc(2)},
+		{Row: "r", Column: "stats:visits", Timestamp: 3000, Value: enc(3)},
+		{Row: "r", Column: "stats:visits", Timestamp: 2000, Value: enc(2)},
+		{Row: "r", Column: "stats:visits", Timestamp: 1000, Value: enc(1)},
+	}}
+	var out mappedRow
+	if err := r.DecodeStruct(&out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Count != 3 {
+		t.Errorf("Count = %d, want latest version 3", out.Count)
+	}
+	if want := []int64{3, 2, 1}; !testutil.Equal(out.History, want) {
+		t.Errorf("History = %v, want %v", out.History, want)
+	}
+}
+
+func TestStructErrors(t *testing.T) {
+	m := NewMutation()
+	if err := m.SetStruct(0, mappedRow{}); err == nil {
+		t.Error("SetStruct with non-pointer: got nil, want error")
+	}
+	var badTag struct {
+		X string `bigtable:"nocolon"`
+	}
+	if err := m.SetStruct(0, &badTag); err == nil {
+		t.Error("SetStruct with bad tag: got nil, want error")
+	}
+	var noCodec struct {
+		X float64 `bigtable:"f:x"`
+	}
+	if err := m.SetStruct(0, &noCodec); err == nil {
+		t.Error("SetStruct with float field: got nil, want error")
+	}
+	var dup struct {
+		mappedEmbedded
+		Other string `bigtable:"meta:note"`
+	}
+	if err := m.SetStruct(0, &dup); err == nil {
+		t.Error("SetStruct with a column mapped twice: got nil, want error")
+	}
+	if err := (Row{}).DecodeStruct(&dup); err == nil {
+		t.Error("DecodeStruct with a column mapped twice: got nil, want error")
+	}
+	if len(m.ops) != 0 {
+		t.Errorf("failed SetStruct calls added %d mutations", len(m.ops))
+	}
+	var small struct {
+		X int8 `bigtable:"f:x"`
+	}
+	r := Row{"f": {{Row: "r", Column: "f:x", Value: []byte{0, 0, 0, 0, 0, 0, 1, 0}}}}
+	if err := r.DecodeStruct(&small); err == nil {
+		t.Error("DecodeStruct with overflowing value: got nil, want error")
+	}
+}
+
+func TestStructPointerFields(t *testing.T) {
+	type ptrRow struct {
+		Count *int64  `bigtable:"stats:count"`
+		Name  *string `bigtable:"profile:name"`
+		Raw   *[]byte `bigtable:"profile:raw"`
+		Gone  *int64  `bigtable:"stats:gone"`
+	}
+	n, name, raw := int64(5), "gopher", []byte{1}
+	m := NewMutation()
+	if err := m.SetStruct(1000, &ptrRow{Count: &n, Name: &name, Raw: &raw}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(m.ops), 3; got != want {
+		t.Fatalf("got %d mutations, want %d; a nil pointer should not be written", got, want)
+	}
+	r := mutationRow(t, "row", m)
+	if want, _ := encodeValue(codecInt, reflect.ValueOf(n)); !bytes.Equal(r["stats"][0].Value, want) {
+		t.Errorf("*int64 encoded as %x, want %x", r["stats"][0].Value, want)
+	}
+	var out ptrRow
+	if err := r.DecodeStruct(&out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Count == nil || *out.Count != n || out.Name == nil || *out.Name != name ||
+		out.Raw == nil || !bytes.Equal(*out.Raw, raw) || out.Gone != nil {
+		t.Errorf("got %+v", out)
+	}
+}
@@ -0,0 +1,236 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bigtable
+
+import (
+	"context"
+	"time"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+	"google.golang.org/grpc/status"
+)
+
+// The following keys are used to tag data operations.
+var (
+	keyMethod     = tag.MustNewKey("method")
+	keyTable      = tag.MustNewKey("table")
+	keyAppProfile = tag.MustNewKey("app_profile")
+	keyStatus     = tag.MustNewKey("status")
+)
+
+const statsPrefix = "github.com/smyte/google-cloud-go/bigtable/"
+
+// The following are measures recorded for data operations.
+var (
+	// OperationLatency is a measure of the number of milliseconds a data
+	// operation took, including all of its retries.
+	// It is EXPERIMENTAL and subject to change or removal without notice.
+	OperationLatency = stats.Float64(statsPrefix+"operation_latency", "The latency in milliseconds per data operation", stats.UnitMilliseconds)
+
+	// AttemptCount is a measure of the number of RPC attempts made by data
+	// operations, including retries.
+	// It is EXPERIMENTAL and subject to change or removal without notice.
+	AttemptCount = stats.Int64(statsPrefix+"attempt_count", "Number of RPC attempts of data operations", stats.UnitDimensionless)
+
+	// RetryCount is a measure of the number of RPC attempts made by data
+	// operations after their first attempt.
+	// It is EXPERIMENTAL and subject to change or removal without notice.
+	RetryCount = stats.Int64(statsPrefix+"retry_count", "Number of retried RPC attempts of data operations", stats.UnitDimensionless)
+
+	// RowsReturned is a measure of the number of rows returned by ReadRows.
+	// It is EXPERIMENTAL and subject to change or removal without notice.
+	RowsReturned = stats.Int64(statsPrefix+"rows_returned", "Number of rows returned by ReadRows", stats.UnitDimensionless)
+
+	// BytesReturned is a measure of the number of cell value bytes returned by ReadRows.
+	// It is EXPERIMENTAL and subject to change or removal without notice.
+	BytesReturned = stats.Int64(statsPrefix+"bytes_returned", "Number of cell value bytes returned by ReadRows", stats.UnitBytes)
+
+	// FailedMutations is a measure of the number of ApplyBulk entries that
+	// failed after all retries.
+	// It is EXPERIMENTAL and subject to change or removal without notice.
+	FailedMutations = stats.Int64(statsPrefix+"failed_mutations", "Number of ApplyBulk entries that failed", stats.UnitDimensionless)
+)
+
+var (
+	// OperationLatencyView is a distribution of OperationLatency.
+	// It is EXPERIMENTAL and subject to change or removal without notice.
+	OperationLatencyView *view.View
+
+	// AttemptCountView is a cumulative sum of AttemptCount.
+	// It is EXPERIMENTAL and subject to change or removal without notice.
+	AttemptCountView *view.View
+
+	// RetryCountView is a cumulative sum of RetryCount.
+	// It is EXPERIMENTAL and subject to change or removal without notice.
+	RetryCountView *view.View
+
+	// RowsReturnedView is a cumulative sum of RowsReturned.
+	// It is EXPERIMENTAL and subject to change or removal without notice.
+	RowsReturnedView *view.View
+
+	// BytesReturnedView is a cumulative sum of BytesReturned.
+	// It is EXPERIMENTAL and subject to change or removal without notice.
+	BytesReturnedView *view.View
+
+	// FailedMutationsView is a cumulative sum of FailedMutations.
+	// It is EXPERIMENTAL and subject to change or removal without notice.
+	FailedMutationsView *view.View
+)
+
+// DefaultViews are the default views for data operations provided by this package.
+// It is EXPERIMENTAL and subject to change or removal without notice.
+var DefaultViews []*view.View
+
+func init() {
+	OperationLatencyView = createDistView(OperationLatency, keyMethod, keyTable, keyAppProfile, keyStatus)
+	AttemptCountView = createCountView(AttemptCount, keyMethod, keyTable, keyAppProfile, keyStatus)
+	RetryCountView = createCountView(RetryCount, keyMethod, keyTable, keyAppProfile, keyStatus)
+	RowsReturnedView = createCountView(RowsReturned, keyMethod, keyTable, keyAppProfile)
+	BytesReturnedView = createCountView(BytesReturned, keyMethod, keyTable, keyAppProfile)
+	FailedMutationsView = createCountView(FailedMutations, keyMethod, keyTable, keyAppProfile)
+
+	DefaultViews = []*view.View{
+		OperationLatencyView,
+		AttemptCountView,
+		RetryCountView,
+		RowsReturnedView,
+		BytesReturnedView,
+		FailedMutationsView,
+	}
+}
+
+func createCountView(m stats.Measure, keys ...tag.Key) *view.View {
+	return &view.View{
+		Name:        m.Name(),
+		Description: m.Description(),
+		TagKeys:     keys,
+		Measure:     m,
+		Aggregation: view.Sum(),
+	}
+}
+
+func createDistView(m stats.Measure, keys ...tag.Key) *view.View {
+	return &view.View{
+		Name:        m.Name(),
+		Description: m.Description(),
+		TagKeys:     keys,
+		Measure:     m,
+		Aggregation: view.Distribution(0, 1, 2, 5, 10, 20, 50, 100, 200, 500, 1000, 2000, 5000, 10000),
+	}
+}
+
+// AttemptInfo describes a single RPC attempt of a data operation. It is
+// passed to ClientConfig.Interceptor.
+type AttemptInfo struct {
+	// Method is the data operation, such as "ReadRows" or "MutateRows".
+	Method string
+
+	// Table and AppProfile identify the target of the operation.
+	Table      string
+	AppProfile string
+
+	// Attempt is the number of the attempt, starting at zero. An attempt
+	// with a number greater than zero is a retry.
+	Attempt int
+
+	// Latency is the duration of the attempt.
+	Latency time.Duration
+
+	// Err is the error the attempt failed with, or nil.
+	Err error
+
+	// FailedEntries is the number of MutateRows entries that failed in the
+	// attempt. It is always zero for other methods.
+	FailedEntries int
+}
+
+// operation records metrics for a single data operation across its attempts.
+type operation struct {
+	ctx         context.Context // tagged with the method, table and app profile
+	info        AttemptInfo
+	start       time.Time
+	interceptor func(context.Context, *AttemptInfo)
+}
+
+// startOperation returns an operation recording metrics for a call of method on t.
+func (t *Table) startOperation(ctx context.Context, method string) *operation {
+	// On error, record the measurements untagged rather than not at all.
+	if tctx, err := tag.New(ctx,
+		tag.Upsert(keyMethod, method),
+		tag.Upsert(keyTable, t.table),
+		tag.Upsert(keyAppProfile, t.c.appProfile)); err == nil {
+		ctx = tctx
+	}
+	return &operation{
+		ctx:         ctx,
+		info:        AttemptInfo{Method: method, Table: t.table, AppProfile: t.c.appProfile},
+		start:       time.Now(),
+		interceptor: t.c.interceptor,
+	}
+}
+
+// startAttempt marks the beginning of an RPC attempt and returns a function
+// to be called with the attempt's outcome.
+func (op *operation) startAttempt() func(err error, failedEntries int) {
+	start := time.Now()
+	return func(err error, failedEntries int) {
+		info := op.info
+		info.Latency = time.Since(start)
+		info.Err = err
+		info.FailedEntries = failedEntries
+		op.info.Attempt++
+
+		mutators := []tag.Mutator{tag.Upsert(keyStatus, status.Code(err).String())}
+		stats.RecordWithTags(op.ctx, mutators, AttemptCount.M(1))
+		if info.Attempt > 0 {
+			stats.RecordWithTags(op.ctx, mutators, RetryCount.M(1))
+		}
+		if op.interceptor != nil {
+			op.interceptor(op.ctx, &info)
+		}
+	}
+}
+
+// restartAttempts starts a new sequence of attempts, for an operation that
+// makes several RPCs, each of which may be retried.
+func (op *operation) restartAttempts() {
+	op.info.Attempt = 0
+}
+
+// end records the outcome of the whole operation.
+func (op *operation) end(err error) {
+	ms := float64(time.Since(op.start)) / float64(time.Millisecond)
+	stats.RecordWithTags(op.ctx, []tag.Mutator{tag.Upsert(keyStatus, status.Code(err).String())}, OperationLatency.M(ms))
+}
+
+// record records measurements that are not tagged with a status.
+func (op *operation) record(ms ...stats.Measurement) {
+	stats.Record(op.ctx, ms...)
+}
+
+// valueSize returns the total size of the cell values in r.
+func (r Row) valueSize() int64 {
+	var n int64
+	for _, items := range r {
+		for _, item := range items {
+			n += int64(len(item.Value))
+		}
+	}
+	return n
+}
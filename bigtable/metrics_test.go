@@ -0,0 +1,199 @@
+/*
+Copyright 2019 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bigtable
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"go.opencensus.io/stats/view"
+	btpb "google.golang.org/genproto/googleapis/bigtable/v2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestInterceptorSeesApplyBulkRetries(t *testing.T) {
+	ctx := context.Background()
+
+	errCount := 0
+	errInjector := func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if strings.HasSuffix(info.FullMethod, "MutateRows") {
+			req := new(btpb.MutateRowsRequest)
+			must(ss.RecvMsg(req))
+			switch errCount {
+			case 0:
+				// One of two mutations fails and is retried.
+				must(writeMutateRowsResponse(ss, codes.OK, codes.Unavailable))
+			case 1:
+				must(writeMutateRowsResponse(ss, codes.OK))
+			}
+			errCount++
+			return nil
+		}
+		return handler(ctx, ss)
+	}
+
+	var (
+		mu       sync.Mutex
+		attempts []AttemptInfo
+	)
+	config := ClientConfig{
+		AppProfile: "profile",
+		Interceptor: func(_ context.Context, info *AttemptInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			attempts = append(attempts, *info)
+		},
+	}
+	tbl, cleanup, err := setupFakeServerWithConfig(config, grpc.StreamInterceptor(errInjector))
+	defer cleanup()
+	if err != nil {
+		t.Fatalf("fake server setup: %v", err)
+	}
+
+	m1 := NewMutation()
+	m1.Set("cf", "col", 1, []byte{})
+	m2 := NewMutation()
+	m2.Set("cf", "col", 1, []byte{})
+	if errs, err := tbl.ApplyBulk(ctx, []string{"row1", "row2"}, []*Mutation{m1, m2}); errs != nil || err != nil {
+		t.Fatalf("ApplyBulk: got %v, %v, want nil", errs, err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if got, want := len(attempts), 2; got != want {
+		t.Fatalf("got %d attempts, want %d: %+v", got, want, attempts)
+	}
+	for i, a := range attempts {
+		if a.Method != "MutateRows" || a.Table != "table" || a.AppProfile != "profile" || a.Attempt != i || a.Err != nil {
+			t.Errorf("attempt %d: got %+v", i, a)
+		}
+	}
+	if got, want := attempts[0].FailedEntries, 1; got != want {
+		t.Errorf("first attempt: got %d failed entries, want %d", got, want)
+	}
+	if got, want := attempts[1].FailedEntries, 0; got != want {
+		t.Errorf("retry: got %d failed entries, want %d", got, want)
+	}
+}
+
+func TestApplyBulkGroupsAreNotRetries(t *testing.T) {
+	if err := view.Register(RetryCountView); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(RetryCountView)
+
+	ctx := context.Background()
+	var (
+		mu       sync.Mutex
+		attempts []AttemptInfo
+	)
+	config := ClientConfig{
+		Interceptor: func(_ context.Context, info *AttemptInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			attempts = append(attempts, *info)
+		},
+	}
+	tbl, cleanup, err := setupFakeServerWithConfig(config)
+	defer cleanup()
+	if err != nil {
+		t.Fatalf("fake server setup: %v", err)
+	}
+
+	// More mutations than fit in one request, so they are sent in two groups.
+	n := maxMutations + 1
+	rowKeys := make([]string, n)
+	muts := make([]*Mutation, n)
+	for i := range muts {
+		rowKeys[i] = fmt.Sprintf("row%06d", i)
+		muts[i] = NewMutation()
+		muts[i].Set("cf", "col", 1, []byte{})
+	}
+	if errs, err := tbl.ApplyBulk(ctx, rowKeys, muts); errs != nil || err != nil {
+		t.Fatalf("ApplyBulk: got %v, %v, want nil", errs, err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if got, want := len(attempts), 2; got != want {
+		t.Fatalf("got %d attempts, want %d", got, want)
+	}
+	for i, a := range attempts {
+		if a.Attempt != 0 || a.Err != nil {
+			t.Errorf("attempt %d: got Attempt %d, Err %v; want 0, nil", i, a.Attempt, a.Err)
+		}
+	}
+	rows, err := view.RetrieveData(RetryCountView.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, row := range rows {
+		if v := row.Data.(*view.SumData).Value; v != 0 {
+			t.Errorf("got %v retries with tags %v, want 0", v, row.Tags)
+		}
+	}
+}
+
+func TestRetryCountView(t *testing.T) {
+	if err := view.Register(RetryCountView); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(RetryCountView)
+
+	ctx := context.Background()
+	errCount := 0
+	errInjector := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if strings.HasSuffix(info.FullMethod, "MutateRow") && errCount < 2 {
+			errCount++
+			return nil, status.Errorf(codes.Unavailable, "")
+		}
+		return handler(ctx, req)
+	}
+	tbl, cleanup, err := setupFakeServer(grpc.UnaryInterceptor(errInjector))
+	defer cleanup()
+	if err != nil {
+		t.Fatalf("fake server setup: %v", err)
+	}
+
+	mut := NewMutation()
+	mut.Set("cf", "col", 1000, []byte("v"))
+	if err := tbl.Apply(ctx, "row", mut); err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := view.RetrieveData(RetryCountView.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var retries int64
+	for _, row := range rows {
+		for _, tg := range row.Tags {
+			if tg.Key == keyMethod && tg.Value == "MutateRow" {
+				retries += int64(row.Data.(*view.SumData).Value)
+			}
+		}
+	}
+	// Both failed attempts were retried: the second and third attempts are retries.
+	if got, want := retries, int64(2); got != want {
+		t.Errorf("got %d retries, want %d", got, want)
+	}
+}
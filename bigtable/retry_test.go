@@ -34,6 +34,10 @@ import (
 )
 
 func setupFakeServer(opt ...grpc.ServerOption) (tbl *Table, cleanup func(), err error) {
+	return setupFakeServerWithConfig(ClientConfig{}, opt...)
+}
+
+func setupFakeServerWithConfig(config ClientConfig, opt ...grpc.ServerOption) (tbl *Table, cleanup func(), err error) {
 	srv, err := bttest.NewServer("localhost:0", opt...)
 	if err != nil {
 		return nil, nil, err
@@ -43,7 +47,7 @@ func setupFakeServer(opt ...grpc.ServerOption) (tbl *Table, cleanup func(), err
 		return nil, nil, err
 	}
 
-	client, err := NewClient(context.Background(), "client", "instance", option.WithGRPCConn(conn), option.WithGRPCDialOption(grpc.WithBlock()))
+	client, err := NewClientWithConfig(context.Background(), "client", "instance", config, option.WithGRPCConn(conn), option.WithGRPCDialOption(grpc.WithBlock()))
 	if err != nil {
 		return nil, nil, err
 	}
@@ -364,6 +368,85 @@ func TestRetainRowsAfter(t *testing.T) {
 	}
 }
 
+func TestRetainRowsBefore(t *testing.T) {
+	prevRowRange := NewRange("a", "z")
+	prevRowKey := "m"
+	want := NewRange("a", "m")
+	got := prevRowRange.retainRowsBefore(prevRowKey)
+	if !testutil.Equal(want, got, cmp.AllowUnexported(RowRange{})) {
+		t.Errorf("range retry: got %v, want %v", got, want)
+	}
+
+	got = InfiniteRange("a").retainRowsBefore(prevRowKey)
+	if !testutil.Equal(want, got, cmp.AllowUnexported(RowRange{})) {
+		t.Errorf("unbounded range retry: got %v, want %v", got, want)
+	}
+
+	prevRowRangeList := RowRangeList{NewRange("a", "d"), NewRange("e", "g"), NewRange("h", "l")}
+	prevRowKey = "f"
+	wantRowRangeList := RowRangeList{NewRange("a", "d"), NewRange("e", "f")}
+	got = prevRowRangeList.retainRowsBefore(prevRowKey)
+	if !testutil.Equal(wantRowRangeList, got, cmp.AllowUnexported(RowRange{})) {
+		t.Errorf("range list retry: got %v, want %v", got, wantRowRangeList)
+	}
+
+	prevRowList := RowList{"a", "b", "c", "d", "e", "f"}
+	prevRowKey = "e"
+	wantList := RowList{"a", "b", "c", "d"}
+	got = prevRowList.retainRowsBefore(prevRowKey)
+	if !testutil.Equal(wantList, got) {
+		t.Errorf("list retry: got %v, want %v", got, wantList)
+	}
+}
+
+func TestRetryReadRowsReversed(t *testing.T) {
+	ctx := context.Background()
+
+	errCount := 0
+	var f func(grpc.ServerStream) error
+	errInjector := func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if strings.HasSuffix(info.FullMethod, "ReadRows") {
+			return f(ss)
+		}
+		return handler(ctx, ss)
+	}
+
+	tbl, cleanup, err := setupFakeServer(grpc.StreamInterceptor(errInjector))
+	defer cleanup()
+	if err != nil {
+		t.Fatalf("fake server setup: %v", err)
+	}
+
+	f = func(ss grpc.ServerStream) error {
+		var err error
+		req := new(btpb.ReadRowsRequest)
+		must(ss.RecvMsg(req))
+		switch errCount {
+		case 0:
+			// Write two rows then error
+			must(writeReadRowsResponse(ss, "d", "c"))
+			err = status.Errorf(codes.Unavailable, "")
+		case 1:
+			if want, got := "c", string(req.Rows.RowRanges[0].GetEndKeyOpen()); want != got {
+				t.Errorf("reversed retry: got end key %q, want %q", got, want)
+			}
+			must(writeReadRowsResponse(ss, "b", "a"))
+		}
+		errCount++
+		return err
+	}
+
+	var got []string
+	must(tbl.ReadRows(ctx, NewRange("a", "z"), func(r Row) bool {
+		got = append(got, r.Key())
+		return true
+	}, ReverseScan()))
+	want := []string{"d", "c", "b", "a"}
+	if !testutil.Equal(got, want) {
+		t.Errorf("reversed retry range integration: got %v, want %v", got, want)
+	}
+}
+
 func TestRetryReadRows(t *testing.T) {
 	ctx := context.Background()
 
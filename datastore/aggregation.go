@@ -0,0 +1,201 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datastore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/smyte/google-cloud-go/datastore/internal/aggpb"
+	"github.com/smyte/google-cloud-go/internal/trace"
+	"google.golang.org/api/iterator"
+	pb "google.golang.org/genproto/googleapis/datastore/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// An AggregationQuery computes aggregations, such as counts, over the
+// entities that a query returns, without returning the entities themselves.
+// Each aggregation has an alias, which names its result.
+//
+// Like queries, aggregation queries are immutable: the With methods return a
+// derivative aggregation query.
+type AggregationQuery struct {
+	query *Query
+	aggs  []*aggpb.Aggregation
+	err   error
+}
+
+// NewAggregationQuery returns an aggregation query over the entities that q
+// returns, with no aggregations.
+func (q *Query) NewAggregationQuery() *AggregationQuery {
+	return &AggregationQuery{query: q}
+}
+
+func (aq *AggregationQuery) clone() *AggregationQuery {
+	x := *aq
+	if len(aq.aggs) > 0 {
+		x.aggs = make([]*aggpb.Aggregation, len(aq.aggs))
+		copy(x.aggs, aq.aggs)
+	}
+	return &x
+}
+
+func (aq *AggregationQuery) with(alias string, a *aggpb.Aggregation) *AggregationQuery {
+	aq = aq.clone()
+	if aq.err != nil {
+		return aq
+	}
+	if alias == "" {
+		aq.err = errors.New("datastore: empty aggregation alias")
+		return aq
+	}
+	for _, b := range aq.aggs {
+		if b.Alias == alias {
+			aq.err = fmt.Errorf("datastore: duplicate aggregation alias %q", alias)
+			return aq
+		}
+	}
+	a.Alias = alias
+	aq.aggs = append(aq.aggs, a)
+	return aq
+}
+
+// WithCount returns a derivative aggregation query that also counts the
+// entities, naming the count alias.
+func (aq *AggregationQuery) WithCount(alias string) *AggregationQuery {
+	return aq.with(alias, &aggpb.Aggregation{Count: &aggpb.Aggregation_Count{}})
+}
+
+// WithSum returns a derivative aggregation query that also sums the integer
+// and floating-point values of the property fieldName, naming the sum alias.
+// Entities whose property has another type of value, or is an array, are
+// ignored. Unlike in Query.Filter, fieldName is not quoted.
+func (aq *AggregationQuery) WithSum(fieldName, alias string) *AggregationQuery {
+	return aq.with(alias, &aggpb.Aggregation{Sum: &aggpb.Aggregation_Sum{
+		Property: &pb.PropertyReference{Name: fieldName},
+	}})
+}
+
+// WithAvg returns a derivative aggregation query that also averages the
+// integer and floating-point values of the property fieldName, naming the
+// average alias. Values are ignored as for WithSum.
+func (aq *AggregationQuery) WithAvg(fieldName, alias string) *AggregationQuery {
+	return aq.with(alias, &aggpb.Aggregation{Avg: &aggpb.Aggregation_Avg{
+		Property: &pb.PropertyReference{Name: fieldName},
+	}})
+}
+
+// AggregationResult holds the results of an aggregation query, by alias.
+//
+// A count is an int64. A sum is an int64 if every value is an integer and the
+// sum does not overflow, and a float64 otherwise. An average is a float64, or
+// nil if there are no values to average.
+type AggregationResult map[string]interface{}
+
+// RunAggregationQuery runs aq and returns its results.
+//
+// The results are computed by Datastore, without the entities being read by
+// the client. If the server does not support aggregation queries, as some
+// versions of the Datastore emulator do not, or if the query must be split
+// into several queries (see Query.FilterEntity), RunAggregationQuery runs the
+// query itself and computes the results from every entity that it returns.
+func (c *Client) RunAggregationQuery(ctx context.Context, aq *AggregationQuery) (res AggregationResult, err error) {
+	ctx = trace.StartSpan(ctx, "github.com/smyte/google-cloud-go/datastore.Query.RunAggregationQuery")
+	defer func() { trace.EndSpan(ctx, err) }()
+
+	if aq.err != nil {
+		return nil, aq.err
+	}
+	q := aq.query
+	if q.err != nil {
+		return nil, q.err
+	}
+	if len(aq.aggs) == 0 {
+		return nil, errors.New("datastore: aggregation query has no aggregations")
+	}
+
+	if ac, ok := c.client.(aggregationQueryClient); ok && !q.needsSplit() {
+		qreq := &pb.RunQueryRequest{}
+		if err := q.toProto(qreq); err != nil {
+			return nil, err
+		}
+		req := &aggpb.RunAggregationQueryRequest{
+			ProjectId:   c.dataset,
+			ReadOptions: qreq.ReadOptions,
+			AggregationQuery: &aggpb.AggregationQuery{
+				NestedQuery:  qreq.GetQuery(),
+				Aggregations: aq.aggs,
+			},
+		}
+		if q.namespace != "" {
+			req.PartitionId = &pb.PartitionId{
+				NamespaceId: q.namespace,
+			}
+		}
+		resp, err := ac.RunAggregationQuery(ctx, req)
+		if err == nil {
+			rs := resp.GetBatch().GetAggregationResults()
+			if len(rs) != 1 {
+				return nil, fmt.Errorf("datastore: internal error: server returned %d aggregation results", len(rs))
+			}
+			return aggregationResult(rs[0])
+		}
+		if status.Code(err) != codes.Unimplemented {
+			return nil, err
+		}
+	}
+
+	// Only the keys are needed to count.
+	keysOnly := len(q.projection) == 0
+	for _, a := range aq.aggs {
+		if a.Count == nil {
+			keysOnly = false
+		}
+	}
+	newQ := q.clone()
+	newQ.keysOnly = keysOnly
+	agg := aggpb.NewAggregator(aq.aggs)
+	it := c.Run(ctx, newQ)
+	for {
+		_, e, err := it.next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		agg.Add(e.Properties)
+	}
+	return aggregationResult(agg.Result())
+}
+
+func aggregationResult(r *aggpb.AggregationResult) (AggregationResult, error) {
+	res := AggregationResult{}
+	for alias, v := range r.AggregateProperties {
+		switch v := v.GetValueType().(type) {
+		case *pb.Value_IntegerValue:
+			res[alias] = v.IntegerValue
+		case *pb.Value_DoubleValue:
+			res[alias] = v.DoubleValue
+		case *pb.Value_NullValue:
+			res[alias] = nil
+		default:
+			return nil, fmt.Errorf("datastore: internal error: unexpected aggregation result %v for %q", v, alias)
+		}
+	}
+	return res, nil
+}
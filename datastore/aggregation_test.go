@@ -0,0 +1,141 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datastore
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/smyte/google-cloud-go/datastore/internal/aggpb"
+	"google.golang.org/api/option"
+	pb "google.golang.org/genproto/googleapis/datastore/v1"
+	"google.golang.org/grpc"
+)
+
+func TestAggregationQueries(t *testing.T) {
+	ctx := context.Background()
+	for _, fallback := range []bool{false, true} {
+		var mu sync.Mutex
+		var methods []string
+		record := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+			mu.Lock()
+			methods = append(methods, method)
+			mu.Unlock()
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}
+		client, done := newFakeClient(ctx, t, option.WithGRPCDialOption(grpc.WithUnaryInterceptor(record)))
+		defer done()
+		if fallback {
+			// Hide the RunAggregationQuery method, as for an old emulator.
+			client.client = struct{ pb.DatastoreClient }{client.client}
+		}
+
+		entities := []PropertyList{
+			{{Name: "N", Value: int64(1)}, {Name: "F", Value: 1.5}},
+			{{Name: "N", Value: int64(2)}, {Name: "F", Value: "x"}},
+			{{Name: "N", Value: int64(3)}},
+			{{Name: "N", Value: int64(4)}, {Name: "F", Value: 2.5}},
+		}
+		keys := make([]*Key, len(entities))
+		for i := range keys {
+			keys[i] = IDKey("Agg", int64(i+1), nil)
+		}
+		if _, err := client.PutMulti(ctx, keys, entities); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, test := range []struct {
+			q         *Query
+			want      AggregationResult
+			wantSplit bool
+		}{
+			{
+				q: NewQuery("Agg"),
+				want: AggregationResult{
+					"count": int64(4), "sumN": int64(10), "avgN": 2.5,
+					"sumF": 4.0, "avgF": 2.0, "sumM": int64(0), "avgM": nil,
+				},
+			},
+			{
+				q: NewQuery("Agg").Filter("N >", 1).Limit(2),
+				want: AggregationResult{
+					"count": int64(2), "sumN": int64(5), "avgN": 2.5,
+					"sumF": int64(0), "avgF": nil, "sumM": int64(0), "avgM": nil,
+				},
+			},
+			{
+				q: NewQuery("Agg").Filter("N in", []int{1, 4}),
+				want: AggregationResult{
+					"count": int64(2), "sumN": int64(5), "avgN": 2.5,
+					"sumF": 4.0, "avgF": 2.0, "sumM": int64(0), "avgM": nil,
+				},
+				wantSplit: true,
+			},
+		} {
+			mu.Lock()
+			methods = nil
+			mu.Unlock()
+			aq := test.q.NewAggregationQuery().
+				WithCount("count").
+				WithSum("N", "sumN").WithAvg("N", "avgN").
+				WithSum("F", "sumF").WithAvg("F", "avgF").
+				WithSum("M", "sumM").WithAvg("M", "avgM")
+			got, err := client.RunAggregationQuery(ctx, aq)
+			if err != nil {
+				t.Errorf("fallback=%t, %v: %v", fallback, test.q.filter, err)
+				continue
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("fallback=%t, %v: got %v, want %v", fallback, test.q.filter, got, test.want)
+			}
+			mu.Lock()
+			wantAggregation := !fallback && !test.wantSplit
+			if gotAggregation := len(methods) == 1 && methods[0] == aggpb.RunAggregationQueryMethod; gotAggregation != wantAggregation {
+				t.Errorf("fallback=%t, %v: methods %v, want RunAggregationQuery only: %t", fallback, test.q.filter, methods, wantAggregation)
+			}
+			mu.Unlock()
+		}
+	}
+}
+
+func TestAggregationQueryErrors(t *testing.T) {
+	ctx := context.Background()
+	client, done := newFakeClient(ctx, t)
+	defer done()
+
+	q := NewQuery("Agg")
+	for _, test := range []struct {
+		desc string
+		aq   *AggregationQuery
+	}{
+		{"no aggregations", q.NewAggregationQuery()},
+		{"empty alias", q.NewAggregationQuery().WithCount("")},
+		{"duplicate alias", q.NewAggregationQuery().WithCount("a").WithSum("N", "a")},
+		{"bad query", NewQuery("Agg").Filter("N ~", 1).NewAggregationQuery().WithCount("a")},
+	} {
+		if _, err := client.RunAggregationQuery(ctx, test.aq); err == nil {
+			t.Errorf("%s: got nil, want error", test.desc)
+		}
+	}
+
+	// The With methods do not change the aggregation query they are called on.
+	aq := q.NewAggregationQuery().WithCount("a")
+	aq.WithCount("b")
+	if len(aq.aggs) != 1 {
+		t.Errorf("got %d aggregations, want 1", len(aq.aggs))
+	}
+}
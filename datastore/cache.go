@@ -0,0 +1,289 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datastore
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/smyte/google-cloud-go/datastore/internal/aggpb"
+	"github.com/golang/protobuf/proto"
+	pb "google.golang.org/genproto/googleapis/datastore/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// A Cache stores entities for a Client returned by Client.WithCache. It is a
+// key-value store, such as memcache, Redis or an LRUCache, whose items may be
+// evicted at any time. Keys are printable strings, but may be long; a store
+// that limits the length of keys should hash them.
+//
+// The methods of a Cache must be safe for concurrent use, and each must be
+// atomic for each key. A ttl of zero means that an item does not expire.
+type Cache interface {
+	// GetMulti returns the values of the items with the given keys, with
+	// nil for each item that is not in the cache.
+	GetMulti(ctx context.Context, keys []string) ([][]byte, error)
+
+	// SetMulti stores the items with the given keys and values.
+	SetMulti(ctx context.Context, keys []string, values [][]byte, ttl time.Duration) error
+
+	// AddMulti stores each item with the given keys and values that is not
+	// already in the cache, and reports which of them it stored.
+	AddMulti(ctx context.Context, keys []string, values [][]byte, ttl time.Duration) ([]bool, error)
+
+	// CompareAndSwapMulti replaces the value of each item with the given
+	// keys whose value is old[i] with new[i], and reports which of them it
+	// replaced.
+	CompareAndSwapMulti(ctx context.Context, keys []string, old, new [][]byte, ttl time.Duration) ([]bool, error)
+
+	// DeleteMulti removes the items with the given keys, if they are in the
+	// cache.
+	DeleteMulti(ctx context.Context, keys []string) error
+}
+
+// cacheLockTTL is how long a key stays locked if the client that locked it
+// fails to unlock it.
+const cacheLockTTL = time.Minute
+
+// The first byte of a cached value says what it holds.
+const (
+	cacheLock     = 'L' // followed by a random token
+	cacheEntity   = 'E' // followed by an encoded pb.EntityResult
+	cacheNoEntity = 'N' // the entity does not exist
+)
+
+// WithCache returns a Client that shares the connection of c, and caches
+// entities in cache. Closing either Client closes the connection.
+//
+// The returned Client's Get and GetMulti look entities up in the cache before
+// Datastore, and cache what they find, including the absence of an entity.
+// Queries, and reads in a transaction, always go to Datastore.
+//
+// Before committing changes to entities, whether with Put, Delete, Mutate or
+// a transaction, the returned Client locks their keys in the cache, so that
+// other Clients using the same cache read them from Datastore and do not
+// cache them until the commit is done and the locks are removed. Reads
+// therefore remain strongly consistent, and transactions keep the guarantees
+// described for Transaction, as long as every Client that writes the
+// entities uses the same cache and each commit finishes within a minute, when
+// locks expire. A commit fails, without changing Datastore, if its keys cannot
+// be locked. Other errors from the cache are treated as cache misses.
+func (c *Client) WithCache(cache Cache) *Client {
+	x := *c
+	x.client = &cachingClient{DatastoreClient: c.client, cache: cache}
+	return &x
+}
+
+// cachingClient is a pb.DatastoreClient that caches the results of Lookup.
+type cachingClient struct {
+	pb.DatastoreClient
+	cache Cache
+}
+
+func (cc *cachingClient) Lookup(ctx context.Context, in *pb.LookupRequest, opts ...grpc.CallOption) (*pb.LookupResponse, error) {
+	if in.ReadOptions.GetTransaction() != nil || len(in.Keys) == 0 {
+		return cc.DatastoreClient.Lookup(ctx, in, opts...)
+	}
+	keys := make([]string, len(in.Keys))
+	for i, k := range in.Keys {
+		keys[i] = cacheKey(in.ProjectId, k)
+	}
+	values, err := cc.cache.GetMulti(ctx, keys)
+	if err != nil || len(values) != len(keys) {
+		values = make([][]byte, len(keys))
+	}
+
+	resp := &pb.LookupResponse{}
+	// The keys to look up in Datastore are misses, by index. Those that are
+	// not locked are to be locked with locks, and lockIndex holds the index
+	// of each in lockKeys.
+	var misses []int
+	var lockKeys []string
+	var locks [][]byte
+	lockIndex := map[string]int{}
+	for i, v := range values {
+		switch {
+		case len(v) > 0 && v[0] == cacheEntity:
+			er := &pb.EntityResult{}
+			if err := proto.Unmarshal(v[1:], er); err == nil {
+				resp.Found = append(resp.Found, er)
+				continue
+			}
+		case len(v) > 0 && v[0] == cacheNoEntity:
+			resp.Missing = append(resp.Missing, &pb.EntityResult{Entity: &pb.Entity{Key: in.Keys[i]}})
+			continue
+		case len(v) > 0 && v[0] == cacheLock:
+			// A commit is changing the entity.
+			misses = append(misses, i)
+			continue
+		}
+		misses = append(misses, i)
+		if _, ok := lockIndex[keys[i]]; !ok {
+			lockIndex[keys[i]] = len(lockKeys)
+			lockKeys = append(lockKeys, keys[i])
+			locks = append(locks, newCacheLock())
+		}
+	}
+	if len(misses) == 0 {
+		return resp, nil
+	}
+
+	// Lock the keys to be looked up, so that their entities can be cached
+	// unless a commit changes them in the meantime.
+	var locked []bool
+	if len(lockKeys) > 0 {
+		locked, err = cc.cache.AddMulti(ctx, lockKeys, locks, cacheLockTTL)
+		if err != nil || len(locked) != len(lockKeys) {
+			locked = nil
+		}
+	}
+
+	req := *in
+	req.Keys = make([]*pb.Key, len(misses))
+	for i, j := range misses {
+		req.Keys[i] = in.Keys[j]
+	}
+	r, err := cc.DatastoreClient.Lookup(ctx, &req, opts...)
+	if err != nil {
+		return nil, err
+	}
+	resp.Found = append(resp.Found, r.Found...)
+	resp.Missing = append(resp.Missing, r.Missing...)
+	resp.Deferred = r.Deferred
+
+	if locked == nil {
+		return resp, nil
+	}
+	var casKeys []string
+	var old, new [][]byte
+	add := func(er *pb.EntityResult, v []byte) {
+		k := cacheKey(in.ProjectId, er.GetEntity().GetKey())
+		if i, ok := lockIndex[k]; ok && locked[i] {
+			casKeys = append(casKeys, k)
+			old = append(old, locks[i])
+			new = append(new, v)
+		}
+	}
+	for _, er := range r.Found {
+		b, err := proto.Marshal(er)
+		if err != nil {
+			continue
+		}
+		add(er, append([]byte{cacheEntity}, b...))
+	}
+	for _, er := range r.Missing {
+		add(er, []byte{cacheNoEntity})
+	}
+	if len(casKeys) > 0 {
+		_, _ = cc.cache.CompareAndSwapMulti(ctx, casKeys, old, new, 0)
+	}
+	return resp, nil
+}
+
+func (cc *cachingClient) Commit(ctx context.Context, in *pb.CommitRequest, opts ...grpc.CallOption) (*pb.CommitResponse, error) {
+	var keys []string
+	seen := map[string]bool{}
+	for _, m := range in.Mutations {
+		var k *pb.Key
+		switch op := m.Operation.(type) {
+		case *pb.Mutation_Insert:
+			k = op.Insert.GetKey()
+		case *pb.Mutation_Update:
+			k = op.Update.GetKey()
+		case *pb.Mutation_Upsert:
+			k = op.Upsert.GetKey()
+		case *pb.Mutation_Delete:
+			k = op.Delete
+		}
+		if !completeKey(k) {
+			continue
+		}
+		if ck := cacheKey(in.ProjectId, k); !seen[ck] {
+			seen[ck] = true
+			keys = append(keys, ck)
+		}
+	}
+	if len(keys) == 0 {
+		return cc.DatastoreClient.Commit(ctx, in, opts...)
+	}
+
+	lock := newCacheLock()
+	locks := make([][]byte, len(keys))
+	for i := range locks {
+		locks[i] = lock
+	}
+	if err := cc.cache.SetMulti(ctx, keys, locks, cacheLockTTL); err != nil {
+		return nil, fmt.Errorf("datastore: locking cached entities: %v", err)
+	}
+	resp, err := cc.DatastoreClient.Commit(ctx, in, opts...)
+	// If the locks cannot be removed, they expire.
+	_ = cc.cache.DeleteMulti(ctx, keys)
+	return resp, err
+}
+
+func (cc *cachingClient) RunAggregationQuery(ctx context.Context, in *aggpb.RunAggregationQueryRequest, opts ...grpc.CallOption) (*aggpb.RunAggregationQueryResponse, error) {
+	ac, ok := cc.DatastoreClient.(aggregationQueryClient)
+	if !ok {
+		return nil, status.Errorf(codes.Unimplemented, "RunAggregationQuery is not supported")
+	}
+	return ac.RunAggregationQuery(ctx, in, opts...)
+}
+
+// cacheKey returns the key in the cache of the entity with the key k in
+// project.
+func cacheKey(project string, k *pb.Key) string {
+	var b strings.Builder
+	b.WriteString("datastore:")
+	b.WriteString(strconv.Quote(project))
+	b.WriteString(":")
+	b.WriteString(strconv.Quote(k.GetPartitionId().GetNamespaceId()))
+	for _, e := range k.GetPath() {
+		b.WriteString("/")
+		b.WriteString(strconv.Quote(e.Kind))
+		b.WriteString(",")
+		if name, ok := e.IdType.(*pb.Key_PathElement_Name); ok {
+			b.WriteString(strconv.Quote(name.Name))
+		} else {
+			b.WriteString(strconv.FormatInt(e.GetId(), 10))
+		}
+	}
+	return b.String()
+}
+
+// completeKey reports whether k has an ID or name.
+func completeKey(k *pb.Key) bool {
+	if len(k.GetPath()) == 0 {
+		return false
+	}
+	e := k.Path[len(k.Path)-1]
+	return e.GetId() != 0 || e.GetName() != ""
+}
+
+// newCacheLock returns a lock with a random token, so that only the client
+// that stored it replaces it.
+func newCacheLock() []byte {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return []byte(string(cacheLock) + hex.EncodeToString(b))
+}
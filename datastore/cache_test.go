@@ -0,0 +1,256 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datastore
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type cacheItem struct {
+	N int
+}
+
+func TestCache(t *testing.T) {
+	ctx := context.Background()
+	base, done := newFakeClient(ctx, t)
+	defer done()
+	cache := NewLRUCache(100)
+	client := base.WithCache(cache)
+
+	k := NameKey("C", "a", nil)
+	ck := cacheKey("P", keyToProto(k))
+	check := func(desc string, want int) {
+		t.Helper()
+		var got cacheItem
+		err := client.Get(ctx, k, &got)
+		if want == 0 {
+			if err != ErrNoSuchEntity {
+				t.Errorf("%s: got (%v, %v), want ErrNoSuchEntity", desc, got, err)
+			}
+			return
+		}
+		if err != nil || got.N != want {
+			t.Errorf("%s: got (%v, %v), want %d", desc, got, err, want)
+		}
+	}
+
+	check("missing", 0)
+	if n := cache.Len(); n != 1 {
+		t.Fatalf("got %d cached items, want 1", n)
+	}
+	// Writes that bypass the cache are not seen.
+	if _, err := base.Put(ctx, k, &cacheItem{1}); err != nil {
+		t.Fatal(err)
+	}
+	check("cached missing", 0)
+	if _, err := client.Put(ctx, k, &cacheItem{2}); err != nil {
+		t.Fatal(err)
+	}
+	check("after Put", 2)
+	if _, err := base.Put(ctx, k, &cacheItem{3}); err != nil {
+		t.Fatal(err)
+	}
+	check("cached", 2)
+
+	// Transactions read from Datastore.
+	_, err := client.RunInTransaction(ctx, func(tx *Transaction) error {
+		var x cacheItem
+		if err := tx.Get(k, &x); err != nil {
+			return err
+		}
+		if x.N != 3 {
+			t.Errorf("in transaction: got %d, want 3", x.N)
+		}
+		x.N++
+		_, err := tx.Put(k, &x)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("after transaction", 4)
+
+	if err := client.Delete(ctx, k); err != nil {
+		t.Fatal(err)
+	}
+	check("after Delete", 0)
+
+	// An entity that is locked by a commit is read from Datastore, and not
+	// cached.
+	lock := []byte("Lx")
+	if err := cache.SetMulti(ctx, []string{ck}, [][]byte{lock}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := base.Put(ctx, k, &cacheItem{5}); err != nil {
+		t.Fatal(err)
+	}
+	check("locked", 5)
+	if got, err := cache.GetMulti(ctx, []string{ck}); err != nil || string(got[0]) != string(lock) {
+		t.Errorf("lock: got (%q, %v), want %q", got, err, lock)
+	}
+	if err := cache.DeleteMulti(ctx, []string{ck}); err != nil {
+		t.Fatal(err)
+	}
+
+	keys := []*Key{k, NameKey("C", "b", nil), k}
+	for i := 0; i < 2; i++ {
+		items := make([]cacheItem, len(keys))
+		err := client.GetMulti(ctx, keys, items)
+		me, ok := err.(MultiError)
+		if !ok || me[0] != nil || me[1] != ErrNoSuchEntity || me[2] != nil {
+			t.Fatalf("GetMulti %d: got %v, want MultiError with ErrNoSuchEntity at 1", i, err)
+		}
+		if want := []cacheItem{{5}, {}, {5}}; !reflect.DeepEqual(items, want) {
+			t.Errorf("GetMulti %d: got %v, want %v", i, items, want)
+		}
+	}
+	if n := cache.Len(); n != 2 {
+		t.Errorf("got %d cached items, want 2", n)
+	}
+}
+
+// failingCache is an LRUCache whose methods can be made to fail.
+type failingCache struct {
+	*LRUCache
+	failGet, failSet bool
+}
+
+var errCache = errors.New("cache failure")
+
+func (c *failingCache) GetMulti(ctx context.Context, keys []string) ([][]byte, error) {
+	if c.failGet {
+		return nil, errCache
+	}
+	return c.LRUCache.GetMulti(ctx, keys)
+}
+
+func (c *failingCache) SetMulti(ctx context.Context, keys []string, values [][]byte, ttl time.Duration) error {
+	if c.failSet {
+		return errCache
+	}
+	return c.LRUCache.SetMulti(ctx, keys, values, ttl)
+}
+
+func TestCacheErrors(t *testing.T) {
+	ctx := context.Background()
+	base, done := newFakeClient(ctx, t)
+	defer done()
+	cache := &failingCache{LRUCache: NewLRUCache(100)}
+	client := base.WithCache(cache)
+
+	k := NameKey("C", "a", nil)
+	cache.failSet = true
+	if _, err := client.Put(ctx, k, &cacheItem{1}); err == nil {
+		t.Error("Put without locks: got nil, want error")
+	}
+	if err := base.Get(ctx, k, &cacheItem{}); err != ErrNoSuchEntity {
+		t.Errorf("after failed Put: got %v, want ErrNoSuchEntity", err)
+	}
+	// Puts of incomplete keys need no locks.
+	if _, err := client.Put(ctx, IncompleteKey("C", nil), &cacheItem{1}); err != nil {
+		t.Errorf("Put of an incomplete key: %v", err)
+	}
+	cache.failSet = false
+
+	if _, err := client.Put(ctx, k, &cacheItem{2}); err != nil {
+		t.Fatal(err)
+	}
+	cache.failGet = true
+	var got cacheItem
+	if err := client.Get(ctx, k, &got); err != nil || got.N != 2 {
+		t.Errorf("Get with a failing cache: got (%v, %v), want 2", got, err)
+	}
+}
+
+func TestLRUCache(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(0, 0)
+	c := NewLRUCache(2)
+	c.now = func() time.Time { return now }
+	get := func(key string) string {
+		t.Helper()
+		vs, err := c.GetMulti(ctx, []string{key})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if vs[0] == nil {
+			return "<nil>"
+		}
+		return string(vs[0])
+	}
+
+	if err := c.SetMulti(ctx, []string{"a", "b"}, [][]byte{[]byte("1"), []byte("2")}, 0); err != nil {
+		t.Fatal(err)
+	}
+	get("a")
+	// b is the least recently used.
+	if err := c.SetMulti(ctx, []string{"c"}, [][]byte{[]byte("3")}, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if got := get("b"); got != "<nil>" {
+		t.Errorf("evicted: got %s", got)
+	}
+	if got := get("a"); got != "1" {
+		t.Errorf("a: got %s, want 1", got)
+	}
+
+	added, err := c.AddMulti(ctx, []string{"a", "b"}, [][]byte{[]byte("x"), []byte("y")}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []bool{false, true}; !reflect.DeepEqual(added, want) {
+		t.Errorf("AddMulti: got %v, want %v", added, want)
+	}
+	if got := get("a"); got != "1" {
+		t.Errorf("a after AddMulti: got %s, want 1", got)
+	}
+
+	swapped, err := c.CompareAndSwapMulti(ctx, []string{"a", "b", "z"},
+		[][]byte{[]byte("1"), []byte("2"), nil}, [][]byte{[]byte("4"), []byte("5"), []byte("6")}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []bool{true, false, false}; !reflect.DeepEqual(swapped, want) {
+		t.Errorf("CompareAndSwapMulti: got %v, want %v", swapped, want)
+	}
+	if got, want := get("a")+get("b"), "4y"; got != want {
+		t.Errorf("after CompareAndSwapMulti: got %s, want %s", got, want)
+	}
+
+	if err := c.SetMulti(ctx, []string{"t"}, [][]byte{[]byte("7")}, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(time.Second)
+	if got := get("t"); got != "<nil>" {
+		t.Errorf("expired: got %s", got)
+	}
+	if added, err := c.AddMulti(ctx, []string{"t"}, [][]byte{[]byte("8")}, 0); err != nil || !added[0] {
+		t.Errorf("AddMulti of an expired item: got (%v, %v), want added", added, err)
+	}
+
+	if err := c.DeleteMulti(ctx, []string{"t", "missing"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := get("t"); got != "<nil>" {
+		t.Errorf("deleted: got %s", got)
+	}
+	if err := c.SetMulti(ctx, []string{"a"}, nil, 0); err == nil {
+		t.Error("SetMulti with too few values: got nil, want error")
+	}
+}
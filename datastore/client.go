@@ -19,6 +19,7 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/smyte/google-cloud-go/datastore/internal/aggpb"
 	"github.com/smyte/google-cloud-go/internal"
 	"github.com/smyte/google-cloud-go/internal/version"
 	gax "github.com/googleapis/gax-go/v2"
@@ -36,13 +37,21 @@ type datastoreClient struct {
 	// if the interface adds more methods.
 	pb.DatastoreClient
 
-	c  pb.DatastoreClient
-	md metadata.MD
+	c    pb.DatastoreClient
+	conn *grpc.ClientConn
+	md   metadata.MD
+}
+
+// aggregationQueryClient is implemented by clients that can call the
+// RunAggregationQuery method, which pb.DatastoreClient lacks.
+type aggregationQueryClient interface {
+	RunAggregationQuery(ctx context.Context, in *aggpb.RunAggregationQueryRequest, opts ...grpc.CallOption) (*aggpb.RunAggregationQueryResponse, error)
 }
 
 func newDatastoreClient(conn *grpc.ClientConn, projectID string) pb.DatastoreClient {
 	return &datastoreClient{
-		c: pb.NewDatastoreClient(conn),
+		c:    pb.NewDatastoreClient(conn),
+		conn: conn,
 		md: metadata.Pairs(
 			resourcePrefixHeader, "projects/"+projectID,
 			"x-goog-api-client", fmt.Sprintf("gl-go/%s gccl/%s grpc/", version.Go(), version.Repo)),
@@ -97,6 +106,14 @@ func (dc *datastoreClient) AllocateIds(ctx context.Context, in *pb.AllocateIdsRe
 	return res, err
 }
 
+func (dc *datastoreClient) RunAggregationQuery(ctx context.Context, in *aggpb.RunAggregationQueryRequest, opts ...grpc.CallOption) (res *aggpb.RunAggregationQueryResponse, err error) {
+	err = dc.invoke(ctx, func(ctx context.Context) error {
+		res = &aggpb.RunAggregationQueryResponse{}
+		return dc.conn.Invoke(ctx, aggpb.RunAggregationQueryMethod, in, res, opts...)
+	})
+	return res, err
+}
+
 func (dc *datastoreClient) invoke(ctx context.Context, f func(ctx context.Context) error) error {
 	ctx = metadata.NewOutgoingContext(ctx, dc.md)
 	return internal.Retry(ctx, gax.Backoff{Initial: 100 * time.Millisecond}, func() (stop bool, err error) {
@@ -409,7 +409,8 @@ Queries are immutable, and are either created by calling NewQuery, or derived
 from an existing query by calling a method like Filter or Order that returns a
 new query value. A query is typically constructed by calling NewQuery followed
 by a chain of zero or more such methods. These methods are:
-  - Ancestor and Filter constrain the entities returned by running a query.
+  - Ancestor, Filter and FilterEntity constrain the entities returned by
+    running a query.
   - Order affects the order in which they are returned.
   - Project constrains the fields returned.
   - Distinct de-duplicates projected entities.
@@ -448,6 +449,32 @@ Example code:
 		}
 	}
 
+Queries that combine filters and orders on several properties need composite
+indexes, declared in an index.yaml file. An IndexAdvisor works out the indexes
+that a set of queries need, and which of them an index.yaml file lacks, so that
+missing indexes can be caught in tests rather than in production.
+
+Datastore itself only runs queries whose filters are all AND'ed together and
+use the operators "=", "<", "<=", ">" and ">=". A query with "!=", "in" or
+"not-in" filters, or with an OrFilter passed to FilterEntity, is split into
+several such queries, whose results the client merges:
+
+	q := datastore.NewQuery("Widget").
+		Filter("Color in", []string{"red", "blue"}).
+		Order("-Price")
+
+An AggregationQuery counts the entities that a query returns, or sums or
+averages one of their properties, without the entities being sent to the
+client:
+
+	aq := datastore.NewQuery("Widget").Filter("Price <", 1000).
+		NewAggregationQuery().WithCount("count").WithAvg("Price", "avg")
+	res, err := client.RunAggregationQuery(ctx, aq)
+	if err != nil {
+		// Handle error.
+	}
+	fmt.Println(res["count"].(int64), res["avg"])
+
 
 Transactions
 
@@ -485,6 +512,18 @@ Example code:
 Pass the ReadOnly option to RunInTransaction if your transaction is used only for Get,
 GetMulti or queries. Read-only transactions are more efficient.
 
+
+Caching
+
+A Client returned by WithCache keeps the entities that Get and GetMulti read
+in a Cache, such as an in-process LRUCache or a wrapper around memcache or
+Redis, and reads them from there until they are changed. Writes lock the
+cached entities while they are committed, so reads stay strongly consistent
+and transactions are unaffected, provided every Client that writes the
+entities uses the same Cache:
+
+	client = client.WithCache(datastore.NewLRUCache(10000))
+
 Google Cloud Datastore Emulator
 
 This package supports the Cloud Datastore emulator, which is useful for testing and
@@ -0,0 +1,110 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dstest
+
+import (
+	"context"
+
+	"github.com/smyte/google-cloud-go/datastore/internal/aggpb"
+	pb "google.golang.org/genproto/googleapis/datastore/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// handleUnknown serves the methods of the Datastore service that
+// pb.DatastoreServer lacks, which is only RunAggregationQuery.
+func (s *server) handleUnknown(_ interface{}, stream grpc.ServerStream) error {
+	method, _ := grpc.MethodFromServerStream(stream)
+	if method != aggpb.RunAggregationQueryMethod {
+		return status.Errorf(codes.Unimplemented, "unknown method %s", method)
+	}
+	req := &aggpb.RunAggregationQueryRequest{}
+	if err := stream.RecvMsg(req); err != nil {
+		return err
+	}
+	res, err := s.RunAggregationQuery(stream.Context(), req)
+	if err != nil {
+		return err
+	}
+	return stream.SendMsg(res)
+}
+
+func (s *server) RunAggregationQuery(_ context.Context, req *aggpb.RunAggregationQueryRequest) (*aggpb.RunAggregationQueryResponse, error) {
+	aq := req.AggregationQuery
+	if aq.GetNestedQuery() == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "missing query")
+	}
+	if len(aq.GetAggregations()) == 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "missing aggregations")
+	}
+	aliases := map[string]bool{}
+	for _, a := range aq.Aggregations {
+		n := 0
+		if a.Count != nil {
+			n++
+			if a.Count.UpTo != nil && a.Count.UpTo.Value <= 0 {
+				return nil, status.Errorf(codes.InvalidArgument, "count up_to must be positive")
+			}
+		}
+		if a.Sum != nil {
+			n++
+			if a.Sum.Property.GetName() == "" {
+				return nil, status.Errorf(codes.InvalidArgument, "missing property in sum")
+			}
+		}
+		if a.Avg != nil {
+			n++
+			if a.Avg.Property.GetName() == "" {
+				return nil, status.Errorf(codes.InvalidArgument, "missing property in avg")
+			}
+		}
+		if n != 1 {
+			return nil, status.Errorf(codes.InvalidArgument, "an aggregation must have exactly one operator")
+		}
+		if a.Alias == "" || aliases[a.Alias] {
+			return nil, status.Errorf(codes.InvalidArgument, "missing or duplicate alias %q", a.Alias)
+		}
+		aliases[a.Alias] = true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	q, rows, more, err := s.query(req.ProjectId, req.PartitionId, req.ReadOptions, aq.NestedQuery)
+	if err != nil {
+		return nil, err
+	}
+	if int(q.offset) < len(rows) {
+		rows = rows[q.offset:]
+	} else {
+		rows = nil
+	}
+	if q.limit >= 0 && len(rows) >= int(q.limit) {
+		rows = rows[:q.limit]
+		more = pb.QueryResultBatch_MORE_RESULTS_AFTER_LIMIT
+	}
+	agg := aggpb.NewAggregator(aq.Aggregations)
+	for _, r := range rows {
+		agg.Add(q.result(r).Properties)
+	}
+	return &aggpb.RunAggregationQueryResponse{
+		Batch: &aggpb.AggregationResultBatch{
+			AggregationResults: []*aggpb.AggregationResult{agg.Result()},
+			MoreResults:        more,
+		},
+		Query: aq,
+	}, nil
+}
@@ -0,0 +1,408 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Package dstest provides an in-memory fake of the Cloud Datastore service for
+testing. It implements a simplified form of the service, suitable for unit
+tests: queries are strongly consistent, transactions detect conflicts
+optimistically, and GQL queries are not supported. Aggregation queries are
+served by counting, summing and averaging the results of their queries.
+
+To use a Server, create it, and then connect to it with no security:
+	srv, err := dstest.NewServer("localhost:0")
+	...
+	conn, err := grpc.Dial(srv.Addr, grpc.WithInsecure())
+	...
+	client, err := datastore.NewClient(ctx, proj, option.WithGRPCConn(conn))
+	...
+
+By default the Server answers every query, as if every composite index
+existed. To check that an application declares the indexes its queries need,
+load its index.yaml with LoadIndexFile or SetIndexes; queries that need a
+missing composite index then fail with FailedPrecondition, as they would in
+production.
+
+This package is EXPERIMENTAL and is subject to change without notice.
+*/
+package dstest // import "github.com/smyte/google-cloud-go/datastore/dstest"
+
+import (
+	"context"
+	"io/ioutil"
+	"strconv"
+	"sync"
+
+	"github.com/smyte/google-cloud-go/datastore/internal/index"
+	"github.com/smyte/google-cloud-go/internal/testutil"
+	"github.com/golang/protobuf/proto"
+	pb "google.golang.org/genproto/googleapis/datastore/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Server is an in-memory Cloud Datastore implementation.
+// It is not safe for use in production environments.
+type Server struct {
+	Addr string
+
+	srv *testutil.Server
+	s   *server
+}
+
+// NewServer creates a new Server listening on laddr, a "host:port" address
+// as for net.Listen. Use "localhost:0" for a system-chosen port. The Server
+// will be listening for gRPC connections, without TLS, on the address named
+// by its Addr field.
+func NewServer(laddr string, opt ...grpc.ServerOption) (*Server, error) {
+	ds := newServer()
+	opt = append(opt[:len(opt):len(opt)], grpc.UnknownServiceHandler(ds.handleUnknown))
+	srv, err := testutil.NewServerWithAddr(laddr, opt...)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		Addr: srv.Addr,
+		srv:  srv,
+		s:    ds,
+	}
+	pb.RegisterDatastoreServer(srv.Gsrv, s.s)
+	srv.Start()
+	return s, nil
+}
+
+// Close shuts down the server.
+func (s *Server) Close() {
+	s.srv.Close()
+}
+
+// SetIndexes parses data, the contents of an index.yaml file, and from then
+// on fails queries that need a composite index that it does not declare.
+func (s *Server) SetIndexes(data []byte) error {
+	ixs, err := index.Parse(data)
+	if err != nil {
+		return err
+	}
+	if ixs == nil {
+		ixs = []*index.Index{}
+	}
+	s.s.mu.Lock()
+	defer s.s.mu.Unlock()
+	s.s.indexes = ixs
+	return nil
+}
+
+// LoadIndexFile calls SetIndexes with the contents of the index.yaml file at
+// path.
+func (s *Server) LoadIndexFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return s.SetIndexes(data)
+}
+
+// Clear removes all entities and transactions from the server. The indexes
+// set with SetIndexes are kept.
+func (s *Server) Clear() {
+	s.s.mu.Lock()
+	defer s.s.mu.Unlock()
+	s.s.entities = map[string]*entity{}
+	s.s.txns = map[string]*transaction{}
+}
+
+type server struct {
+	mu       sync.Mutex
+	entities map[string]*entity // by keyString
+	version  int64              // of the latest commit
+	lastID   int64              // the greatest ID allocated or used
+	txns     map[string]*transaction
+	nextTxn  int
+	indexes  []*index.Index // nil if indexes are not checked
+}
+
+func newServer() *server {
+	return &server{
+		entities: map[string]*entity{},
+		txns:     map[string]*transaction{},
+	}
+}
+
+// An entity is a stored entity, or a record that one was deleted, which
+// keeps its version so that transactions can detect the deletion.
+type entity struct {
+	key     *pb.Key // normalized
+	props   map[string]*pb.Value
+	deleted bool
+	version int64 // of the commit that last wrote or deleted it
+}
+
+func (e *entity) proto() *pb.Entity {
+	return proto.Clone(&pb.Entity{Key: e.key, Properties: e.props}).(*pb.Entity)
+}
+
+type transaction struct {
+	readOnly bool
+	version  int64           // s.version when the transaction began
+	reads    map[string]bool // keyStrings of the entities looked up
+	queries  []*pb.Key       // ancestors of the queries run
+	done     bool
+}
+
+// conflicts reports whether an entity read by t has been written since t
+// began. Must be called with the lock held.
+func (s *server) conflicts(t *transaction) bool {
+	for ks := range t.reads {
+		if e := s.entities[ks]; e != nil && e.version > t.version {
+			return true
+		}
+	}
+	for _, a := range t.queries {
+		for _, e := range s.entities {
+			if e.version > t.version && hasAncestor(e.key, a) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// transaction returns the active transaction with the given ID.
+// Must be called with the lock held.
+func (s *server) transaction(id []byte) (*transaction, error) {
+	t := s.txns[string(id)]
+	if t == nil || t.done {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid transaction %q", id)
+	}
+	return t, nil
+}
+
+// readTransaction returns the transaction that ro reads in, or nil.
+// Must be called with the lock held.
+func (s *server) readTransaction(ro *pb.ReadOptions) (*transaction, error) {
+	id := ro.GetTransaction()
+	if id == nil {
+		return nil, nil
+	}
+	return s.transaction(id)
+}
+
+// useID records that id has been used, so that it is never allocated.
+// Must be called with the lock held.
+func (s *server) useID(k *pb.Key) {
+	if id := k.Path[len(k.Path)-1].GetId(); id > s.lastID {
+		s.lastID = id
+	}
+}
+
+// allocateID completes the incomplete key k with a new ID.
+// Must be called with the lock held.
+func (s *server) allocateID(k *pb.Key) *pb.Key {
+	s.lastID++
+	k = proto.Clone(k).(*pb.Key)
+	k.Path[len(k.Path)-1].IdType = &pb.Key_PathElement_Id{Id: s.lastID}
+	return k
+}
+
+func (s *server) Lookup(_ context.Context, req *pb.LookupRequest) (*pb.LookupResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, err := s.readTransaction(req.ReadOptions)
+	if err != nil {
+		return nil, err
+	}
+	res := &pb.LookupResponse{}
+	for _, k := range req.Keys {
+		if err := checkKey(k, true); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+		}
+		k = normalizeKey(req.ProjectId, k)
+		ks := keyString(k)
+		if t != nil {
+			t.reads[ks] = true
+		}
+		if e := s.entities[ks]; e != nil && !e.deleted {
+			res.Found = append(res.Found, &pb.EntityResult{Entity: e.proto(), Version: e.version})
+		} else {
+			res.Missing = append(res.Missing, &pb.EntityResult{Entity: &pb.Entity{Key: k}, Version: s.version})
+		}
+	}
+	return res, nil
+}
+
+func (s *server) BeginTransaction(_ context.Context, req *pb.BeginTransactionRequest) (*pb.BeginTransactionResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nextTxn++
+	id := "txn" + strconv.Itoa(s.nextTxn)
+	s.txns[id] = &transaction{
+		readOnly: req.TransactionOptions.GetReadOnly() != nil,
+		version:  s.version,
+		reads:    map[string]bool{},
+	}
+	return &pb.BeginTransactionResponse{Transaction: []byte(id)}, nil
+}
+
+func (s *server) Rollback(_ context.Context, req *pb.RollbackRequest) (*pb.RollbackResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, err := s.transaction(req.Transaction)
+	if err != nil {
+		return nil, err
+	}
+	t.done = true
+	return &pb.RollbackResponse{}, nil
+}
+
+func (s *server) Commit(_ context.Context, req *pb.CommitRequest) (*pb.CommitResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch req.Mode {
+	case pb.CommitRequest_TRANSACTIONAL:
+		t, err := s.transaction(req.GetTransaction())
+		if err != nil {
+			return nil, err
+		}
+		t.done = true
+		if t.readOnly && len(req.Mutations) > 0 {
+			return nil, status.Errorf(codes.InvalidArgument, "cannot modify entities in a read-only transaction")
+		}
+		if s.conflicts(t) {
+			return nil, status.Errorf(codes.Aborted, "too much contention on these datastore entities. please try again.")
+		}
+	case pb.CommitRequest_NON_TRANSACTIONAL:
+		if req.GetTransaction() != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "a non-transactional commit cannot have a transaction")
+		}
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "bad commit mode %v", req.Mode)
+	}
+
+	// Check every mutation before applying any, so that the commit is atomic.
+	version := s.version + 1
+	res := &pb.CommitResponse{}
+	staged := map[string]*entity{}
+	var order []string
+	for _, m := range req.Mutations {
+		var (
+			k     *pb.Key
+			props map[string]*pb.Value
+			del   bool
+		)
+		switch op := m.Operation.(type) {
+		case *pb.Mutation_Insert:
+			k, props = op.Insert.GetKey(), op.Insert.GetProperties()
+		case *pb.Mutation_Upsert:
+			k, props = op.Upsert.GetKey(), op.Upsert.GetProperties()
+		case *pb.Mutation_Update:
+			k, props = op.Update.GetKey(), op.Update.GetProperties()
+		case *pb.Mutation_Delete:
+			k, del = op.Delete, true
+		default:
+			return nil, status.Errorf(codes.InvalidArgument, "mutation with no operation")
+		}
+		if k == nil {
+			return nil, status.Errorf(codes.InvalidArgument, "mutation with no key")
+		}
+		mr := &pb.MutationResult{Version: version}
+		incomplete := !isComplete(k)
+		if incomplete && (del || m.GetUpdate() != nil) {
+			return nil, status.Errorf(codes.InvalidArgument, "cannot update or delete an entity with an incomplete key")
+		}
+		if err := checkKey(k, !incomplete); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+		}
+		k = normalizeKey(req.ProjectId, k)
+		if incomplete {
+			k = s.allocateID(k)
+			mr.Key = k
+		} else {
+			s.useID(k)
+		}
+		ks := keyString(k)
+		if _, ok := staged[ks]; ok {
+			return nil, status.Errorf(codes.InvalidArgument, "a key cannot be mutated more than once in a single commit: %s", ks)
+		}
+
+		cur := s.entities[ks]
+		exists := cur != nil && !cur.deleted
+		var curVersion int64
+		if cur != nil {
+			curVersion = cur.version
+		}
+		if bv, ok := m.ConflictDetectionStrategy.(*pb.Mutation_BaseVersion); ok && bv.BaseVersion != curVersion {
+			mr.ConflictDetected = true
+			mr.Version = curVersion
+			res.MutationResults = append(res.MutationResults, mr)
+			staged[ks] = nil
+			continue
+		}
+		switch {
+		case m.GetInsert() != nil && exists:
+			return nil, status.Errorf(codes.AlreadyExists, "entity already exists: %s", ks)
+		case m.GetUpdate() != nil && !exists:
+			return nil, status.Errorf(codes.NotFound, "no entity to update: %s", ks)
+		}
+		if del {
+			staged[ks] = &entity{key: k, deleted: true, version: version}
+		} else {
+			props = proto.Clone(&pb.Entity{Properties: props}).(*pb.Entity).Properties
+			staged[ks] = &entity{key: k, props: props, version: version}
+		}
+		order = append(order, ks)
+		res.MutationResults = append(res.MutationResults, mr)
+	}
+	if len(order) > 0 {
+		for _, ks := range order {
+			s.entities[ks] = staged[ks]
+		}
+		s.version = version
+	}
+	return res, nil
+}
+
+func (s *server) AllocateIds(_ context.Context, req *pb.AllocateIdsRequest) (*pb.AllocateIdsResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, k := range req.Keys {
+		if err := checkKey(k, false); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+		}
+	}
+	res := &pb.AllocateIdsResponse{}
+	for _, k := range req.Keys {
+		res.Keys = append(res.Keys, s.allocateID(normalizeKey(req.ProjectId, k)))
+	}
+	return res, nil
+}
+
+func (s *server) ReserveIds(_ context.Context, req *pb.ReserveIdsRequest) (*pb.ReserveIdsResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, k := range req.Keys {
+		if err := checkKey(k, true); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+		}
+	}
+	for _, k := range req.Keys {
+		s.useID(k)
+	}
+	return &pb.ReserveIdsResponse{}, nil
+}
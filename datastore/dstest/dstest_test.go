@@ -0,0 +1,427 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dstest
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/smyte/google-cloud-go/datastore"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func newFake(ctx context.Context, t *testing.T) (*datastore.Client, *Server) {
+	srv, err := NewServer("localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := grpc.Dial(srv.Addr, grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := datastore.NewClient(ctx, "P", option.WithGRPCConn(conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, srv
+}
+
+type item struct {
+	A    int
+	B    string
+	Tags []string
+}
+
+func TestPutGetDelete(t *testing.T) {
+	ctx := context.Background()
+	client, srv := newFake(ctx, t)
+	defer srv.Close()
+	defer client.Close()
+
+	k, err := client.Put(ctx, datastore.IncompleteKey("Item", nil), &item{A: 1, B: "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k.Incomplete() {
+		t.Fatalf("Put returned incomplete key %v", k)
+	}
+	var got item
+	if err := client.Get(ctx, k, &got); err != nil {
+		t.Fatal(err)
+	}
+	if want := (item{A: 1, B: "x"}); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	named := datastore.NameKey("Item", "n", nil)
+	if _, err := client.Mutate(ctx, datastore.NewUpdate(named, &item{})); status.Code(err) != codes.NotFound {
+		t.Errorf("update of missing entity: got %v, want NotFound", err)
+	}
+	if _, err := client.Mutate(ctx, datastore.NewInsert(named, &item{A: 2})); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Mutate(ctx, datastore.NewInsert(named, &item{A: 3})); status.Code(err) != codes.AlreadyExists {
+		t.Errorf("insert of existing entity: got %v, want AlreadyExists", err)
+	}
+
+	if err := client.Delete(ctx, k); err != nil {
+		t.Fatal(err)
+	}
+	items := make([]item, 2)
+	err = client.GetMulti(ctx, []*datastore.Key{k, named}, items)
+	merr, ok := err.(datastore.MultiError)
+	if !ok {
+		t.Fatalf("GetMulti: got %v, want a MultiError", err)
+	}
+	if merr[0] != datastore.ErrNoSuchEntity || merr[1] != nil {
+		t.Errorf("GetMulti: got %v, want [%v <nil>]", merr, datastore.ErrNoSuchEntity)
+	}
+	if items[1].A != 2 {
+		t.Errorf("got %+v, want A=2", items[1])
+	}
+}
+
+func TestAllocateIDs(t *testing.T) {
+	ctx := context.Background()
+	client, srv := newFake(ctx, t)
+	defer srv.Close()
+	defer client.Close()
+
+	if _, err := client.Put(ctx, datastore.IDKey("Item", 100, nil), &item{}); err != nil {
+		t.Fatal(err)
+	}
+	parent := datastore.NameKey("Parent", "p", nil)
+	keys, err := client.AllocateIDs(ctx, []*datastore.Key{
+		datastore.IncompleteKey("Item", nil),
+		datastore.IncompleteKey("Item", parent),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := map[int64]bool{}
+	for _, k := range keys {
+		if k.Incomplete() || k.ID <= 100 || seen[k.ID] {
+			t.Errorf("bad allocated key %v", k)
+		}
+		seen[k.ID] = true
+	}
+	if !keys[1].Parent.Equal(parent) {
+		t.Errorf("got parent %v, want %v", keys[1].Parent, parent)
+	}
+	if _, err := client.AllocateIDs(ctx, []*datastore.Key{datastore.IDKey("Item", 1, nil)}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("allocating a complete key: got %v, want InvalidArgument", err)
+	}
+}
+
+func TestTransactions(t *testing.T) {
+	ctx := context.Background()
+	client, srv := newFake(ctx, t)
+	defer srv.Close()
+	defer client.Close()
+
+	k := datastore.NameKey("Counter", "c", nil)
+	if _, err := client.Put(ctx, k, &item{}); err != nil {
+		t.Fatal(err)
+	}
+	var pk *datastore.PendingKey
+	cmt, err := client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		var it item
+		if err := tx.Get(k, &it); err != nil {
+			return err
+		}
+		it.A++
+		if _, err := tx.Put(k, &it); err != nil {
+			return err
+		}
+		var err error
+		pk, err = tx.Put(datastore.IncompleteKey("Item", k), &item{})
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newKey := cmt.Key(pk); newKey.Incomplete() || !newKey.Parent.Equal(k) {
+		t.Errorf("bad key from commit: %v", newKey)
+	}
+
+	// A transaction that read the entity fails to commit after it changes.
+	tx, err := client.NewTransaction(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var it item
+	if err := tx.Get(k, &it); err != nil {
+		t.Fatal(err)
+	}
+	if it.A != 1 {
+		t.Errorf("got A=%d, want 1", it.A)
+	}
+	if _, err := client.Put(ctx, k, &item{A: 10}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Put(k, &item{A: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Commit(); err != datastore.ErrConcurrentTransaction {
+		t.Errorf("got %v, want ErrConcurrentTransaction", err)
+	}
+
+	// So does one whose ancestor query would see a change.
+	tx, err = client.NewTransaction(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.GetAll(ctx, datastore.NewQuery("Item").Ancestor(k).Transaction(tx), &[]item{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Put(ctx, datastore.IncompleteKey("Item", k), &item{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Commit(); err != datastore.ErrConcurrentTransaction {
+		t.Errorf("got %v, want ErrConcurrentTransaction", err)
+	}
+
+	// Non-ancestor queries are not allowed in transactions.
+	tx, err = client.NewTransaction(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.GetAll(ctx, datastore.NewQuery("Item").Transaction(tx), &[]item{}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("got %v, want InvalidArgument", err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Read-only transactions cannot write.
+	tx, err = client.NewTransaction(ctx, datastore.ReadOnly)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Put(k, &item{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Commit(); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("got %v, want InvalidArgument", err)
+	}
+}
+
+func TestQueries(t *testing.T) {
+	ctx := context.Background()
+	client, srv := newFake(ctx, t)
+	defer srv.Close()
+	defer client.Close()
+
+	parent := datastore.NameKey("Parent", "p", nil)
+	keys := []*datastore.Key{
+		datastore.IDKey("Item", 1, parent),
+		datastore.IDKey("Item", 2, parent),
+		datastore.IDKey("Item", 3, nil),
+		datastore.IDKey("Item", 4, nil),
+		datastore.IDKey("Item", 5, nil),
+	}
+	items := []*item{
+		{A: 3, B: "a", Tags: []string{"x", "y"}},
+		{A: 1, B: "b", Tags: []string{"y"}},
+		{A: 2, B: "a"},
+		{A: 5, B: "c", Tags: []string{"z", "x"}},
+		{A: 4, B: "b"},
+	}
+	if _, err := client.PutMulti(ctx, keys, items); err != nil {
+		t.Fatal(err)
+	}
+	other := datastore.IDKey("Item", 1, nil)
+	other.Namespace = "other"
+	if _, err := client.Put(ctx, other, &item{A: 100}); err != nil {
+		t.Fatal(err)
+	}
+
+	ids := func(ks []*datastore.Key) []int64 {
+		var res []int64
+		for _, k := range ks {
+			res = append(res, k.ID)
+		}
+		return res
+	}
+	for _, test := range []struct {
+		q    *datastore.Query
+		want []int64
+	}{
+		{datastore.NewQuery("Item"), []int64{3, 4, 5, 1, 2}},
+		{datastore.NewQuery("Item").Ancestor(parent), []int64{1, 2}},
+		{datastore.NewQuery("Item").Namespace("other"), []int64{1}},
+		{datastore.NewQuery("Item").Filter("B =", "a"), []int64{3, 1}},
+		{datastore.NewQuery("Item").Filter("A >", 2), []int64{1, 5, 4}},
+		{datastore.NewQuery("Item").Filter("A >=", 2).Filter("A <", 4), []int64{3, 1}},
+		{datastore.NewQuery("Item").Filter("A >", 2).Order("-A"), []int64{4, 5, 1}},
+		{datastore.NewQuery("Item").Order("B").Order("-A"), []int64{1, 3, 5, 2, 4}},
+		{datastore.NewQuery("Item").Filter("Tags =", "x"), []int64{4, 1}},
+		{datastore.NewQuery("Item").Filter("Tags =", "x").Filter("Tags =", "y"), []int64{1}},
+		{datastore.NewQuery("Item").Order("Tags"), []int64{4, 1, 2}},
+		{datastore.NewQuery("Item").Order("-Tags"), []int64{4, 1, 2}},
+		{datastore.NewQuery("Item").Filter("__key__ >", keys[3]), []int64{5, 1, 2}},
+		{datastore.NewQuery("").Ancestor(parent), []int64{1, 2}},
+		{datastore.NewQuery("Item").Order("A").Offset(1).Limit(2), []int64{3, 1}},
+	} {
+		got, err := client.GetAll(ctx, test.q.KeysOnly(), nil)
+		if err != nil {
+			t.Errorf("%+v: %v", test.q, err)
+			continue
+		}
+		if !reflect.DeepEqual(ids(got), test.want) {
+			t.Errorf("%+v: got %v, want %v", test.q, ids(got), test.want)
+		}
+	}
+
+	var got []item
+	if _, err := client.GetAll(ctx, datastore.NewQuery("Item").Filter("A =", 3), &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || !reflect.DeepEqual(got[0], *items[0]) {
+		t.Errorf("got %+v, want [%+v]", got, *items[0])
+	}
+
+	got = nil
+	if _, err := client.GetAll(ctx, datastore.NewQuery("Item").Project("B").Distinct().Order("B"), &got); err != nil {
+		t.Fatal(err)
+	}
+	if want := []item{{B: "a"}, {B: "b"}, {B: "c"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("distinct projection: got %+v, want %+v", got, want)
+	}
+
+	type tagged struct{ Tags string }
+	var tags []tagged
+	if _, err := client.GetAll(ctx, datastore.NewQuery("Item").Project("Tags").Order("Tags"), &tags); err != nil {
+		t.Fatal(err)
+	}
+	if want := []tagged{{"x"}, {"x"}, {"y"}, {"y"}, {"z"}}; !reflect.DeepEqual(tags, want) {
+		t.Errorf("projection of an array: got %+v, want %+v", tags, want)
+	}
+
+	if _, err := client.GetAll(ctx, datastore.NewQuery("Item").Filter("A >", 1).Filter("B >", "a").KeysOnly(), nil); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("inequalities on two properties: got %v, want InvalidArgument", err)
+	}
+}
+
+func TestQueryCursors(t *testing.T) {
+	defer func(n int) { batchSize = n }(batchSize)
+	batchSize = 3
+
+	ctx := context.Background()
+	client, srv := newFake(ctx, t)
+	defer srv.Close()
+	defer client.Close()
+
+	var keys []*datastore.Key
+	var items []*item
+	for i := 1; i <= 10; i++ {
+		keys = append(keys, datastore.IDKey("Item", int64(i), nil))
+		items = append(items, &item{A: 10 - i})
+	}
+	if _, err := client.PutMulti(ctx, keys, items); err != nil {
+		t.Fatal(err)
+	}
+
+	q := datastore.NewQuery("Item").Order("A").KeysOnly()
+	n, err := client.Count(ctx, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 10 {
+		t.Errorf("Count: got %d, want 10", n)
+	}
+
+	// Read the results four at a time, resuming from cursors.
+	var got []int64
+	var cursor datastore.Cursor
+	for {
+		it := client.Run(ctx, q.Start(cursor).Limit(4))
+		var page int
+		for {
+			k, err := it.Next(nil)
+			if err == iterator.Done {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, k.ID)
+			page++
+		}
+		if page == 0 {
+			break
+		}
+		if cursor, err = it.Cursor(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if want := []int64{10, 9, 8, 7, 6, 5, 4, 3, 2, 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// An end cursor stops the query after the result it was taken at.
+	it := client.Run(ctx, q.Offset(2))
+	if _, err := it.Next(nil); err != nil {
+		t.Fatal(err)
+	}
+	end, err := it.Cursor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks, err := client.GetAll(ctx, q.End(end), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ks) != 3 || ks[2].ID != 8 {
+		t.Errorf("got %v, want the first three keys", ks)
+	}
+
+	if _, err := client.GetAll(ctx, datastore.NewQuery("Item").KeysOnly().Start(end), nil); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("cursor from another query: got %v, want InvalidArgument", err)
+	}
+}
+
+func TestIndexes(t *testing.T) {
+	ctx := context.Background()
+	client, srv := newFake(ctx, t)
+	defer srv.Close()
+	defer client.Close()
+
+	if err := srv.LoadIndexFile("../testdata/index.yaml"); err != nil {
+		t.Fatal(err)
+	}
+	parent := datastore.NameKey("SQParent", "p", nil)
+	for _, test := range []struct {
+		q    *datastore.Query
+		want codes.Code
+	}{
+		{datastore.NewQuery("SQChild").Filter("T =", 1).Filter("I =", 2), codes.OK},
+		{datastore.NewQuery("SQChild").Order("-I"), codes.OK},
+		{datastore.NewQuery("SQChild").Ancestor(parent).Filter("T =", 1).Order("-I"), codes.OK},
+		{datastore.NewQuery("SQChild").Ancestor(parent).Filter("T =", 1).Filter("J =", 1).Order("U"), codes.OK},
+		{datastore.NewQuery("SQChild").Ancestor(parent).Filter("T =", 1).Filter("U >", 1), codes.FailedPrecondition},
+		{datastore.NewQuery("SQChild").Filter("T =", 1).Order("I"), codes.FailedPrecondition},
+	} {
+		_, err := client.GetAll(ctx, test.q.KeysOnly(), nil)
+		if got := status.Code(err); got != test.want {
+			t.Errorf("%+v: got %v, want %v", test.q, err, test.want)
+		}
+	}
+}
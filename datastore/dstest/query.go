@@ -0,0 +1,545 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dstest
+
+import (
+	"context"
+	"sort"
+
+	"github.com/smyte/google-cloud-go/datastore/internal/index"
+	"github.com/smyte/google-cloud-go/datastore/internal/pbvalue"
+	"github.com/golang/protobuf/proto"
+	pb "google.golang.org/genproto/googleapis/datastore/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const keyProperty = "__key__"
+
+// batchSize is the largest number of results that RunQuery returns at once.
+// It is a variable so that tests can make clients fetch several batches.
+var batchSize = 300
+
+// A query is a validated pb.Query.
+type query struct {
+	kind       string
+	ancestor   *pb.Key
+	filters    []*pb.PropertyFilter // except the HAS_ANCESTOR filter
+	orders     []*pb.PropertyOrder  // always includes an order on the key
+	projection []string
+	keysOnly   bool
+	distinctOn []string
+	start, end []*pb.Value // decoded cursors
+	offset     int32
+	limit      int32 // negative for no limit
+}
+
+// A row is a result of a query. An entity has several rows in a projection
+// query that projects a property with several values.
+type row struct {
+	e    *entity
+	pos  []*pb.Value          // the values sorted on, then the projected values
+	proj map[string]*pb.Value // the projected values
+}
+
+func (s *server) RunQuery(_ context.Context, req *pb.RunQueryRequest) (*pb.RunQueryResponse, error) {
+	pq := req.GetQuery()
+	if pq == nil {
+		if req.GetGqlQuery() != nil {
+			return nil, status.Errorf(codes.Unimplemented, "GQL queries are not supported")
+		}
+		return nil, status.Errorf(codes.InvalidArgument, "missing query")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	q, rows, more, err := s.query(req.ProjectId, req.PartitionId, req.ReadOptions, pq)
+	if err != nil {
+		return nil, err
+	}
+
+	batch := &pb.QueryResultBatch{
+		EntityResultType: pb.EntityResult_FULL,
+		EndCursor:        pq.StartCursor,
+		SnapshotVersion:  s.version,
+	}
+	switch {
+	case q.keysOnly:
+		batch.EntityResultType = pb.EntityResult_KEY_ONLY
+	case len(q.projection) > 0:
+		batch.EntityResultType = pb.EntityResult_PROJECTION
+	}
+	if skip := int(q.offset); skip > 0 {
+		if skip > len(rows) {
+			skip = len(rows)
+		}
+		if skip > 0 {
+			batch.SkippedResults = int32(skip)
+			batch.SkippedCursor = encodeCursor(rows[skip-1].pos)
+			batch.EndCursor = batch.SkippedCursor
+		}
+		rows = rows[skip:]
+	}
+	if q.limit >= 0 && len(rows) >= int(q.limit) {
+		rows = rows[:q.limit]
+		more = pb.QueryResultBatch_MORE_RESULTS_AFTER_LIMIT
+	}
+	if len(rows) > batchSize {
+		rows = rows[:batchSize]
+		more = pb.QueryResultBatch_NOT_FINISHED
+	}
+	batch.MoreResults = more
+	for _, r := range rows {
+		batch.EntityResults = append(batch.EntityResults, &pb.EntityResult{
+			Entity:  q.result(r),
+			Version: r.e.version,
+			Cursor:  encodeCursor(r.pos),
+		})
+	}
+	if len(rows) > 0 {
+		batch.EndCursor = batch.EntityResults[len(rows)-1].Cursor
+	}
+	return &pb.RunQueryResponse{Batch: batch, Query: pq}, nil
+}
+
+// query runs the query pq, and returns it parsed and its rows after the
+// start and end cursors, but before the offset and limit. The caller must
+// hold s.mu.
+func (s *server) query(project string, partition *pb.PartitionId, ro *pb.ReadOptions, pq *pb.Query) (*query, []*row, pb.QueryResultBatch_MoreResultsType, error) {
+	const none = pb.QueryResultBatch_MORE_RESULTS_TYPE_UNSPECIFIED
+	t, err := s.readTransaction(ro)
+	if err != nil {
+		return nil, nil, none, err
+	}
+	q, err := parseQuery(project, pq)
+	if err != nil {
+		return nil, nil, none, err
+	}
+	if t != nil {
+		if q.ancestor == nil {
+			return nil, nil, none, status.Errorf(codes.InvalidArgument, "only ancestor queries are allowed inside transactions")
+		}
+		t.queries = append(t.queries, q.ancestor)
+	}
+	if s.indexes != nil {
+		if ix := index.Required(pq); ix != nil && !satisfied(s.indexes, ix) {
+			return nil, nil, none, status.Errorf(codes.FailedPrecondition, "no matching index found. recommended index is:\n%s", ix)
+		}
+	}
+
+	var rows []*row
+	for _, e := range s.entities {
+		if !e.deleted && e.key.PartitionId.ProjectId == project &&
+			e.key.PartitionId.NamespaceId == partition.GetNamespaceId() && q.matches(e) {
+			rows = append(rows, q.rows(e)...)
+		}
+	}
+	sort.Slice(rows, func(i, j int) bool { return q.compare(rows[i].pos, rows[j].pos) < 0 })
+	if len(q.distinctOn) > 0 {
+		rows = q.distinct(rows)
+	}
+	if q.start != nil {
+		i := sort.Search(len(rows), func(i int) bool { return q.compare(rows[i].pos, q.start) > 0 })
+		rows = rows[i:]
+	}
+	more := pb.QueryResultBatch_NO_MORE_RESULTS
+	if q.end != nil {
+		i := sort.Search(len(rows), func(i int) bool { return q.compare(rows[i].pos, q.end) > 0 })
+		if i < len(rows) {
+			more = pb.QueryResultBatch_MORE_RESULTS_AFTER_CURSOR
+		}
+		rows = rows[:i]
+	}
+	return q, rows, more, nil
+}
+
+func satisfied(ixs []*index.Index, req *index.Index) bool {
+	for _, ix := range ixs {
+		if ix.Satisfies(req) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseQuery checks pq, a query in project, and returns it as a query.
+func parseQuery(project string, pq *pb.Query) (*query, error) {
+	q := &query{offset: pq.Offset, limit: -1}
+	switch len(pq.Kind) {
+	case 0:
+	case 1:
+		q.kind = pq.Kind[0].Name
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "a query can have at most one kind")
+	}
+	if l := pq.Limit; l != nil {
+		if l.Value < 0 {
+			return nil, status.Errorf(codes.InvalidArgument, "negative limit %d", l.Value)
+		}
+		q.limit = l.Value
+	}
+	if q.offset < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "negative offset %d", q.offset)
+	}
+	if err := q.addFilter(project, pq.Filter); err != nil {
+		return nil, err
+	}
+
+	var ineq string
+	eqs := map[string]bool{}
+	for _, f := range q.filters {
+		name := f.Property.Name
+		switch {
+		case f.Op == pb.PropertyFilter_EQUAL:
+			eqs[name] = true
+		case ineq == "":
+			ineq = name
+		case ineq != name:
+			return nil, status.Errorf(codes.InvalidArgument, "cannot have inequality filters on multiple properties: [%s, %s]", ineq, name)
+		}
+		if q.kind == "" && name != keyProperty {
+			return nil, status.Errorf(codes.InvalidArgument, "kind is required for filters on properties other than %s", keyProperty)
+		}
+	}
+
+	hasKeyOrder := false
+	for i, o := range pq.Order {
+		name := o.Property.GetName()
+		if name == "" {
+			return nil, status.Errorf(codes.InvalidArgument, "order with no property")
+		}
+		if i == 0 && ineq != "" && name != ineq {
+			return nil, status.Errorf(codes.InvalidArgument, "the first sort property must be the same as the property to which the inequality filter is applied. "+
+				"In your query the first sort property is %s but the inequality filter is on %s", name, ineq)
+		}
+		if q.kind == "" && (name != keyProperty || o.Direction == pb.PropertyOrder_DESCENDING) {
+			return nil, status.Errorf(codes.InvalidArgument, "kind is required for all orders except %s ascending", keyProperty)
+		}
+		hasKeyOrder = hasKeyOrder || name == keyProperty
+		q.orders = append(q.orders, o)
+	}
+	if ineq != "" && len(q.orders) == 0 && ineq != keyProperty {
+		q.orders = append(q.orders, &pb.PropertyOrder{Property: &pb.PropertyReference{Name: ineq}})
+	}
+	if !hasKeyOrder {
+		q.orders = append(q.orders, &pb.PropertyOrder{Property: &pb.PropertyReference{Name: keyProperty}})
+	}
+
+	projected := map[string]bool{}
+	for _, p := range pq.Projection {
+		name := p.Property.GetName()
+		switch {
+		case name == "":
+			return nil, status.Errorf(codes.InvalidArgument, "projection with no property")
+		case projected[name]:
+			return nil, status.Errorf(codes.InvalidArgument, "cannot project %s more than once", name)
+		case eqs[name]:
+			return nil, status.Errorf(codes.InvalidArgument, "cannot use projection on a property with an equality filter: %s", name)
+		}
+		projected[name] = true
+		if name != keyProperty {
+			q.projection = append(q.projection, name)
+		}
+	}
+	q.keysOnly = len(pq.Projection) > 0 && len(q.projection) == 0
+	for _, p := range pq.DistinctOn {
+		name := p.GetName()
+		if !projected[name] {
+			return nil, status.Errorf(codes.InvalidArgument, "distinct on %s, which is not projected", name)
+		}
+		q.distinctOn = append(q.distinctOn, name)
+	}
+
+	var err error
+	if q.start, err = q.decodeCursor(pq.StartCursor); err != nil {
+		return nil, err
+	}
+	if q.end, err = q.decodeCursor(pq.EndCursor); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// addFilter adds the property filters of f to q, which supports only
+// conjunctions.
+func (q *query) addFilter(project string, f *pb.Filter) error {
+	switch f := f.GetFilterType().(type) {
+	case nil:
+		return nil
+	case *pb.Filter_CompositeFilter:
+		if f.CompositeFilter.Op != pb.CompositeFilter_AND {
+			return status.Errorf(codes.InvalidArgument, "unsupported composite filter operator %v", f.CompositeFilter.Op)
+		}
+		for _, g := range f.CompositeFilter.Filters {
+			if err := q.addFilter(project, g); err != nil {
+				return err
+			}
+		}
+		return nil
+	case *pb.Filter_PropertyFilter:
+		pf := f.PropertyFilter
+		name := pf.Property.GetName()
+		if name == "" {
+			return status.Errorf(codes.InvalidArgument, "filter with no property")
+		}
+		if pf.Value == nil {
+			return status.Errorf(codes.InvalidArgument, "filter on %s with no value", name)
+		}
+		if name == keyProperty {
+			k := pf.Value.GetKeyValue()
+			if k == nil {
+				return status.Errorf(codes.InvalidArgument, "filter on %s with a value that is not a key", name)
+			}
+			if err := checkKey(k, true); err != nil {
+				return status.Errorf(codes.InvalidArgument, "%v", err)
+			}
+		}
+		switch pf.Op {
+		case pb.PropertyFilter_HAS_ANCESTOR:
+			if name != keyProperty {
+				return status.Errorf(codes.InvalidArgument, "ancestor filter on %s instead of %s", name, keyProperty)
+			}
+			if q.ancestor != nil {
+				return status.Errorf(codes.InvalidArgument, "a query can have at most one ancestor filter")
+			}
+			q.ancestor = normalizeKey(project, pf.Value.GetKeyValue())
+		case pb.PropertyFilter_EQUAL, pb.PropertyFilter_LESS_THAN, pb.PropertyFilter_LESS_THAN_OR_EQUAL,
+			pb.PropertyFilter_GREATER_THAN, pb.PropertyFilter_GREATER_THAN_OR_EQUAL:
+			q.filters = append(q.filters, pf)
+		default:
+			return status.Errorf(codes.InvalidArgument, "unsupported filter operator %v", pf.Op)
+		}
+		return nil
+	default:
+		return status.Errorf(codes.InvalidArgument, "unsupported filter %T", f)
+	}
+}
+
+// values returns the indexed values of the property name of e.
+func (q *query) values(e *entity, name string) []*pb.Value {
+	if name == keyProperty {
+		return []*pb.Value{{ValueType: &pb.Value_KeyValue{KeyValue: e.key}}}
+	}
+	return pbvalue.PropertyValues(e.props, name)
+}
+
+// candidates returns the values of the property name of e that satisfy the
+// inequality filters on it, and equal the value of an equality filter on it,
+// if it has any. These are the values that the entity can be sorted on or
+// projected to.
+func (q *query) candidates(e *entity, name string) []*pb.Value {
+	var vs []*pb.Value
+	for _, v := range q.values(e, name) {
+		ok, hasEq, eq := true, false, false
+		for _, f := range q.filters {
+			if f.Property.Name != name {
+				continue
+			}
+			if f.Op == pb.PropertyFilter_EQUAL {
+				hasEq = true
+				eq = eq || pbvalue.Compare(v, f.Value) == 0
+			} else {
+				ok = ok && satisfies(v, f)
+			}
+		}
+		if ok && (!hasEq || eq) {
+			vs = append(vs, v)
+		}
+	}
+	return vs
+}
+
+// satisfies reports whether v satisfies the inequality filter f. Values only
+// satisfy inequalities with values of the same type.
+func satisfies(v *pb.Value, f *pb.PropertyFilter) bool {
+	if !pbvalue.SameType(v, f.Value) {
+		return false
+	}
+	c := pbvalue.Compare(v, f.Value)
+	switch f.Op {
+	case pb.PropertyFilter_LESS_THAN:
+		return c < 0
+	case pb.PropertyFilter_LESS_THAN_OR_EQUAL:
+		return c <= 0
+	case pb.PropertyFilter_GREATER_THAN:
+		return c > 0
+	case pb.PropertyFilter_GREATER_THAN_OR_EQUAL:
+		return c >= 0
+	}
+	return false
+}
+
+// matches reports whether e has the query's kind and ancestor and satisfies
+// its filters.
+func (q *query) matches(e *entity) bool {
+	if q.kind != "" && kind(e.key) != q.kind {
+		return false
+	}
+	if q.ancestor != nil && !hasAncestor(e.key, q.ancestor) {
+		return false
+	}
+	for _, f := range q.filters {
+		if f.Op != pb.PropertyFilter_EQUAL {
+			if len(q.candidates(e, f.Property.Name)) == 0 {
+				return false
+			}
+			continue
+		}
+		found := false
+		for _, v := range q.values(e, f.Property.Name) {
+			if pbvalue.Compare(v, f.Value) == 0 {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// rows returns the rows of e, which matches q. An entity that lacks a property
+// that the query sorts on or projects has no rows.
+func (q *query) rows(e *entity) []*row {
+	rows := []*row{{e: e, proj: map[string]*pb.Value{}}}
+	for _, name := range q.projection {
+		vs := q.candidates(e, name)
+		var next []*row
+		for _, r := range rows {
+			for _, v := range vs {
+				proj := map[string]*pb.Value{name: v}
+				for n, pv := range r.proj {
+					proj[n] = pv
+				}
+				next = append(next, &row{e: e, proj: proj})
+			}
+		}
+		rows = next
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+
+	sortValues := make([]*pb.Value, len(q.orders))
+	for i, o := range q.orders {
+		name := o.Property.Name
+		if _, ok := rows[0].proj[name]; ok {
+			continue
+		}
+		vs := q.candidates(e, name)
+		if len(vs) == 0 {
+			return nil
+		}
+		v := vs[0]
+		for _, w := range vs[1:] {
+			c := pbvalue.Compare(w, v)
+			if o.Direction == pb.PropertyOrder_DESCENDING {
+				c = -c
+			}
+			if c < 0 {
+				v = w
+			}
+		}
+		sortValues[i] = v
+	}
+	for _, r := range rows {
+		for i, o := range q.orders {
+			if v, ok := r.proj[o.Property.Name]; ok {
+				r.pos = append(r.pos, v)
+			} else {
+				r.pos = append(r.pos, sortValues[i])
+			}
+		}
+		for _, name := range q.projection {
+			r.pos = append(r.pos, r.proj[name])
+		}
+	}
+	return rows
+}
+
+// compare compares the positions of two rows in the query's results.
+func (q *query) compare(a, b []*pb.Value) int {
+	for i := range a {
+		c := pbvalue.Compare(a[i], b[i])
+		if i < len(q.orders) && q.orders[i].Direction == pb.PropertyOrder_DESCENDING {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// distinct returns the first of the sorted rows with each combination of
+// values of the distinct-on properties.
+func (q *query) distinct(rows []*row) []*row {
+	seen := map[string]bool{}
+	var res []*row
+	for _, r := range rows {
+		var vs []*pb.Value
+		for _, name := range q.distinctOn {
+			vs = append(vs, r.proj[name])
+		}
+		k := string(encodeCursor(vs))
+		if !seen[k] {
+			seen[k] = true
+			res = append(res, r)
+		}
+	}
+	return res
+}
+
+// result returns the entity to return for r.
+func (q *query) result(r *row) *pb.Entity {
+	switch {
+	case q.keysOnly:
+		return &pb.Entity{Key: proto.Clone(r.e.key).(*pb.Key)}
+	case len(q.projection) > 0:
+		e := &pb.Entity{Key: proto.Clone(r.e.key).(*pb.Key), Properties: map[string]*pb.Value{}}
+		for name, v := range r.proj {
+			e.Properties[name] = proto.Clone(v).(*pb.Value)
+		}
+		return e
+	default:
+		return r.e.proto()
+	}
+}
+
+// A cursor is an encoded array value holding the position of a row.
+func encodeCursor(pos []*pb.Value) []byte {
+	b, err := proto.Marshal(&pb.Value{ValueType: &pb.Value_ArrayValue{ArrayValue: &pb.ArrayValue{Values: pos}}})
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func (q *query) decodeCursor(c []byte) ([]*pb.Value, error) {
+	if len(c) == 0 {
+		return nil, nil
+	}
+	var v pb.Value
+	if err := proto.Unmarshal(c, &v); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid cursor: %v", err)
+	}
+	pos := v.GetArrayValue().GetValues()
+	if len(pos) != len(q.orders)+len(q.projection) {
+		return nil, status.Errorf(codes.InvalidArgument, "cursor does not belong to this query")
+	}
+	return pos, nil
+}
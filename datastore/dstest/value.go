@@ -0,0 +1,124 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dstest
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	pb "google.golang.org/genproto/googleapis/datastore/v1"
+)
+
+// keyString returns a string that uniquely identifies k, which must have been
+// normalized by normalizeKey.
+func keyString(k *pb.Key) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%q/%q", k.PartitionId.GetProjectId(), k.PartitionId.GetNamespaceId())
+	for _, e := range k.Path {
+		switch id := e.IdType.(type) {
+		case *pb.Key_PathElement_Id:
+			fmt.Fprintf(&b, "/%q,%d", e.Kind, id.Id)
+		case *pb.Key_PathElement_Name:
+			fmt.Fprintf(&b, "/%q,%q", e.Kind, id.Name)
+		default:
+			fmt.Fprintf(&b, "/%q,?", e.Kind)
+		}
+	}
+	return b.String()
+}
+
+// normalizeKey returns a copy of k whose partition names the project, which
+// clients usually leave out.
+func normalizeKey(project string, k *pb.Key) *pb.Key {
+	k = proto.Clone(k).(*pb.Key)
+	k.PartitionId = &pb.PartitionId{
+		ProjectId:   project,
+		NamespaceId: k.PartitionId.GetNamespaceId(),
+	}
+	return k
+}
+
+// checkKey checks that the kinds and IDs of k are valid. If complete is
+// true, the last element must have an ID or a name; otherwise it must have
+// neither.
+func checkKey(k *pb.Key, complete bool) error {
+	if k == nil || len(k.Path) == 0 {
+		return fmt.Errorf("key with an empty path")
+	}
+	for i, e := range k.Path {
+		if e.Kind == "" {
+			return fmt.Errorf("key %s has an element with no kind", keyString(k))
+		}
+		if isReserved(e.Kind) {
+			return fmt.Errorf("key %s has the reserved kind %q", keyString(k), e.Kind)
+		}
+		last := i == len(k.Path)-1
+		switch id := e.IdType.(type) {
+		case *pb.Key_PathElement_Id:
+			if id.Id <= 0 {
+				return fmt.Errorf("key %s has a non-positive ID", keyString(k))
+			}
+			if last && !complete {
+				return fmt.Errorf("key %s must be incomplete", keyString(k))
+			}
+		case *pb.Key_PathElement_Name:
+			if id.Name == "" {
+				return fmt.Errorf("key %s has an empty name", keyString(k))
+			}
+			if isReserved(id.Name) {
+				return fmt.Errorf("key %s has the reserved name %q", keyString(k), id.Name)
+			}
+			if last && !complete {
+				return fmt.Errorf("key %s must be incomplete", keyString(k))
+			}
+		default:
+			if !last || complete {
+				return fmt.Errorf("key %s is incomplete", keyString(k))
+			}
+		}
+	}
+	return nil
+}
+
+func isReserved(s string) bool {
+	return len(s) > 4 && strings.HasPrefix(s, "__") && strings.HasSuffix(s, "__")
+}
+
+// isComplete reports whether the last element of k has an ID or a name.
+func isComplete(k *pb.Key) bool {
+	if len(k.Path) == 0 {
+		return false
+	}
+	return k.Path[len(k.Path)-1].IdType != nil
+}
+
+// hasAncestor reports whether a is k or one of its ancestors.
+func hasAncestor(k, a *pb.Key) bool {
+	if k.PartitionId.GetNamespaceId() != a.PartitionId.GetNamespaceId() || len(a.Path) > len(k.Path) {
+		return false
+	}
+	for i, e := range a.Path {
+		if !proto.Equal(k.Path[i], e) {
+			return false
+		}
+	}
+	return true
+}
+
+// kind returns the kind of the entity that k names.
+func kind(k *pb.Key) string {
+	return k.Path[len(k.Path)-1].Kind
+}
@@ -0,0 +1,812 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datastore
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+
+	"github.com/smyte/google-cloud-go/datastore/internal/pbvalue"
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/api/iterator"
+	pb "google.golang.org/genproto/googleapis/datastore/v1"
+)
+
+// maxSubqueries is the largest number of queries that a query is split into.
+const maxSubqueries = 30
+
+// An EntityFilter is a filter on the entities that a query returns, for use
+// with Query.FilterEntity. It is a PropertyFilter, an AndFilter or an
+// OrFilter.
+type EntityFilter interface {
+	// disjunction returns the filter as an OR of ANDs of filters that
+	// Datastore supports.
+	disjunction() ([][]filter, error)
+}
+
+// A PropertyFilter compares a property with a value.
+type PropertyFilter struct {
+	// FieldName is the name of the property. Unlike in Query.Filter, it is
+	// not quoted.
+	FieldName string
+
+	// Operator is one of ">", "<", ">=", "<=", "=", "!=", "in" and "not-in".
+	Operator string
+
+	// Value is compared with the property. It must be a slice for the "in"
+	// and "not-in" operators.
+	Value interface{}
+}
+
+// An AndFilter matches the entities that match all of its filters.
+type AndFilter struct {
+	Filters []EntityFilter
+}
+
+// An OrFilter matches the entities that match any of its filters.
+type OrFilter struct {
+	Filters []EntityFilter
+}
+
+func (f PropertyFilter) disjunction() ([][]filter, error) {
+	pf, err := newFilter(f.FieldName, f.Operator, f.Value)
+	if err != nil {
+		return nil, fmt.Errorf("datastore: %v in filter on %q", err, f.FieldName)
+	}
+	// The name is not quoted.
+	pf.FieldName = f.FieldName
+	return pf.disjunction()
+}
+
+func (f AndFilter) disjunction() ([][]filter, error) {
+	d := [][]filter{{}}
+	for _, g := range f.Filters {
+		if g == nil {
+			return nil, errors.New("datastore: nil filter in AndFilter")
+		}
+		gd, err := g.disjunction()
+		if err != nil {
+			return nil, err
+		}
+		if d, err = and(d, gd); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+func (f OrFilter) disjunction() ([][]filter, error) {
+	if len(f.Filters) == 0 {
+		return nil, errors.New("datastore: empty OrFilter")
+	}
+	var d [][]filter
+	for _, g := range f.Filters {
+		if g == nil {
+			return nil, errors.New("datastore: nil filter in OrFilter")
+		}
+		gd, err := g.disjunction()
+		if err != nil {
+			return nil, err
+		}
+		d = append(d, gd...)
+		if len(d) > maxSubqueries {
+			return nil, errTooManySubqueries
+		}
+	}
+	return d, nil
+}
+
+var errTooManySubqueries = fmt.Errorf("datastore: query needs more than %d sub-queries", maxSubqueries)
+
+// and returns the conjunction of two disjunctions.
+func and(a, b [][]filter) ([][]filter, error) {
+	if len(a)*len(b) > maxSubqueries {
+		return nil, errTooManySubqueries
+	}
+	var d [][]filter
+	for _, fa := range a {
+		for _, fb := range b {
+			fs := make([]filter, 0, len(fa)+len(fb))
+			d = append(d, append(append(fs, fa...), fb...))
+		}
+	}
+	return d, nil
+}
+
+func (f filter) disjunction() ([][]filter, error) {
+	switch f.Op {
+	case notEqual:
+		return [][]filter{
+			{{FieldName: f.FieldName, Op: lessThan, Value: f.Value}},
+			{{FieldName: f.FieldName, Op: greaterThan, Value: f.Value}},
+		}, nil
+	case in:
+		vs, err := filterValues(f.Value)
+		if err != nil {
+			return nil, err
+		}
+		if len(vs) > maxSubqueries {
+			return nil, errTooManySubqueries
+		}
+		var d [][]filter
+		for _, v := range vs {
+			d = append(d, []filter{{FieldName: f.FieldName, Op: equal, Value: v}})
+		}
+		return d, nil
+	case notIn:
+		vs, err := filterValues(f.Value)
+		if err != nil {
+			return nil, err
+		}
+		if vs, err = sortValues(vs); err != nil {
+			return nil, err
+		}
+		if len(vs) == 0 {
+			return [][]filter{{}}, nil
+		}
+		if len(vs)+1 > maxSubqueries {
+			return nil, errTooManySubqueries
+		}
+		// Match the ranges between the values.
+		d := [][]filter{{{FieldName: f.FieldName, Op: lessThan, Value: vs[0]}}}
+		for i := 1; i < len(vs); i++ {
+			d = append(d, []filter{
+				{FieldName: f.FieldName, Op: greaterThan, Value: vs[i-1]},
+				{FieldName: f.FieldName, Op: lessThan, Value: vs[i]},
+			})
+		}
+		d = append(d, []filter{{FieldName: f.FieldName, Op: greaterThan, Value: vs[len(vs)-1]}})
+		return d, nil
+	default:
+		return [][]filter{{f}}, nil
+	}
+}
+
+// filterValues returns the elements of v, the value of an "in" or "not-in"
+// filter.
+func filterValues(v interface{}) ([]interface{}, error) {
+	rv := reflect.ValueOf(v)
+	if !rv.IsValid() || (rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array) || rv.Type() == typeOfByteSlice {
+		return nil, fmt.Errorf("the value of an in or not-in filter must be a slice, not %T", v)
+	}
+	vs := make([]interface{}, rv.Len())
+	for i := range vs {
+		vs[i] = rv.Index(i).Interface()
+	}
+	return vs, nil
+}
+
+// sortValues sorts vs in Datastore's order, and removes duplicates.
+func sortValues(vs []interface{}) ([]interface{}, error) {
+	pvs := make([]*pb.Value, len(vs))
+	for i, v := range vs {
+		pv, err := interfaceToProto(v, false)
+		if err != nil {
+			return nil, fmt.Errorf("bad filter value type: %v", err)
+		}
+		pvs[i] = pv
+	}
+	idx := make([]int, len(vs))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.Slice(idx, func(i, j int) bool { return pbvalue.Compare(pvs[idx[i]], pvs[idx[j]]) < 0 })
+	var res []interface{}
+	for n, i := range idx {
+		if n > 0 && pbvalue.Compare(pvs[idx[n-1]], pvs[i]) == 0 {
+			continue
+		}
+		res = append(res, vs[i])
+	}
+	return res, nil
+}
+
+// needsSplit reports whether q must be split into several queries to be run.
+func (q *Query) needsSplit() bool {
+	if len(q.entFilter) > 0 {
+		return true
+	}
+	for _, f := range q.filter {
+		if f.Op == notEqual || f.Op == in || f.Op == notIn {
+			return true
+		}
+	}
+	return false
+}
+
+// split returns the queries that q is split into, or nil if it need not be.
+// The queries have the filters and orders of the split, but the other
+// settings of q.
+func (q *Query) split() ([]*Query, error) {
+	if !q.needsSplit() {
+		return nil, nil
+	}
+	d := [][]filter{{}}
+	for _, f := range q.filter {
+		fd, err := f.disjunction()
+		if err != nil {
+			return nil, err
+		}
+		if d, err = and(d, fd); err != nil {
+			return nil, err
+		}
+	}
+	for _, ef := range q.entFilter {
+		efd, err := ef.disjunction()
+		if err != nil {
+			return nil, err
+		}
+		if d, err = and(d, efd); err != nil {
+			return nil, err
+		}
+	}
+
+	var orders []order
+	if len(q.order) == 0 && len(d) > 1 {
+		// Datastore orders the results of a query with an inequality filter
+		// by its property, so all the queries must be ordered by it.
+		var ineq string
+		for _, fs := range d {
+			for _, f := range fs {
+				if f.Op == equal || f.FieldName == keyFieldName || f.FieldName == ineq {
+					continue
+				}
+				if ineq != "" {
+					return nil, fmt.Errorf("datastore: query is split into queries with inequality filters on different properties, %q and %q", ineq, f.FieldName)
+				}
+				ineq = f.FieldName
+			}
+		}
+		if ineq != "" {
+			orders = []order{{FieldName: ineq, Direction: ascending}}
+		}
+	}
+
+	subs := make([]*Query, len(d))
+	for i, fs := range d {
+		sub := q.clone()
+		sub.filter = fs
+		sub.entFilter = nil
+		if orders != nil {
+			sub.order = orders
+		}
+		subs[i] = sub
+	}
+	return subs, nil
+}
+
+// runMerged returns an iterator over the merged results of subs, the queries
+// that q is split into.
+func (c *Client) runMerged(ctx context.Context, q *Query, subs []*Query) *Iterator {
+	t := &Iterator{ctx: ctx, client: c, keysOnly: q.keysOnly}
+	m := &merger{
+		orders: subs[0].order,
+		offset: q.offset,
+		limit:  q.limit,
+		seen:   map[string]bool{},
+	}
+	m.forgettable.m = m
+	t.merge = m
+	switch {
+	case q.distinct:
+		m.distinctOn = q.projection
+	case len(q.distinctOn) > 0:
+		m.distinctOn = q.distinctOn
+	}
+	m.projection = len(q.projection) > 0
+
+	starts, seen, err := decodeMergedCursor(q.start, len(subs), len(m.orders)+1)
+	if err != nil {
+		t.err = err
+		return t
+	}
+	for _, r := range seen {
+		m.seen[r.key] = true
+		heap.Push(&m.forgettable, r)
+	}
+	ends, _, err := decodeMergedCursor(q.end, len(subs), len(m.orders)+1)
+	if err != nil {
+		t.err = err
+		return t
+	}
+	for i, sub := range subs {
+		s := &mergeSource{}
+		m.sources = append(m.sources, s)
+		if starts != nil {
+			s.cursor = starts[i]
+			if s.cursor == nil {
+				s.done = true
+				continue
+			}
+			sub.start = s.cursor
+		}
+		if ends != nil {
+			if len(ends[i]) == 0 {
+				s.done = true
+				continue
+			}
+			sub.end = ends[i]
+		}
+		sub.offset = 0
+		if q.limit >= 0 {
+			sub.limit = int32(math.Min(float64(q.offset)+float64(q.limit), math.MaxInt32))
+		}
+		// The results are merged by the values of the properties they are
+		// ordered by, so only keys-only queries ordered by key can be run
+		// as keys-only.
+		for _, o := range sub.order {
+			if o.FieldName != keyFieldName {
+				sub.keysOnly = false
+			}
+		}
+		s.it = c.Run(ctx, sub)
+		if s.it.err == nil {
+			s.filters = propertyFilters(s.it.req.GetQuery().GetFilter())
+		}
+	}
+	return t
+}
+
+// propertyFilters returns the property filters in f, a conjunction.
+func propertyFilters(f *pb.Filter) []*pb.PropertyFilter {
+	switch f := f.GetFilterType().(type) {
+	case *pb.Filter_PropertyFilter:
+		return []*pb.PropertyFilter{f.PropertyFilter}
+	case *pb.Filter_CompositeFilter:
+		var pfs []*pb.PropertyFilter
+		for _, g := range f.CompositeFilter.Filters {
+			pfs = append(pfs, propertyFilters(g)...)
+		}
+		return pfs
+	}
+	return nil
+}
+
+// A merger merges the results of the queries that a query is split into.
+type merger struct {
+	orders     []order  // of the queries; results are then ordered by key
+	distinctOn []string // properties to deduplicate results by, if any
+	projection bool
+	offset     int32
+	limit      int32
+	sources    []*mergeSource
+	started    bool
+	err        error
+
+	// The dedupe keys of the results that have been returned or skipped,
+	// and that a source may still return. Once every source has passed the
+	// last position at which it could return a result, the result is
+	// forgotten.
+	seen        map[string]bool
+	forgettable seenHeap
+}
+
+// A seenResult is a result that is in merger.seen.
+type seenResult struct {
+	key string // the result's dedupe key
+
+	// The last position at which a source could return the result, or a
+	// prefix of positions if only the prefix matters. If it is nil, the
+	// result is never forgotten.
+	bound []*pb.Value
+}
+
+// A seenHeap is a heap of seen results, ordered by their bounds. Those with
+// nil bounds come last.
+type seenHeap struct {
+	m     *merger
+	items []*seenResult
+}
+
+func (h *seenHeap) Len() int      { return len(h.items) }
+func (h *seenHeap) Swap(i, j int) { h.items[i], h.items[j] = h.items[j], h.items[i] }
+func (h *seenHeap) Less(i, j int) bool {
+	a, b := h.items[i].bound, h.items[j].bound
+	if a == nil || b == nil {
+		return b == nil && a != nil
+	}
+	return h.m.compare(a, b) < 0
+}
+func (h *seenHeap) Push(x interface{}) { h.items = append(h.items, x.(*seenResult)) }
+func (h *seenHeap) Pop() interface{} {
+	x := h.items[len(h.items)-1]
+	h.items = h.items[:len(h.items)-1]
+	return x
+}
+
+// A mergeSource is one of the queries that a merger merges.
+type mergeSource struct {
+	it      *Iterator
+	filters []*pb.PropertyFilter
+	done    bool
+	cursor  []byte // the position of the query before its current result
+
+	// The current result.
+	key *Key
+	e   *pb.Entity
+	pos []*pb.Value
+}
+
+func (m *merger) next() (*Key, *pb.Entity, error) {
+	if m.limit == 0 {
+		return nil, nil, iterator.Done
+	}
+	s, err := m.peek()
+	if err != nil {
+		return nil, nil, err
+	}
+	k, e := s.key, s.e
+	m.markSeen(s)
+	if err := m.pop(s); err != nil {
+		return nil, nil, err
+	}
+	if m.limit > 0 {
+		m.limit--
+	}
+	return k, e, nil
+}
+
+// peek returns the source whose current result is the next result of the
+// merged query, skipping duplicates and the results before the offset.
+func (m *merger) peek() (*mergeSource, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	if !m.started {
+		m.started = true
+		for _, s := range m.sources {
+			if !s.done {
+				if m.err = m.advance(s); m.err != nil {
+					return nil, m.err
+				}
+			}
+		}
+	}
+	for {
+		var best *mergeSource
+		for _, s := range m.sources {
+			if !s.done && (best == nil || m.compare(s.pos, best.pos) < 0) {
+				best = s
+			}
+		}
+		if best == nil {
+			return nil, iterator.Done
+		}
+		k := m.dedupeKey(best)
+		if !m.seen[k] && m.offset == 0 {
+			return best, nil
+		}
+		if !m.seen[k] {
+			m.markSeen(best)
+			m.offset--
+		}
+		if m.err = m.pop(best); m.err != nil {
+			return nil, m.err
+		}
+	}
+}
+
+// markSeen adds the current result of s to the seen results.
+func (m *merger) markSeen(s *mergeSource) {
+	r := &seenResult{key: m.dedupeKey(s)}
+	if len(m.distinctOn) > 0 {
+		// Results with the same values of the distinct properties are
+		// duplicates, and sources return them at positions with those
+		// values, if the query is ordered by the distinct properties first.
+		if m.orderedByDistinct() {
+			r.bound = s.pos[:len(m.distinctOn)]
+		}
+	} else {
+		// A source returns each entity, or each combination of the values of
+		// its projected properties, at most once, at the position given by
+		// its filters.
+		for _, o := range m.sources {
+			if o.done {
+				continue
+			}
+			if pos := m.position(o, s.e); r.bound == nil || m.compare(pos, r.bound) > 0 {
+				r.bound = pos
+			}
+		}
+	}
+	m.seen[r.key] = true
+	heap.Push(&m.forgettable, r)
+}
+
+// orderedByDistinct reports whether the first orders of the query are by the
+// properties of m.distinctOn.
+func (m *merger) orderedByDistinct() bool {
+	if len(m.orders) < len(m.distinctOn) {
+		return false
+	}
+	names := map[string]bool{}
+	for _, o := range m.orders[:len(m.distinctOn)] {
+		names[o.FieldName] = true
+	}
+	for _, name := range m.distinctOn {
+		if !names[name] {
+			return false
+		}
+	}
+	return true
+}
+
+// forget removes the seen results that no source can return any more.
+func (m *merger) forget() {
+	var least []*pb.Value
+	for _, s := range m.sources {
+		if !s.done && (least == nil || m.compare(s.pos, least) < 0) {
+			least = s.pos
+		}
+	}
+	h := &m.forgettable
+	for h.Len() > 0 {
+		r := h.items[0]
+		if least != nil && (r.bound == nil || m.compare(r.bound, least[:len(r.bound)]) >= 0) {
+			return
+		}
+		heap.Pop(h)
+		delete(m.seen, r.key)
+	}
+}
+
+// pop moves s, and every other source whose current result is the same as
+// that of s, to their next results.
+func (m *merger) pop(s *mergeSource) error {
+	k := m.dedupeKey(s)
+	pos := s.pos
+	for _, o := range m.sources {
+		if !o.done && (o == s || m.compare(o.pos, pos) == 0 && m.dedupeKey(o) == k) {
+			if err := m.advance(o); err != nil {
+				return err
+			}
+		}
+	}
+	m.forget()
+	return nil
+}
+
+// advance moves s to its next result.
+func (m *merger) advance(s *mergeSource) error {
+	s.cursor = s.it.entityCursor
+	k, e, err := s.it.next()
+	if err == iterator.Done {
+		s.done = true
+		s.cursor = s.it.entityCursor
+		s.key, s.e, s.pos = nil, nil, nil
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	s.key, s.e = k, e
+	s.pos = m.position(s, e)
+	return nil
+}
+
+// position returns the position at which the query of s returns e, if it
+// does: the values that e is sorted by, followed by its key.
+func (m *merger) position(s *mergeSource, e *pb.Entity) []*pb.Value {
+	pos := make([]*pb.Value, 0, len(m.orders)+1)
+	for _, o := range m.orders {
+		pos = append(pos, s.sortValue(e, o))
+	}
+	return append(pos, &pb.Value{ValueType: &pb.Value_KeyValue{KeyValue: e.Key}})
+}
+
+// sortValue returns the value of e that Datastore sorts it by for o in the
+// query of s: the least or greatest of the indexed values of the property
+// that satisfy the query's filters.
+func (s *mergeSource) sortValue(e *pb.Entity, o order) *pb.Value {
+	if o.FieldName == keyFieldName {
+		return &pb.Value{ValueType: &pb.Value_KeyValue{KeyValue: e.Key}}
+	}
+	var best *pb.Value
+	for _, v := range pbvalue.PropertyValues(e.Properties, o.FieldName) {
+		if !s.satisfies(o.FieldName, v) {
+			continue
+		}
+		if best == nil {
+			best = v
+			continue
+		}
+		c := pbvalue.Compare(v, best)
+		if o.Direction == descending {
+			c = -c
+		}
+		if c < 0 {
+			best = v
+		}
+	}
+	if best == nil {
+		best = &pb.Value{ValueType: &pb.Value_NullValue{}}
+	}
+	return best
+}
+
+// satisfies reports whether v, a value of the property name, satisfies the
+// query's filters on that property. Like Datastore, it requires a value to
+// satisfy every inequality filter, but only one of the equality filters.
+func (s *mergeSource) satisfies(name string, v *pb.Value) bool {
+	hasEq, eq := false, false
+	for _, f := range s.filters {
+		if f.Property.GetName() != name {
+			continue
+		}
+		c := pbvalue.Compare(v, f.Value)
+		switch f.Op {
+		case pb.PropertyFilter_EQUAL:
+			hasEq = true
+			eq = eq || c == 0
+		case pb.PropertyFilter_LESS_THAN:
+			if c >= 0 {
+				return false
+			}
+		case pb.PropertyFilter_LESS_THAN_OR_EQUAL:
+			if c > 0 {
+				return false
+			}
+		case pb.PropertyFilter_GREATER_THAN:
+			if c <= 0 {
+				return false
+			}
+		case pb.PropertyFilter_GREATER_THAN_OR_EQUAL:
+			if c < 0 {
+				return false
+			}
+		}
+	}
+	return !hasEq || eq
+}
+
+func (m *merger) compare(a, b []*pb.Value) int {
+	for i := range a {
+		c := pbvalue.Compare(a[i], b[i])
+		if i < len(m.orders) && m.orders[i].Direction == descending {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// dedupeKey returns a string that is the same for the current results of
+// sources that are duplicates of each other.
+func (m *merger) dedupeKey(s *mergeSource) string {
+	var vs []*pb.Value
+	switch {
+	case len(m.distinctOn) > 0:
+		for _, name := range m.distinctOn {
+			vs = append(vs, s.e.Properties[name])
+		}
+	case m.projection:
+		// An entity has a result for each combination of the values of
+		// its projected properties.
+		vs = append(vs, &pb.Value{ValueType: &pb.Value_KeyValue{KeyValue: s.e.Key}})
+		names := make([]string, 0, len(s.e.Properties))
+		for name := range s.e.Properties {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			vs = append(vs, &pb.Value{ValueType: &pb.Value_StringValue{StringValue: name}}, s.e.Properties[name])
+		}
+	default:
+		vs = append(vs, &pb.Value{ValueType: &pb.Value_KeyValue{KeyValue: s.e.Key}})
+	}
+	b, err := proto.Marshal(&pb.Value{ValueType: &pb.Value_ArrayValue{ArrayValue: &pb.ArrayValue{Values: vs}}})
+	if err != nil {
+		panic(err)
+	}
+	return string(b)
+}
+
+// mergedCursorTag starts a merged cursor, so that cursors of other queries
+// are not mistaken for one.
+const mergedCursorTag = "datastore.merged"
+
+// cursor returns a cursor holding the position of each source before its
+// current result, followed by the seen results. A source that has no
+// position is encoded as an empty blob if it has not started, and as null if
+// it has finished. Each seen result is encoded as an array of its dedupe key
+// and its bound, or null if it has none.
+func (m *merger) cursor() ([]byte, error) {
+	// A query with a limit of zero never starts its sources.
+	if m.started || m.limit != 0 {
+		if _, err := m.peek(); err != nil && err != iterator.Done {
+			return nil, err
+		}
+	}
+	vs := []*pb.Value{{ValueType: &pb.Value_StringValue{StringValue: mergedCursorTag}}}
+	for _, s := range m.sources {
+		v := &pb.Value{ValueType: &pb.Value_BlobValue{BlobValue: s.cursor}}
+		if s.cursor == nil && s.done {
+			v = &pb.Value{ValueType: &pb.Value_NullValue{}}
+		}
+		vs = append(vs, v)
+	}
+	var seen []*pb.Value
+	for _, r := range m.forgettable.items {
+		bound := &pb.Value{ValueType: &pb.Value_NullValue{}}
+		if r.bound != nil {
+			bound = &pb.Value{ValueType: &pb.Value_ArrayValue{ArrayValue: &pb.ArrayValue{Values: r.bound}}}
+		}
+		seen = append(seen, &pb.Value{ValueType: &pb.Value_ArrayValue{ArrayValue: &pb.ArrayValue{Values: []*pb.Value{
+			{ValueType: &pb.Value_BlobValue{BlobValue: []byte(r.key)}},
+			bound,
+		}}}})
+	}
+	vs = append(vs, &pb.Value{ValueType: &pb.Value_ArrayValue{ArrayValue: &pb.ArrayValue{Values: seen}}})
+	return proto.Marshal(&pb.Value{ValueType: &pb.Value_ArrayValue{ArrayValue: &pb.ArrayValue{Values: vs}}})
+}
+
+// decodeMergedCursor returns the positions of the n sources in the cursor c,
+// and the seen results, whose bounds have at most posLen values, or nil if c
+// is empty. A nil position means that the source had finished without one,
+// and an empty position that it had not started.
+func decodeMergedCursor(c []byte, n, posLen int) ([][]byte, []*seenResult, error) {
+	if len(c) == 0 {
+		return nil, nil, nil
+	}
+	errBad := errors.New("datastore: cursor does not belong to a query with OR, in, != or not-in filters")
+	var v pb.Value
+	if err := proto.Unmarshal(c, &v); err != nil {
+		return nil, nil, errBad
+	}
+	vs := v.GetArrayValue().GetValues()
+	if len(vs) != n+2 || vs[0].GetStringValue() != mergedCursorTag {
+		return nil, nil, errBad
+	}
+	res := make([][]byte, n)
+	for i, v := range vs[1 : n+1] {
+		switch v := v.ValueType.(type) {
+		case *pb.Value_BlobValue:
+			res[i] = v.BlobValue
+			if res[i] == nil {
+				res[i] = []byte{}
+			}
+		case *pb.Value_NullValue:
+		default:
+			return nil, nil, errBad
+		}
+	}
+	var seen []*seenResult
+	for _, v := range vs[n+1].GetArrayValue().GetValues() {
+		rv := v.GetArrayValue().GetValues()
+		if len(rv) != 2 {
+			return nil, nil, errBad
+		}
+		r := &seenResult{key: string(rv[0].GetBlobValue())}
+		switch b := rv[1].ValueType.(type) {
+		case *pb.Value_ArrayValue:
+			r.bound = b.ArrayValue.Values
+			if len(r.bound) == 0 || len(r.bound) > posLen {
+				return nil, nil, errBad
+			}
+		case *pb.Value_NullValue:
+		default:
+			return nil, nil, errBad
+		}
+		seen = append(seen, r)
+	}
+	return res, seen, nil
+}
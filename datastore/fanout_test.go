@@ -0,0 +1,294 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datastore
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/smyte/google-cloud-go/datastore/dstest"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+)
+
+type fanoutItem struct {
+	N int
+	T []string
+}
+
+// newFakeClient returns a client of a new fake server, and a function that
+// closes them.
+func newFakeClient(ctx context.Context, t *testing.T, opts ...option.ClientOption) (*Client, func()) {
+	srv, err := dstest.NewServer("localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts = append([]option.ClientOption{
+		option.WithEndpoint(srv.Addr),
+		option.WithoutAuthentication(),
+		option.WithGRPCDialOption(grpc.WithInsecure()),
+	}, opts...)
+	client, err := NewClient(ctx, "P", opts...)
+	if err != nil {
+		srv.Close()
+		t.Fatal(err)
+	}
+	return client, func() {
+		client.Close()
+		srv.Close()
+	}
+}
+
+// newFanoutClient returns a client of a fake server holding six fanoutItems
+// with IDs 1 to 6.
+func newFanoutClient(ctx context.Context, t *testing.T) (*Client, func()) {
+	client, done := newFakeClient(ctx, t)
+	items := []*fanoutItem{
+		{N: 3, T: []string{"a"}},
+		{N: 1, T: []string{"b"}},
+		{N: 5, T: []string{"a", "b"}},
+		{N: 2, T: []string{"c"}},
+		{N: 4},
+		{N: 3, T: []string{"b"}},
+	}
+	keys := make([]*Key, len(items))
+	for i := range keys {
+		keys[i] = IDKey("Item", int64(i+1), nil)
+	}
+	if _, err := client.PutMulti(ctx, keys, items); err != nil {
+		done()
+		t.Fatal(err)
+	}
+	return client, done
+}
+
+func keyIDs(keys []*Key) []int64 {
+	ids := []int64{}
+	for _, k := range keys {
+		ids = append(ids, k.ID)
+	}
+	return ids
+}
+
+func TestFanoutQueries(t *testing.T) {
+	ctx := context.Background()
+	client, done := newFanoutClient(ctx, t)
+	defer done()
+
+	for _, test := range []struct {
+		desc string
+		q    *Query
+		want []int64
+	}{
+		{"!=", NewQuery("Item").Filter("N !=", 3), []int64{2, 4, 5, 3}},
+		{"in", NewQuery("Item").Filter("N in", []int{5, 1, 3}), []int64{1, 2, 3, 6}},
+		{"in, ordered", NewQuery("Item").Filter("N IN", []int{5, 1, 3}).Order("-N"), []int64{3, 1, 6, 2}},
+		{"in, empty", NewQuery("Item").Filter("N in", []int{}), []int64{}},
+		{"not-in", NewQuery("Item").Filter("N not-in", []int{4, 2, 4}), []int64{2, 1, 6, 3}},
+		{"in, multi-valued", NewQuery("Item").Filter("T in", []string{"a", "b"}), []int64{1, 2, 3, 6}},
+		{"in, ordered by multi-valued", NewQuery("Item").Filter("T in", []string{"a", "b"}).Order("T"), []int64{1, 3, 2, 6}},
+		{"or", NewQuery("Item").FilterEntity(OrFilter{Filters: []EntityFilter{
+			PropertyFilter{FieldName: "N", Operator: "=", Value: 4},
+			PropertyFilter{FieldName: "T", Operator: "=", Value: "c"},
+		}}), []int64{4, 5}},
+		{"or of and", NewQuery("Item").FilterEntity(OrFilter{Filters: []EntityFilter{
+			AndFilter{Filters: []EntityFilter{
+				PropertyFilter{FieldName: "N", Operator: ">=", Value: 3},
+				PropertyFilter{FieldName: "N", Operator: "<", Value: 5},
+			}},
+			PropertyFilter{FieldName: "N", Operator: "=", Value: 1},
+		}}), []int64{2, 1, 6, 5}},
+		{"and with Filter", NewQuery("Item").Filter("N >", 1).FilterEntity(OrFilter{Filters: []EntityFilter{
+			PropertyFilter{FieldName: "T", Operator: "=", Value: "b"},
+			PropertyFilter{FieldName: "T", Operator: "=", Value: "c"},
+		}}), []int64{4, 6, 3}},
+		{"offset and limit", NewQuery("Item").Filter("N !=", 3).Offset(1).Limit(2), []int64{4, 5}},
+	} {
+		keys, err := client.GetAll(ctx, test.q.KeysOnly(), nil)
+		if err != nil {
+			t.Errorf("%s: %v", test.desc, err)
+			continue
+		}
+		if got := keyIDs(keys); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.desc, got, test.want)
+		}
+		n, err := client.Count(ctx, test.q)
+		if err != nil {
+			t.Errorf("%s: Count: %v", test.desc, err)
+			continue
+		}
+		if n != len(test.want) {
+			t.Errorf("%s: Count: got %d, want %d", test.desc, n, len(test.want))
+		}
+	}
+
+	var items []fanoutItem
+	if _, err := client.GetAll(ctx, NewQuery("Item").Filter("N in", []int{1, 2}), &items); err != nil {
+		t.Fatal(err)
+	}
+	if want := []fanoutItem{{N: 1, T: []string{"b"}}, {N: 2, T: []string{"c"}}}; !reflect.DeepEqual(items, want) {
+		t.Errorf("got %+v, want %+v", items, want)
+	}
+}
+
+func TestFanoutQueryCursors(t *testing.T) {
+	ctx := context.Background()
+	client, done := newFanoutClient(ctx, t)
+	defer done()
+
+	q := NewQuery("Item").Filter("N not-in", []int{1}).Order("N").KeysOnly()
+	var got []int64
+	var cursors []Cursor
+	var c Cursor
+	for page := 0; ; page++ {
+		if page > 5 {
+			t.Fatal("too many pages")
+		}
+		it := client.Run(ctx, q.Start(c).Limit(2))
+		n := 0
+		for {
+			k, err := it.Next(nil)
+			if err == iterator.Done {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, k.ID)
+			n++
+		}
+		if n == 0 {
+			break
+		}
+		var err error
+		if c, err = it.Cursor(); err != nil {
+			t.Fatal(err)
+		}
+		cursors = append(cursors, c)
+	}
+	if want := []int64{4, 1, 6, 5, 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("paged: got %v, want %v", got, want)
+	}
+
+	keys, err := client.GetAll(ctx, q.End(cursors[0]), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := keyIDs(keys), []int64{4, 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("End: got %v, want %v", got, want)
+	}
+	keys, err = client.GetAll(ctx, q.Start(cursors[0]).End(cursors[1]), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := keyIDs(keys), []int64{6, 5}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Start and End: got %v, want %v", got, want)
+	}
+
+	// A cursor of an unsplit query cannot be used with a split one.
+	it := client.Run(ctx, NewQuery("Item").KeysOnly())
+	if _, err := it.Next(nil); err != nil {
+		t.Fatal(err)
+	}
+	plain, err := it.Cursor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.GetAll(ctx, q.Start(plain), nil); err == nil {
+		t.Error("merged query with a plain cursor: got nil, want error")
+	}
+}
+
+func TestFanoutQueryCursorsMultiValued(t *testing.T) {
+	ctx := context.Background()
+	client, done := newFanoutClient(ctx, t)
+	defer done()
+
+	// Item 3 has T values a and b, so both queries return it.
+	q := NewQuery("Item").Filter("T in", []string{"a", "b"}).Order("T").KeysOnly()
+	want := []int64{1, 3, 2, 6}
+	keys, err := client.GetAll(ctx, q, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := keyIDs(keys); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	// Resuming after item 3 does not return it again.
+	for n := 0; n <= len(want); n++ {
+		it := client.Run(ctx, q.Limit(n))
+		var got []int64
+		for {
+			k, err := it.Next(nil)
+			if err == iterator.Done {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, k.ID)
+			// Only item 3 can be returned again, and only until the
+			// query for b has passed it.
+			if len(it.merge.seen) > 1 {
+				t.Errorf("after %v: %d seen results, want at most 1", got, len(it.merge.seen))
+			}
+		}
+		c, err := it.Cursor()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys, err := client.GetAll(ctx, q.Start(c), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, keyIDs(keys)...)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("resumed after %d: got %v, want %v", n, got, want)
+		}
+	}
+}
+
+func TestFanoutQueryErrors(t *testing.T) {
+	ctx := context.Background()
+	client, done := newFanoutClient(ctx, t)
+	defer done()
+
+	var many []int
+	for i := 0; i <= maxSubqueries; i++ {
+		many = append(many, i)
+	}
+	for _, test := range []struct {
+		desc string
+		q    *Query
+	}{
+		{"in of a non-slice", NewQuery("Item").Filter("N in", 3)},
+		{"not-in of a []byte", NewQuery("Item").Filter("N not-in", []byte("x"))},
+		{"too many sub-queries", NewQuery("Item").Filter("N in", many)},
+		{"too many sub-queries in product", NewQuery("Item").Filter("N in", many[:6]).Filter("T in", []string{"a", "b", "c", "d", "e", "f"})},
+		{"empty OrFilter", NewQuery("Item").FilterEntity(OrFilter{})},
+		{"nil filter", NewQuery("Item").FilterEntity(AndFilter{Filters: []EntityFilter{nil}})},
+		{"bad operator", NewQuery("Item").FilterEntity(PropertyFilter{FieldName: "N", Operator: "~", Value: 1})},
+		{"inequalities on different properties", NewQuery("Item").FilterEntity(OrFilter{Filters: []EntityFilter{
+			PropertyFilter{FieldName: "N", Operator: "<", Value: 1},
+			PropertyFilter{FieldName: "T", Operator: ">", Value: "a"},
+		}})},
+	} {
+		if _, err := client.GetAll(ctx, test.q.KeysOnly(), nil); err == nil {
+			t.Errorf("%s: got nil, want error", test.desc)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datastore
+
+import (
+	"context"
+	"sync"
+
+	"github.com/smyte/google-cloud-go/datastore/internal/index"
+	"google.golang.org/api/option"
+	pb "google.golang.org/genproto/googleapis/datastore/v1"
+	"google.golang.org/grpc"
+)
+
+// An IndexAdvisor works out the composite indexes that queries need, so that
+// they can be checked against an app's index.yaml before it is deployed,
+// rather than failing in production for lack of an index.
+//
+// Queries can be added explicitly with Add, or recorded as a Client runs them
+// by creating the Client with the option returned by ClientOption.
+//
+// An IndexAdvisor is safe for concurrent use.
+type IndexAdvisor struct {
+	mu      sync.Mutex
+	indexes []*index.Index
+}
+
+// NewIndexAdvisor returns an IndexAdvisor that has seen no queries.
+func NewIndexAdvisor() *IndexAdvisor {
+	return &IndexAdvisor{}
+}
+
+// Add records the composite indexes, if any, that q needs. A query with OR,
+// in, != or not-in filters needs the indexes of the queries that it is split
+// into.
+func (a *IndexAdvisor) Add(q *Query) error {
+	if q.err != nil {
+		return q.err
+	}
+	subs, err := q.split()
+	if err != nil {
+		return err
+	}
+	if subs == nil {
+		subs = []*Query{q}
+	}
+	for _, sub := range subs {
+		req := &pb.RunQueryRequest{}
+		if err := sub.toProto(req); err != nil {
+			return err
+		}
+		a.add(req.GetQuery())
+	}
+	return nil
+}
+
+func (a *IndexAdvisor) add(q *pb.Query) {
+	ix := index.Required(q)
+	if ix == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, seen := range a.indexes {
+		if seen.Satisfies(ix) {
+			return
+		}
+	}
+	a.indexes = append(a.indexes, ix)
+}
+
+// ClientOption returns an option for NewClient that makes the Client record
+// the indexes needed by the queries it runs in a.
+//
+// The option has no effect if it is combined with option.WithGRPCConn.
+func (a *IndexAdvisor) ClientOption() option.ClientOption {
+	return option.WithGRPCDialOption(grpc.WithChainUnaryInterceptor(a.intercept))
+}
+
+func (a *IndexAdvisor) intercept(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	if r, ok := req.(*pb.RunQueryRequest); ok {
+		if q := r.GetQuery(); q != nil {
+			a.add(q)
+		}
+	}
+	return invoker(ctx, method, req, reply, cc, opts...)
+}
+
+// IndexYAML returns an index.yaml file declaring the composite indexes that
+// the queries seen so far need, in the order in which they were first needed.
+func (a *IndexAdvisor) IndexYAML() []byte {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return index.Format(a.indexes)
+}
+
+// MissingIndexes parses indexYAML, the contents of an index.yaml file, and
+// returns an index.yaml file declaring the indexes that it lacks to serve the
+// queries seen so far. It returns nil if indexYAML declares every index that
+// is needed.
+func (a *IndexAdvisor) MissingIndexes(indexYAML []byte) ([]byte, error) {
+	declared, err := index.Parse(indexYAML)
+	if err != nil {
+		return nil, err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var missing []*index.Index
+	for _, ix := range a.indexes {
+		found := false
+		for _, d := range declared {
+			if d.Satisfies(ix) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, ix)
+		}
+	}
+	if len(missing) == 0 {
+		return nil, nil
+	}
+	return index.Format(missing), nil
+}
@@ -0,0 +1,131 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datastore
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+
+	"github.com/smyte/google-cloud-go/datastore/dstest"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+)
+
+func TestIndexAdvisor(t *testing.T) {
+	parent := NameKey("SQParent", "p", nil)
+	a := NewIndexAdvisor()
+	for _, q := range []*Query{
+		NewQuery("SQChild").Ancestor(parent).Filter("T=", 1).Order("I"),
+		NewQuery("SQChild").Filter("T=", 1).Filter("I=", 2),             // built-in
+		NewQuery("SQChild").Order("-I"),                                 // built-in
+		NewQuery("SQChild").Ancestor(parent).Filter("T=", 1).Order("I"), // duplicate
+		NewQuery("SQChild").Filter("U>", 1).Order("U").Order("-T"),
+		NewQuery("SQChild").Project("I", "J"),
+	} {
+		if err := a.Add(q); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := a.Add(NewQuery("SQChild").Filter("A ~", 1)); err == nil {
+		t.Error("Add of a bad query: got nil, want error")
+	}
+
+	const want = `indexes:
+
+- kind: SQChild
+  ancestor: yes
+  properties:
+  - name: T
+  - name: I
+
+- kind: SQChild
+  properties:
+  - name: U
+  - name: T
+    direction: desc
+
+- kind: SQChild
+  properties:
+  - name: I
+  - name: J
+`
+	if got := string(a.IndexYAML()); got != want {
+		t.Errorf("IndexYAML: got\n%s\nwant\n%s", got, want)
+	}
+
+	declared, err := ioutil.ReadFile("testdata/index.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	missing, err := a.MissingIndexes(declared)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const wantMissing = `indexes:
+
+- kind: SQChild
+  properties:
+  - name: U
+  - name: T
+    direction: desc
+
+- kind: SQChild
+  properties:
+  - name: I
+  - name: J
+`
+	if string(missing) != wantMissing {
+		t.Errorf("MissingIndexes: got\n%s\nwant\n%s", missing, wantMissing)
+	}
+	if missing, err := a.MissingIndexes(a.IndexYAML()); err != nil || missing != nil {
+		t.Errorf("MissingIndexes of its own indexes: got (%q, %v), want (nil, nil)", missing, err)
+	}
+}
+
+func TestIndexAdvisorClientOption(t *testing.T) {
+	ctx := context.Background()
+	srv, err := dstest.NewServer("localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	a := NewIndexAdvisor()
+	client, err := NewClient(ctx, "P",
+		option.WithEndpoint(srv.Addr),
+		option.WithoutAuthentication(),
+		option.WithGRPCDialOption(grpc.WithInsecure()),
+		a.ClientOption())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if _, err := client.GetAll(ctx, NewQuery("K").Filter("A=", 1).Order("-B").KeysOnly(), nil); err != nil {
+		t.Fatal(err)
+	}
+	const want = `indexes:
+
+- kind: K
+  properties:
+  - name: A
+  - name: B
+    direction: desc
+`
+	if got := string(a.IndexYAML()); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package aggpb is a subset of the google.datastore.v1 protobufs for the
+// RunAggregationQuery method, which the version of
+// google.golang.org/genproto/googleapis/datastore/v1 that this module depends
+// on predates. They are written by hand to match the wire format of the
+// generated messages, except that the members of each oneof are plain fields,
+// of which at most one may be set.
+//
+// The package also computes aggregation results, for servers that do not
+// implement the method.
+package aggpb
+
+import (
+	"github.com/golang/protobuf/proto"
+	wrapperspb "github.com/golang/protobuf/ptypes/wrappers"
+	pb "google.golang.org/genproto/googleapis/datastore/v1"
+)
+
+// RunAggregationQueryMethod is the full name of the RunAggregationQuery
+// method, for grpc.ClientConn.Invoke.
+const RunAggregationQueryMethod = "/google.datastore.v1.Datastore/RunAggregationQuery"
+
+// RunAggregationQueryRequest is the request for RunAggregationQuery.
+type RunAggregationQueryRequest struct {
+	ReadOptions      *pb.ReadOptions   `protobuf:"bytes,1,opt,name=read_options,json=readOptions,proto3" json:"read_options,omitempty"`
+	PartitionId      *pb.PartitionId   `protobuf:"bytes,2,opt,name=partition_id,json=partitionId,proto3" json:"partition_id,omitempty"`
+	AggregationQuery *AggregationQuery `protobuf:"bytes,3,opt,name=aggregation_query,json=aggregationQuery,proto3" json:"aggregation_query,omitempty"`
+	ProjectId        string            `protobuf:"bytes,8,opt,name=project_id,json=projectId,proto3" json:"project_id,omitempty"`
+}
+
+func (m *RunAggregationQueryRequest) Reset()         { *m = RunAggregationQueryRequest{} }
+func (m *RunAggregationQueryRequest) String() string { return proto.CompactTextString(m) }
+func (*RunAggregationQueryRequest) ProtoMessage()    {}
+
+// RunAggregationQueryResponse is the response for RunAggregationQuery.
+type RunAggregationQueryResponse struct {
+	Batch *AggregationResultBatch `protobuf:"bytes,1,opt,name=batch,proto3" json:"batch,omitempty"`
+	Query *AggregationQuery       `protobuf:"bytes,2,opt,name=query,proto3" json:"query,omitempty"`
+}
+
+func (m *RunAggregationQueryResponse) Reset()         { *m = RunAggregationQueryResponse{} }
+func (m *RunAggregationQueryResponse) String() string { return proto.CompactTextString(m) }
+func (*RunAggregationQueryResponse) ProtoMessage()    {}
+
+func (m *RunAggregationQueryResponse) GetBatch() *AggregationResultBatch {
+	if m != nil {
+		return m.Batch
+	}
+	return nil
+}
+
+// AggregationQuery computes aggregations over the results of a query.
+type AggregationQuery struct {
+	NestedQuery  *pb.Query      `protobuf:"bytes,1,opt,name=nested_query,json=nestedQuery,proto3" json:"nested_query,omitempty"`
+	Aggregations []*Aggregation `protobuf:"bytes,3,rep,name=aggregations,proto3" json:"aggregations,omitempty"`
+}
+
+func (m *AggregationQuery) Reset()         { *m = AggregationQuery{} }
+func (m *AggregationQuery) String() string { return proto.CompactTextString(m) }
+func (*AggregationQuery) ProtoMessage()    {}
+
+func (m *AggregationQuery) GetNestedQuery() *pb.Query {
+	if m != nil {
+		return m.NestedQuery
+	}
+	return nil
+}
+
+func (m *AggregationQuery) GetAggregations() []*Aggregation {
+	if m != nil {
+		return m.Aggregations
+	}
+	return nil
+}
+
+// Aggregation is a single aggregation, whose result is named by Alias.
+// Exactly one of Count, Sum and Avg is set.
+type Aggregation struct {
+	Count *Aggregation_Count `protobuf:"bytes,1,opt,name=count,proto3" json:"count,omitempty"`
+	Sum   *Aggregation_Sum   `protobuf:"bytes,2,opt,name=sum,proto3" json:"sum,omitempty"`
+	Avg   *Aggregation_Avg   `protobuf:"bytes,3,opt,name=avg,proto3" json:"avg,omitempty"`
+	Alias string             `protobuf:"bytes,7,opt,name=alias,proto3" json:"alias,omitempty"`
+}
+
+func (m *Aggregation) Reset()         { *m = Aggregation{} }
+func (m *Aggregation) String() string { return proto.CompactTextString(m) }
+func (*Aggregation) ProtoMessage()    {}
+
+// Aggregation_Count counts the results of the query, up to UpTo if it is
+// set.
+type Aggregation_Count struct {
+	UpTo *wrapperspb.Int64Value `protobuf:"bytes,1,opt,name=up_to,json=upTo,proto3" json:"up_to,omitempty"`
+}
+
+func (m *Aggregation_Count) Reset()         { *m = Aggregation_Count{} }
+func (m *Aggregation_Count) String() string { return proto.CompactTextString(m) }
+func (*Aggregation_Count) ProtoMessage()    {}
+
+// Aggregation_Sum sums the numeric values of a property.
+type Aggregation_Sum struct {
+	Property *pb.PropertyReference `protobuf:"bytes,1,opt,name=property,proto3" json:"property,omitempty"`
+}
+
+func (m *Aggregation_Sum) Reset()         { *m = Aggregation_Sum{} }
+func (m *Aggregation_Sum) String() string { return proto.CompactTextString(m) }
+func (*Aggregation_Sum) ProtoMessage()    {}
+
+// Aggregation_Avg averages the numeric values of a property.
+type Aggregation_Avg struct {
+	Property *pb.PropertyReference `protobuf:"bytes,1,opt,name=property,proto3" json:"property,omitempty"`
+}
+
+func (m *Aggregation_Avg) Reset()         { *m = Aggregation_Avg{} }
+func (m *Aggregation_Avg) String() string { return proto.CompactTextString(m) }
+func (*Aggregation_Avg) ProtoMessage()    {}
+
+// AggregationResultBatch is a batch of aggregation results. Datastore
+// returns a single result.
+type AggregationResultBatch struct {
+	AggregationResults []*AggregationResult                `protobuf:"bytes,1,rep,name=aggregation_results,json=aggregationResults,proto3" json:"aggregation_results,omitempty"`
+	MoreResults        pb.QueryResultBatch_MoreResultsType `protobuf:"varint,2,opt,name=more_results,json=moreResults,proto3,enum=google.datastore.v1.QueryResultBatch_MoreResultsType" json:"more_results,omitempty"`
+}
+
+func (m *AggregationResultBatch) Reset()         { *m = AggregationResultBatch{} }
+func (m *AggregationResultBatch) String() string { return proto.CompactTextString(m) }
+func (*AggregationResultBatch) ProtoMessage()    {}
+
+func (m *AggregationResultBatch) GetAggregationResults() []*AggregationResult {
+	if m != nil {
+		return m.AggregationResults
+	}
+	return nil
+}
+
+// AggregationResult holds the result of each aggregation, by alias.
+type AggregationResult struct {
+	AggregateProperties map[string]*pb.Value `protobuf:"bytes,2,rep,name=aggregate_properties,json=aggregateProperties,proto3" json:"aggregate_properties,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+}
+
+func (m *AggregationResult) Reset()         { *m = AggregationResult{} }
+func (m *AggregationResult) String() string { return proto.CompactTextString(m) }
+func (*AggregationResult) ProtoMessage()    {}
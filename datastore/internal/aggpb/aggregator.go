@@ -0,0 +1,115 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggpb
+
+import (
+	pb "google.golang.org/genproto/googleapis/datastore/v1"
+)
+
+// An Aggregator computes the results of aggregations from the entities that
+// a query returns, as Datastore does.
+//
+// A count is the number of entities. A sum or average is over the integer and
+// double values of a property, ignoring other values and arrays. A sum is an
+// integer if all the values are integers and it does not overflow, and a
+// double otherwise. An average is a double, or null if there are no values.
+type Aggregator struct {
+	aggs  []*Aggregation
+	count int64
+	sums  []sum
+}
+
+type sum struct {
+	n     int64 // the number of values
+	i     int64
+	f     float64
+	float bool // whether the sum is f rather than i
+}
+
+// NewAggregator returns an Aggregator for aggs that has seen no entities.
+func NewAggregator(aggs []*Aggregation) *Aggregator {
+	return &Aggregator{aggs: aggs, sums: make([]sum, len(aggs))}
+}
+
+// Add adds an entity with the properties props to the aggregations.
+func (a *Aggregator) Add(props map[string]*pb.Value) {
+	a.count++
+	for i, agg := range a.aggs {
+		switch {
+		case agg.Sum != nil:
+			a.sums[i].add(props[agg.Sum.Property.GetName()])
+		case agg.Avg != nil:
+			a.sums[i].add(props[agg.Avg.Property.GetName()])
+		}
+	}
+}
+
+func (s *sum) add(v *pb.Value) {
+	switch v := v.GetValueType().(type) {
+	case *pb.Value_IntegerValue:
+		s.n++
+		if s.float {
+			s.f += float64(v.IntegerValue)
+			return
+		}
+		r := s.i + v.IntegerValue
+		if (r > s.i) != (v.IntegerValue > 0) {
+			// The sum overflows.
+			s.f, s.float = float64(s.i)+float64(v.IntegerValue), true
+			return
+		}
+		s.i = r
+	case *pb.Value_DoubleValue:
+		s.n++
+		if !s.float {
+			s.f, s.float = float64(s.i), true
+		}
+		s.f += v.DoubleValue
+	}
+}
+
+// Result returns the results of the aggregations over the entities added so
+// far.
+func (a *Aggregator) Result() *AggregationResult {
+	props := make(map[string]*pb.Value, len(a.aggs))
+	for i, agg := range a.aggs {
+		s := a.sums[i]
+		var v *pb.Value
+		switch {
+		case agg.Count != nil:
+			n := a.count
+			if upTo := agg.Count.UpTo; upTo != nil && upTo.Value < n {
+				n = upTo.Value
+			}
+			v = &pb.Value{ValueType: &pb.Value_IntegerValue{IntegerValue: n}}
+		case agg.Sum != nil && s.float:
+			v = &pb.Value{ValueType: &pb.Value_DoubleValue{DoubleValue: s.f}}
+		case agg.Sum != nil:
+			v = &pb.Value{ValueType: &pb.Value_IntegerValue{IntegerValue: s.i}}
+		case agg.Avg != nil && s.n == 0:
+			v = &pb.Value{ValueType: &pb.Value_NullValue{}}
+		case agg.Avg != nil:
+			f := s.f
+			if !s.float {
+				f = float64(s.i)
+			}
+			v = &pb.Value{ValueType: &pb.Value_DoubleValue{DoubleValue: f / float64(s.n)}}
+		default:
+			continue
+		}
+		props[agg.Alias] = v
+	}
+	return &AggregationResult{AggregateProperties: props}
+}
@@ -0,0 +1,99 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aggpb
+
+import (
+	"math"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	wrapperspb "github.com/golang/protobuf/ptypes/wrappers"
+	pb "google.golang.org/genproto/googleapis/datastore/v1"
+)
+
+func intValue(i int64) *pb.Value {
+	return &pb.Value{ValueType: &pb.Value_IntegerValue{IntegerValue: i}}
+}
+
+func doubleValue(f float64) *pb.Value {
+	return &pb.Value{ValueType: &pb.Value_DoubleValue{DoubleValue: f}}
+}
+
+func TestAggregator(t *testing.T) {
+	prop := func(name string) *pb.PropertyReference { return &pb.PropertyReference{Name: name} }
+	a := NewAggregator([]*Aggregation{
+		{Alias: "count", Count: &Aggregation_Count{}},
+		{Alias: "upTo", Count: &Aggregation_Count{UpTo: &wrapperspb.Int64Value{Value: 2}}},
+		{Alias: "sumI", Sum: &Aggregation_Sum{Property: prop("I")}},
+		{Alias: "sumBig", Sum: &Aggregation_Sum{Property: prop("Big")}},
+		{Alias: "avgBig", Avg: &Aggregation_Avg{Property: prop("Big")}},
+		{Alias: "avgNone", Avg: &Aggregation_Avg{Property: prop("None")}},
+	})
+	for _, props := range []map[string]*pb.Value{
+		{"I": intValue(1), "Big": intValue(math.MaxInt64)},
+		{"I": intValue(-3), "Big": intValue(math.MaxInt64), "None": {ValueType: &pb.Value_StringValue{StringValue: "x"}}},
+		{"I": {ValueType: &pb.Value_ArrayValue{ArrayValue: &pb.ArrayValue{Values: []*pb.Value{intValue(5)}}}}},
+	} {
+		a.Add(props)
+	}
+	got := a.Result().AggregateProperties
+	want := map[string]*pb.Value{
+		"count":   intValue(3),
+		"upTo":    intValue(2),
+		"sumI":    intValue(-2),
+		"sumBig":  doubleValue(2 * float64(math.MaxInt64)),
+		"avgBig":  doubleValue(float64(math.MaxInt64)),
+		"avgNone": {ValueType: &pb.Value_NullValue{}},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d results, want %d", len(got), len(want))
+	}
+	for alias, w := range want {
+		if !proto.Equal(got[alias], w) {
+			t.Errorf("%s: got %v, want %v", alias, got[alias], w)
+		}
+	}
+}
+
+func TestMarshal(t *testing.T) {
+	// Aggregation_Count has no set fields, so only the presence of the Count
+	// field distinguishes the aggregations.
+	want := &RunAggregationQueryResponse{
+		Batch: &AggregationResultBatch{
+			AggregationResults: []*AggregationResult{{
+				AggregateProperties: map[string]*pb.Value{"n": intValue(1)},
+			}},
+			MoreResults: pb.QueryResultBatch_NO_MORE_RESULTS,
+		},
+		Query: &AggregationQuery{
+			NestedQuery: &pb.Query{Kind: []*pb.KindExpression{{Name: "K"}}},
+			Aggregations: []*Aggregation{
+				{Alias: "n", Count: &Aggregation_Count{}},
+				{Alias: "s", Sum: &Aggregation_Sum{Property: &pb.PropertyReference{Name: "P"}}},
+			},
+		},
+	}
+	b, err := proto.Marshal(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := &RunAggregationQueryResponse{}
+	if err := proto.Unmarshal(b, got); err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
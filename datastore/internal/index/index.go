@@ -0,0 +1,277 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package index works out the composite indexes that Datastore queries need,
+// and reads and writes them in the index.yaml format.
+package index
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+
+	pb "google.golang.org/genproto/googleapis/datastore/v1"
+)
+
+const keyProperty = "__key__"
+
+// An Index is a composite index, as declared in index.yaml.
+type Index struct {
+	Kind       string
+	Ancestor   bool
+	Properties []Property
+
+	// eq is the number of leading properties that are used by equality
+	// filters, and so may be in any order. It is only set by Required.
+	eq int
+}
+
+// A Property is one of the properties of an Index.
+type Property struct {
+	Name       string
+	Descending bool
+}
+
+// Required returns the composite index that q needs, or nil if q can be served
+// by the built-in indexes.
+func Required(q *pb.Query) *Index {
+	if len(q.Kind) != 1 {
+		// Kindless queries can only filter and sort on keys.
+		return nil
+	}
+	ix := &Index{Kind: q.Kind[0].Name}
+	eqs := map[string]bool{}
+	var ineq string
+	var walk func(*pb.Filter)
+	walk = func(f *pb.Filter) {
+		switch f := f.GetFilterType().(type) {
+		case *pb.Filter_CompositeFilter:
+			for _, g := range f.CompositeFilter.Filters {
+				walk(g)
+			}
+		case *pb.Filter_PropertyFilter:
+			pf := f.PropertyFilter
+			name := pf.Property.GetName()
+			switch {
+			case pf.Op == pb.PropertyFilter_HAS_ANCESTOR:
+				ix.Ancestor = true
+			case name == keyProperty:
+			case pf.Op == pb.PropertyFilter_EQUAL:
+				eqs[name] = true
+			default:
+				ineq = name
+			}
+		}
+	}
+	walk(q.Filter)
+
+	for name := range eqs {
+		ix.Properties = append(ix.Properties, Property{Name: name})
+	}
+	sort.Slice(ix.Properties, func(i, j int) bool { return ix.Properties[i].Name < ix.Properties[j].Name })
+	ix.eq = len(ix.Properties)
+
+	var orders []Property
+	seen := map[string]bool{}
+	for i, o := range q.Order {
+		name := o.Property.GetName()
+		desc := o.Direction == pb.PropertyOrder_DESCENDING
+		if eqs[name] || seen[name] {
+			continue
+		}
+		if name == keyProperty && !desc && i == len(q.Order)-1 {
+			// Every index ends with the key in ascending order.
+			continue
+		}
+		seen[name] = true
+		orders = append(orders, Property{Name: name, Descending: desc})
+	}
+	if ineq != "" && !seen[ineq] {
+		orders = append([]Property{{Name: ineq}}, orders...)
+		seen[ineq] = true
+	}
+	ix.Properties = append(ix.Properties, orders...)
+	for _, p := range q.Projection {
+		name := p.Property.GetName()
+		if name == keyProperty || eqs[name] || seen[name] {
+			continue
+		}
+		seen[name] = true
+		ix.Properties = append(ix.Properties, Property{Name: name})
+	}
+
+	switch {
+	case len(ix.Properties) == ix.eq:
+		// Only equality filters, which are served by merging the built-in
+		// single-property indexes.
+		return nil
+	case !ix.Ancestor && len(ix.Properties) == 1:
+		// A single property, in either direction.
+		return nil
+	}
+	return ix
+}
+
+// Satisfies reports whether ix can serve the queries that need req, which
+// must have been returned by Required.
+func (ix *Index) Satisfies(req *Index) bool {
+	if ix.Kind != req.Kind || ix.Ancestor != req.Ancestor || len(ix.Properties) != len(req.Properties) {
+		return false
+	}
+	eqs := map[string]bool{}
+	for _, p := range req.Properties[:req.eq] {
+		eqs[p.Name] = true
+	}
+	for _, p := range ix.Properties[:req.eq] {
+		if !eqs[p.Name] {
+			return false
+		}
+		delete(eqs, p.Name)
+	}
+	for i := req.eq; i < len(req.Properties); i++ {
+		if ix.Properties[i] != req.Properties[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// String returns ix as an entry of the indexes list in index.yaml.
+func (ix *Index) String() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "- kind: %s\n", ix.Kind)
+	if ix.Ancestor {
+		buf.WriteString("  ancestor: yes\n")
+	}
+	if len(ix.Properties) > 0 {
+		buf.WriteString("  properties:\n")
+	}
+	for _, p := range ix.Properties {
+		fmt.Fprintf(&buf, "  - name: %s\n", p.Name)
+		if p.Descending {
+			buf.WriteString("    direction: desc\n")
+		}
+	}
+	return buf.String()
+}
+
+// Format returns the contents of an index.yaml file declaring ixs.
+func Format(ixs []*Index) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("indexes:\n")
+	for _, ix := range ixs {
+		buf.WriteString("\n")
+		buf.WriteString(ix.String())
+	}
+	return buf.Bytes()
+}
+
+// Parse parses the contents of an index.yaml file. It understands only the
+// subset of YAML that index.yaml files use: block lists and mappings with
+// scalar values, and comments.
+func Parse(data []byte) ([]*Index, error) {
+	var (
+		ixs []*Index
+		ix  *Index
+		p   *Property
+	)
+	for i, line := range strings.Split(string(data), "\n") {
+		lineno := i + 1
+		if j := strings.Index(line, "#"); j >= 0 {
+			line = line[:j]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		item := strings.HasPrefix(line, "- ")
+		if item {
+			line = strings.TrimSpace(line[2:])
+		}
+		j := strings.Index(line, ":")
+		if j < 0 {
+			return nil, fmt.Errorf("index: line %d: expected \"key: value\", got %q", lineno, line)
+		}
+		key := strings.TrimSpace(line[:j])
+		value := strings.Trim(strings.TrimSpace(line[j+1:]), `"'`)
+
+		switch key {
+		case "indexes":
+			if item || value != "" {
+				return nil, fmt.Errorf("index: line %d: indexes must be a list", lineno)
+			}
+		case "kind":
+			if item || ix == nil {
+				ix = &Index{}
+				ixs = append(ixs, ix)
+				p = nil
+			}
+			if value == "" {
+				return nil, fmt.Errorf("index: line %d: empty kind", lineno)
+			}
+			ix.Kind = value
+		case "ancestor":
+			if ix == nil {
+				return nil, fmt.Errorf("index: line %d: ancestor outside of an index", lineno)
+			}
+			switch strings.ToLower(value) {
+			case "yes", "true":
+				ix.Ancestor = true
+			case "no", "false":
+				ix.Ancestor = false
+			default:
+				return nil, fmt.Errorf("index: line %d: bad ancestor value %q", lineno, value)
+			}
+		case "properties":
+			if ix == nil || value != "" {
+				return nil, fmt.Errorf("index: line %d: properties must be a list within an index", lineno)
+			}
+		case "name":
+			if ix == nil {
+				return nil, fmt.Errorf("index: line %d: property outside of an index", lineno)
+			}
+			if item || p == nil {
+				ix.Properties = append(ix.Properties, Property{})
+			}
+			p = &ix.Properties[len(ix.Properties)-1]
+			p.Name = value
+		case "direction":
+			if p == nil {
+				return nil, fmt.Errorf("index: line %d: direction outside of a property", lineno)
+			}
+			switch strings.ToLower(value) {
+			case "asc", "ascending":
+				p.Descending = false
+			case "desc", "descending":
+				p.Descending = true
+			default:
+				return nil, fmt.Errorf("index: line %d: bad direction %q", lineno, value)
+			}
+		default:
+			return nil, fmt.Errorf("index: line %d: unknown key %q", lineno, key)
+		}
+	}
+	for _, ix := range ixs {
+		if ix.Kind == "" {
+			return nil, fmt.Errorf("index: index with no kind")
+		}
+		for _, p := range ix.Properties {
+			if p.Name == "" {
+				return nil, fmt.Errorf("index: index of kind %s has a property with no name", ix.Kind)
+			}
+		}
+	}
+	return ixs, nil
+}
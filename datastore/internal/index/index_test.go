@@ -0,0 +1,165 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package index
+
+import (
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	pb "google.golang.org/genproto/googleapis/datastore/v1"
+)
+
+func TestParse(t *testing.T) {
+	data, err := ioutil.ReadFile("../../testdata/index.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ixs, err := Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ixs) != 6 {
+		t.Fatalf("got %d indexes, want 6", len(ixs))
+	}
+	want := &Index{
+		Kind:       "SQChild",
+		Ancestor:   true,
+		Properties: []Property{{Name: "T"}, {Name: "I", Descending: true}},
+	}
+	if !reflect.DeepEqual(ixs[1], want) {
+		t.Errorf("got %+v, want %+v", ixs[1], want)
+	}
+
+	// Format and Parse are inverses.
+	again, err := Parse(Format(ixs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(again, ixs) {
+		t.Errorf("after formatting and parsing, got %+v, want %+v", again, ixs)
+	}
+
+	for _, bad := range []string{
+		"indexes:\n- kind: K\n  ancestor: maybe\n",
+		"indexes:\n- kind: K\n  properties:\n  - name: A\n    direction: up\n",
+		"indexes:\n- kind: K\n  colour: red\n",
+		"indexes:\n- ancestor: yes\n",
+		"indexes:\n- kind: K\n  properties:\n  - direction: desc\n",
+	} {
+		if _, err := Parse([]byte(bad)); err == nil {
+			t.Errorf("Parse(%q): got nil, want error", bad)
+		}
+	}
+}
+
+func TestRequired(t *testing.T) {
+	filter := func(name string, op pb.PropertyFilter_Operator) *pb.Filter {
+		return &pb.Filter{FilterType: &pb.Filter_PropertyFilter{PropertyFilter: &pb.PropertyFilter{
+			Property: &pb.PropertyReference{Name: name},
+			Op:       op,
+			Value:    &pb.Value{ValueType: &pb.Value_IntegerValue{IntegerValue: 1}},
+		}}}
+	}
+	and := func(fs ...*pb.Filter) *pb.Filter {
+		return &pb.Filter{FilterType: &pb.Filter_CompositeFilter{CompositeFilter: &pb.CompositeFilter{
+			Op:      pb.CompositeFilter_AND,
+			Filters: fs,
+		}}}
+	}
+	order := func(name string, desc bool) *pb.PropertyOrder {
+		o := &pb.PropertyOrder{Property: &pb.PropertyReference{Name: name}}
+		if desc {
+			o.Direction = pb.PropertyOrder_DESCENDING
+		}
+		return o
+	}
+	kind := []*pb.KindExpression{{Name: "K"}}
+	const (
+		eq  = pb.PropertyFilter_EQUAL
+		gt  = pb.PropertyFilter_GREATER_THAN
+		anc = pb.PropertyFilter_HAS_ANCESTOR
+	)
+
+	for _, test := range []struct {
+		desc string
+		q    *pb.Query
+		want string // "" for no index
+	}{
+		{"kindless", &pb.Query{Filter: filter("__key__", anc)}, ""},
+		{"no filters", &pb.Query{Kind: kind}, ""},
+		{"one order", &pb.Query{Kind: kind, Order: []*pb.PropertyOrder{order("A", true)}}, ""},
+		{"equalities", &pb.Query{Kind: kind, Filter: and(filter("A", eq), filter("B", eq), filter("__key__", anc))}, ""},
+		{"one inequality", &pb.Query{Kind: kind, Filter: filter("A", gt)}, ""},
+		{"key inequality", &pb.Query{Kind: kind, Filter: and(filter("A", eq), filter("__key__", gt))}, ""},
+		{
+			"equality and order",
+			&pb.Query{Kind: kind, Filter: and(filter("B", eq), filter("A", eq)), Order: []*pb.PropertyOrder{order("C", true)}},
+			"- kind: K\n  properties:\n  - name: A\n  - name: B\n  - name: C\n    direction: desc\n",
+		},
+		{
+			"ancestor and order",
+			&pb.Query{Kind: kind, Filter: filter("__key__", anc), Order: []*pb.PropertyOrder{order("A", false), order("__key__", false)}},
+			"- kind: K\n  ancestor: yes\n  properties:\n  - name: A\n",
+		},
+		{
+			"inequality and order",
+			&pb.Query{Kind: kind, Filter: filter("A", gt), Order: []*pb.PropertyOrder{order("A", false), order("B", false)}},
+			"- kind: K\n  properties:\n  - name: A\n  - name: B\n",
+		},
+		{
+			"equality and inequality",
+			&pb.Query{Kind: kind, Filter: and(filter("A", gt), filter("B", eq))},
+			"- kind: K\n  properties:\n  - name: B\n  - name: A\n",
+		},
+		{
+			"projection",
+			&pb.Query{Kind: kind, Projection: []*pb.Projection{{Property: &pb.PropertyReference{Name: "A"}}, {Property: &pb.PropertyReference{Name: "B"}}}},
+			"- kind: K\n  properties:\n  - name: A\n  - name: B\n",
+		},
+	} {
+		got := Required(test.q)
+		var gotStr string
+		if got != nil {
+			gotStr = got.String()
+		}
+		if gotStr != test.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", test.desc, gotStr, test.want)
+		}
+	}
+}
+
+func TestSatisfies(t *testing.T) {
+	req := &Index{
+		Kind:       "K",
+		Properties: []Property{{Name: "A"}, {Name: "B"}, {Name: "C", Descending: true}},
+		eq:         2,
+	}
+	for _, test := range []struct {
+		ix   *Index
+		want bool
+	}{
+		{&Index{Kind: "K", Properties: []Property{{Name: "A"}, {Name: "B"}, {Name: "C", Descending: true}}}, true},
+		{&Index{Kind: "K", Properties: []Property{{Name: "B", Descending: true}, {Name: "A"}, {Name: "C", Descending: true}}}, true},
+		{&Index{Kind: "K", Properties: []Property{{Name: "A"}, {Name: "B"}, {Name: "C"}}}, false},
+		{&Index{Kind: "K", Properties: []Property{{Name: "A"}, {Name: "C", Descending: true}, {Name: "B"}}}, false},
+		{&Index{Kind: "K", Ancestor: true, Properties: []Property{{Name: "A"}, {Name: "B"}, {Name: "C", Descending: true}}}, false},
+		{&Index{Kind: "L", Properties: []Property{{Name: "A"}, {Name: "B"}, {Name: "C", Descending: true}}}, false},
+	} {
+		if got := test.ix.Satisfies(req); got != test.want {
+			t.Errorf("%s.Satisfies: got %t, want %t", test.ix, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package pbvalue orders Datastore values as the service does in its indexes.
+package pbvalue
+
+import (
+	"bytes"
+	"strings"
+
+	pb "google.golang.org/genproto/googleapis/datastore/v1"
+)
+
+// Values of different types are ordered by these ranks, as in Datastore.
+// Integers and timestamps have the same rank, and are compared as integers of
+// microseconds.
+const (
+	rankNull = iota
+	rankNumber
+	rankBool
+	rankBlob
+	rankString
+	rankDouble
+	rankGeoPoint
+	rankKey
+	rankOther // entities and arrays, which are not indexed
+)
+
+// SameType reports whether a and b are values of the same type, as far as
+// ordering is concerned: integers and timestamps are of the same type.
+func SameType(a, b *pb.Value) bool {
+	return rank(a) == rank(b)
+}
+
+func rank(v *pb.Value) int {
+	switch v.ValueType.(type) {
+	case *pb.Value_NullValue:
+		return rankNull
+	case *pb.Value_IntegerValue, *pb.Value_TimestampValue:
+		return rankNumber
+	case *pb.Value_BooleanValue:
+		return rankBool
+	case *pb.Value_BlobValue:
+		return rankBlob
+	case *pb.Value_StringValue:
+		return rankString
+	case *pb.Value_DoubleValue:
+		return rankDouble
+	case *pb.Value_GeoPointValue:
+		return rankGeoPoint
+	case *pb.Value_KeyValue:
+		return rankKey
+	default:
+		return rankOther
+	}
+}
+
+// Compare returns -1, 0 or 1 as a is less than, equal to or greater
+// than b in Datastore's ordering of indexed values.
+func Compare(a, b *pb.Value) int {
+	ra, rb := rank(a), rank(b)
+	if ra != rb {
+		return compareInts(int64(ra), int64(rb))
+	}
+	switch ra {
+	case rankNumber:
+		return compareInts(micros(a), micros(b))
+	case rankBool:
+		ab, bb := a.GetBooleanValue(), b.GetBooleanValue()
+		switch {
+		case ab == bb:
+			return 0
+		case bb:
+			return -1
+		default:
+			return 1
+		}
+	case rankBlob:
+		return bytes.Compare(a.GetBlobValue(), b.GetBlobValue())
+	case rankString:
+		return strings.Compare(a.GetStringValue(), b.GetStringValue())
+	case rankDouble:
+		return compareFloats(a.GetDoubleValue(), b.GetDoubleValue())
+	case rankGeoPoint:
+		ag, bg := a.GetGeoPointValue(), b.GetGeoPointValue()
+		if c := compareFloats(ag.GetLatitude(), bg.GetLatitude()); c != 0 {
+			return c
+		}
+		return compareFloats(ag.GetLongitude(), bg.GetLongitude())
+	case rankKey:
+		return CompareKeys(a.GetKeyValue(), b.GetKeyValue())
+	}
+	return 0
+}
+
+func micros(v *pb.Value) int64 {
+	if ts := v.GetTimestampValue(); ts != nil {
+		return ts.Seconds*1e6 + int64(ts.Nanos)/1e3
+	}
+	return v.GetIntegerValue()
+}
+
+func compareInts(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// compareFloats orders NaN before all other values.
+func compareFloats(a, b float64) int {
+	switch {
+	case a == b || a != a && b != b:
+		return 0
+	case a != a || a < b:
+		return -1
+	}
+	return 1
+}
+
+// CompareKeys orders keys by namespace and then by path. The project is
+// ignored, because all keys in a query are in the same one.
+func CompareKeys(a, b *pb.Key) int {
+	if c := strings.Compare(a.PartitionId.GetNamespaceId(), b.PartitionId.GetNamespaceId()); c != 0 {
+		return c
+	}
+	for i := 0; i < len(a.Path) && i < len(b.Path); i++ {
+		if c := comparePathElements(a.Path[i], b.Path[i]); c != 0 {
+			return c
+		}
+	}
+	return compareInts(int64(len(a.Path)), int64(len(b.Path)))
+}
+
+// comparePathElements orders elements by kind, and then orders IDs before
+// names.
+func comparePathElements(a, b *pb.Key_PathElement) int {
+	if c := strings.Compare(a.Kind, b.Kind); c != 0 {
+		return c
+	}
+	switch aid := a.IdType.(type) {
+	case *pb.Key_PathElement_Id:
+		if bid, ok := b.IdType.(*pb.Key_PathElement_Id); ok {
+			return compareInts(aid.Id, bid.Id)
+		}
+		return -1
+	case *pb.Key_PathElement_Name:
+		if bid, ok := b.IdType.(*pb.Key_PathElement_Name); ok {
+			return strings.Compare(aid.Name, bid.Name)
+		}
+		return 1
+	}
+	return 0
+}
+
+// PropertyValues returns the indexed values of the property name of an entity
+// with the given properties, looking inside entity values for a name of the
+// form "a.b". An array contributes each of its indexed elements.
+func PropertyValues(props map[string]*pb.Value, name string) []*pb.Value {
+	if v, ok := props[name]; ok {
+		return indexedValues(v)
+	}
+	var vs []*pb.Value
+	for i := strings.Index(name, "."); i >= 0; i = nextDot(name, i) {
+		v, ok := props[name[:i]]
+		if !ok {
+			continue
+		}
+		for _, e := range elements(v) {
+			if ev := e.GetEntityValue(); ev != nil {
+				vs = append(vs, PropertyValues(ev.Properties, name[i+1:])...)
+			}
+		}
+	}
+	return vs
+}
+
+func nextDot(s string, i int) int {
+	j := strings.Index(s[i+1:], ".")
+	if j < 0 {
+		return -1
+	}
+	return i + 1 + j
+}
+
+func elements(v *pb.Value) []*pb.Value {
+	if av := v.GetArrayValue(); av != nil {
+		return av.Values
+	}
+	return []*pb.Value{v}
+}
+
+func indexedValues(v *pb.Value) []*pb.Value {
+	var vs []*pb.Value
+	for _, e := range elements(v) {
+		if !e.ExcludeFromIndexes && rank(e) != rankOther {
+			vs = append(vs, e)
+		}
+	}
+	return vs
+}
@@ -0,0 +1,172 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datastore
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// An LRUCache is a Cache that holds up to a fixed number of items in memory,
+// evicting the least recently used item to make room for another.
+//
+// An LRUCache only keeps the Clients of one process consistent with each
+// other. Processes that write the same entities must share a Cache backed by
+// a common store instead.
+type LRUCache struct {
+	mu       sync.Mutex
+	maxItems int
+	ll       *list.List               // of *lruItem, most recently used first
+	items    map[string]*list.Element // by key
+	now      func() time.Time         // for testing
+}
+
+type lruItem struct {
+	key     string
+	value   []byte
+	expires time.Time // zero if the item does not expire
+}
+
+// NewLRUCache returns an empty LRUCache that holds up to maxItems items.
+func NewLRUCache(maxItems int) *LRUCache {
+	return &LRUCache{
+		maxItems: maxItems,
+		ll:       list.New(),
+		items:    map[string]*list.Element{},
+		now:      time.Now,
+	}
+}
+
+// Len returns the number of items in the cache, including expired items that
+// have not been removed yet.
+func (c *LRUCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ll.Len()
+}
+
+// get returns the element of the item with key, or nil if there is none. The
+// caller must hold c.mu.
+func (c *LRUCache) get(key string) *list.Element {
+	el, ok := c.items[key]
+	if !ok {
+		return nil
+	}
+	if it := el.Value.(*lruItem); !it.expires.IsZero() && !c.now().Before(it.expires) {
+		c.ll.Remove(el)
+		delete(c.items, key)
+		return nil
+	}
+	return el
+}
+
+// set stores an item. The caller must hold c.mu.
+func (c *LRUCache) set(key string, value []byte, ttl time.Duration) {
+	it := &lruItem{key: key, value: append([]byte(nil), value...)}
+	if ttl > 0 {
+		it.expires = c.now().Add(ttl)
+	}
+	if el, ok := c.items[key]; ok {
+		el.Value = it
+		c.ll.MoveToFront(el)
+		return
+	}
+	c.items[key] = c.ll.PushFront(it)
+	for c.ll.Len() > c.maxItems {
+		el := c.ll.Back()
+		c.ll.Remove(el)
+		delete(c.items, el.Value.(*lruItem).key)
+	}
+}
+
+var errCacheArgs = errors.New("datastore: cache keys and values have different lengths")
+
+// GetMulti implements Cache.GetMulti.
+func (c *LRUCache) GetMulti(_ context.Context, keys []string) ([][]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	values := make([][]byte, len(keys))
+	for i, k := range keys {
+		if el := c.get(k); el != nil {
+			c.ll.MoveToFront(el)
+			values[i] = append([]byte(nil), el.Value.(*lruItem).value...)
+		}
+	}
+	return values, nil
+}
+
+// SetMulti implements Cache.SetMulti.
+func (c *LRUCache) SetMulti(_ context.Context, keys []string, values [][]byte, ttl time.Duration) error {
+	if len(keys) != len(values) {
+		return errCacheArgs
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, k := range keys {
+		c.set(k, values[i], ttl)
+	}
+	return nil
+}
+
+// AddMulti implements Cache.AddMulti.
+func (c *LRUCache) AddMulti(_ context.Context, keys []string, values [][]byte, ttl time.Duration) ([]bool, error) {
+	if len(keys) != len(values) {
+		return nil, errCacheArgs
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	added := make([]bool, len(keys))
+	for i, k := range keys {
+		if c.get(k) == nil {
+			c.set(k, values[i], ttl)
+			added[i] = true
+		}
+	}
+	return added, nil
+}
+
+// CompareAndSwapMulti implements Cache.CompareAndSwapMulti.
+func (c *LRUCache) CompareAndSwapMulti(_ context.Context, keys []string, old, new [][]byte, ttl time.Duration) ([]bool, error) {
+	if len(keys) != len(old) || len(keys) != len(new) {
+		return nil, errCacheArgs
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	swapped := make([]bool, len(keys))
+	for i, k := range keys {
+		if el := c.get(k); el != nil && bytes.Equal(el.Value.(*lruItem).value, old[i]) {
+			c.set(k, new[i], ttl)
+			swapped[i] = true
+		}
+	}
+	return swapped, nil
+}
+
+// DeleteMulti implements Cache.DeleteMulti.
+func (c *LRUCache) DeleteMulti(_ context.Context, keys []string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, k := range keys {
+		if el, ok := c.items[k]; ok {
+			c.ll.Remove(el)
+			delete(c.items, k)
+		}
+	}
+	return nil
+}
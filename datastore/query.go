@@ -38,6 +38,9 @@ const (
 	equal
 	greaterEq
 	greaterThan
+	notEqual
+	in
+	notIn
 
 	keyFieldName = "__key__"
 )
@@ -92,6 +95,7 @@ type Query struct {
 	kind       string
 	ancestor   *Key
 	filter     []filter
+	entFilter  []EntityFilter
 	order      []order
 	projection []string
 
@@ -118,6 +122,10 @@ func (q *Query) clone() *Query {
 		x.filter = make([]filter, len(q.filter))
 		copy(x.filter, q.filter)
 	}
+	if len(q.entFilter) > 0 {
+		x.entFilter = make([]EntityFilter, len(q.entFilter))
+		copy(x.entFilter, q.entFilter)
+	}
 	if len(q.order) > 0 {
 		x.order = make([]order, len(q.order))
 		copy(x.order, q.order)
@@ -172,12 +180,18 @@ func (q *Query) Transaction(t *Transaction) *Query {
 
 // Filter returns a derivative query with a field-based filter.
 // The filterStr argument must be a field name followed by optional space,
-// followed by an operator, one of ">", "<", ">=", "<=", or "=".
+// followed by an operator, one of ">", "<", ">=", "<=", "=", "!=", "in" or
+// "not-in". The "in" and "not-in" operators must be separated from the field
+// name by a space, and their value must be a slice.
 // Fields are compared against the provided value using the operator.
 // Multiple filters are AND'ed together.
 // Field names which contain spaces, quote marks, or operator characters
 // should be passed as quoted Go string literals as returned by strconv.Quote
 // or the fmt package's %q verb.
+//
+// Datastore does not support the "!=", "in" and "not-in" operators itself, so
+// a query that uses them is split into several queries, as described for
+// FilterEntity.
 func (q *Query) Filter(filterStr string, value interface{}) *Query {
 	q = q.clone()
 	filterStr = strings.TrimSpace(filterStr)
@@ -185,11 +199,31 @@ func (q *Query) Filter(filterStr string, value interface{}) *Query {
 		q.err = fmt.Errorf("datastore: invalid filter %q", filterStr)
 		return q
 	}
-	f := filter{
-		FieldName: strings.TrimRight(filterStr, " ><=!"),
-		Value:     value,
+	var fieldName, op string
+	lower := strings.ToLower(filterStr)
+	switch {
+	case strings.HasSuffix(lower, " not-in"):
+		fieldName, op = filterStr[:len(filterStr)-len(" not-in")], "not-in"
+	case strings.HasSuffix(lower, " in"):
+		fieldName, op = filterStr[:len(filterStr)-len(" in")], "in"
+	default:
+		fieldName = strings.TrimRight(filterStr, " ><=!")
+		op = filterStr[len(fieldName):]
+	}
+	fieldName, op = strings.TrimSpace(fieldName), strings.TrimSpace(op)
+	f, err := newFilter(fieldName, op, value)
+	if err != nil {
+		q.err = fmt.Errorf("datastore: %v in filter %q", err, filterStr)
+		return q
 	}
-	switch op := strings.TrimSpace(filterStr[len(f.FieldName):]); op {
+	q.filter = append(q.filter, f)
+	return q
+}
+
+// newFilter returns a filter on the unquoted fieldName with the operator op.
+func newFilter(fieldName, op string, value interface{}) (filter, error) {
+	f := filter{Value: value}
+	switch strings.ToLower(op) {
 	case "<=":
 		f.Op = lessEq
 	case ">=":
@@ -200,17 +234,60 @@ func (q *Query) Filter(filterStr string, value interface{}) *Query {
 		f.Op = greaterThan
 	case "=":
 		f.Op = equal
+	case "!=":
+		f.Op = notEqual
+	case "in":
+		f.Op = in
+	case "not-in":
+		f.Op = notIn
 	default:
-		q.err = fmt.Errorf("datastore: invalid operator %q in filter %q", op, filterStr)
-		return q
+		return f, fmt.Errorf("invalid operator %q", op)
 	}
 	var err error
-	f.FieldName, err = unquote(f.FieldName)
+	f.FieldName, err = unquote(fieldName)
 	if err != nil {
-		q.err = fmt.Errorf("datastore: invalid syntax for quoted field name %q", f.FieldName)
+		return f, fmt.Errorf("invalid syntax for quoted field name %q", fieldName)
+	}
+	if f.FieldName == "" {
+		return f, errors.New("empty field name")
+	}
+	if f.Op == in || f.Op == notIn {
+		if _, err := filterValues(value); err != nil {
+			return f, err
+		}
+	}
+	return f, nil
+}
+
+// FilterEntity returns a derivative query with the filter ef, which is AND'ed
+// with its other filters.
+//
+// Datastore only runs queries that are conjunctions of filters with the
+// operators "=", "<", "<=", ">" and ">=". A query with an OrFilter, or with
+// the "!=", "in" or "not-in" operators, is split into at most 30 such
+// queries, whose results are merged according to the query's orders and
+// deduplicated by key. If such a query has no orders and one of the queries
+// it is split into has an inequality filter, its results are ordered by the
+// property of that filter. As with any query, only entities that have the
+// properties it is ordered by are returned.
+//
+// A cursor from the iterator of a split query can be used to resume it,
+// but not with other queries. An entity with several values of a property
+// that the query is ordered by may be returned by more than one of the
+// queries, at different positions, so the cursor includes the results that
+// could still be duplicated, and grows with them. Offsets and limits are
+// applied after merging, so every skipped result is read.
+func (q *Query) FilterEntity(ef EntityFilter) *Query {
+	q = q.clone()
+	if ef == nil {
+		q.err = errors.New("datastore: nil entity filter")
 		return q
 	}
-	q.filter = append(q.filter, f)
+	if _, err := ef.disjunction(); err != nil {
+		q.err = err
+		return q
+	}
+	q.entFilter = append(q.entFilter, ef)
 	return q
 }
 
@@ -339,6 +416,9 @@ func (q *Query) toProto(req *pb.RunQueryRequest) error {
 	if len(q.distinctOn) != 0 && q.distinct {
 		return errors.New("datastore: query cannot be both distinct and distinct-on")
 	}
+	if q.needsSplit() {
+		return errors.New("datastore: internal error: query must be split before it is run")
+	}
 	dst := &pb.Query{}
 	if q.kind != "" {
 		dst.Kind = []*pb.KindExpression{{Name: q.kind}}
@@ -446,6 +526,8 @@ func (q *Query) toProto(req *pb.RunQueryRequest) error {
 // the sum of the query's offset and limit. Unless the result count is
 // expected to be small, it is best to specify a limit; otherwise Count will
 // continue until it finishes counting or the provided context expires.
+// An aggregation query with WithCount is counted by the server instead; see
+// RunAggregationQuery.
 func (c *Client) Count(ctx context.Context, q *Query) (n int, err error) {
 	ctx = trace.StartSpan(ctx, "github.com/smyte/google-cloud-go/datastore.Query.Count")
 	defer func() { trace.EndSpan(ctx, err) }()
@@ -463,6 +545,19 @@ func (c *Client) Count(ctx context.Context, q *Query) (n int, err error) {
 	// Create an iterator and use it to walk through the batches of results
 	// directly.
 	it := c.Run(ctx, newQ)
+	if it.merge != nil {
+		// Duplicates are only removed from the merged results.
+		for {
+			_, _, err := it.next()
+			if err == iterator.Done {
+				return n, nil
+			}
+			if err != nil {
+				return 0, err
+			}
+			n++
+		}
+	}
 	for {
 		err := it.nextBatch()
 		if err == iterator.Done {
@@ -568,6 +663,21 @@ func (c *Client) Run(ctx context.Context, q *Query) *Iterator {
 	if q.err != nil {
 		return &Iterator{err: q.err}
 	}
+	subs, err := q.split()
+	if err != nil {
+		return &Iterator{err: err}
+	}
+	switch len(subs) {
+	case 0:
+		if subs != nil {
+			// The query matches no entities, as with an empty "in" filter.
+			return &Iterator{err: iterator.Done, keysOnly: q.keysOnly}
+		}
+	case 1:
+		q = subs[0]
+	default:
+		return c.runMerged(ctx, q, subs)
+	}
 	t := &Iterator{
 		ctx:          ctx,
 		client:       c,
@@ -622,6 +732,10 @@ type Iterator struct {
 	pageCursor []byte
 	// entityCursor is the compiled cursor of the next result.
 	entityCursor []byte
+
+	// merge merges the results of the queries that a query with OR, in, !=
+	// or not-in filters is split into. It is nil for other queries.
+	merge *merger
 }
 
 // Next returns the key of the next result. When there are no more results,
@@ -642,6 +756,12 @@ func (t *Iterator) Next(dst interface{}) (k *Key, err error) {
 }
 
 func (t *Iterator) next() (*Key, *pb.Entity, error) {
+	if t.merge != nil {
+		if t.err != nil {
+			return nil, nil, t.err
+		}
+		return t.merge.next()
+	}
 	// Fetch additional batches while there are no more results.
 	for t.err == nil && len(t.results) == 0 {
 		t.err = t.nextBatch()
@@ -741,6 +861,14 @@ func (t *Iterator) Cursor() (c Cursor, err error) {
 	t.ctx = trace.StartSpan(t.ctx, "github.com/smyte/google-cloud-go/datastore.Query.Cursor")
 	defer func() { trace.EndSpan(t.ctx, err) }()
 
+	if t.merge != nil && t.err == nil {
+		cc, err := t.merge.cursor()
+		if err != nil {
+			return Cursor{}, err
+		}
+		return Cursor{cc}, nil
+	}
+
 	// If there is still an offset, we need to the skip those results first.
 	for t.err == nil && t.offset > 0 {
 		t.err = t.nextBatch()
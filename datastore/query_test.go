@@ -409,12 +409,13 @@ func TestFilterParser(t *testing.T) {
 		{"x >", true, "x", greaterThan},
 		{"in >", true, "in", greaterThan},
 		{"in>", true, "in", greaterThan},
-		// Valid but (currently) unsupported ops.
-		{"x!=", false, "", 0},
-		{"x !=", false, "", 0},
-		{" x  !=  ", false, "", 0},
+		{"x!=", true, "x", notEqual},
+		{"x !=", true, "x", notEqual},
+		{" x  !=  ", true, "x", notEqual},
+		// in and not-in need a slice value.
 		{"x IN", false, "", 0},
 		{"x in", false, "", 0},
+		{"x not-in", false, "", 0},
 		// Invalid ops.
 		{"x EQ", false, "", 0},
 		{"x lt", false, "", 0},
@@ -61,7 +61,14 @@ func NewServer(opts ...grpc.ServerOption) (*Server, error) {
 // NewServerWithPort creates a new Server at a specific port. The Server will be listening
 // for gRPC connections at the address named by the Addr field, without TLS.
 func NewServerWithPort(port int, opts ...grpc.ServerOption) (*Server, error) {
-	l, err := net.Listen("tcp", fmt.Sprintf("localhost:%d", port))
+	return NewServerWithAddr(fmt.Sprintf("localhost:%d", port), opts...)
+}
+
+// NewServerWithAddr creates a new Server listening at addr, a "host:port"
+// address as for net.Listen. The Server will be listening for gRPC
+// connections at the address named by the Addr field, without TLS.
+func NewServerWithAddr(addr string, opts ...grpc.ServerOption) (*Server, error) {
+	l, err := net.Listen("tcp", addr)
 	if err != nil {
 		return nil, err
 	}
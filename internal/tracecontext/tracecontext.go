@@ -12,7 +12,8 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-// Package tracecontext provides encoders and decoders for Stackdriver Trace contexts.
+// Package tracecontext provides encoders and decoders for Stackdriver Trace
+// contexts, and for the traceparent values of W3C Trace Context.
 package tracecontext
 
 import "encoding/binary"
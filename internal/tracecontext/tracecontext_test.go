@@ -138,3 +138,39 @@ func BenchmarkEncode(b *testing.B) {
 		Encode(validData, traceID, 0, opts)
 	}
 }
+
+func TestTraceparent(t *testing.T) {
+	traceID := [16]byte{0x4b, 0xf9, 0x2f, 0x35, 0x77, 0xb3, 0x4d, 0xa6, 0xa3, 0xce, 0x92, 0x9d, 0x0e, 0x0e, 0x47, 0x36}
+	spanID := [8]byte{0x00, 0xf0, 0x67, 0xaa, 0x0b, 0xa9, 0x02, 0xb7}
+	const want = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+	got := EncodeTraceparent(traceID, spanID, 1)
+	if got != want {
+		t.Errorf("EncodeTraceparent() = %q, want %q", got, want)
+	}
+	if len(got) != TraceparentLen {
+		t.Errorf("len = %d, want TraceparentLen", len(got))
+	}
+	for _, s := range []string{want, "cc-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra"} {
+		gotTraceID, gotSpanID, gotOpts, ok := DecodeTraceparent(s)
+		if !ok || gotTraceID != traceID || gotSpanID != spanID || gotOpts != 1 {
+			t.Errorf("DecodeTraceparent(%q) = %x, %x, %d, %t", s, gotTraceID, gotSpanID, gotOpts, ok)
+		}
+	}
+	for _, s := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"cc-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01.extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902bx-01",
+		"00_4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+	} {
+		if _, _, _, ok := DecodeTraceparent(s); ok {
+			t.Errorf("DecodeTraceparent(%q): got ok", s)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracecontext
+
+import (
+	"encoding/hex"
+	"fmt"
+)
+
+// TraceparentLen is the length of a version 00 W3C traceparent value.
+const TraceparentLen = 2 + 1 + 2*traceIDLen + 1 + 2*spanIDLen + 1 + 2*optsLen
+
+// EncodeTraceparent returns the trace ID, span ID and options in the
+// version 00 traceparent format of the W3C Trace Context specification.
+func EncodeTraceparent(traceID [16]byte, spanID [8]byte, opts byte) string {
+	return fmt.Sprintf("00-%x-%x-%02x", traceID[:], spanID[:], opts)
+}
+
+// DecodeTraceparent decodes a traceparent value in the format of the W3C
+// Trace Context specification. As the specification requires, values of
+// later versions are decoded as version 00, ignoring any additional fields.
+// ok is false if s is not valid, or has an all-zero trace or span ID.
+func DecodeTraceparent(s string) (traceID [16]byte, spanID [8]byte, opts byte, ok bool) {
+	if len(s) < TraceparentLen || s[2] != '-' || s[35] != '-' || s[52] != '-' {
+		return traceID, spanID, 0, false
+	}
+	for i := 0; i < TraceparentLen; i++ {
+		if c := s[i]; c >= 'A' && c <= 'F' {
+			return traceID, spanID, 0, false
+		}
+	}
+	var version [1]byte
+	if !decodeHex(version[:], s[0:2]) || version[0] == 0xff {
+		return traceID, spanID, 0, false
+	}
+	if version[0] == 0 && len(s) != TraceparentLen || len(s) > TraceparentLen && s[TraceparentLen] != '-' {
+		return traceID, spanID, 0, false
+	}
+	var o [1]byte
+	if !decodeHex(traceID[:], s[3:35]) || !decodeHex(spanID[:], s[36:52]) || !decodeHex(o[:], s[53:55]) {
+		return traceID, spanID, 0, false
+	}
+	if traceID == ([16]byte{}) || spanID == ([8]byte{}) {
+		return traceID, spanID, 0, false
+	}
+	return traceID, spanID, o[0], true
+}
+
+func decodeHex(dst []byte, s string) bool {
+	n, err := hex.Decode(dst, []byte(s))
+	return err == nil && n == len(dst)
+}
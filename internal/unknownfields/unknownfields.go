@@ -0,0 +1,108 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package unknownfields encodes and decodes protocol buffer fields that are
+// newer than the generated messages that carry them, and so are kept in the
+// messages' XXX_unrecognized bytes.
+package unknownfields
+
+import (
+	"errors"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// AppendVarint appends a varint field with the number num and value v to b.
+func AppendVarint(b []byte, num int, v uint64) []byte {
+	buf := proto.NewBuffer(b)
+	buf.EncodeVarint(uint64(num)<<3 | proto.WireVarint)
+	buf.EncodeVarint(v)
+	return buf.Bytes()
+}
+
+// AppendBytes appends a bytes field with the number num and value v to b.
+func AppendBytes(b []byte, num int, v []byte) []byte {
+	buf := proto.NewBuffer(b)
+	buf.EncodeVarint(uint64(num)<<3 | proto.WireBytes)
+	buf.EncodeRawBytes(v)
+	return buf.Bytes()
+}
+
+// Varint returns the value of the last varint field with the number num in
+// b, and whether there is one.
+func Varint(b []byte, num int) (v uint64, ok bool) {
+	scan(b, func(n int, wire uint64, buf *proto.Buffer) error {
+		if n != num || wire != proto.WireVarint {
+			return skip(buf, wire)
+		}
+		x, err := buf.DecodeVarint()
+		if err == nil {
+			v, ok = x, true
+		}
+		return err
+	})
+	return v, ok
+}
+
+// Bytes returns the value of the last bytes field with the number num in b,
+// and whether there is one.
+func Bytes(b []byte, num int) (v []byte, ok bool) {
+	scan(b, func(n int, wire uint64, buf *proto.Buffer) error {
+		if n != num || wire != proto.WireBytes {
+			return skip(buf, wire)
+		}
+		x, err := buf.DecodeRawBytes(true)
+		if err == nil {
+			v, ok = x, true
+		}
+		return err
+	})
+	return v, ok
+}
+
+// scan calls f with the number and wire type of each field in b, and a
+// buffer positioned at the field's value, which f must consume. It stops at
+// the first error, or at malformed input.
+func scan(b []byte, f func(num int, wire uint64, buf *proto.Buffer) error) {
+	buf := proto.NewBuffer(b)
+	for {
+		tag, err := buf.DecodeVarint()
+		if err != nil {
+			return
+		}
+		if err := f(int(tag>>3), tag&7, buf); err != nil {
+			return
+		}
+	}
+}
+
+var errWireType = errors.New("unknownfields: unknown wire type")
+
+// skip consumes a value of the wire type from buf.
+func skip(buf *proto.Buffer, wire uint64) error {
+	var err error
+	switch wire {
+	case proto.WireVarint:
+		_, err = buf.DecodeVarint()
+	case proto.WireFixed64:
+		_, err = buf.DecodeFixed64()
+	case proto.WireBytes:
+		_, err = buf.DecodeRawBytes(false)
+	case proto.WireFixed32:
+		_, err = buf.DecodeFixed32()
+	default:
+		err = errWireType
+	}
+	return err
+}
@@ -0,0 +1,54 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package unknownfields
+
+import (
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+)
+
+func TestFields(t *testing.T) {
+	buf := proto.NewBuffer(nil)
+	buf.EncodeVarint(3<<3 | proto.WireFixed32)
+	buf.EncodeFixed32(12)
+	buf.EncodeVarint(4<<3 | proto.WireFixed64)
+	buf.EncodeFixed64(12)
+	b := buf.Bytes()
+	b = AppendBytes(b, 12, []byte("first"))
+	b = AppendVarint(b, 7, 5)
+	b = AppendBytes(b, 12, []byte("last"))
+	b = AppendVarint(b, 12, 9)
+
+	if v, ok := Bytes(b, 12); !ok || string(v) != "last" {
+		t.Errorf("Bytes(12) = %q, %t, want \"last\", true", v, ok)
+	}
+	if v, ok := Varint(b, 7); !ok || v != 5 {
+		t.Errorf("Varint(7) = %d, %t, want 5, true", v, ok)
+	}
+	if v, ok := Varint(b, 12); !ok || v != 9 {
+		t.Errorf("Varint(12) = %d, %t, want 9, true", v, ok)
+	}
+	if _, ok := Bytes(b, 7); ok {
+		t.Error("Bytes(7) found a varint field")
+	}
+	if _, ok := Varint(b, 8); ok {
+		t.Error("Varint(8) found a missing field")
+	}
+	// Malformed input ends the search.
+	if v, ok := Bytes(append(b[:len(b):len(b)], 12<<3|proto.WireBytes, 9, 'x'), 12); !ok || string(v) != "last" {
+		t.Errorf("Bytes of truncated input = %q, %t, want \"last\", true", v, ok)
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// The pstest command runs the fake Cloud PubSub service of package pstest as a
+// standalone emulator, for programs that are not written in Go.
+//
+// Usage:
+//
+//     pstest [-addr host:port] [-admin_addr host:port]
+//
+// Clients connect to the gRPC service at -addr without TLS. For the Go client
+// and gcloud, set PUBSUB_EMULATOR_HOST to its address. The HTTP admin API at
+// -admin_addr lists topics, subscriptions and messages, clears state and
+// advances the server's clock; see pstest.Server.AdminHandler for its
+// endpoints.
+//
+// This command is EXPERIMENTAL and is subject to change without notice.
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/smyte/google-cloud-go/pubsub/pstest"
+)
+
+func main() {
+	addr := flag.String("addr", "localhost:8085", "address to serve the PubSub gRPC service on")
+	adminAddr := flag.String("admin_addr", "localhost:8086", "address to serve the HTTP admin API on; empty to disable it")
+	flag.Parse()
+
+	srv, err := pstest.NewServerWithAddr(*addr)
+	if err != nil {
+		log.Fatalf("pstest: %v", err)
+	}
+	log.Printf("pstest: serving PubSub on %s", srv.Addr)
+	if *adminAddr != "" {
+		go func() {
+			log.Printf("pstest: serving admin API on %s", *adminAddr)
+			log.Fatalf("pstest: %v", http.ListenAndServe(*adminAddr, srv.AdminHandler()))
+		}()
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
+	log.Print("pstest: shutting down")
+	srv.Close()
+}
@@ -0,0 +1,195 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pubsub
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression is a codec that Publish can compress message data with.
+type Compression int
+
+const (
+	// NoCompression leaves message data as it is. This is the default.
+	NoCompression Compression = iota
+
+	// Gzip compresses message data with gzip.
+	Gzip
+
+	// Zstd compresses message data with Zstandard.
+	Zstd
+)
+
+// compressionAttribute is the message attribute that records the codec that
+// the message's data was compressed with. Receive removes it when it
+// decompresses the data.
+const compressionAttribute = "googclient_compression"
+
+func (c Compression) String() string {
+	switch c {
+	case NoCompression:
+		return "none"
+	case Gzip:
+		return "gzip"
+	case Zstd:
+		return "zstd"
+	default:
+		return fmt.Sprintf("Compression(%d)", int(c))
+	}
+}
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+	zstdErr     error
+)
+
+// zstdCodec returns an encoder and decoder shared by all topics and
+// subscriptions. Their EncodeAll and DecodeAll methods may be called
+// concurrently. The decoder does not decode more than maxDecompressedBytes.
+func zstdCodec() (*zstd.Encoder, *zstd.Decoder, error) {
+	zstdOnce.Do(func() {
+		zstdEncoder, zstdErr = zstd.NewWriter(nil)
+		if zstdErr != nil {
+			return
+		}
+		zstdDecoder, zstdErr = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(uint64(maxDecompressedBytes)))
+	})
+	return zstdEncoder, zstdDecoder, zstdErr
+}
+
+func (c Compression) compress(data []byte) ([]byte, error) {
+	switch c {
+	case Gzip:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case Zstd:
+		enc, _, err := zstdCodec()
+		if err != nil {
+			return nil, err
+		}
+		return enc.EncodeAll(data, nil), nil
+	default:
+		return nil, fmt.Errorf("pubsub: unknown compression %v", c)
+	}
+}
+
+// maxDecompressedBytes is the largest data that decompress returns. Publish
+// only compresses data that fits in a publish request, so larger data did not
+// come from Publish.
+const maxDecompressedBytes int = MaxPublishRequestBytes
+
+var errDecompressedTooLarge = fmt.Errorf("decompressed data is larger than %d bytes", maxDecompressedBytes)
+
+func decompress(codec string, data []byte) ([]byte, error) {
+	switch codec {
+	case Gzip.String():
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		out, err := ioutil.ReadAll(io.LimitReader(r, int64(maxDecompressedBytes)+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(out) > maxDecompressedBytes {
+			return nil, errDecompressedTooLarge
+		}
+		return out, nil
+	case Zstd.String():
+		_, dec, err := zstdCodec()
+		if err != nil {
+			return nil, err
+		}
+		out, err := dec.DecodeAll(data, nil)
+		if err == zstd.ErrDecoderSizeExceeded || len(out) > maxDecompressedBytes {
+			return nil, errDecompressedTooLarge
+		}
+		return out, err
+	default:
+		return nil, fmt.Errorf("unknown compression %q", codec)
+	}
+}
+
+// compressMessage returns msg with its data compressed according to ps, or
+// msg itself if the data is too small to compress, too large to decompress,
+// or does not get smaller. msg is not modified.
+func compressMessage(ps *PublishSettings, msg *Message) (*Message, error) {
+	if ps.Compression == NoCompression || len(msg.Data) == 0 || len(msg.Data) <= ps.CompressionThreshold || len(msg.Data) > maxDecompressedBytes {
+		return msg, nil
+	}
+	data, err := ps.Compression.compress(msg.Data)
+	if err != nil {
+		return nil, err
+	}
+	if len(data)+len(compressionAttribute)+len(ps.Compression.String()) >= len(msg.Data) {
+		return msg, nil
+	}
+	attrs := make(map[string]string, len(msg.Attributes)+1)
+	for k, v := range msg.Attributes {
+		attrs[k] = v
+	}
+	attrs[compressionAttribute] = ps.Compression.String()
+	return &Message{
+		Data:        data,
+		Attributes:  attrs,
+		OrderingKey: msg.OrderingKey,
+	}, nil
+}
+
+var logDecompressOnce sync.Once
+
+// decompressMessage decompresses the data of a received message that was
+// compressed by Publish, and removes the attribute that marks it. If the data
+// cannot be decompressed, the message is left as it is, so that the
+// attribute tells the receiver that its data is still compressed.
+func decompressMessage(m *Message) {
+	codec, ok := m.Attributes[compressionAttribute]
+	if !ok {
+		return
+	}
+	data, err := decompress(codec, m.Data)
+	if err != nil {
+		logDecompressOnce.Do(func() {
+			log.Printf("pubsub: cannot decompress data of message %s: %v", m.ID, err)
+		})
+		return
+	}
+	attrs := make(map[string]string, len(m.Attributes)-1)
+	for k, v := range m.Attributes {
+		if k != compressionAttribute {
+			attrs[k] = v
+		}
+	}
+	m.Data = data
+	m.Attributes = attrs
+}
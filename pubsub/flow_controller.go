@@ -21,7 +21,8 @@ import (
 	"golang.org/x/sync/semaphore"
 )
 
-// flowController implements flow control for Subscription.Receive.
+// flowController implements flow control for Subscription.Receive and
+// Topic.Publish.
 type flowController struct {
 	maxCount          int
 	maxSize           int                 // max total size of messages
@@ -82,9 +83,16 @@ func (f *flowController) acquire(ctx context.Context, size int) error {
 // tryAcquire allows large messages to proceed by treating a size greater than
 // maxSize as if it were equal to maxSize.
 func (f *flowController) tryAcquire(size int) bool {
+	return f.tryAcquireErr(size) == nil
+}
+
+// tryAcquireErr is like tryAcquire, but reports which limit would make
+// acquire block: it returns ErrFlowControllerMaxOutstandingMessages or
+// ErrFlowControllerMaxOutstandingBytes.
+func (f *flowController) tryAcquireErr(size int) error {
 	if f.semCount != nil {
 		if !f.semCount.TryAcquire(1) {
-			return false
+			return ErrFlowControllerMaxOutstandingMessages
 		}
 	}
 	if f.semSize != nil {
@@ -92,11 +100,11 @@ func (f *flowController) tryAcquire(size int) bool {
 			if f.semCount != nil {
 				f.semCount.Release(1)
 			}
-			return false
+			return ErrFlowControllerMaxOutstandingBytes
 		}
 	}
 	atomic.AddInt64(&f.countRemaining, 1)
-	return true
+	return nil
 }
 
 // release notes that one message of size bytes is no longer outstanding.
@@ -1,6 +1,6 @@
 module cloud.google.com/go/pubsub
 
-go 1.11
+go 1.22
 
 require (
 	cloud.google.com/go v0.46.3
@@ -8,6 +8,7 @@ require (
 	github.com/golang/protobuf v1.3.2
 	github.com/google/go-cmp v0.3.0
 	github.com/googleapis/gax-go/v2 v2.0.5
+	github.com/klauspost/compress v1.18.0
 	go.opencensus.io v0.22.0
 	golang.org/x/exp v0.0.0-20190912063710-ac5d2bfcbfe0 // indirect
 	golang.org/x/oauth2 v0.0.0-20190604053449-0f29369cfe45
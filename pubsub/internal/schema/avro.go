@@ -0,0 +1,770 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package schema
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// An avroType is a parsed Avro schema. Logical types are treated as their
+// underlying types.
+//
+// Values of a type, called datums here, are represented as
+//     null                     nil
+//     boolean                  bool
+//     int, long                int64
+//     float, double            float64
+//     bytes, fixed             []byte
+//     string, enum             string
+//     array                    []interface{}
+//     map, record              map[string]interface{}
+//     union                    *unionDatum
+type avroType struct {
+	kind     string // a primitive type name, or record, enum, array, map, union or fixed
+	name     string // full name of named types
+	fields   []*avroField
+	symbols  []string
+	items    *avroType // items of arrays, values of maps
+	branches []*avroType
+	size     int // size of fixed
+}
+
+type avroField struct {
+	name   string
+	typ    *avroType
+	def    interface{} // default as decoded from JSON
+	hasDef bool
+}
+
+type unionDatum struct {
+	branch int
+	value  interface{}
+}
+
+var avroPrimitives = map[string]bool{
+	"null": true, "boolean": true, "int": true, "long": true,
+	"float": true, "double": true, "bytes": true, "string": true,
+}
+
+func parseAvro(def string) (*avroType, error) {
+	var v interface{}
+	if err := json.Unmarshal([]byte(def), &v); err != nil {
+		return nil, fmt.Errorf("schema: bad Avro schema: %v", err)
+	}
+	p := &avroParser{named: map[string]*avroType{}}
+	t, err := p.parse(v, "")
+	if err != nil {
+		return nil, fmt.Errorf("schema: bad Avro schema: %v", err)
+	}
+	return t, nil
+}
+
+type avroParser struct {
+	named map[string]*avroType // by full name
+}
+
+func fullName(name, namespace string) string {
+	if strings.Contains(name, ".") || namespace == "" {
+		return name
+	}
+	return namespace + "." + name
+}
+
+func (p *avroParser) parse(v interface{}, namespace string) (*avroType, error) {
+	switch v := v.(type) {
+	case string:
+		if avroPrimitives[v] {
+			return &avroType{kind: v}, nil
+		}
+		if t := p.named[fullName(v, namespace)]; t != nil {
+			return t, nil
+		}
+		if t := p.named[v]; t != nil {
+			return t, nil
+		}
+		return nil, fmt.Errorf("unknown type %q", v)
+
+	case []interface{}:
+		t := &avroType{kind: "union"}
+		for _, b := range v {
+			bt, err := p.parse(b, namespace)
+			if err != nil {
+				return nil, err
+			}
+			if bt.kind == "union" {
+				return nil, errors.New("unions may not contain unions")
+			}
+			t.branches = append(t.branches, bt)
+		}
+		return t, nil
+
+	case map[string]interface{}:
+		typ, _ := v["type"].(string)
+		switch typ {
+		case "record", "error", "enum", "fixed":
+			return p.parseNamed(typ, v, namespace)
+		case "array":
+			items, err := p.parse(v["items"], namespace)
+			if err != nil {
+				return nil, err
+			}
+			return &avroType{kind: "array", items: items}, nil
+		case "map":
+			values, err := p.parse(v["values"], namespace)
+			if err != nil {
+				return nil, err
+			}
+			return &avroType{kind: "map", items: values}, nil
+		default:
+			// A primitive or named type, maybe with a logical type.
+			return p.parse(v["type"], namespace)
+		}
+
+	default:
+		return nil, fmt.Errorf("bad type declaration %v", v)
+	}
+}
+
+func (p *avroParser) parseNamed(typ string, v map[string]interface{}, namespace string) (*avroType, error) {
+	name, _ := v["name"].(string)
+	if name == "" {
+		return nil, fmt.Errorf("%s without a name", typ)
+	}
+	if ns, ok := v["namespace"].(string); ok {
+		namespace = ns
+	}
+	full := fullName(name, namespace)
+	if p.named[full] != nil {
+		return nil, fmt.Errorf("type %q is defined twice", full)
+	}
+	if typ == "error" {
+		typ = "record"
+	}
+	t := &avroType{kind: typ, name: full}
+	// Register the type before parsing fields, which may refer to it.
+	p.named[full] = t
+	if i := strings.LastIndex(full, "."); i >= 0 {
+		namespace = full[:i]
+	} else {
+		namespace = ""
+	}
+	switch typ {
+	case "record":
+		fields, ok := v["fields"].([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("record %q has no fields", full)
+		}
+		for _, f := range fields {
+			fm, _ := f.(map[string]interface{})
+			fname, _ := fm["name"].(string)
+			if fname == "" {
+				return nil, fmt.Errorf("record %q has a field without a name", full)
+			}
+			ft, err := p.parse(fm["type"], namespace)
+			if err != nil {
+				return nil, err
+			}
+			def, hasDef := fm["default"]
+			t.fields = append(t.fields, &avroField{name: fname, typ: ft, def: def, hasDef: hasDef})
+		}
+	case "enum":
+		symbols, _ := v["symbols"].([]interface{})
+		for _, s := range symbols {
+			sym, ok := s.(string)
+			if !ok {
+				return nil, fmt.Errorf("enum %q has a bad symbol %v", full, s)
+			}
+			t.symbols = append(t.symbols, sym)
+		}
+		if len(t.symbols) == 0 {
+			return nil, fmt.Errorf("enum %q has no symbols", full)
+		}
+	case "fixed":
+		size, ok := v["size"].(float64)
+		if !ok || size < 0 || size != math.Trunc(size) {
+			return nil, fmt.Errorf("fixed %q has a bad size", full)
+		}
+		t.size = int(size)
+	}
+	return t, nil
+}
+
+// typeName is the name of t in the JSON encoding of unions.
+func (t *avroType) typeName() string {
+	if t.name != "" {
+		return t.name
+	}
+	return t.kind
+}
+
+// fromGo converts a Go value to a datum of type t, through its JSON encoding.
+func (t *avroType) fromGo(v interface{}) (interface{}, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var g interface{}
+	if err := dec.Decode(&g); err != nil {
+		return nil, err
+	}
+	return t.fromGeneric(g, false)
+}
+
+// toGo stores d, a datum of type t, in the value pointed to by v, through
+// its JSON encoding.
+func (t *avroType) toGo(d interface{}, v interface{}) error {
+	b, err := json.Marshal(toGeneric(d))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// toGeneric returns d without unions, so that it can be marshaled as JSON.
+// Bytes are marshaled as base64.
+func toGeneric(d interface{}) interface{} {
+	switch d := d.(type) {
+	case *unionDatum:
+		return toGeneric(d.value)
+	case []interface{}:
+		g := make([]interface{}, len(d))
+		for i, e := range d {
+			g[i] = toGeneric(e)
+		}
+		return g
+	case map[string]interface{}:
+		g := make(map[string]interface{}, len(d))
+		for k, e := range d {
+			g[k] = toGeneric(e)
+		}
+		return g
+	default:
+		return d
+	}
+}
+
+// fromGeneric converts g, a value decoded from JSON with numbers as
+// json.Number, to a datum of type t. If avroJSON is true, g is in the Avro JSON
+// encoding, which wraps the values of unions and encodes bytes as strings of
+// code points. Otherwise g is plain JSON, in which bytes are base64.
+func (t *avroType) fromGeneric(g interface{}, avroJSON bool) (interface{}, error) {
+	mismatch := func() (interface{}, error) {
+		return nil, fmt.Errorf("schema: %s value %v does not match the Avro schema", t.typeName(), g)
+	}
+	if g == nil && !avroJSON {
+		// Go marshals nil slices and maps as null.
+		switch t.kind {
+		case "bytes":
+			g = ""
+		case "array":
+			g = []interface{}{}
+		case "map":
+			g = map[string]interface{}{}
+		}
+	}
+	switch t.kind {
+	case "null":
+		if g != nil {
+			return mismatch()
+		}
+		return nil, nil
+
+	case "boolean":
+		if _, ok := g.(bool); !ok {
+			return mismatch()
+		}
+		return g, nil
+
+	case "int", "long":
+		n, ok := g.(json.Number)
+		if !ok {
+			return mismatch()
+		}
+		i, err := n.Int64()
+		if err != nil || (t.kind == "int" && (i < math.MinInt32 || i > math.MaxInt32)) {
+			return mismatch()
+		}
+		return i, nil
+
+	case "float", "double":
+		n, ok := g.(json.Number)
+		if !ok {
+			return mismatch()
+		}
+		f, err := n.Float64()
+		if err != nil {
+			return mismatch()
+		}
+		return f, nil
+
+	case "bytes", "fixed":
+		s, ok := g.(string)
+		if !ok {
+			return mismatch()
+		}
+		var b []byte
+		if avroJSON {
+			for _, r := range s {
+				if r > 0xff {
+					return mismatch()
+				}
+				b = append(b, byte(r))
+			}
+		} else {
+			var err error
+			if b, err = base64.StdEncoding.DecodeString(s); err != nil {
+				return mismatch()
+			}
+		}
+		if t.kind == "fixed" && len(b) != t.size {
+			return mismatch()
+		}
+		return b, nil
+
+	case "string":
+		if _, ok := g.(string); !ok {
+			return mismatch()
+		}
+		return g, nil
+
+	case "enum":
+		s, ok := g.(string)
+		if !ok || t.symbolIndex(s) < 0 {
+			return mismatch()
+		}
+		return s, nil
+
+	case "array":
+		a, ok := g.([]interface{})
+		if !ok {
+			return mismatch()
+		}
+		d := make([]interface{}, len(a))
+		for i, e := range a {
+			var err error
+			if d[i], err = t.items.fromGeneric(e, avroJSON); err != nil {
+				return nil, err
+			}
+		}
+		return d, nil
+
+	case "map":
+		m, ok := g.(map[string]interface{})
+		if !ok {
+			return mismatch()
+		}
+		d := make(map[string]interface{}, len(m))
+		for k, e := range m {
+			var err error
+			if d[k], err = t.items.fromGeneric(e, avroJSON); err != nil {
+				return nil, err
+			}
+		}
+		return d, nil
+
+	case "record":
+		m, ok := g.(map[string]interface{})
+		if !ok {
+			return mismatch()
+		}
+		d := make(map[string]interface{}, len(t.fields))
+		for _, f := range t.fields {
+			e, ok := m[f.name]
+			var err error
+			switch {
+			case ok:
+				d[f.name], err = f.typ.fromGeneric(e, avroJSON)
+			case f.hasDef:
+				// Defaults are in the Avro JSON encoding, except that a union's
+				// default is a value of its first branch.
+				if f.typ.kind == "union" {
+					var v interface{}
+					v, err = f.typ.branches[0].fromGeneric(jsonNumbers(f.def), true)
+					d[f.name] = &unionDatum{0, v}
+				} else {
+					d[f.name], err = f.typ.fromGeneric(jsonNumbers(f.def), true)
+				}
+			case !avroJSON && f.typ.nullBranch() >= 0:
+				d[f.name] = &unionDatum{f.typ.nullBranch(), nil}
+			default:
+				err = fmt.Errorf("schema: record %s is missing field %q", t.name, f.name)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		return d, nil
+
+	case "union":
+		if avroJSON {
+			if g == nil {
+				if i := t.nullBranch(); i >= 0 {
+					return &unionDatum{i, nil}, nil
+				}
+				return mismatch()
+			}
+			m, ok := g.(map[string]interface{})
+			if !ok || len(m) != 1 {
+				return mismatch()
+			}
+			for name, e := range m {
+				for i, b := range t.branches {
+					if b.typeName() == name {
+						v, err := b.fromGeneric(e, true)
+						if err != nil {
+							return nil, err
+						}
+						return &unionDatum{i, v}, nil
+					}
+				}
+			}
+			return mismatch()
+		}
+		// Use the first branch that the value matches.
+		for i, b := range t.branches {
+			if v, err := b.fromGeneric(g, false); err == nil {
+				return &unionDatum{i, v}, nil
+			}
+		}
+		return mismatch()
+
+	default:
+		return nil, fmt.Errorf("schema: unknown Avro type %q", t.kind)
+	}
+}
+
+// jsonNumbers returns g with float64s, as decoded by encoding/json without
+// UseNumber, replaced by json.Numbers.
+func jsonNumbers(g interface{}) interface{} {
+	switch g := g.(type) {
+	case float64:
+		return json.Number(fmt.Sprint(g))
+	case []interface{}:
+		a := make([]interface{}, len(g))
+		for i, e := range g {
+			a[i] = jsonNumbers(e)
+		}
+		return a
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(g))
+		for k, e := range g {
+			m[k] = jsonNumbers(e)
+		}
+		return m
+	default:
+		return g
+	}
+}
+
+func (t *avroType) symbolIndex(s string) int {
+	for i, sym := range t.symbols {
+		if sym == s {
+			return i
+		}
+	}
+	return -1
+}
+
+// nullBranch returns the index of the null branch of a union, or -1.
+func (t *avroType) nullBranch() int {
+	for i, b := range t.branches {
+		if b.kind == "null" {
+			return i
+		}
+	}
+	return -1
+}
+
+// encodeJSON returns the Avro JSON encoding of d.
+func (t *avroType) encodeJSON(d interface{}) ([]byte, error) {
+	return json.Marshal(t.avroJSON(d))
+}
+
+// avroJSON returns d in the Avro JSON encoding, ready to be marshaled.
+func (t *avroType) avroJSON(d interface{}) interface{} {
+	switch t.kind {
+	case "bytes", "fixed":
+		var sb strings.Builder
+		for _, b := range d.([]byte) {
+			sb.WriteRune(rune(b))
+		}
+		return sb.String()
+	case "array":
+		a := d.([]interface{})
+		j := make([]interface{}, len(a))
+		for i, e := range a {
+			j[i] = t.items.avroJSON(e)
+		}
+		return j
+	case "map":
+		m := d.(map[string]interface{})
+		j := make(map[string]interface{}, len(m))
+		for k, e := range m {
+			j[k] = t.items.avroJSON(e)
+		}
+		return j
+	case "record":
+		m := d.(map[string]interface{})
+		j := make(map[string]interface{}, len(t.fields))
+		for _, f := range t.fields {
+			j[f.name] = f.typ.avroJSON(m[f.name])
+		}
+		return j
+	case "union":
+		u := d.(*unionDatum)
+		b := t.branches[u.branch]
+		if b.kind == "null" {
+			return nil
+		}
+		return map[string]interface{}{b.typeName(): b.avroJSON(u.value)}
+	default:
+		return d
+	}
+}
+
+// decodeJSON decodes the Avro JSON encoding of a datum of type t.
+func (t *avroType) decodeJSON(data []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var g interface{}
+	if err := dec.Decode(&g); err != nil {
+		return nil, fmt.Errorf("schema: bad JSON: %v", err)
+	}
+	if dec.More() {
+		return nil, errors.New("schema: data after JSON value")
+	}
+	return t.fromGeneric(g, true)
+}
+
+// encodeBinary appends the Avro binary encoding of d to buf.
+func (t *avroType) encodeBinary(buf *bytes.Buffer, d interface{}) {
+	var tmp [binary.MaxVarintLen64]byte
+	writeLong := func(n int64) {
+		buf.Write(tmp[:binary.PutVarint(tmp[:], n)])
+	}
+	switch t.kind {
+	case "null":
+	case "boolean":
+		if d.(bool) {
+			buf.WriteByte(1)
+		} else {
+			buf.WriteByte(0)
+		}
+	case "int", "long":
+		writeLong(d.(int64))
+	case "float":
+		binary.LittleEndian.PutUint32(tmp[:4], math.Float32bits(float32(d.(float64))))
+		buf.Write(tmp[:4])
+	case "double":
+		binary.LittleEndian.PutUint64(tmp[:8], math.Float64bits(d.(float64)))
+		buf.Write(tmp[:8])
+	case "bytes":
+		writeLong(int64(len(d.([]byte))))
+		buf.Write(d.([]byte))
+	case "fixed":
+		buf.Write(d.([]byte))
+	case "string":
+		writeLong(int64(len(d.(string))))
+		buf.WriteString(d.(string))
+	case "enum":
+		writeLong(int64(t.symbolIndex(d.(string))))
+	case "array":
+		a := d.([]interface{})
+		if len(a) > 0 {
+			writeLong(int64(len(a)))
+			for _, e := range a {
+				t.items.encodeBinary(buf, e)
+			}
+		}
+		writeLong(0)
+	case "map":
+		m := d.(map[string]interface{})
+		if len(m) > 0 {
+			writeLong(int64(len(m)))
+			for k, e := range m {
+				writeLong(int64(len(k)))
+				buf.WriteString(k)
+				t.items.encodeBinary(buf, e)
+			}
+		}
+		writeLong(0)
+	case "record":
+		m := d.(map[string]interface{})
+		for _, f := range t.fields {
+			f.typ.encodeBinary(buf, m[f.name])
+		}
+	case "union":
+		u := d.(*unionDatum)
+		writeLong(int64(u.branch))
+		t.branches[u.branch].encodeBinary(buf, u.value)
+	}
+}
+
+// decodeBinary decodes the Avro binary encoding of a datum of type t. All of
+// data must be used.
+func (t *avroType) decodeBinary(data []byte) (interface{}, error) {
+	r := &avroReader{data: data}
+	d := t.read(r)
+	if r.err == nil && r.pos != len(r.data) {
+		r.err = fmt.Errorf("%d bytes after the value", len(r.data)-r.pos)
+	}
+	if r.err != nil {
+		return nil, fmt.Errorf("schema: data does not match the Avro schema: %v", r.err)
+	}
+	return d, nil
+}
+
+// avroReader reads Avro binary data. After an error, it returns zero values.
+type avroReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *avroReader) fail(err error) {
+	if r.err == nil {
+		r.err = err
+	}
+}
+
+func (r *avroReader) long() int64 {
+	if r.err != nil {
+		return 0
+	}
+	n, k := binary.Varint(r.data[r.pos:])
+	if k <= 0 {
+		r.fail(errors.New("bad varint"))
+		return 0
+	}
+	r.pos += k
+	return n
+}
+
+func (r *avroReader) bytes(n int64) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || n > int64(len(r.data)-r.pos) {
+		r.fail(fmt.Errorf("bad length %d", n))
+		return nil
+	}
+	b := r.data[r.pos : r.pos+int(n)]
+	r.pos += int(n)
+	return b
+}
+
+// blockCount returns the number of items in the next block of an array or
+// map, or 0 at the end.
+func (r *avroReader) blockCount() int64 {
+	n := r.long()
+	if n < 0 {
+		// A negative count is followed by the block's size in bytes.
+		n = -n
+		r.long()
+	}
+	if n > int64(len(r.data)) {
+		r.fail(fmt.Errorf("bad block count %d", n))
+		return 0
+	}
+	return n
+}
+
+func (t *avroType) read(r *avroReader) interface{} {
+	switch t.kind {
+	case "null":
+		return nil
+	case "boolean":
+		b := r.bytes(1)
+		if r.err != nil {
+			return false
+		}
+		if b[0] > 1 {
+			r.fail(fmt.Errorf("bad boolean %d", b[0]))
+		}
+		return b[0] == 1
+	case "int", "long":
+		n := r.long()
+		if t.kind == "int" && (n < math.MinInt32 || n > math.MaxInt32) {
+			r.fail(fmt.Errorf("int %d out of range", n))
+		}
+		return n
+	case "float":
+		b := r.bytes(4)
+		if r.err != nil {
+			return 0.0
+		}
+		return float64(math.Float32frombits(binary.LittleEndian.Uint32(b)))
+	case "double":
+		b := r.bytes(8)
+		if r.err != nil {
+			return 0.0
+		}
+		return math.Float64frombits(binary.LittleEndian.Uint64(b))
+	case "bytes":
+		return append([]byte(nil), r.bytes(r.long())...)
+	case "fixed":
+		return append([]byte(nil), r.bytes(int64(t.size))...)
+	case "string":
+		return string(r.bytes(r.long()))
+	case "enum":
+		i := r.long()
+		if i < 0 || i >= int64(len(t.symbols)) {
+			r.fail(fmt.Errorf("bad enum index %d", i))
+			return ""
+		}
+		return t.symbols[i]
+	case "array":
+		a := []interface{}{}
+		for n := r.blockCount(); n > 0 && r.err == nil; n = r.blockCount() {
+			for ; n > 0 && r.err == nil; n-- {
+				a = append(a, t.items.read(r))
+			}
+		}
+		return a
+	case "map":
+		m := map[string]interface{}{}
+		for n := r.blockCount(); n > 0 && r.err == nil; n = r.blockCount() {
+			for ; n > 0 && r.err == nil; n-- {
+				k := string(r.bytes(r.long()))
+				m[k] = t.items.read(r)
+			}
+		}
+		return m
+	case "record":
+		m := make(map[string]interface{}, len(t.fields))
+		for _, f := range t.fields {
+			m[f.name] = f.typ.read(r)
+		}
+		return m
+	case "union":
+		i := r.long()
+		if i < 0 || i >= int64(len(t.branches)) {
+			r.fail(fmt.Errorf("bad union index %d", i))
+			return nil
+		}
+		return &unionDatum{int(i), t.branches[i].read(r)}
+	}
+	r.fail(fmt.Errorf("unknown Avro type %q", t.kind))
+	return nil
+}
@@ -0,0 +1,209 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package schema validates, encodes and decodes message data according to
+// Avro and protocol buffer schemas. It is shared by the pubsub client and
+// pstest.
+package schema
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+)
+
+// Type is the type of a schema.
+type Type int
+
+const (
+	// ProtocolBuffer schemas name a protocol buffer message type that is
+	// registered with the github.com/golang/protobuf/proto package.
+	ProtocolBuffer Type = iota + 1
+	// Avro schemas are Avro schema declarations in JSON.
+	Avro
+)
+
+// Encoding is the encoding of message data.
+type Encoding int
+
+const (
+	// JSON is the JSON encoding of the schema's type.
+	JSON Encoding = iota + 1
+	// Binary is the binary encoding of the schema's type.
+	Binary
+)
+
+// Message attributes that record the schema and encoding of message data.
+const (
+	NameAttribute     = "googclient_schemaname"
+	EncodingAttribute = "googclient_schemaencoding"
+)
+
+func (e Encoding) String() string {
+	switch e {
+	case JSON:
+		return "JSON"
+	case Binary:
+		return "BINARY"
+	default:
+		return fmt.Sprintf("Encoding(%d)", int(e))
+	}
+}
+
+// ParseEncoding parses the value of EncodingAttribute.
+func ParseEncoding(s string) (Encoding, error) {
+	switch s {
+	case "JSON":
+		return JSON, nil
+	case "BINARY":
+		return Binary, nil
+	default:
+		return 0, fmt.Errorf("schema: unknown encoding %q", s)
+	}
+}
+
+// A Schema is a parsed schema definition.
+type Schema struct {
+	typ   Type
+	avro  *avroType    // for Avro schemas
+	proto reflect.Type // for ProtocolBuffer schemas; a pointer to a struct
+}
+
+// Parse parses the definition of a schema of type typ.
+func Parse(typ Type, definition string) (*Schema, error) {
+	switch typ {
+	case Avro:
+		t, err := parseAvro(definition)
+		if err != nil {
+			return nil, err
+		}
+		return &Schema{typ: typ, avro: t}, nil
+	case ProtocolBuffer:
+		t := proto.MessageType(definition)
+		if t == nil {
+			return nil, fmt.Errorf("schema: protocol buffer message type %q is not registered", definition)
+		}
+		return &Schema{typ: typ, proto: t}, nil
+	default:
+		return nil, fmt.Errorf("schema: unknown schema type %d", typ)
+	}
+}
+
+// Validate reports an error if data is not a valid encoding of a value of
+// the schema.
+func (s *Schema) Validate(data []byte, enc Encoding) error {
+	if s.typ == Avro {
+		_, err := s.avroDecode(data, enc)
+		return err
+	}
+	return s.Decode(data, enc, s.newMessage())
+}
+
+// Encode encodes v. For Avro schemas, v is converted to the schema's type
+// through encoding/json, so it may be a struct with JSON field tags, or a
+// map. For protocol buffer schemas, v must be a message of the schema's type.
+func (s *Schema) Encode(v interface{}, enc Encoding) ([]byte, error) {
+	if s.typ == Avro {
+		d, err := s.avro.fromGo(v)
+		if err != nil {
+			return nil, err
+		}
+		switch enc {
+		case Binary:
+			var buf bytes.Buffer
+			s.avro.encodeBinary(&buf, d)
+			return buf.Bytes(), nil
+		case JSON:
+			return s.avro.encodeJSON(d)
+		default:
+			return nil, fmt.Errorf("schema: unknown encoding %v", enc)
+		}
+	}
+	m, err := s.checkMessage(v)
+	if err != nil {
+		return nil, err
+	}
+	switch enc {
+	case Binary:
+		return proto.Marshal(m)
+	case JSON:
+		var buf bytes.Buffer
+		if err := (&jsonpb.Marshaler{}).Marshal(&buf, m); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	default:
+		return nil, fmt.Errorf("schema: unknown encoding %v", enc)
+	}
+}
+
+// Decode decodes data into v, which must be a pointer. For Avro schemas, the
+// decoded value is converted to v through encoding/json. For protocol
+// buffer schemas, v must be a message of the schema's type.
+func (s *Schema) Decode(data []byte, enc Encoding, v interface{}) error {
+	if s.typ == Avro {
+		d, err := s.avroDecode(data, enc)
+		if err != nil {
+			return err
+		}
+		return s.avro.toGo(d, v)
+	}
+	m, err := s.checkMessage(v)
+	if err != nil {
+		return err
+	}
+	switch enc {
+	case Binary:
+		err = proto.Unmarshal(data, m)
+	case JSON:
+		err = jsonpb.Unmarshal(bytes.NewReader(data), m)
+	default:
+		return fmt.Errorf("schema: unknown encoding %v", enc)
+	}
+	if err != nil {
+		return fmt.Errorf("schema: data does not match %s: %v", proto.MessageName(m), err)
+	}
+	return nil
+}
+
+func (s *Schema) avroDecode(data []byte, enc Encoding) (interface{}, error) {
+	switch enc {
+	case Binary:
+		return s.avro.decodeBinary(data)
+	case JSON:
+		return s.avro.decodeJSON(data)
+	default:
+		return nil, fmt.Errorf("schema: unknown encoding %v", enc)
+	}
+}
+
+func (s *Schema) newMessage() proto.Message {
+	return reflect.New(s.proto.Elem()).Interface().(proto.Message)
+}
+
+// checkMessage returns v as a message of the schema's type.
+func (s *Schema) checkMessage(v interface{}) (proto.Message, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, errors.New("schema: value is not a protocol buffer message")
+	}
+	if reflect.TypeOf(m) != s.proto {
+		return nil, fmt.Errorf("schema: got message of type %T, want %s", m, s.proto)
+	}
+	return m, nil
+}
@@ -0,0 +1,194 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package schema
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/smyte/google-cloud-go/internal/testutil"
+	"github.com/golang/protobuf/proto"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	pb "google.golang.org/genproto/googleapis/pubsub/v1"
+)
+
+const orderSchema = `{
+	"type": "record",
+	"name": "Order",
+	"namespace": "com.example",
+	"fields": [
+		{"name": "id", "type": "long"},
+		{"name": "item", "type": "string"},
+		{"name": "price", "type": "double"},
+		{"name": "tags", "type": {"type": "array", "items": "string"}},
+		{"name": "note", "type": ["null", "string"]},
+		{"name": "status", "type": {"type": "enum", "name": "Status", "symbols": ["NEW", "SHIPPED"]}, "default": "NEW"},
+		{"name": "payload", "type": "bytes"},
+		{"name": "next", "type": ["null", "Order"], "default": null}
+	]
+}`
+
+type order struct {
+	ID      int64    `json:"id"`
+	Item    string   `json:"item"`
+	Price   float64  `json:"price"`
+	Tags    []string `json:"tags"`
+	Note    *string  `json:"note"`
+	Status  string   `json:"status"`
+	Payload []byte   `json:"payload"`
+	Next    *order   `json:"next"`
+}
+
+func TestAvroRoundTrip(t *testing.T) {
+	s, err := Parse(Avro, orderSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	note := "fragile"
+	in := order{
+		ID:      7,
+		Item:    "widget",
+		Price:   2.5,
+		Tags:    []string{"a", "b"},
+		Note:    &note,
+		Status:  "SHIPPED",
+		Payload: []byte{0, 1, 0xff},
+		Next:    &order{ID: 8, Status: "NEW"},
+	}
+	for _, enc := range []Encoding{Binary, JSON} {
+		data, err := s.Encode(in, enc)
+		if err != nil {
+			t.Fatalf("%v: %v", enc, err)
+		}
+		if err := s.Validate(data, enc); err != nil {
+			t.Errorf("%v: %v", enc, err)
+		}
+		var out order
+		if err := s.Decode(data, enc, &out); err != nil {
+			t.Fatalf("%v: %v", enc, err)
+		}
+		if !testutil.Equal(out, in, cmpopts.EquateEmpty()) {
+			t.Errorf("%v: got %+v, want %+v", enc, out, in)
+		}
+	}
+}
+
+func TestAvroBinary(t *testing.T) {
+	s, err := Parse(Avro, `{"type": "record", "name": "R", "fields": [
+		{"name": "a", "type": "long"},
+		{"name": "b", "type": "string"},
+		{"name": "c", "type": ["null", "int"]}
+	]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Examples from the Avro specification: long -64 is 0x7f, string "foo"
+	// is 06 66 6f 6f, and a union index precedes the value.
+	got, err := s.Encode(map[string]interface{}{"a": -64, "b": "foo", "c": 2}, Binary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{0x7f, 0x06, 'f', 'o', 'o', 0x02, 0x04}
+	if !bytes.Equal(got, want) {
+		t.Errorf("got % x, want % x", got, want)
+	}
+	got, err = s.Encode(map[string]interface{}{"a": 1, "b": ""}, JSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"a":1,"b":"","c":null}`; string(got) != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	if err := s.Validate([]byte(`{"a":1,"b":"","c":{"int":3}}`), JSON); err != nil {
+		t.Error(err)
+	}
+
+	for _, data := range [][]byte{
+		{0x7f, 0x06, 'f', 'o'},                           // short string
+		{0x7f, 0x00, 0x06},                               // bad union index
+		{0x7f, 0x00, 0x00, 0x00},                         // trailing byte
+		{0x7f, 0x00, 0x02, 0x80, 0x80, 0x80, 0x80, 0x10}, // int out of range
+	} {
+		if err := s.Validate(data, Binary); err == nil {
+			t.Errorf("% x: got no error", data)
+		}
+	}
+	for _, data := range []string{
+		`{"a":1,"b":""}`,
+		`{"a":"1","b":"","c":null}`,
+		`{"a":1,"b":"","c":3}`,
+		`{"a":1.5,"b":"","c":null}`,
+		`{"a":1,"b":"","c":null} {}`,
+	} {
+		if err := s.Validate([]byte(data), JSON); err == nil {
+			t.Errorf("%s: got no error", data)
+		}
+	}
+	if _, err := s.Encode(map[string]interface{}{"a": "x", "b": ""}, Binary); err == nil {
+		t.Error("encoding a bad value: got no error")
+	}
+}
+
+func TestParseAvroErrors(t *testing.T) {
+	for _, def := range []string{
+		`{`,
+		`"nope"`,
+		`{"type": "record", "fields": []}`,
+		`{"type": "record", "name": "R", "fields": [{"name": "a", "type": "Missing"}]}`,
+		`{"type": "enum", "name": "E", "symbols": []}`,
+		`{"type": "fixed", "name": "F", "size": -1}`,
+		`[["null"]]`,
+	} {
+		if _, err := Parse(Avro, def); err == nil {
+			t.Errorf("%s: got no error", def)
+		}
+	}
+}
+
+func TestProtoSchema(t *testing.T) {
+	s, err := Parse(ProtocolBuffer, "google.pubsub.v1.PubsubMessage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := &pb.PubsubMessage{Data: []byte("d"), Attributes: map[string]string{"k": "v"}, OrderingKey: "o"}
+	for _, enc := range []Encoding{Binary, JSON} {
+		data, err := s.Encode(in, enc)
+		if err != nil {
+			t.Fatalf("%v: %v", enc, err)
+		}
+		if err := s.Validate(data, enc); err != nil {
+			t.Errorf("%v: %v", enc, err)
+		}
+		out := &pb.PubsubMessage{}
+		if err := s.Decode(data, enc, out); err != nil {
+			t.Fatalf("%v: %v", enc, err)
+		}
+		if !proto.Equal(out, in) {
+			t.Errorf("%v: got %v, want %v", enc, out, in)
+		}
+	}
+	if err := s.Validate([]byte(`{"nope": 1}`), JSON); err == nil {
+		t.Error("unknown JSON field: got no error")
+	}
+	if err := s.Validate([]byte{0xff}, Binary); err == nil {
+		t.Error("bad binary: got no error")
+	}
+	if _, err := s.Encode(&pb.Topic{}, Binary); err == nil {
+		t.Error("encoding a message of another type: got no error")
+	}
+	if _, err := Parse(ProtocolBuffer, "no.such.Message"); err == nil {
+		t.Error("unregistered message type: got no error")
+	}
+}
@@ -35,6 +35,13 @@ type Message struct {
 	// is labelled with.
 	Attributes map[string]string
 
+	// OrderingKey identifies related messages for which publish order should
+	// be respected. Messages with the same ordering key are delivered to
+	// subscriptions with EnableMessageOrdering in the order they were
+	// published. Publishing with an ordering key requires that the Topic's
+	// EnableMessageOrdering is true.
+	OrderingKey string
+
 	// ackID is the identifier to acknowledge this message.
 	ackID string
 
@@ -43,6 +50,12 @@ type Message struct {
 	// This field is read-only.
 	PublishTime time.Time
 
+	// DeliveryAttempt is the number of times the message has been delivered,
+	// counting this delivery. It is populated only for Messages obtained from
+	// a subscription with a DeadLetterPolicy, and is nil otherwise.
+	// This field is read-only.
+	DeliveryAttempt *int
+
 	// receiveTime is the time the message was received by the client.
 	receiveTime time.Time
 
@@ -64,12 +77,19 @@ func toMessage(resp *pb.ReceivedMessage) (*Message, error) {
 	if err != nil {
 		return nil, err
 	}
+	var deliveryAttempt *int
+	if resp.DeliveryAttempt > 0 {
+		da := int(resp.DeliveryAttempt)
+		deliveryAttempt = &da
+	}
 	return &Message{
-		ackID:       resp.AckId,
-		Data:        resp.Message.Data,
-		Attributes:  resp.Message.Attributes,
-		ID:          resp.Message.MessageId,
-		PublishTime: pubTime,
+		ackID:           resp.AckId,
+		Data:            resp.Message.Data,
+		Attributes:      resp.Message.Attributes,
+		ID:              resp.Message.MessageId,
+		PublishTime:     pubTime,
+		OrderingKey:     resp.Message.OrderingKey,
+		DeliveryAttempt: deliveryAttempt,
 	}, nil
 }
 
@@ -0,0 +1,201 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pstest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	pb "google.golang.org/genproto/googleapis/pubsub/v1"
+)
+
+// AdminHandler returns an HTTP handler for inspecting and controlling the
+// server from outside the process, as by the pstest command. Responses are
+// JSON. The handler serves:
+//
+//   GET  /topics                 the topics, as Topic protos in JSON
+//   GET  /subscriptions          the subscriptions, as Subscription protos in JSON
+//   GET  /messages[?topic=T]     the messages published, optionally only to topic T
+//   POST /messages/clear         calls ClearMessages
+//   POST /reset                  calls Reset
+//   GET  /clock                  the server's current time
+//   POST /clock/advance?d=D      advances the server's clock by the duration D
+//
+// Advancing the clock calls SetTimeNowFunc, so it affects every server in
+// the process.
+func (s *Server) AdminHandler() http.Handler {
+	a := &admin{s: s}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/topics", a.handle("GET", a.topics))
+	mux.HandleFunc("/subscriptions", a.handle("GET", a.subscriptions))
+	mux.HandleFunc("/messages", a.handle("GET", a.messages))
+	mux.HandleFunc("/messages/clear", a.handle("POST", func(*http.Request) (interface{}, error) {
+		s.ClearMessages()
+		return struct{}{}, nil
+	}))
+	mux.HandleFunc("/reset", a.handle("POST", func(*http.Request) (interface{}, error) {
+		s.Reset()
+		return struct{}{}, nil
+	}))
+	mux.HandleFunc("/clock", a.handle("GET", a.clock))
+	mux.HandleFunc("/clock/advance", a.handle("POST", a.advanceClock))
+	return mux
+}
+
+type admin struct {
+	s *Server
+
+	mu     sync.Mutex
+	offset time.Duration // added to time.Now by the clock
+}
+
+// errBadRequest wraps errors caused by the request.
+type errBadRequest struct{ err error }
+
+func (e errBadRequest) Error() string { return e.err.Error() }
+
+// handle returns a handler that serves requests with method by calling f
+// and writing its result as JSON.
+func (a *admin) handle(method string, f func(*http.Request) (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		v, err := f(r)
+		if err != nil {
+			code := http.StatusInternalServerError
+			if _, ok := err.(errBadRequest); ok {
+				code = http.StatusBadRequest
+			}
+			http.Error(w, err.Error(), code)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(v); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+func (a *admin) topics(*http.Request) (interface{}, error) {
+	res, err := a.s.GServer.ListTopics(context.Background(), &pb.ListTopicsRequest{})
+	if err != nil {
+		return nil, err
+	}
+	ms := make([]proto.Message, len(res.Topics))
+	for i, t := range res.Topics {
+		ms[i] = t
+	}
+	return protosToJSON(ms)
+}
+
+func (a *admin) subscriptions(*http.Request) (interface{}, error) {
+	res, err := a.s.GServer.ListSubscriptions(context.Background(), &pb.ListSubscriptionsRequest{})
+	if err != nil {
+		return nil, err
+	}
+	ms := make([]proto.Message, len(res.Subscriptions))
+	for i, s := range res.Subscriptions {
+		ms[i] = s
+	}
+	return protosToJSON(ms)
+}
+
+// protosToJSON encodes each of ms in the JSON format for protocol buffers.
+func protosToJSON(ms []proto.Message) ([]json.RawMessage, error) {
+	res := []json.RawMessage{}
+	for _, m := range ms {
+		var buf bytes.Buffer
+		if err := (&jsonpb.Marshaler{}).Marshal(&buf, m); err != nil {
+			return nil, err
+		}
+		res = append(res, buf.Bytes())
+	}
+	return res, nil
+}
+
+// adminMessage is the JSON form of a Message.
+type adminMessage struct {
+	ID          string            `json:"id"`
+	Topic       string            `json:"topic"`
+	Data        []byte            `json:"data"`
+	Attributes  map[string]string `json:"attributes,omitempty"`
+	OrderingKey string            `json:"orderingKey,omitempty"`
+	PublishTime time.Time         `json:"publishTime"`
+	Deliveries  int               `json:"deliveries"`
+	Acks        int               `json:"acks"`
+	Modacks     []Modack          `json:"modacks,omitempty"`
+}
+
+func (a *admin) messages(r *http.Request) (interface{}, error) {
+	topic := r.FormValue("topic")
+	s := &a.s.GServer
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := []adminMessage{}
+	for _, m := range s.msgs {
+		if topic != "" && m.topic != topic {
+			continue
+		}
+		res = append(res, adminMessage{
+			ID:          m.ID,
+			Topic:       m.topic,
+			Data:        m.Data,
+			Attributes:  m.Attributes,
+			OrderingKey: m.OrderingKey,
+			PublishTime: m.PublishTime,
+			Deliveries:  m.deliveries,
+			Acks:        m.acks,
+			Modacks:     append([]Modack(nil), m.Modacks...),
+		})
+	}
+	return res, nil
+}
+
+type adminClock struct {
+	Now    time.Time `json:"now"`
+	Offset string    `json:"offset"`
+}
+
+func (a *admin) clock(*http.Request) (interface{}, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return adminClock{Now: timeNow(), Offset: a.offset.String()}, nil
+}
+
+func (a *admin) advanceClock(r *http.Request) (interface{}, error) {
+	d, err := time.ParseDuration(r.FormValue("d"))
+	if err != nil {
+		return nil, errBadRequest{err}
+	}
+	if d < 0 {
+		return nil, errBadRequest{fmt.Errorf("cannot move the clock back by %s", d)}
+	}
+	a.mu.Lock()
+	a.offset += d
+	offset := a.offset
+	a.mu.Unlock()
+	SetTimeNowFunc(func() time.Time { return time.Now().Add(offset) })
+	return a.clock(r)
+}
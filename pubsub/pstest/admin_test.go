@@ -0,0 +1,119 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pstest
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	pb "google.golang.org/genproto/googleapis/pubsub/v1"
+)
+
+func TestAdminHandler(t *testing.T) {
+	ctx := context.Background()
+	pclient, sclient, srv, cleanup := newFake(ctx, t)
+	defer cleanup()
+	defer SetTimeNowFunc(nil)
+
+	hs := httptest.NewServer(srv.AdminHandler())
+	defer hs.Close()
+	call := func(method, path string, wantCode int, v interface{}) {
+		t.Helper()
+		req, err := http.NewRequest(method, hs.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		if res.StatusCode != wantCode {
+			t.Fatalf("%s %s: got status %d, want %d", method, path, res.StatusCode, wantCode)
+		}
+		if v != nil {
+			if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+				t.Fatalf("%s %s: %v", method, path, err)
+			}
+		}
+	}
+
+	top := mustCreateTopic(ctx, t, pclient, &pb.Topic{Name: "projects/P/topics/T"})
+	mustCreateTopic(ctx, t, pclient, &pb.Topic{Name: "projects/P/topics/U"})
+	mustCreateSubscription(ctx, t, sclient, &pb.Subscription{
+		Name:               "projects/P/subscriptions/S",
+		Topic:              top.Name,
+		AckDeadlineSeconds: 10,
+	})
+	srv.Publish(top.Name, []byte("hello"), map[string]string{"k": "v"})
+	srv.Publish("projects/P/topics/U", []byte("other"), nil)
+
+	var topics []struct{ Name string }
+	call("GET", "/topics", http.StatusOK, &topics)
+	if len(topics) != 2 || topics[0].Name != top.Name {
+		t.Errorf("got topics %+v", topics)
+	}
+	var subs []struct{ Name, Topic string }
+	call("GET", "/subscriptions", http.StatusOK, &subs)
+	if len(subs) != 1 || subs[0].Topic != top.Name {
+		t.Errorf("got subscriptions %+v", subs)
+	}
+	var msgs []adminMessage
+	call("GET", "/messages?topic="+top.Name, http.StatusOK, &msgs)
+	if len(msgs) != 1 || string(msgs[0].Data) != "hello" || msgs[0].Attributes["k"] != "v" {
+		t.Errorf("got messages %+v", msgs)
+	}
+	call("POST", "/topics", http.StatusMethodNotAllowed, nil)
+
+	var c adminClock
+	call("POST", "/clock/advance?d=2h", http.StatusOK, &c)
+	if d := c.Now.Sub(time.Now()); d < 119*time.Minute || d > 2*time.Hour {
+		t.Errorf("after advancing the clock by 2h, got %s", c.Now)
+	}
+	if got := timeNow().Sub(time.Now()); got < 119*time.Minute {
+		t.Errorf("server clock is %s ahead, want 2h", got)
+	}
+	call("POST", "/clock/advance?d=x", http.StatusBadRequest, nil)
+	call("POST", "/clock/advance?d=-1s", http.StatusBadRequest, nil)
+
+	call("POST", "/messages/clear", http.StatusOK, nil)
+	call("GET", "/messages", http.StatusOK, &msgs)
+	if len(msgs) != 0 {
+		t.Errorf("after clear, got %d messages", len(msgs))
+	}
+	call("POST", "/reset", http.StatusOK, nil)
+	call("GET", "/topics", http.StatusOK, &topics)
+	call("GET", "/subscriptions", http.StatusOK, &subs)
+	if len(topics) != 0 || len(subs) != 0 {
+		t.Errorf("after reset, got topics %+v and subscriptions %+v", topics, subs)
+	}
+	// The server is usable after a reset.
+	mustCreateTopic(ctx, t, pclient, &pb.Topic{Name: top.Name})
+}
+
+func TestNewServerWithAddr(t *testing.T) {
+	srv, err := NewServerWithAddr("localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewServerWithAddr(srv.Addr); err == nil {
+		t.Error("listening on an address in use: got no error")
+	}
+	srv.Close()
+}
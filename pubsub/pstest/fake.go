@@ -17,6 +17,14 @@
 // differently from the actual service in ways in which the service is
 // non-deterministic or unspecified: timing, delivery order, etc.
 //
+// Subscriptions with a push endpoint have their messages POSTed to it over HTTP,
+// so push handlers can be tested against an httptest.Server. See Server.OIDCKey
+// for verifying the tokens of authenticated push requests.
+//
+// The command github.com/smyte/google-cloud-go/pubsub/cmd/pstest runs the fake as
+// a standalone emulator, with an HTTP API for inspecting and resetting its
+// state. See Server.AdminHandler.
+//
 // This package is EXPERIMENTAL and is subject to change without notice.
 //
 // See the example for usage.
@@ -24,6 +32,7 @@ package pstest
 
 import (
 	"context"
+	"crypto/rsa"
 	"fmt"
 	"io"
 	"path"
@@ -57,6 +66,18 @@ func timeNow() time.Time {
 	return now.Load().(func() time.Time)()
 }
 
+// SetTimeNowFunc makes the fake use f to tell the time, so that tests can
+// advance it deterministically. The time decides when messages fall out of
+// their subscription's retention duration and when idle subscriptions expire.
+// A nil f restores time.Now. The same caveats as for the now variable apply:
+// do not call SetTimeNowFunc while another test is using the fake.
+func SetTimeNowFunc(f func() time.Time) {
+	if f == nil {
+		f = time.Now
+	}
+	now.Store(f)
+}
+
 // Server is a fake Pub/Sub server.
 type Server struct {
 	srv     *testutil.Server
@@ -75,9 +96,13 @@ type GServer struct {
 	subs          map[string]*subscription
 	msgs          []*Message // all messages ever published
 	msgsByID      map[string]*Message
+	snapshots     map[string]*snapshot
 	wg            sync.WaitGroup
 	nextID        int
+	nextSnapID    int
 	streamTimeout time.Duration
+	oidcKeyOnce   sync.Once
+	oidcKeyVal    *rsa.PrivateKey // signs OIDC tokens of push requests
 }
 
 // NewServer creates a new fake server running in the current process.
@@ -86,13 +111,29 @@ func NewServer() *Server {
 	if err != nil {
 		panic(fmt.Sprintf("pstest.NewServer: %v", err))
 	}
+	return newServer(srv)
+}
+
+// NewServerWithAddr creates a new fake server running in the current process
+// and listening at addr, a "host:port" address as for net.Listen. Unlike
+// NewServer, it returns an error if it cannot listen at addr.
+func NewServerWithAddr(addr string) (*Server, error) {
+	srv, err := testutil.NewServerWithAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	return newServer(srv), nil
+}
+
+func newServer(srv *testutil.Server) *Server {
 	s := &Server{
 		srv:  srv,
 		Addr: srv.Addr,
 		GServer: GServer{
-			topics:   map[string]*topic{},
-			subs:     map[string]*subscription{},
-			msgsByID: map[string]*Message{},
+			topics:    map[string]*topic{},
+			subs:      map[string]*subscription{},
+			msgsByID:  map[string]*Message{},
+			snapshots: map[string]*snapshot{},
 		},
 	}
 	pb.RegisterPublisherServer(srv.Gsrv, &s.GServer)
@@ -142,6 +183,7 @@ type Message struct {
 	ID          string
 	Data        []byte
 	Attributes  map[string]string
+	OrderingKey string
 	PublishTime time.Time
 	Deliveries  int // number of times delivery of the message was attempted
 	Acks        int // number of acks received from clients
@@ -150,7 +192,9 @@ type Message struct {
 	deliveries int
 	acks       int
 	Modacks    []Modack // modacks received by server for this message
-
+	seq        int      // order of publication
+	topic      string   // name of the topic the message was published to
+	proto      *pb.PubsubMessage
 }
 
 // Modack represents a modack sent to the server.
@@ -202,6 +246,21 @@ func (s *Server) ClearMessages() {
 	s.GServer.mu.Unlock()
 }
 
+// Reset deletes all topics, subscriptions, snapshots and messages, returning
+// the server to its initial state.
+func (s *Server) Reset() {
+	s.GServer.mu.Lock()
+	defer s.GServer.mu.Unlock()
+	for _, sub := range s.GServer.subs {
+		sub.stop()
+	}
+	s.GServer.topics = map[string]*topic{}
+	s.GServer.subs = map[string]*subscription{}
+	s.GServer.snapshots = map[string]*snapshot{}
+	s.GServer.msgs = nil
+	s.GServer.msgsByID = map[string]*Message{}
+}
+
 // Close shuts down the server and releases all resources.
 func (s *Server) Close() error {
 	s.srv.Close()
@@ -309,6 +368,11 @@ func (s *GServer) DeleteTopic(_ context.Context, req *pb.DeleteTopicRequest) (*e
 	}
 	t.stop()
 	delete(s.topics, req.Topic)
+	for _, snap := range s.snapshots {
+		if snap.proto.Topic == req.Topic {
+			snap.proto.Topic = "_deleted-topic_"
+		}
+	}
 	return &emptypb.Empty{}, nil
 }
 
@@ -341,8 +405,23 @@ func (s *GServer) CreateSubscription(_ context.Context, ps *pb.Subscription) (*p
 	if ps.PushConfig == nil {
 		ps.PushConfig = &pb.PushConfig{}
 	}
+	if err := s.checkDeadLetterPolicy(ps.DeadLetterPolicy); err != nil {
+		return nil, err
+	}
+	if err := checkExpirationPolicy(ps.ExpirationPolicy); err != nil {
+		return nil, err
+	}
+	var filter messageFilter
+	if f := subscriptionFilter(ps); f != "" {
+		var err error
+		if filter, err = parseFilter(f); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+		}
+	}
 
 	sub := newSubscription(top, &s.mu, ps)
+	sub.server = s
+	sub.filter = filter
 	top.subs[ps.Name] = sub
 	s.subs[ps.Name] = sub
 	sub.start(&s.wg)
@@ -385,6 +464,49 @@ const (
 
 var defaultMessageRetentionDuration = ptypes.DurationProto(maxMessageRetentionDuration)
 
+const (
+	minExpirationTTL     = 24 * time.Hour
+	defaultExpirationTTL = 31 * 24 * time.Hour
+)
+
+func checkExpirationPolicy(ep *pb.ExpirationPolicy) error {
+	if ep.GetTtl() == nil {
+		return nil
+	}
+	ttl, err := ptypes.Duration(ep.Ttl)
+	if err != nil || ttl < minExpirationTTL {
+		return status.Errorf(codes.InvalidArgument, "bad expiration_policy %+v", ep)
+	}
+	return nil
+}
+
+const (
+	defaultMaxDeliveryAttempts = 5
+	maxMaxDeliveryAttempts     = 100
+)
+
+// checkDeadLetterPolicy validates dlp and fills in its defaults.
+// Must be called with the lock held.
+func (s *GServer) checkDeadLetterPolicy(dlp *pb.DeadLetterPolicy) error {
+	if dlp == nil {
+		return nil
+	}
+	if dlp.DeadLetterTopic == "" {
+		return status.Errorf(codes.InvalidArgument, "missing dead letter topic")
+	}
+	if s.topics[dlp.DeadLetterTopic] == nil {
+		return status.Errorf(codes.NotFound, "dead letter topic %q", dlp.DeadLetterTopic)
+	}
+	if dlp.MaxDeliveryAttempts == 0 {
+		dlp.MaxDeliveryAttempts = defaultMaxDeliveryAttempts
+	}
+	if dlp.MaxDeliveryAttempts < defaultMaxDeliveryAttempts || dlp.MaxDeliveryAttempts > maxMaxDeliveryAttempts {
+		return status.Errorf(codes.InvalidArgument, "max delivery attempts %d must be between %d and %d",
+			dlp.MaxDeliveryAttempts, defaultMaxDeliveryAttempts, maxMaxDeliveryAttempts)
+	}
+	return nil
+}
+
 func checkMRD(pmrd *durpb.Duration) error {
 	mrd, err := ptypes.Duration(pmrd)
 	if err != nil || mrd < minMessageRetentionDuration || mrd > maxMessageRetentionDuration {
@@ -427,6 +549,9 @@ func (s *GServer) UpdateSubscription(_ context.Context, req *pb.UpdateSubscripti
 
 		case "retain_acked_messages":
 			sub.proto.RetainAckedMessages = req.Subscription.RetainAckedMessages
+			if !sub.proto.RetainAckedMessages {
+				sub.acked = map[string]*Message{}
+			}
 
 		case "message_retention_duration":
 			if err := checkMRD(req.Subscription.MessageRetentionDuration); err != nil {
@@ -438,8 +563,17 @@ func (s *GServer) UpdateSubscription(_ context.Context, req *pb.UpdateSubscripti
 			sub.proto.Labels = req.Subscription.Labels
 
 		case "expiration_policy":
+			if err := checkExpirationPolicy(req.Subscription.ExpirationPolicy); err != nil {
+				return nil, err
+			}
 			sub.proto.ExpirationPolicy = req.Subscription.ExpirationPolicy
 
+		case "dead_letter_policy":
+			if err := s.checkDeadLetterPolicy(req.Subscription.DeadLetterPolicy); err != nil {
+				return nil, err
+			}
+			sub.proto.DeadLetterPolicy = req.Subscription.DeadLetterPolicy
+
 		default:
 			return nil, status.Errorf(codes.InvalidArgument, "unknown field name %q", path)
 		}
@@ -476,10 +610,15 @@ func (s *GServer) DeleteSubscription(_ context.Context, req *pb.DeleteSubscripti
 	if err != nil {
 		return nil, err
 	}
+	s.deleteSubscription(sub)
+	return &emptypb.Empty{}, nil
+}
+
+// Must be called with the lock held.
+func (s *GServer) deleteSubscription(sub *subscription) {
 	sub.stop()
-	delete(s.subs, req.Subscription)
+	delete(s.subs, sub.proto.Name)
 	sub.topic.deleteSub(sub)
-	return &emptypb.Empty{}, nil
 }
 
 func (s *GServer) Publish(_ context.Context, req *pb.PublishRequest) (*pb.PublishResponse, error) {
@@ -493,34 +632,59 @@ func (s *GServer) Publish(_ context.Context, req *pb.PublishRequest) (*pb.Publis
 	if top == nil {
 		return nil, status.Errorf(codes.NotFound, "topic %q", req.Topic)
 	}
+	if top.schema != nil {
+		for _, pm := range req.Messages {
+			if err := top.schema.check(pm); err != nil {
+				return nil, err
+			}
+		}
+		for _, pm := range req.Messages {
+			top.schema.annotate(pm)
+		}
+	}
 	var ids []string
 	for _, pm := range req.Messages {
-		id := fmt.Sprintf("m%d", s.nextID)
-		s.nextID++
-		pm.MessageId = id
-		pubTime := timeNow()
-		tsPubTime, err := ptypes.TimestampProto(pubTime)
+		id, err := s.publish(top, pm)
 		if err != nil {
-			return nil, status.Errorf(codes.Internal, err.Error())
+			return nil, err
 		}
-		pm.PublishTime = tsPubTime
-		m := &Message{
-			ID:          id,
-			Data:        pm.Data,
-			Attributes:  pm.Attributes,
-			PublishTime: pubTime,
-		}
-		top.publish(pm, m)
 		ids = append(ids, id)
-		s.msgs = append(s.msgs, m)
-		s.msgsByID[id] = m
 	}
 	return &pb.PublishResponse{MessageIds: ids}, nil
 }
 
+// publish publishes pm to top and returns its ID.
+// Must be called with the lock held.
+func (s *GServer) publish(top *topic, pm *pb.PubsubMessage) (string, error) {
+	id := fmt.Sprintf("m%d", s.nextID)
+	s.nextID++
+	pm.MessageId = id
+	pubTime := timeNow()
+	tsPubTime, err := ptypes.TimestampProto(pubTime)
+	if err != nil {
+		return "", status.Errorf(codes.Internal, err.Error())
+	}
+	pm.PublishTime = tsPubTime
+	m := &Message{
+		ID:          id,
+		Data:        pm.Data,
+		Attributes:  pm.Attributes,
+		OrderingKey: pm.OrderingKey,
+		PublishTime: pubTime,
+		seq:         s.nextID,
+		topic:       top.proto.Name,
+		proto:       pm,
+	}
+	top.publish(m)
+	s.msgs = append(s.msgs, m)
+	s.msgsByID[id] = m
+	return id, nil
+}
+
 type topic struct {
-	proto *pb.Topic
-	subs  map[string]*subscription
+	proto  *pb.Topic
+	subs   map[string]*subscription
+	schema *topicSchema // nil if the topic has no schema
 }
 
 func newTopic(pt *pb.Topic) *topic {
@@ -541,29 +705,31 @@ func (t *topic) deleteSub(sub *subscription) {
 	delete(t.subs, sub.proto.Name)
 }
 
-func (t *topic) publish(pm *pb.PubsubMessage, m *Message) {
+func (t *topic) publish(m *Message) {
 	for _, s := range t.subs {
-		s.msgs[pm.MessageId] = &message{
-			publishTime: m.PublishTime,
-			proto: &pb.ReceivedMessage{
-				AckId:   pm.MessageId,
-				Message: pm,
-			},
-			deliveries:  &m.deliveries,
-			acks:        &m.acks,
-			streamIndex: -1,
+		if s.matches(m) {
+			s.msgs[m.ID] = newMessage(m)
 		}
 	}
 }
 
 type subscription struct {
 	topic      *topic
-	mu         *sync.Mutex // the server mutex, here for convenience
+	server     *GServer      // for dead lettering; nil in some tests
+	mu         *sync.Mutex   // the server mutex, here for convenience
+	filter     messageFilter // nil if the subscription has no filter
 	proto      *pb.Subscription
 	ackTimeout time.Duration
 	msgs       map[string]*message // unacked messages by message ID
+	acked      map[string]*Message // acked messages kept for seeking, by ID
 	streams    []*stream
 	done       chan struct{}
+	wg         *sync.WaitGroup // the server's, which tracks pushes; set by start
+
+	// lastActivity is the last time a client pulled, acked or modacked,
+	// or a push succeeded. Subscriptions expire after a period without
+	// activity.
+	lastActivity time.Time
 }
 
 func newSubscription(t *topic, mu *sync.Mutex, ps *pb.Subscription) *subscription {
@@ -572,16 +738,19 @@ func newSubscription(t *topic, mu *sync.Mutex, ps *pb.Subscription) *subscriptio
 		at = 10 * time.Second
 	}
 	return &subscription{
-		topic:      t,
-		mu:         mu,
-		proto:      ps,
-		ackTimeout: at,
-		msgs:       map[string]*message{},
-		done:       make(chan struct{}),
+		topic:        t,
+		mu:           mu,
+		proto:        ps,
+		ackTimeout:   at,
+		msgs:         map[string]*message{},
+		acked:        map[string]*Message{},
+		done:         make(chan struct{}),
+		lastActivity: timeNow(),
 	}
 }
 
 func (s *subscription) start(wg *sync.WaitGroup) {
+	s.wg = wg
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
@@ -611,6 +780,7 @@ func (s *GServer) Acknowledge(_ context.Context, req *pb.AcknowledgeRequest) (*e
 	for _, id := range req.AckIds {
 		sub.ack(id)
 	}
+	sub.lastActivity = timeNow()
 	return &emptypb.Empty{}, nil
 }
 
@@ -629,6 +799,7 @@ func (s *GServer) ModifyAckDeadline(_ context.Context, req *pb.ModifyAckDeadline
 	for _, id := range req.AckIds {
 		sub.modifyAckDeadline(id, dur)
 	}
+	sub.lastActivity = timeNow()
 	return &emptypb.Empty{}, nil
 }
 
@@ -647,6 +818,7 @@ func (s *GServer) Pull(ctx context.Context, req *pb.PullRequest) (*pb.PullRespon
 	if max == 0 { // MaxMessages not specified; use a default.
 		max = 1000
 	}
+	sub.lastActivity = timeNow()
 	msgs := sub.pull(max)
 	s.mu.Unlock()
 	// Implement the spec from the pubsub proto:
@@ -689,55 +861,57 @@ func (s *GServer) StreamingPull(sps pb.Subscriber_StreamingPullServer) error {
 }
 
 func (s *GServer) Seek(ctx context.Context, req *pb.SeekRequest) (*pb.SeekResponse, error) {
-	// Only handle time-based seeking for now.
-	// This fake doesn't deal with snapshots.
-	var target time.Time
-	switch v := req.Target.(type) {
-	case nil:
-		return nil, status.Errorf(codes.InvalidArgument, "missing Seek target type")
-	case *pb.SeekRequest_Time:
-		var err error
-		target, err = ptypes.Timestamp(v.Time)
-		if err != nil {
-			return nil, status.Errorf(codes.InvalidArgument, "bad Time target: %v", err)
-		}
-	default:
-		return nil, status.Errorf(codes.Unimplemented, "unhandled Seek target type %T", v)
-	}
-
 	// The entire server must be locked while doing the work below,
 	// because the messages don't have any other synchronization.
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	if req.Target == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "missing Seek target type")
+	}
 	sub, err := s.findSubscription(req.Subscription)
 	if err != nil {
 		return nil, err
 	}
-	// Drop all messages from sub that were published before the target time.
-	for id, m := range sub.msgs {
-		if m.publishTime.Before(target) {
-			delete(sub.msgs, id)
-			(*m.acks)++
+	sub.maintainMessages(timeNow())
+	var msgs []*Message // the messages that are unacked after the seek
+	switch v := req.Target.(type) {
+	case *pb.SeekRequest_Time:
+		target, err := ptypes.Timestamp(v.Time)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "bad Time target: %v", err)
 		}
-	}
-	// Un-ack any already-acked messages after this time;
-	// redelivering them to the subscription is the closest analogue here.
-	for _, m := range s.msgs {
-		if m.PublishTime.Before(target) {
-			continue
+		// Retained messages published before the target time are acked,
+		// and the others are redelivered.
+		for _, m := range sub.retained() {
+			if !m.PublishTime.Before(target) {
+				msgs = append(msgs, m)
+			}
+		}
+	case *pb.SeekRequest_Snapshot:
+		snap, err := s.findSnapshot(v.Snapshot)
+		if err != nil {
+			return nil, err
+		}
+		if snap.proto.Topic != sub.proto.Topic {
+			return nil, status.Errorf(codes.InvalidArgument, "snapshot %q is for topic %q, not %q",
+				v.Snapshot, snap.proto.Topic, sub.proto.Topic)
+		}
+		// Messages unacked when the snapshot was taken and those published
+		// since then are redelivered.
+		for _, m := range snap.msgs {
+			if sub.matches(m) {
+				msgs = append(msgs, m)
+			}
 		}
-		sub.msgs[m.ID] = &message{
-			publishTime: m.PublishTime,
-			proto: &pb.ReceivedMessage{
-				AckId: m.ID,
-				// This was not preserved!
-				//Message: pm,
-			},
-			deliveries:  &m.deliveries,
-			acks:        &m.acks,
-			streamIndex: -1,
+		for _, m := range s.msgs {
+			if m.seq > snap.seq && sub.matches(m) {
+				msgs = append(msgs, m)
+			}
 		}
+	default:
+		return nil, status.Errorf(codes.Unimplemented, "unhandled Seek target type %T", v)
 	}
+	sub.seek(msgs)
 	return &pb.SeekResponse{}, nil
 }
 
@@ -754,18 +928,57 @@ func (s *GServer) findSubscription(name string) (*subscription, error) {
 	return sub, nil
 }
 
+// matches reports whether m was published to the topic of s and passes its
+// filter.
+func (s *subscription) matches(m *Message) bool {
+	return m.topic == s.topic.proto.Name && (s.filter == nil || s.filter(m.Attributes))
+}
+
+// seek makes msgs the unacked messages of s, redelivering them. Other
+// unacked messages are acked.
+// Must be called with the lock held.
+func (s *subscription) seek(msgs []*Message) {
+	keep := map[string]bool{}
+	for _, m := range msgs {
+		keep[m.ID] = true
+	}
+	for id := range s.msgs {
+		if !keep[id] {
+			s.ack(id)
+		}
+	}
+	for _, m := range msgs {
+		s.msgs[m.ID] = newMessage(m)
+		delete(s.acked, m.ID)
+	}
+}
+
+// retained returns the messages retained by s: the unacked ones, and the
+// acked ones if it retains acked messages.
+// Must be called with the lock held.
+func (s *subscription) retained() []*Message {
+	var msgs []*Message
+	for _, m := range s.msgs {
+		if m.msg != nil {
+			msgs = append(msgs, m.msg)
+		}
+	}
+	for _, m := range s.acked {
+		msgs = append(msgs, m)
+	}
+	return msgs
+}
+
 // Must be called with the lock held.
 func (s *subscription) pull(max int) []*pb.ReceivedMessage {
 	now := timeNow()
 	s.maintainMessages(now)
 	var msgs []*pb.ReceivedMessage
-	for _, m := range s.msgs {
-		if m.outstanding() {
-			continue
-		}
+	for _, m := range s.deliverable() {
+		msgs = append(msgs, s.received(m))
 		(*m.deliveries)++
+		m.attempts++
 		m.ackDeadline = now.Add(s.ackTimeout)
-		msgs = append(msgs, m.proto)
 		if len(msgs) >= max {
 			break
 		}
@@ -778,13 +991,18 @@ func (s *subscription) deliver() {
 	defer s.mu.Unlock()
 
 	now := timeNow()
+	if s.expired(now) {
+		s.server.deleteSubscription(s)
+		return
+	}
 	s.maintainMessages(now)
+	if s.isPush() {
+		s.push(now)
+		return
+	}
 	// Try to deliver each remaining message.
 	curIndex := 0
-	for _, m := range s.msgs {
-		if m.outstanding() {
-			continue
-		}
+	for _, m := range s.deliverable() {
 		// If the message was never delivered before, start with the stream at
 		// curIndex. If it was delivered before, start with the stream after the one
 		// that owned it.
@@ -805,6 +1023,58 @@ func (s *subscription) deliver() {
 	}
 }
 
+// received returns the ReceivedMessage for the next delivery of m. If the
+// subscription has a dead letter policy, it includes the delivery attempt.
+//
+// Must be called with the lock held.
+func (s *subscription) received(m *message) *pb.ReceivedMessage {
+	if s.proto.DeadLetterPolicy == nil || m.proto == nil {
+		return m.proto
+	}
+	return &pb.ReceivedMessage{
+		AckId:           m.proto.AckId,
+		Message:         m.proto.Message,
+		DeliveryAttempt: int32(m.attempts + 1),
+	}
+}
+
+// deliverable returns the messages that may be delivered. If the
+// subscription has message ordering enabled, they are in publish order, and
+// a message with an ordering key is deliverable only if every earlier message
+// with its key has been acked.
+//
+// Must be called with the lock held.
+func (s *subscription) deliverable() []*message {
+	var msgs []*message
+	if !s.proto.EnableMessageOrdering {
+		for _, m := range s.msgs {
+			if !m.outstanding() {
+				msgs = append(msgs, m)
+			}
+		}
+		return msgs
+	}
+	all := make([]*message, 0, len(s.msgs))
+	for _, m := range s.msgs {
+		all = append(all, m)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].seq < all[j].seq })
+	blocked := map[string]bool{} // ordering keys with an earlier unacked message
+	for _, m := range all {
+		key := m.proto.Message.GetOrderingKey()
+		if key != "" {
+			if blocked[key] {
+				continue
+			}
+			blocked[key] = true
+		}
+		if !m.outstanding() {
+			msgs = append(msgs, m)
+		}
+	}
+	return msgs
+}
+
 // tryDeliverMessage attempts to deliver m to the stream at index i. If it can't, it
 // tries streams i+1, i+2, ..., wrapping around. Once it's tried all streams, it
 // exits.
@@ -823,8 +1093,9 @@ func (s *subscription) tryDeliverMessage(m *message, start int, now time.Time) (
 			s.streams = deleteStreamAt(s.streams, idx)
 			i--
 
-		case st.msgc <- m.proto:
+		case st.msgc <- s.received(m):
 			(*m.deliveries)++
+			m.attempts++
 			m.ackDeadline = now.Add(st.ackTimeout)
 			return idx, true
 
@@ -834,26 +1105,91 @@ func (s *subscription) tryDeliverMessage(m *message, start int, now time.Time) (
 	return 0, false
 }
 
-var retentionDuration = 10 * time.Minute
+// retention returns how long s retains messages after they are published.
+// Must be called with the lock held.
+func (s *subscription) retention() time.Duration {
+	d, err := ptypes.Duration(s.proto.MessageRetentionDuration)
+	if err != nil {
+		return maxMessageRetentionDuration
+	}
+	return d
+}
+
+// expired reports whether s has had no activity for longer than the TTL of
+// its expiration policy. A subscription with open streams is active.
+// Must be called with the lock held.
+func (s *subscription) expired(now time.Time) bool {
+	if s.server == nil {
+		return false
+	}
+	if len(s.streams) > 0 {
+		s.lastActivity = now
+		return false
+	}
+	ttl := defaultExpirationTTL
+	if ep := s.proto.ExpirationPolicy; ep != nil {
+		if ep.Ttl == nil {
+			return false // never expires
+		}
+		var err error
+		if ttl, err = ptypes.Duration(ep.Ttl); err != nil {
+			return false
+		}
+	}
+	return now.Sub(s.lastActivity) > ttl
+}
 
 // Must be called with the lock held.
 func (s *subscription) maintainMessages(now time.Time) {
+	retention := s.retention()
+	for id, m := range s.acked {
+		if now.Sub(m.PublishTime) > retention {
+			delete(s.acked, id)
+		}
+	}
 	for id, m := range s.msgs {
 		// Mark a message as re-deliverable if its ack deadline has expired.
 		if m.outstanding() && now.After(m.ackDeadline) {
 			m.makeAvailable()
 		}
+		if !m.outstanding() && s.deadLetter(m) {
+			delete(s.msgs, id)
+			continue
+		}
 		pubTime, err := ptypes.Timestamp(m.proto.Message.PublishTime)
 		if err != nil {
 			panic(err)
 		}
-		// Remove messages that have been undelivered for a long time.
-		if !m.outstanding() && now.Sub(pubTime) > retentionDuration {
+		// Remove messages that are older than the retention duration.
+		if !m.outstanding() && now.Sub(pubTime) > retention {
 			delete(s.msgs, id)
 		}
 	}
 }
 
+// deadLetter forwards m to the subscription's dead letter topic if every
+// allowed delivery attempt has failed. It reports whether m was forwarded.
+// Messages are not forwarded while the dead letter topic does not exist.
+//
+// Must be called with the lock held.
+func (s *subscription) deadLetter(m *message) bool {
+	dlp := s.proto.DeadLetterPolicy
+	if dlp == nil || s.server == nil || m.attempts < int(dlp.MaxDeliveryAttempts) {
+		return false
+	}
+	top := s.server.topics[dlp.DeadLetterTopic]
+	if top == nil {
+		return false
+	}
+	pm := m.proto.GetMessage()
+	_, err := s.server.publish(top, &pb.PubsubMessage{
+		Data:        pm.GetData(),
+		Attributes:  pm.GetAttributes(),
+		OrderingKey: pm.GetOrderingKey(),
+	})
+	return err == nil
+}
+
 func (s *subscription) newStream(gs pb.Subscriber_StreamingPullServer, timeout time.Duration) *stream {
 	st := &stream{
 		sub:        s,
@@ -894,6 +1230,25 @@ type message struct {
 	deliveries  *int
 	acks        *int
 	streamIndex int // index of stream that currently owns msg, for round-robin delivery
+	seq         int      // order of publication
+	attempts    int      // number of deliveries to this subscription
+	msg         *Message // the published message; nil in some tests
+}
+
+// newMessage returns a message for delivering m to a subscription.
+func newMessage(m *Message) *message {
+	return &message{
+		publishTime: m.PublishTime,
+		seq:         m.seq,
+		proto: &pb.ReceivedMessage{
+			AckId:   m.ID,
+			Message: m.proto,
+		},
+		deliveries:  &m.deliveries,
+		acks:        &m.acks,
+		streamIndex: -1,
+		msg:         m,
+	}
 }
 
 // A message is outstanding if it is owned by some stream.
@@ -989,6 +1344,9 @@ func (s *subscription) ack(id string) {
 	if m != nil {
 		(*m.acks)++
 		delete(s.msgs, id)
+		if s.proto.RetainAckedMessages && m.msg != nil {
+			s.acked[id] = m.msg
+		}
 	}
 }
 
@@ -16,14 +16,24 @@ package pstest
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/smyte/google-cloud-go/internal/testutil"
 	"github.com/golang/protobuf/ptypes"
+	tspb "github.com/golang/protobuf/ptypes/timestamp"
+	"golang.org/x/oauth2/jws"
 	pb "google.golang.org/genproto/googleapis/pubsub/v1"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
@@ -284,6 +294,140 @@ func TestPull(t *testing.T) {
 	}
 }
 
+func TestOrderedDelivery(t *testing.T) {
+	ctx := context.Background()
+	pclient, sclient, _, cleanup := newFake(ctx, t)
+	defer cleanup()
+
+	top := mustCreateTopic(ctx, t, pclient, &pb.Topic{Name: "projects/P/topics/T"})
+	sub := mustCreateSubscription(ctx, t, sclient, &pb.Subscription{
+		Name:                  "projects/P/subscriptions/S",
+		Topic:                 top.Name,
+		AckDeadlineSeconds:    10,
+		EnableMessageOrdering: true,
+	})
+	publish(t, pclient, top, []*pb.PubsubMessage{
+		{Data: []byte("a1"), OrderingKey: "a"},
+		{Data: []byte("b1"), OrderingKey: "b"},
+		{Data: []byte("a2"), OrderingKey: "a"},
+		{Data: []byte("u")},
+		{Data: []byte("a3"), OrderingKey: "a"},
+	})
+
+	// pull returns the data of the deliverable messages, and acks those in ack.
+	pull := func(ack ...string) []string {
+		t.Helper()
+		res, err := sclient.Pull(ctx, &pb.PullRequest{Subscription: sub.Name, ReturnImmediately: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got, ackIDs []string
+		for _, rm := range res.ReceivedMessages {
+			got = append(got, string(rm.Message.Data))
+			for _, a := range ack {
+				if a == string(rm.Message.Data) {
+					ackIDs = append(ackIDs, rm.AckId)
+				}
+			}
+		}
+		if len(ackIDs) > 0 {
+			if _, err := sclient.Acknowledge(ctx, &pb.AcknowledgeRequest{Subscription: sub.Name, AckIds: ackIDs}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return got
+	}
+	if got, want := pull("a1"), []string{"a1", "b1", "u"}; !testutil.Equal(got, want) {
+		t.Errorf("first pull: got %q, want %q", got, want)
+	}
+	if got, want := pull(), []string{"a2"}; !testutil.Equal(got, want) {
+		t.Errorf("second pull: got %q, want %q", got, want)
+	}
+	// a3 waits for a2, which is outstanding.
+	if got := pull(); len(got) != 0 {
+		t.Errorf("third pull: got %q, want none", got)
+	}
+}
+
+func TestDeadLetter(t *testing.T) {
+	ctx := context.Background()
+	pclient, sclient, _, cleanup := newFake(ctx, t)
+	defer cleanup()
+
+	top := mustCreateTopic(ctx, t, pclient, &pb.Topic{Name: "projects/P/topics/T"})
+	dlTop := mustCreateTopic(ctx, t, pclient, &pb.Topic{Name: "projects/P/topics/DL"})
+	dlSub := mustCreateSubscription(ctx, t, sclient, &pb.Subscription{
+		Name:               "projects/P/subscriptions/DL",
+		Topic:              dlTop.Name,
+		AckDeadlineSeconds: 10,
+	})
+	_, err := sclient.CreateSubscription(ctx, &pb.Subscription{
+		Name:               "projects/P/subscriptions/bad",
+		Topic:              top.Name,
+		AckDeadlineSeconds: 10,
+		DeadLetterPolicy:   &pb.DeadLetterPolicy{DeadLetterTopic: "projects/P/topics/none"},
+	})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("missing dead letter topic: got %v, want NotFound", err)
+	}
+	_, err = sclient.CreateSubscription(ctx, &pb.Subscription{
+		Name:               "projects/P/subscriptions/bad",
+		Topic:              top.Name,
+		AckDeadlineSeconds: 10,
+		DeadLetterPolicy:   &pb.DeadLetterPolicy{DeadLetterTopic: dlTop.Name, MaxDeliveryAttempts: 2},
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("too few attempts: got %v, want InvalidArgument", err)
+	}
+
+	sub := mustCreateSubscription(ctx, t, sclient, &pb.Subscription{
+		Name:               "projects/P/subscriptions/S",
+		Topic:              top.Name,
+		AckDeadlineSeconds: 10,
+		DeadLetterPolicy:   &pb.DeadLetterPolicy{DeadLetterTopic: dlTop.Name},
+	})
+	if got := sub.DeadLetterPolicy.MaxDeliveryAttempts; got != 5 {
+		t.Errorf("got MaxDeliveryAttempts %d, want default of 5", got)
+	}
+	publish(t, pclient, top, []*pb.PubsubMessage{{Data: []byte("d")}})
+
+	// Nack the message on each of its five deliveries.
+	for i := 1; i <= 5; i++ {
+		res, err := sclient.Pull(ctx, &pb.PullRequest{Subscription: sub.Name, ReturnImmediately: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res.ReceivedMessages) != 1 {
+			t.Fatalf("delivery %d: got %d messages, want 1", i, len(res.ReceivedMessages))
+		}
+		if got := res.ReceivedMessages[0].DeliveryAttempt; got != int32(i) {
+			t.Errorf("got delivery attempt %d, want %d", got, i)
+		}
+		if _, err := sclient.ModifyAckDeadline(ctx, &pb.ModifyAckDeadlineRequest{
+			Subscription: sub.Name,
+			AckIds:       []string{res.ReceivedMessages[0].AckId},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	res, err := sclient.Pull(ctx, &pb.PullRequest{Subscription: sub.Name, ReturnImmediately: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.ReceivedMessages) != 0 {
+		t.Errorf("got %d messages after the last attempt, want none", len(res.ReceivedMessages))
+	}
+	got := pullN(ctx, t, 1, sclient, dlSub)
+	for _, rm := range got {
+		if string(rm.Message.Data) != "d" {
+			t.Errorf("dead lettered message has data %q, want %q", rm.Message.Data, "d")
+		}
+		if rm.DeliveryAttempt != 0 {
+			t.Errorf("got delivery attempt %d from a subscription without a dead letter policy", rm.DeliveryAttempt)
+		}
+	}
+}
+
 func TestStreamingPull(t *testing.T) {
 	// A simple test of streaming pull.
 	pclient, sclient, _, cleanup := newFake(context.TODO(), t)
@@ -609,6 +753,428 @@ func TestSeek(t *testing.T) {
 	}
 }
 
+func TestSnapshots(t *testing.T) {
+	ctx := context.Background()
+	pclient, sclient, _, cleanup := newFake(ctx, t)
+	defer cleanup()
+
+	start := ptypes.TimestampNow()
+	top := mustCreateTopic(ctx, t, pclient, &pb.Topic{Name: "projects/P/topics/T"})
+	other := mustCreateTopic(ctx, t, pclient, &pb.Topic{Name: "projects/P/topics/U"})
+	sub := mustCreateSubscription(ctx, t, sclient, &pb.Subscription{
+		Name:                "projects/P/subscriptions/S",
+		Topic:               top.Name,
+		AckDeadlineSeconds:  10,
+		RetainAckedMessages: true,
+	})
+	otherSub := mustCreateSubscription(ctx, t, sclient, &pb.Subscription{
+		Name:               "projects/P/subscriptions/U",
+		Topic:              other.Name,
+		AckDeadlineSeconds: 10,
+	})
+	ack := func(msgs map[string]*pb.ReceivedMessage, data string) {
+		t.Helper()
+		for _, m := range msgs {
+			if string(m.Message.Data) == data {
+				if _, err := sclient.Acknowledge(ctx, &pb.AcknowledgeRequest{Subscription: sub.Name, AckIds: []string{m.AckId}}); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+	pullData := func(n int) (map[string]*pb.ReceivedMessage, []string) {
+		t.Helper()
+		msgs := pullN(ctx, t, n, sclient, sub)
+		var data []string
+		for _, m := range msgs {
+			data = append(data, string(m.Message.Data))
+		}
+		sort.Strings(data)
+		return msgs, data
+	}
+
+	publish(t, pclient, top, []*pb.PubsubMessage{{Data: []byte("d1")}, {Data: []byte("d2")}})
+	msgs, _ := pullData(2)
+	ack(msgs, "d1")
+	snap, err := sclient.CreateSnapshot(ctx, &pb.CreateSnapshotRequest{
+		Name:         "projects/P/snapshots/snap",
+		Subscription: sub.Name,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snap.Topic != top.Name {
+		t.Errorf("got snapshot topic %q, want %q", snap.Topic, top.Name)
+	}
+	if exp, _ := ptypes.Timestamp(snap.ExpireTime); exp.Before(time.Now().Add(maxSnapshotLifetime - time.Minute)) {
+		t.Errorf("snapshot expires at %v, too early", exp)
+	}
+	ack(msgs, "d2")
+	publish(t, pclient, top, []*pb.PubsubMessage{{Data: []byte("d3")}})
+	msgs, _ = pullData(1)
+	ack(msgs, "d3")
+
+	// Seeking to the snapshot redelivers the message that was unacked when
+	// the snapshot was created, and the one published since.
+	if _, err := sclient.Seek(ctx, &pb.SeekRequest{
+		Subscription: sub.Name,
+		Target:       &pb.SeekRequest_Snapshot{Snapshot: snap.Name},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, got := pullData(2); fmt.Sprint(got) != "[d2 d3]" {
+		t.Errorf("after seeking to snapshot, got %v, want [d2 d3]", got)
+	}
+
+	// Seeking to a time redelivers full messages.
+	if _, err := sclient.Seek(ctx, &pb.SeekRequest{
+		Subscription: sub.Name,
+		Target:       &pb.SeekRequest_Time{Time: start},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, got := pullData(3); fmt.Sprint(got) != "[d1 d2 d3]" {
+		t.Errorf("after seeking to time, got %v, want [d1 d2 d3]", got)
+	}
+
+	checkCode := func(err error, want codes.Code) {
+		t.Helper()
+		if status.Code(err) != want {
+			t.Errorf("got %v, want code %s", err, want)
+		}
+	}
+	_, err = sclient.CreateSnapshot(ctx, &pb.CreateSnapshotRequest{Name: snap.Name, Subscription: sub.Name})
+	checkCode(err, codes.AlreadyExists)
+	_, err = sclient.Seek(ctx, &pb.SeekRequest{
+		Subscription: otherSub.Name,
+		Target:       &pb.SeekRequest_Snapshot{Snapshot: snap.Name},
+	})
+	checkCode(err, codes.InvalidArgument)
+	_, err = sclient.Seek(ctx, &pb.SeekRequest{
+		Subscription: sub.Name,
+		Target:       &pb.SeekRequest_Snapshot{Snapshot: "projects/P/snapshots/none"},
+	})
+	checkCode(err, codes.NotFound)
+
+	snap2, err := sclient.CreateSnapshot(ctx, &pb.CreateSnapshotRequest{Subscription: sub.Name})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := sclient.ListSnapshots(ctx, &pb.ListSnapshotsRequest{Project: "projects/P"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Snapshots) != 2 {
+		t.Errorf("listed %d snapshots, want 2", len(res.Snapshots))
+	}
+	if _, err := sclient.DeleteSnapshot(ctx, &pb.DeleteSnapshotRequest{Snapshot: snap2.Name}); err != nil {
+		t.Fatal(err)
+	}
+	_, err = sclient.GetSnapshot(ctx, &pb.GetSnapshotRequest{Snapshot: snap2.Name})
+	checkCode(err, codes.NotFound)
+	_, err = sclient.DeleteSnapshot(ctx, &pb.DeleteSnapshotRequest{Snapshot: snap2.Name})
+	checkCode(err, codes.NotFound)
+}
+
+func TestPush(t *testing.T) {
+	defer func(d time.Duration) { minPushBackoff = d }(minPushBackoff)
+	minPushBackoff = 10 * time.Millisecond
+
+	ctx := context.Background()
+	pclient, sclient, srv, cleanup := newFake(ctx, t)
+	defer cleanup()
+
+	var (
+		mu       sync.Mutex
+		requests int
+		got      pushEnvelope
+		tokenErr error
+		claims   map[string]interface{}
+	)
+	done := make(chan struct{})
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		// Fail the first two attempts.
+		if requests < 3 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		tok := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if tokenErr = jws.Verify(tok, srv.OIDCKey()); tokenErr == nil {
+			var b []byte
+			b, tokenErr = base64.RawURLEncoding.DecodeString(strings.Split(tok, ".")[1])
+			if tokenErr == nil {
+				tokenErr = json.Unmarshal(b, &claims)
+			}
+		}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Error(err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+		close(done)
+	}))
+	defer hs.Close()
+
+	top := mustCreateTopic(ctx, t, pclient, &pb.Topic{Name: "projects/P/topics/T"})
+	sub := mustCreateSubscription(ctx, t, sclient, &pb.Subscription{
+		Name:               "projects/P/subscriptions/S",
+		Topic:              top.Name,
+		AckDeadlineSeconds: 10,
+		PushConfig: &pb.PushConfig{
+			PushEndpoint: hs.URL + "/push",
+			AuthenticationMethod: &pb.PushConfig_OidcToken_{OidcToken: &pb.PushConfig_OidcToken{
+				ServiceAccountEmail: "push@P.iam.gserviceaccount.com",
+				Audience:            "aud",
+			}},
+		},
+	})
+	id := srv.Publish(top.Name, []byte("hello"), map[string]string{"k": "v"})
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("message was not pushed")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if tokenErr != nil {
+		t.Errorf("bad OIDC token: %v", tokenErr)
+	} else if claims["aud"] != "aud" || claims["iss"] != oidcIssuer || claims["email"] != "push@P.iam.gserviceaccount.com" {
+		t.Errorf("got claims %+v", claims)
+	}
+	if string(got.Message.Data) != "hello" || got.Message.MessageID != id || got.Message.Attributes["k"] != "v" ||
+		got.Subscription != sub.Name || got.Message.PublishTime == "" {
+		t.Errorf("got push request %+v", got)
+	}
+	for start := time.Now(); srv.Message(id).Acks == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("pushed message was not acked")
+		}
+	}
+	if d := srv.Message(id).Deliveries; d != 3 {
+		t.Errorf("got %d deliveries, want 3", d)
+	}
+}
+
+func TestPushStopsOnClose(t *testing.T) {
+	ctx := context.Background()
+	srv := NewServer()
+	conn, err := grpc.DialContext(ctx, srv.Addr, grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	pclient, sclient := pb.NewPublisherClient(conn), pb.NewSubscriberClient(conn)
+
+	var requests int32
+	started := make(chan struct{}, 1)
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		// The request's context is canceled only once its body is read.
+		io.Copy(ioutil.Discard, r.Body)
+		started <- struct{}{}
+		<-r.Context().Done()
+	}))
+	defer hs.Close()
+
+	top := mustCreateTopic(ctx, t, pclient, &pb.Topic{Name: "projects/P/topics/T"})
+	mustCreateSubscription(ctx, t, sclient, &pb.Subscription{
+		Name:               "projects/P/subscriptions/S",
+		Topic:              top.Name,
+		AckDeadlineSeconds: 10,
+		PushConfig:         &pb.PushConfig{PushEndpoint: hs.URL + "/push"},
+	})
+	srv.Publish(top.Name, []byte("hello"), nil)
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("message was not pushed")
+	}
+
+	// Closing the server cancels the push in flight, and Wait waits for it.
+	srv.Close()
+	waited := make(chan struct{})
+	go func() {
+		srv.Wait()
+		close(waited)
+	}()
+	select {
+	case <-waited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Wait did not return after Close")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("got %d push requests, want 1", n)
+	}
+}
+
+func TestRetentionAndExpiration(t *testing.T) {
+	var mu sync.Mutex
+	clock := time.Now()
+	SetTimeNowFunc(func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return clock
+	})
+	defer SetTimeNowFunc(nil)
+	advance := func(d time.Duration) {
+		mu.Lock()
+		defer mu.Unlock()
+		clock = clock.Add(d)
+	}
+
+	ctx := context.Background()
+	pclient, sclient, srv, cleanup := newFake(ctx, t)
+	defer cleanup()
+
+	top := mustCreateTopic(ctx, t, pclient, &pb.Topic{Name: "projects/P/topics/T"})
+	_, err := sclient.CreateSubscription(ctx, &pb.Subscription{
+		Name:               "projects/P/subscriptions/bad",
+		Topic:              top.Name,
+		AckDeadlineSeconds: 10,
+		ExpirationPolicy:   &pb.ExpirationPolicy{Ttl: ptypes.DurationProto(time.Hour)},
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("short TTL: got %v, want InvalidArgument", err)
+	}
+	sub := mustCreateSubscription(ctx, t, sclient, &pb.Subscription{
+		Name:                     "projects/P/subscriptions/S",
+		Topic:                    top.Name,
+		AckDeadlineSeconds:       10,
+		RetainAckedMessages:      true,
+		MessageRetentionDuration: ptypes.DurationProto(time.Hour),
+		ExpirationPolicy:         &pb.ExpirationPolicy{Ttl: ptypes.DurationProto(24 * time.Hour)},
+	})
+	forever := mustCreateSubscription(ctx, t, sclient, &pb.Subscription{
+		Name:               "projects/P/subscriptions/forever",
+		Topic:              top.Name,
+		AckDeadlineSeconds: 10,
+		ExpirationPolicy:   &pb.ExpirationPolicy{},
+	})
+
+	pullAll := func() []string {
+		t.Helper()
+		res, err := sclient.Pull(ctx, &pb.PullRequest{Subscription: sub.Name, ReturnImmediately: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var data []string
+		for _, m := range res.ReceivedMessages {
+			data = append(data, string(m.Message.Data))
+			if _, err := sclient.Acknowledge(ctx, &pb.AcknowledgeRequest{Subscription: sub.Name, AckIds: []string{m.AckId}}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		sort.Strings(data)
+		return data
+	}
+	seekToStart := func() {
+		t.Helper()
+		if _, err := sclient.Seek(ctx, &pb.SeekRequest{
+			Subscription: sub.Name,
+			Target:       &pb.SeekRequest_Time{Time: &tspb.Timestamp{}},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	srv.Publish(top.Name, []byte("m1"), nil)
+	pullAll()
+	advance(30 * time.Minute)
+	srv.Publish(top.Name, []byte("m2"), nil)
+	pullAll()
+
+	// Acked messages are retained, so seeking redelivers them.
+	seekToStart()
+	if got := pullAll(); fmt.Sprint(got) != "[m1 m2]" {
+		t.Errorf("got %v, want [m1 m2]", got)
+	}
+	// Messages older than the retention duration are gone.
+	advance(45 * time.Minute)
+	seekToStart()
+	if got := pullAll(); fmt.Sprint(got) != "[m2]" {
+		t.Errorf("got %v, want [m2]", got)
+	}
+	srv.Publish(top.Name, []byte("m3"), nil)
+	advance(2 * time.Hour)
+	if got := pullAll(); len(got) != 0 {
+		t.Errorf("got %v after the retention duration, want nothing", got)
+	}
+
+	// Without activity, the subscription expires.
+	advance(25 * time.Hour)
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		_, err := sclient.GetSubscription(ctx, &pb.GetSubscriptionRequest{Subscription: sub.Name})
+		if status.Code(err) == codes.NotFound {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("subscription did not expire: %v", err)
+		}
+	}
+	if _, err := sclient.GetSubscription(ctx, &pb.GetSubscriptionRequest{Subscription: forever.Name}); err != nil {
+		t.Errorf("subscription that never expires: %v", err)
+	}
+}
+
+func TestTopicSchema(t *testing.T) {
+	ctx := context.Background()
+	pclient, _, srv, cleanup := newFake(ctx, t)
+	defer cleanup()
+
+	top := mustCreateTopic(ctx, t, pclient, &pb.Topic{Name: "projects/P/topics/T"})
+	sch := &Schema{
+		Name:       "projects/P/schemas/S",
+		Type:       "AVRO",
+		Definition: `{"type": "record", "name": "R", "fields": [{"name": "name", "type": "string"}]}`,
+		Encoding:   "JSON",
+	}
+	if err := srv.SetTopicSchema("projects/P/topics/none", sch); err == nil {
+		t.Error("unknown topic: got no error")
+	}
+	if err := srv.SetTopicSchema(top.Name, &Schema{Type: "AVRO", Definition: "{", Encoding: "JSON"}); err == nil {
+		t.Error("bad definition: got no error")
+	}
+	if err := srv.SetTopicSchema(top.Name, sch); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := pclient.Publish(ctx, &pb.PublishRequest{
+		Topic:    top.Name,
+		Messages: []*pb.PubsubMessage{{Data: []byte(`{"name": "x"}`)}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := srv.Message(res.MessageIds[0])
+	if m.Attributes["googclient_schemaname"] != sch.Name || m.Attributes["googclient_schemaencoding"] != "JSON" {
+		t.Errorf("got attributes %v", m.Attributes)
+	}
+	_, err = pclient.Publish(ctx, &pb.PublishRequest{
+		Topic:    top.Name,
+		Messages: []*pb.PubsubMessage{{Data: []byte(`{"name": "y"}`)}, {Data: []byte(`{"nome": 1}`)}},
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("nonconforming message: got %v, want InvalidArgument", err)
+	}
+	if n := len(srv.Messages()); n != 1 {
+		t.Errorf("got %d messages, want 1", n)
+	}
+
+	if err := srv.SetTopicSchema(top.Name, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pclient.Publish(ctx, &pb.PublishRequest{
+		Topic:    top.Name,
+		Messages: []*pb.PubsubMessage{{Data: []byte("anything")}},
+	}); err != nil {
+		t.Errorf("after removing the schema: %v", err)
+	}
+}
+
 func TestTryDeliverMessage(t *testing.T) {
 	for _, test := range []struct {
 		availStreamIdx int
@@ -0,0 +1,267 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pstest
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/smyte/google-cloud-go/internal/unknownfields"
+	pb "google.golang.org/genproto/googleapis/pubsub/v1"
+)
+
+// filterFieldNumber is the number of the filter field of Subscription. The
+// field is newer than the generated Subscription, so clients send it as an
+// unrecognized field.
+const filterFieldNumber = 12
+
+// maxFilterLength is the maximum length of a filter in bytes.
+const maxFilterLength = 256
+
+// subscriptionFilter returns the filter of ps, or "" if it has none.
+func subscriptionFilter(ps *pb.Subscription) string {
+	filter, _ := unknownfields.Bytes(ps.XXX_unrecognized, filterFieldNumber)
+	return string(filter)
+}
+
+// A messageFilter reports whether a message with the given attributes
+// matches a subscription's filter.
+type messageFilter func(attrs map[string]string) bool
+
+// parseFilter parses a subscription filter. Filters select messages by their
+// attributes:
+//     attributes:KEY                       the message has the attribute
+//     attributes.KEY = "value"             the attribute has the value
+//     attributes.KEY != "value"            the attribute is missing or has another value
+//     hasPrefix(attributes.KEY, "prefix")  the attribute has the prefix
+// Expressions can be negated with NOT or -, and combined with AND or OR and
+// parentheses. AND and OR cannot be mixed without parentheses. Keys may be
+// quoted strings.
+//
+// expr ::= term ("AND" term)* | term ("OR" term)*
+// term ::= ["NOT" | "-"] primary
+// primary ::= "(" expr ")" | "attributes" ":" key | "attributes" "." key ("=" | "!=") string |
+//             "hasPrefix" "(" "attributes" "." key "," string ")"
+func parseFilter(s string) (messageFilter, error) {
+	if len(s) > maxFilterLength {
+		return nil, fmt.Errorf("filter is longer than %d bytes", maxFilterLength)
+	}
+	p := &filterParser{s: s}
+	f := p.expr()
+	if t := p.next(); p.err == nil && t != "" {
+		p.fail("unexpected %q", t)
+	}
+	if p.err != nil {
+		return nil, fmt.Errorf("invalid filter %q: %v", s, p.err)
+	}
+	return f, nil
+}
+
+// filterParser is a recursive-descent parser of filters. Once it fails, it
+// records the first error and the results of its methods are meaningless.
+type filterParser struct {
+	s      string
+	pos    int
+	peeked string
+	err    error
+}
+
+func (p *filterParser) fail(format string, args ...interface{}) {
+	if p.err == nil {
+		p.err = fmt.Errorf(format, args...)
+	}
+}
+
+// next returns the next token, or "" at the end of input or after a failure.
+// Quoted strings are returned with their quotes.
+func (p *filterParser) next() string {
+	if p.peeked != "" {
+		t := p.peeked
+		p.peeked = ""
+		return t
+	}
+	for p.pos < len(p.s) && strings.IndexByte(" \t\r\n", p.s[p.pos]) >= 0 {
+		p.pos++
+	}
+	if p.err != nil || p.pos == len(p.s) {
+		return ""
+	}
+	rest := p.s[p.pos:]
+	n := 1
+	switch c := rest[0]; {
+	case strings.HasPrefix(rest, "!="):
+		n = 2
+	case strings.IndexByte("():.,=-", c) >= 0:
+	case c == '"':
+		for n < len(rest) && rest[n] != '"' {
+			if rest[n] == '\\' {
+				n++
+			}
+			n++
+		}
+		if n >= len(rest) {
+			p.fail("unterminated string %s", rest)
+			return ""
+		}
+		n++
+	case isIdentByte(c):
+		for n < len(rest) && isIdentByte(rest[n]) {
+			n++
+		}
+	default:
+		p.fail("unexpected character %q", c)
+		return ""
+	}
+	p.pos += n
+	return rest[:n]
+}
+
+func isIdentByte(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '_'
+}
+
+func (p *filterParser) peek() string {
+	if p.peeked == "" {
+		p.peeked = p.next()
+	}
+	return p.peeked
+}
+
+func (p *filterParser) expect(tok string) {
+	if t := p.next(); t != tok {
+		p.fail("want %q, got %q", tok, t)
+	}
+}
+
+func (p *filterParser) expr() messageFilter {
+	fs := []messageFilter{p.term()}
+	op := ""
+	for t := p.peek(); t == "AND" || t == "OR"; t = p.peek() {
+		if op != "" && t != op {
+			p.fail("AND and OR must be separated by parentheses")
+			return nil
+		}
+		op = p.next()
+		fs = append(fs, p.term())
+	}
+	switch {
+	case len(fs) == 1:
+		return fs[0]
+	case op == "AND":
+		return func(attrs map[string]string) bool {
+			for _, f := range fs {
+				if !f(attrs) {
+					return false
+				}
+			}
+			return true
+		}
+	default:
+		return func(attrs map[string]string) bool {
+			for _, f := range fs {
+				if f(attrs) {
+					return true
+				}
+			}
+			return false
+		}
+	}
+}
+
+func (p *filterParser) term() messageFilter {
+	if t := p.peek(); t == "NOT" || t == "-" {
+		p.next()
+		f := p.primary()
+		return func(attrs map[string]string) bool { return !f(attrs) }
+	}
+	return p.primary()
+}
+
+func (p *filterParser) primary() messageFilter {
+	switch t := p.next(); t {
+	case "(":
+		f := p.expr()
+		p.expect(")")
+		return f
+
+	case "attributes":
+		if p.peek() == ":" {
+			p.next()
+			key := p.key()
+			return func(attrs map[string]string) bool {
+				_, ok := attrs[key]
+				return ok
+			}
+		}
+		p.expect(".")
+		key := p.key()
+		op := p.next()
+		if op != "=" && op != "!=" {
+			p.fail("want = or != after attributes.%s, got %q", key, op)
+			return nil
+		}
+		val := p.str()
+		if op == "=" {
+			return func(attrs map[string]string) bool {
+				v, ok := attrs[key]
+				return ok && v == val
+			}
+		}
+		return func(attrs map[string]string) bool {
+			v, ok := attrs[key]
+			return !ok || v != val
+		}
+
+	case "hasPrefix":
+		p.expect("(")
+		p.expect("attributes")
+		p.expect(".")
+		key := p.key()
+		p.expect(",")
+		prefix := p.str()
+		p.expect(")")
+		return func(attrs map[string]string) bool {
+			v, ok := attrs[key]
+			return ok && strings.HasPrefix(v, prefix)
+		}
+
+	default:
+		p.fail("want a filter, got %q", t)
+		return nil
+	}
+}
+
+// key parses an attribute key, which is an identifier or a quoted string.
+func (p *filterParser) key() string {
+	if t := p.peek(); t != "" && isIdentByte(t[0]) {
+		return p.next()
+	}
+	return p.str()
+}
+
+// str parses a quoted string.
+func (p *filterParser) str() string {
+	t := p.next()
+	if !strings.HasPrefix(t, `"`) {
+		p.fail("want a quoted string, got %q", t)
+		return ""
+	}
+	s, err := strconv.Unquote(t)
+	if err != nil {
+		p.fail("bad string %s: %v", t, err)
+	}
+	return s
+}
@@ -0,0 +1,126 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pstest
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/smyte/google-cloud-go/internal/unknownfields"
+	pb "google.golang.org/genproto/googleapis/pubsub/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestParseFilter(t *testing.T) {
+	attrs := map[string]string{"type": "order", "region": "eu-west1", "x-y": "1"}
+	for _, test := range []struct {
+		filter string
+		want   bool
+	}{
+		{`attributes:type`, true},
+		{`attributes:missing`, false},
+		{`attributes.type = "order"`, true},
+		{`attributes.type="refund"`, false},
+		{`attributes.type != "refund"`, true},
+		{`attributes.missing != "x"`, true},
+		{`hasPrefix(attributes.region, "eu")`, true},
+		{`hasPrefix(attributes.missing, "")`, false},
+		{`attributes."x-y" = "1"`, true},
+		{`attributes.type = "order" AND hasPrefix(attributes.region, "eu")`, true},
+		{`attributes.type = "order" AND hasPrefix(attributes.region, "us")`, false},
+		{`attributes.type = "refund" OR attributes:region`, true},
+		{`NOT attributes:type`, false},
+		{`-attributes:missing`, true},
+		{`attributes:type AND (attributes.region = "us" OR attributes.region = "eu-west1")`, true},
+		{`NOT (attributes:type AND attributes:missing)`, true},
+	} {
+		f, err := parseFilter(test.filter)
+		if err != nil {
+			t.Errorf("%s: %v", test.filter, err)
+			continue
+		}
+		if got := f(attrs); got != test.want {
+			t.Errorf("%s: got %t, want %t", test.filter, got, test.want)
+		}
+	}
+}
+
+func TestParseFilterErrors(t *testing.T) {
+	for _, filter := range []string{
+		``,
+		`attributes`,
+		`attributes.type`,
+		`attributes.type = order`,
+		`attributes.type = "order`,
+		`attributes:a AND attributes:b OR attributes:c`,
+		`hasPrefix(attributes.a)`,
+		`(attributes:a`,
+		`attributes:a attributes:b`,
+		`data = "x"`,
+		`attributes:` + strings.Repeat("a", maxFilterLength),
+	} {
+		if _, err := parseFilter(filter); err == nil {
+			t.Errorf("%q: got no error", filter)
+		}
+	}
+}
+
+func withFilter(ps *pb.Subscription, filter string) *pb.Subscription {
+	ps.XXX_unrecognized = unknownfields.AppendBytes(nil, filterFieldNumber, []byte(filter))
+	return ps
+}
+
+func TestFilteredSubscription(t *testing.T) {
+	ctx := context.Background()
+	pclient, sclient, _, cleanup := newFake(ctx, t)
+	defer cleanup()
+
+	top := mustCreateTopic(ctx, t, pclient, &pb.Topic{Name: "projects/P/topics/T"})
+	_, err := sclient.CreateSubscription(ctx, withFilter(&pb.Subscription{
+		Name:               "projects/P/subscriptions/bad",
+		Topic:              top.Name,
+		AckDeadlineSeconds: 10,
+	}, "attributes."))
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("bad filter: got %v, want InvalidArgument", err)
+	}
+	sub := mustCreateSubscription(ctx, t, sclient, withFilter(&pb.Subscription{
+		Name:               "projects/P/subscriptions/S",
+		Topic:              top.Name,
+		AckDeadlineSeconds: 10,
+	}, `attributes.type = "order"`))
+	if got := subscriptionFilter(sub); got != `attributes.type = "order"` {
+		t.Errorf("got filter %q from CreateSubscription", got)
+	}
+	publish(t, pclient, top, []*pb.PubsubMessage{
+		{Data: []byte("d1"), Attributes: map[string]string{"type": "order"}},
+		{Data: []byte("d2"), Attributes: map[string]string{"type": "refund"}},
+		{Data: []byte("d3")},
+		{Data: []byte("d4"), Attributes: map[string]string{"type": "order"}},
+	})
+	res, err := sclient.Pull(ctx, &pb.PullRequest{Subscription: sub.Name, ReturnImmediately: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]bool{}
+	for _, rm := range res.ReceivedMessages {
+		got[string(rm.Message.Data)] = true
+	}
+	if len(got) != 2 || !got["d1"] || !got["d4"] {
+		t.Errorf("got messages %v, want d1 and d4", got)
+	}
+}
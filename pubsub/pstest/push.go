@@ -0,0 +1,227 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pstest
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	emptypb "github.com/golang/protobuf/ptypes/empty"
+	"golang.org/x/oauth2/jws"
+	pb "google.golang.org/genproto/googleapis/pubsub/v1"
+)
+
+// The delay before a failed push is retried starts at minPushBackoff and
+// doubles with each attempt, up to maxPushBackoff. The delays are much shorter
+// than the service's, so that tests run quickly.
+var (
+	minPushBackoff = 100 * time.Millisecond
+	maxPushBackoff = 10 * time.Second
+)
+
+// oidcIssuer is the issuer of the OIDC tokens attached to push requests.
+const oidcIssuer = "https://accounts.google.com"
+
+// OIDCKey returns the public key that verifies the OIDC tokens the server
+// attaches to push requests of subscriptions whose PushConfig has an
+// OidcToken. The tokens are JWTs signed with RS256, as by the service, and
+// can be verified with golang.org/x/oauth2/jws.Verify.
+func (s *Server) OIDCKey() *rsa.PublicKey {
+	return &s.GServer.oidcKey().PublicKey
+}
+
+// oidcKey returns the key that signs OIDC tokens, generating it on first use.
+func (s *GServer) oidcKey() *rsa.PrivateKey {
+	s.oidcKeyOnce.Do(func() {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			panic(fmt.Sprintf("pstest: generating OIDC key: %v", err))
+		}
+		s.oidcKeyVal = key
+	})
+	return s.oidcKeyVal
+}
+
+// oidcToken returns a signed OIDC token for a push request to endpoint.
+func (s *GServer) oidcToken(tok *pb.PushConfig_OidcToken, endpoint string) (string, error) {
+	aud := tok.Audience
+	if aud == "" {
+		aud = endpoint
+	}
+	now := timeNow()
+	claims := &jws.ClaimSet{
+		Iss: oidcIssuer,
+		Aud: aud,
+		Sub: tok.ServiceAccountEmail,
+		Iat: now.Unix(),
+		Exp: now.Add(time.Hour).Unix(),
+		PrivateClaims: map[string]interface{}{
+			"email":          tok.ServiceAccountEmail,
+			"email_verified": true,
+		},
+	}
+	header := &jws.Header{Algorithm: "RS256", Typ: "JWT", KeyID: "pstest"}
+	return jws.Encode(header, claims, s.oidcKey())
+}
+
+func (s *GServer) ModifyPushConfig(_ context.Context, req *pb.ModifyPushConfigRequest) (*emptypb.Empty, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sub, err := s.findSubscription(req.Subscription)
+	if err != nil {
+		return nil, err
+	}
+	pc := req.PushConfig
+	if pc == nil {
+		pc = &pb.PushConfig{}
+	}
+	sub.proto.PushConfig = pc
+	return &emptypb.Empty{}, nil
+}
+
+// pushEnvelope is the JSON body of a push request.
+type pushEnvelope struct {
+	Message         pushMessage `json:"message"`
+	Subscription    string      `json:"subscription"`
+	DeliveryAttempt int32       `json:"deliveryAttempt,omitempty"`
+}
+
+// pushMessage is a message in a push request. Like the service, it has both
+// camel-case and snake-case forms of some fields.
+type pushMessage struct {
+	Attributes   map[string]string `json:"attributes,omitempty"`
+	Data         []byte            `json:"data,omitempty"`
+	MessageID    string            `json:"messageId"`
+	MessageID2   string            `json:"message_id"`
+	PublishTime  string            `json:"publishTime"`
+	PublishTime2 string            `json:"publish_time"`
+	OrderingKey  string            `json:"orderingKey,omitempty"`
+}
+
+// isPush reports whether the subscription delivers messages by push.
+// Must be called with the lock held.
+func (s *subscription) isPush() bool {
+	return s.proto.PushConfig.GetPushEndpoint() != ""
+}
+
+// push starts pushing each deliverable message to the subscription's
+// endpoint. A message stays outstanding until its push completes. Nothing is
+// pushed once the subscription is stopped.
+//
+// Must be called with the lock held.
+func (s *subscription) push(now time.Time) {
+	pc := s.proto.PushConfig
+	for _, m := range s.deliverable() {
+		select {
+		case <-s.done:
+			return
+		default:
+		}
+		rm := s.received(m)
+		(*m.deliveries)++
+		m.attempts++
+		m.ackDeadline = now.Add(s.ackTimeout)
+		env := &pushEnvelope{
+			Message: pushMessage{
+				Attributes:  rm.Message.Attributes,
+				Data:        rm.Message.Data,
+				MessageID:   rm.Message.MessageId,
+				MessageID2:  rm.Message.MessageId,
+				OrderingKey: rm.Message.OrderingKey,
+			},
+			Subscription:    s.proto.Name,
+			DeliveryAttempt: rm.DeliveryAttempt,
+		}
+		pt := m.publishTime.UTC().Format(time.RFC3339Nano)
+		env.Message.PublishTime, env.Message.PublishTime2 = pt, pt
+		s.wg.Add(1)
+		go func(m *message, ackID string) {
+			defer s.wg.Done()
+			s.pushMessage(m, ackID, pc, env)
+		}(m, rm.AckId)
+	}
+}
+
+// pushMessage sends a push request for m, and acks m if the endpoint accepts
+// it. Otherwise m is redelivered after a backoff.
+func (s *subscription) pushMessage(m *message, ackID string, pc *pb.PushConfig, env *pushEnvelope) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.ackTimeout)
+	defer cancel()
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		select {
+		case <-s.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	err := s.postPush(ctx, pc, env)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.msgs[ackID] != m {
+		// The message was acked or replaced by a seek.
+		return
+	}
+	if err == nil {
+		s.ack(ackID)
+		s.lastActivity = timeNow()
+		return
+	}
+	d := maxPushBackoff
+	if m.attempts < 32 && minPushBackoff<<uint(m.attempts-1) < d {
+		d = minPushBackoff << uint(m.attempts-1)
+	}
+	m.ackDeadline = timeNow().Add(d)
+}
+
+func (s *subscription) postPush(ctx context.Context, pc *pb.PushConfig, env *pushEnvelope) error {
+	body, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", pc.PushEndpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	if tok := pc.GetOidcToken(); tok != nil && s.server != nil {
+		t, err := s.server.oidcToken(tok, pc.PushEndpoint)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+t)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, res.Body)
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("push endpoint returned %s", res.Status)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pstest
+
+import (
+	"fmt"
+
+	"github.com/smyte/google-cloud-go/pubsub/internal/schema"
+	pb "google.golang.org/genproto/googleapis/pubsub/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// A Schema is a schema that the data of a topic's messages must conform to.
+type Schema struct {
+	// Name is the name of the schema, in the format
+	// "projects/<projid>/schemas/<schema>".
+	Name string
+
+	// Type is "AVRO" or "PROTOCOL_BUFFER". The definition of a protocol
+	// buffer schema is the full name of a message type registered with
+	// github.com/golang/protobuf/proto.
+	Type       string
+	Definition string
+
+	// Encoding is "JSON" or "BINARY".
+	Encoding string
+}
+
+type topicSchema struct {
+	name string
+	enc  schema.Encoding
+	s    *schema.Schema
+}
+
+// SetTopicSchema makes the server reject messages published to the topic
+// whose data does not conform to sch, failing the Publish RPC with
+// InvalidArgument. Like the service, the server records the schema and
+// encoding in the attributes of the messages it accepts. A nil sch removes
+// the topic's schema.
+func (s *Server) SetTopicSchema(topic string, sch *Schema) error {
+	var ts *topicSchema
+	if sch != nil {
+		var typ schema.Type
+		switch sch.Type {
+		case "AVRO":
+			typ = schema.Avro
+		case "PROTOCOL_BUFFER":
+			typ = schema.ProtocolBuffer
+		default:
+			return fmt.Errorf("pstest: unknown schema type %q", sch.Type)
+		}
+		enc, err := schema.ParseEncoding(sch.Encoding)
+		if err != nil {
+			return fmt.Errorf("pstest: %v", err)
+		}
+		parsed, err := schema.Parse(typ, sch.Definition)
+		if err != nil {
+			return fmt.Errorf("pstest: %v", err)
+		}
+		ts = &topicSchema{name: sch.Name, enc: enc, s: parsed}
+	}
+	s.GServer.mu.Lock()
+	defer s.GServer.mu.Unlock()
+	top := s.GServer.topics[topic]
+	if top == nil {
+		return fmt.Errorf("pstest: topic %q not found", topic)
+	}
+	top.schema = ts
+	return nil
+}
+
+// check returns an error if the data of pm does not conform to the schema.
+func (ts *topicSchema) check(pm *pb.PubsubMessage) error {
+	if err := ts.s.Validate(pm.Data, ts.enc); err != nil {
+		return status.Errorf(codes.InvalidArgument, "message does not conform to schema %s: %v", ts.name, err)
+	}
+	return nil
+}
+
+// annotate records the schema and encoding in the attributes of pm.
+func (ts *topicSchema) annotate(pm *pb.PubsubMessage) {
+	if pm.Attributes == nil {
+		pm.Attributes = map[string]string{}
+	}
+	pm.Attributes[schema.NameAttribute] = ts.name
+	pm.Attributes[schema.EncodingAttribute] = ts.enc.String()
+}
@@ -0,0 +1,209 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pstest
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/smyte/google-cloud-go/internal/testutil"
+	"github.com/golang/protobuf/ptypes"
+	emptypb "github.com/golang/protobuf/ptypes/empty"
+	pb "google.golang.org/genproto/googleapis/pubsub/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// maxSnapshotLifetime is how long a snapshot retains the oldest message of
+// its backlog.
+const maxSnapshotLifetime = 7 * 24 * time.Hour
+
+// A snapshot captures the unacked messages of a subscription.
+type snapshot struct {
+	proto *pb.Snapshot
+	seq   int        // messages published later are not part of the snapshot
+	msgs  []*Message // messages unacked when the snapshot was created
+}
+
+func (s *GServer) CreateSnapshot(_ context.Context, req *pb.CreateSnapshotRequest) (*pb.Snapshot, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sub, err := s.findSubscription(req.Subscription)
+	if err != nil {
+		return nil, err
+	}
+	name := req.Name
+	if name == "" {
+		// Assign a unique name in the subscription's project.
+		project := strings.SplitN(sub.proto.Name, "/subscriptions/", 2)[0]
+		for name == "" || s.snapshots[name] != nil {
+			name = fmt.Sprintf("%s/snapshots/snapshot%d", project, s.nextSnapID)
+			s.nextSnapID++
+		}
+	}
+	if s.snapshots[name] != nil {
+		return nil, status.Errorf(codes.AlreadyExists, "snapshot %q", name)
+	}
+	if sub.proto.Topic == "_deleted-topic_" {
+		return nil, status.Errorf(codes.FailedPrecondition, "topic of subscription %q was deleted", sub.proto.Name)
+	}
+
+	now := timeNow()
+	snap := &snapshot{seq: s.nextID}
+	oldest := now
+	for id := range sub.msgs {
+		m := s.msgsByID[id]
+		if m == nil {
+			continue
+		}
+		snap.msgs = append(snap.msgs, m)
+		if m.PublishTime.Before(oldest) {
+			oldest = m.PublishTime
+		}
+	}
+	sort.Slice(snap.msgs, func(i, j int) bool { return snap.msgs[i].seq < snap.msgs[j].seq })
+	// The snapshot expires when its oldest message would. Like the service,
+	// refuse to create a snapshot that would expire within an hour.
+	expire := oldest.Add(maxSnapshotLifetime)
+	if expire.Before(now.Add(time.Hour)) {
+		return nil, status.Errorf(codes.FailedPrecondition, "snapshot would expire in less than an hour")
+	}
+	tsExpire, err := ptypes.TimestampProto(expire)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, err.Error())
+	}
+	snap.proto = &pb.Snapshot{
+		Name:       name,
+		Topic:      sub.proto.Topic,
+		ExpireTime: tsExpire,
+		Labels:     req.Labels,
+	}
+	s.snapshots[name] = snap
+	return snap.proto, nil
+}
+
+func (s *GServer) GetSnapshot(_ context.Context, req *pb.GetSnapshotRequest) (*pb.Snapshot, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snap, err := s.findSnapshot(req.Snapshot)
+	if err != nil {
+		return nil, err
+	}
+	return snap.proto, nil
+}
+
+func (s *GServer) UpdateSnapshot(_ context.Context, req *pb.UpdateSnapshotRequest) (*pb.Snapshot, error) {
+	if req.Snapshot == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "missing snapshot")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snap, err := s.findSnapshot(req.Snapshot.Name)
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range req.UpdateMask.GetPaths() {
+		switch path {
+		case "expire_time":
+			if _, err := ptypes.Timestamp(req.Snapshot.ExpireTime); err != nil {
+				return nil, status.Errorf(codes.InvalidArgument, "bad expire_time: %v", err)
+			}
+			snap.proto.ExpireTime = req.Snapshot.ExpireTime
+
+		case "labels":
+			snap.proto.Labels = req.Snapshot.Labels
+
+		default:
+			return nil, status.Errorf(codes.InvalidArgument, "unknown field name %q", path)
+		}
+	}
+	return snap.proto, nil
+}
+
+func (s *GServer) ListSnapshots(_ context.Context, req *pb.ListSnapshotsRequest) (*pb.ListSnapshotsResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var names []string
+	for name := range s.snapshots {
+		if strings.HasPrefix(name, req.Project) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	from, to, nextToken, err := testutil.PageBounds(int(req.PageSize), req.PageToken, len(names))
+	if err != nil {
+		return nil, err
+	}
+	res := &pb.ListSnapshotsResponse{NextPageToken: nextToken}
+	for i := from; i < to; i++ {
+		res.Snapshots = append(res.Snapshots, s.snapshots[names[i]].proto)
+	}
+	return res, nil
+}
+
+func (s *GServer) ListTopicSnapshots(_ context.Context, req *pb.ListTopicSnapshotsRequest) (*pb.ListTopicSnapshotsResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.topics[req.Topic] == nil {
+		return nil, status.Errorf(codes.NotFound, "topic %q", req.Topic)
+	}
+	var names []string
+	for name, snap := range s.snapshots {
+		if snap.proto.Topic == req.Topic {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	from, to, nextToken, err := testutil.PageBounds(int(req.PageSize), req.PageToken, len(names))
+	if err != nil {
+		return nil, err
+	}
+	return &pb.ListTopicSnapshotsResponse{
+		Snapshots:     names[from:to],
+		NextPageToken: nextToken,
+	}, nil
+}
+
+func (s *GServer) DeleteSnapshot(_ context.Context, req *pb.DeleteSnapshotRequest) (*emptypb.Empty, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.findSnapshot(req.Snapshot); err != nil {
+		return nil, err
+	}
+	delete(s.snapshots, req.Snapshot)
+	return &emptypb.Empty{}, nil
+}
+
+// Gets a snapshot that must exist.
+// Must be called with the lock held.
+func (s *GServer) findSnapshot(name string) (*snapshot, error) {
+	if name == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "missing snapshot")
+	}
+	snap := s.snapshots[name]
+	if snap == nil {
+		return nil, status.Errorf(codes.NotFound, "snapshot %s", name)
+	}
+	return snap, nil
+}
@@ -19,6 +19,7 @@ import (
 	"fmt"
 	"os"
 	"runtime"
+	"sync"
 	"time"
 
 	"github.com/smyte/google-cloud-go/internal/version"
@@ -48,6 +49,9 @@ type Client struct {
 	projectID string
 	pubc      *vkit.PublisherClient
 	subc      *vkit.SubscriberClient
+
+	schemaMu sync.Mutex
+	schemas  map[string]*Schema // registered schemas by name
 }
 
 // NewClient creates a new PubSub client.
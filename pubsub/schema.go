@@ -0,0 +1,245 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/smyte/google-cloud-go/pubsub/internal/schema"
+)
+
+// SchemaType is the type of a schema.
+type SchemaType int
+
+const (
+	// SchemaProtocolBuffer is the type of protocol buffer schemas. The
+	// definition of a protocol buffer schema is the full name of a message
+	// type registered with github.com/golang/protobuf/proto, such as
+	// "google.pubsub.v1.PubsubMessage".
+	SchemaProtocolBuffer = SchemaType(schema.ProtocolBuffer)
+
+	// SchemaAvro is the type of Avro schemas. The definition of an Avro
+	// schema is an Avro schema declaration in JSON.
+	SchemaAvro = SchemaType(schema.Avro)
+)
+
+// SchemaEncoding is the encoding of message data.
+type SchemaEncoding int
+
+const (
+	// EncodingJSON is the JSON encoding: JSON for protocol buffers as defined
+	// by github.com/golang/protobuf/jsonpb, or the Avro JSON encoding.
+	EncodingJSON = SchemaEncoding(schema.JSON)
+
+	// EncodingBinary is the binary encoding of protocol buffers or Avro.
+	EncodingBinary = SchemaEncoding(schema.Binary)
+)
+
+func (e SchemaEncoding) String() string {
+	return schema.Encoding(e).String()
+}
+
+var errNoSchemaSettings = errors.New("pubsub: Topic.SchemaSettings is nil")
+
+// Schema is a schema that the data of messages must conform to. Schemas
+// are registered with a Client by RegisterSchema.
+type Schema struct {
+	// The fully qualified identifier for the schema, in the format "projects/<projid>/schemas/<schema>"
+	name       string
+	typ        SchemaType
+	definition string
+	s          *schema.Schema
+}
+
+// RegisterSchema parses the definition of a schema of the given type, and
+// registers it with the client under id. Messages published with the schema
+// record its name in their attributes, so that DecodeMessage can find it.
+func (c *Client) RegisterSchema(id string, typ SchemaType, definition string) (*Schema, error) {
+	s, err := schema.Parse(schema.Type(typ), definition)
+	if err != nil {
+		return nil, fmt.Errorf("pubsub: %v", err)
+	}
+	sch := &Schema{
+		name:       fmt.Sprintf("projects/%s/schemas/%s", c.projectID, id),
+		typ:        typ,
+		definition: definition,
+		s:          s,
+	}
+	c.schemaMu.Lock()
+	defer c.schemaMu.Unlock()
+	if c.schemas == nil {
+		c.schemas = make(map[string]*Schema)
+	}
+	if c.schemas[sch.name] != nil {
+		return nil, fmt.Errorf("pubsub: schema %q is already registered", id)
+	}
+	c.schemas[sch.name] = sch
+	return sch, nil
+}
+
+// Schema returns the schema registered with the client under id, or nil if
+// there is none.
+func (c *Client) Schema(id string) *Schema {
+	c.schemaMu.Lock()
+	defer c.schemaMu.Unlock()
+	return c.schemas[fmt.Sprintf("projects/%s/schemas/%s", c.projectID, id)]
+}
+
+// ID returns the unique identifier of the schema within its project.
+func (s *Schema) ID() string {
+	return s.name[strings.LastIndex(s.name, "/")+1:]
+}
+
+// String returns the printable globally unique name for the schema.
+func (s *Schema) String() string {
+	return s.name
+}
+
+// Type returns the type of the schema.
+func (s *Schema) Type() SchemaType {
+	return s.typ
+}
+
+// Definition returns the definition of the schema.
+func (s *Schema) Definition() string {
+	return s.definition
+}
+
+// Validate returns an error if data is not a valid encoding of a value of the
+// schema.
+func (s *Schema) Validate(data []byte, enc SchemaEncoding) error {
+	if err := s.s.Validate(data, schema.Encoding(enc)); err != nil {
+		return fmt.Errorf("pubsub: %v", err)
+	}
+	return nil
+}
+
+// Encode encodes v with the schema.
+//
+// For protocol buffer schemas, v must be a message of the schema's type.
+// For Avro schemas, v is converted to the schema's type through its JSON
+// encoding by encoding/json, so it may be a struct with JSON field tags or a
+// map. Avro bytes correspond to []byte, and unions to the value of one of
+// their branches, with nil for null.
+func (s *Schema) Encode(v interface{}, enc SchemaEncoding) ([]byte, error) {
+	data, err := s.s.Encode(v, schema.Encoding(enc))
+	if err != nil {
+		return nil, fmt.Errorf("pubsub: %v", err)
+	}
+	return data, nil
+}
+
+// Decode decodes data into v, which must be a pointer. The Go types of v
+// correspond to the schema as for Encode.
+func (s *Schema) Decode(data []byte, enc SchemaEncoding, v interface{}) error {
+	if err := s.s.Decode(data, schema.Encoding(enc), v); err != nil {
+		return fmt.Errorf("pubsub: %v", err)
+	}
+	return nil
+}
+
+// SchemaSettings are the schema that a topic's messages conform to, and
+// their encoding.
+type SchemaSettings struct {
+	Schema   *Schema
+	Encoding SchemaEncoding
+}
+
+// apply validates the data of msg against the schema, and returns a copy of
+// msg with the schema and encoding recorded in its attributes. msg is not
+// modified.
+func (ss *SchemaSettings) apply(msg *Message) (*Message, error) {
+	if ss.Schema == nil {
+		return nil, errors.New("pubsub: SchemaSettings.Schema is nil")
+	}
+	if err := ss.Schema.Validate(msg.Data, ss.Encoding); err != nil {
+		return nil, err
+	}
+	attrs := make(map[string]string, len(msg.Attributes)+2)
+	for k, v := range msg.Attributes {
+		attrs[k] = v
+	}
+	attrs[schema.NameAttribute] = ss.Schema.name
+	attrs[schema.EncodingAttribute] = ss.Encoding.String()
+	return &Message{
+		Data:        msg.Data,
+		Attributes:  attrs,
+		OrderingKey: msg.OrderingKey,
+	}, nil
+}
+
+// PublishValue encodes v with the topic's SchemaSettings, and publishes it
+// with the given attributes. See Schema.Encode for the types that v may have.
+func (t *Topic) PublishValue(ctx context.Context, v interface{}, attrs map[string]string) *PublishResult {
+	if t.SchemaSettings == nil || t.SchemaSettings.Schema == nil {
+		r := &PublishResult{ready: make(chan struct{})}
+		r.set("", errNoSchemaSettings)
+		return r
+	}
+	data, err := t.SchemaSettings.Schema.Encode(v, t.SchemaSettings.Encoding)
+	if err != nil {
+		r := &PublishResult{ready: make(chan struct{})}
+		r.set("", err)
+		return r
+	}
+	return t.Publish(ctx, &Message{Data: data, Attributes: attrs})
+}
+
+// DecodeMessage decodes the data of m into v, which must be a pointer, with
+// the schema and encoding recorded in m's attributes. The schema must be
+// registered with the client. Subscription.Receive does not decode messages;
+// call DecodeMessage from its callback, or use Subscription.ReceiveValues.
+func (c *Client) DecodeMessage(m *Message, v interface{}) error {
+	name := m.Attributes[schema.NameAttribute]
+	if name == "" {
+		return errors.New("pubsub: message has no schema")
+	}
+	c.schemaMu.Lock()
+	s := c.schemas[name]
+	c.schemaMu.Unlock()
+	if s == nil {
+		return fmt.Errorf("pubsub: schema %q is not registered", name)
+	}
+	enc, err := schema.ParseEncoding(m.Attributes[schema.EncodingAttribute])
+	if err != nil {
+		return fmt.Errorf("pubsub: %v", err)
+	}
+	return s.Decode(m.Data, SchemaEncoding(enc), v)
+}
+
+// ReceiveValues is like Receive, but decodes the data of each message with
+// DecodeMessage before passing it to f. newValue returns the pointer to
+// decode each message into, such as new(Order); f is called with the message
+// and that pointer. A message that cannot be decoded is nacked without
+// calling f, and the first such error is logged.
+func (s *Subscription) ReceiveValues(ctx context.Context, newValue func() interface{}, f func(context.Context, *Message, interface{})) error {
+	var logOnce sync.Once
+	return s.Receive(ctx, func(ctx context.Context, m *Message) {
+		v := newValue()
+		if err := s.c.DecodeMessage(m, v); err != nil {
+			logOnce.Do(func() {
+				log.Printf("pubsub: cannot decode message %s from %s: %v", m.ID, s.name, err)
+			})
+			m.Nack()
+			return
+		}
+		f(ctx, m, v)
+	})
+}
@@ -0,0 +1,257 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pubsub
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/smyte/google-cloud-go/internal/testutil"
+	"github.com/smyte/google-cloud-go/pubsub/internal/schema"
+	"github.com/smyte/google-cloud-go/pubsub/pstest"
+	"github.com/golang/protobuf/proto"
+	pb "google.golang.org/genproto/googleapis/pubsub/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const testAvroSchema = `{
+	"type": "record",
+	"name": "Order",
+	"fields": [
+		{"name": "item", "type": "string"},
+		{"name": "quantity", "type": "int"},
+		{"name": "note", "type": ["null", "string"]}
+	]
+}`
+
+type testOrder struct {
+	Item     string  `json:"item"`
+	Quantity int     `json:"quantity"`
+	Note     *string `json:"note"`
+}
+
+func TestRegisterSchema(t *testing.T) {
+	client, srv := newFake(t)
+	defer client.Close()
+	defer srv.Close()
+
+	s, err := client.RegisterSchema("orders", SchemaAvro, testAvroSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := s.String(), "projects/P/schemas/orders"; got != want {
+		t.Errorf("got name %q, want %q", got, want)
+	}
+	if s.ID() != "orders" || s.Type() != SchemaAvro || s.Definition() != testAvroSchema {
+		t.Errorf("got schema %s of type %v", s.ID(), s.Type())
+	}
+	if client.Schema("orders") != s {
+		t.Error("Schema did not return the registered schema")
+	}
+	if _, err := client.RegisterSchema("orders", SchemaAvro, testAvroSchema); err == nil {
+		t.Error("registering twice: got no error")
+	}
+	if _, err := client.RegisterSchema("bad", SchemaAvro, `{"type": "record"}`); err == nil {
+		t.Error("bad definition: got no error")
+	}
+	if _, err := client.RegisterSchema("bad", SchemaProtocolBuffer, "no.such.Message"); err == nil {
+		t.Error("unknown message type: got no error")
+	}
+}
+
+func TestPublishValue(t *testing.T) {
+	ctx := context.Background()
+	client, srv := newFake(t)
+	defer client.Close()
+	defer srv.Close()
+
+	s, err := client.RegisterSchema("orders", SchemaAvro, testAvroSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic := mustCreateTopic(t, client, "t")
+	defer topic.Stop()
+	sub, err := client.CreateSubscription(ctx, "s", SubscriptionConfig{Topic: topic})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := topic.PublishValue(ctx, testOrder{}, nil).Get(ctx); err != errNoSchemaSettings {
+		t.Errorf("without SchemaSettings: got %v, want errNoSchemaSettings", err)
+	}
+	topic.SchemaSettings = &SchemaSettings{Schema: s, Encoding: EncodingBinary}
+
+	note := "gift"
+	want := testOrder{Item: "widget", Quantity: 3, Note: &note}
+	if _, err := topic.PublishValue(ctx, want, map[string]string{"k": "v"}).Get(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// Publish does not modify the message.
+	data, err := s.Encode(want, EncodingBinary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	attrs := map[string]string{"k": "v"}
+	msg := &Message{Data: data, Attributes: attrs}
+	if _, err := topic.Publish(ctx, msg).Get(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.Attributes) != 1 || len(attrs) != 1 {
+		t.Errorf("Publish modified the attributes: %v", msg.Attributes)
+	}
+	// Data that does not conform to the schema is rejected before publishing.
+	if _, err := topic.Publish(ctx, &Message{Data: []byte("garbage")}).Get(ctx); err == nil {
+		t.Error("publishing nonconforming data: got no error")
+	}
+	if _, err := topic.PublishValue(ctx, map[string]interface{}{"item": 1}, nil).Get(ctx); err == nil {
+		t.Error("publishing a nonconforming value: got no error")
+	}
+
+	msgs, err := pullN(ctx, sub, 1, func(_ context.Context, m *Message) { m.Ack() })
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := msgs[0]
+	if m.Attributes["k"] != "v" || m.Attributes["googclient_schemaencoding"] != "BINARY" {
+		t.Errorf("got attributes %v", m.Attributes)
+	}
+	var got testOrder
+	if err := client.DecodeMessage(m, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !testutil.Equal(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if err := client.DecodeMessage(&Message{Data: m.Data}, &got); err == nil {
+		t.Error("decoding a message without a schema: got no error")
+	}
+}
+
+func TestReceiveValues(t *testing.T) {
+	ctx := context.Background()
+	client, srv := newFake(t)
+	defer client.Close()
+	defer srv.Close()
+
+	s, err := client.RegisterSchema("orders", SchemaAvro, testAvroSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic := mustCreateTopic(t, client, "t")
+	defer topic.Stop()
+	sub, err := client.CreateSubscription(ctx, "s", SubscriptionConfig{Topic: topic})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A message that claims the schema but does not conform to it, published
+	// without SchemaSettings to skip validation.
+	badID, err := topic.Publish(ctx, &Message{
+		Data:       []byte("garbage"),
+		Attributes: map[string]string{schema.NameAttribute: s.name, schema.EncodingAttribute: "BINARY"},
+	}).Get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic.SchemaSettings = &SchemaSettings{Schema: s, Encoding: EncodingJSON}
+	want := testOrder{Item: "widget", Quantity: 3}
+	if _, err := topic.PublishValue(ctx, want, nil).Get(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	cctx, cancel := context.WithCancel(ctx)
+	var (
+		mu  sync.Mutex
+		got []testOrder
+	)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- sub.ReceiveValues(cctx, func() interface{} { return new(testOrder) }, func(_ context.Context, m *Message, v interface{}) {
+			m.Ack()
+			mu.Lock()
+			got = append(got, *v.(*testOrder))
+			mu.Unlock()
+		})
+	}()
+	// Receive until the message that cannot be decoded has been delivered.
+	for start := time.Now(); srv.Message(badID).Deliveries == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 10*time.Second {
+			t.Fatal("the message that cannot be decoded was not delivered")
+		}
+	}
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		mu.Lock()
+		n := len(got)
+		mu.Unlock()
+		if n > 0 || time.Since(start) > 10*time.Second {
+			break
+		}
+	}
+	cancel()
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if want := []testOrder{want}; !testutil.Equal(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if m := srv.Message(badID); m.Acks != 0 {
+		t.Errorf("the message that cannot be decoded was acked %d times", m.Acks)
+	}
+}
+
+func TestProtoSchemaAndServerValidation(t *testing.T) {
+	ctx := context.Background()
+	client, srv := newFake(t)
+	defer client.Close()
+	defer srv.Close()
+
+	s, err := client.RegisterSchema("msgs", SchemaProtocolBuffer, "google.pubsub.v1.PubsubMessage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic := mustCreateTopic(t, client, "t")
+	defer topic.Stop()
+	err = srv.SetTopicSchema(topic.name, &pstest.Schema{
+		Name:       s.String(),
+		Type:       "PROTOCOL_BUFFER",
+		Definition: "google.pubsub.v1.PubsubMessage",
+		Encoding:   "JSON",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without SchemaSettings the client does not validate, but the server does.
+	_, err = topic.Publish(ctx, &Message{Data: []byte(`{"nope": true}`)}).Get(ctx)
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("got %v, want InvalidArgument", err)
+	}
+
+	topic.SchemaSettings = &SchemaSettings{Schema: s, Encoding: EncodingJSON}
+	want := &pb.PubsubMessage{Data: []byte("inner"), OrderingKey: "k"}
+	id, err := topic.PublishValue(ctx, want, nil).Get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := srv.Message(id)
+	got := &pb.PubsubMessage{}
+	if err := s.Decode(m.Data, EncodingJSON, got); err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
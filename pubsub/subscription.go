@@ -19,12 +19,14 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"log"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/smyte/google-cloud-go/iam"
 	"github.com/smyte/google-cloud-go/internal/optional"
+	"github.com/smyte/google-cloud-go/internal/unknownfields"
 	"github.com/golang/protobuf/ptypes"
 	durpb "github.com/golang/protobuf/ptypes/duration"
 	gax "github.com/googleapis/gax-go/v2"
@@ -47,6 +49,7 @@ type Subscription struct {
 
 	mu            sync.Mutex
 	receiveActive bool
+	ordering      *bool // the subscription's EnableMessageOrdering, once known
 }
 
 // Subscription creates a reference to a subscription.
@@ -227,6 +230,77 @@ type SubscriptionConfig struct {
 
 	// The set of labels for the subscription.
 	Labels map[string]string
+
+	// EnableMessageOrdering enables ordered delivery: messages with the same
+	// ordering key are delivered in the order they were published, and
+	// Receive passes them to its callback one at a time, waiting for it to
+	// return, but not for the message to be acked, before passing the next.
+	// It cannot be changed after the subscription is created.
+	EnableMessageOrdering bool
+
+	// DeadLetterPolicy specifies where messages are forwarded when they cannot
+	// be delivered. If nil, messages are never dead-lettered.
+	DeadLetterPolicy *DeadLetterPolicy
+
+	// Filter is an expression that selects the messages delivered to the
+	// subscription by their attributes, such as
+	//   attributes.type = "order" AND hasPrefix(attributes.region, "eu")
+	// Messages that do not match are not delivered. If empty, every message
+	// is delivered. It cannot be changed after the subscription is created.
+	Filter string
+}
+
+// filterFieldNumber is the number of the filter field of Subscription. The
+// field is newer than the generated Subscription, so it is sent as an
+// unrecognized field.
+const filterFieldNumber = 12
+
+func setSubscriptionFilter(pbSub *pb.Subscription, filter string) {
+	if filter == "" {
+		return
+	}
+	pbSub.XXX_unrecognized = unknownfields.AppendBytes(pbSub.XXX_unrecognized, filterFieldNumber, []byte(filter))
+}
+
+// subscriptionFilter returns the filter of pbSub, or "" if it has none.
+func subscriptionFilter(pbSub *pb.Subscription) string {
+	filter, _ := unknownfields.Bytes(pbSub.XXX_unrecognized, filterFieldNumber)
+	return string(filter)
+}
+
+// DeadLetterPolicy specifies the conditions for dead lettering messages in
+// a subscription.
+type DeadLetterPolicy struct {
+	// DeadLetterTopic is the name of the topic, in the format
+	// "projects/<projid>/topics/<name>", to which messages are forwarded
+	// after MaxDeliveryAttempts failed deliveries.
+	DeadLetterTopic string
+
+	// MaxDeliveryAttempts is the number of delivery attempts, between 5 and
+	// 100, after which a message is forwarded to DeadLetterTopic. A delivery
+	// attempt fails when the message is nacked or its ack deadline expires.
+	// If zero, the service uses a default of 5.
+	MaxDeliveryAttempts int
+}
+
+func (dlp *DeadLetterPolicy) toProto() *pb.DeadLetterPolicy {
+	if dlp == nil || dlp.DeadLetterTopic == "" {
+		return nil
+	}
+	return &pb.DeadLetterPolicy{
+		DeadLetterTopic:     dlp.DeadLetterTopic,
+		MaxDeliveryAttempts: int32(dlp.MaxDeliveryAttempts),
+	}
+}
+
+func protoToDeadLetterPolicy(pbDLP *pb.DeadLetterPolicy) *DeadLetterPolicy {
+	if pbDLP == nil {
+		return nil
+	}
+	return &DeadLetterPolicy{
+		DeadLetterTopic:     pbDLP.DeadLetterTopic,
+		MaxDeliveryAttempts: int(pbDLP.MaxDeliveryAttempts),
+	}
 }
 
 func (cfg *SubscriptionConfig) toProto(name string) *pb.Subscription {
@@ -238,7 +312,7 @@ func (cfg *SubscriptionConfig) toProto(name string) *pb.Subscription {
 	if cfg.RetentionDuration != 0 {
 		retentionDuration = ptypes.DurationProto(cfg.RetentionDuration)
 	}
-	return &pb.Subscription{
+	pbSub := &pb.Subscription{
 		Name:                     name,
 		Topic:                    cfg.Topic.name,
 		PushConfig:               pbPushConfig,
@@ -247,7 +321,11 @@ func (cfg *SubscriptionConfig) toProto(name string) *pb.Subscription {
 		MessageRetentionDuration: retentionDuration,
 		Labels:                   cfg.Labels,
 		ExpirationPolicy:         expirationPolicyToProto(cfg.ExpirationPolicy),
+		EnableMessageOrdering:    cfg.EnableMessageOrdering,
+		DeadLetterPolicy:         cfg.DeadLetterPolicy.toProto(),
 	}
+	setSubscriptionFilter(pbSub, cfg.Filter)
+	return pbSub
 }
 
 func protoToSubscriptionConfig(pbSub *pb.Subscription, c *Client) (SubscriptionConfig, error) {
@@ -267,12 +345,15 @@ func protoToSubscriptionConfig(pbSub *pb.Subscription, c *Client) (SubscriptionC
 		}
 	}
 	subC := SubscriptionConfig{
-		Topic:               newTopic(c, pbSub.Topic),
-		AckDeadline:         time.Second * time.Duration(pbSub.AckDeadlineSeconds),
-		RetainAckedMessages: pbSub.RetainAckedMessages,
-		RetentionDuration:   rd,
-		Labels:              pbSub.Labels,
-		ExpirationPolicy:    expirationPolicy,
+		Topic:                 newTopic(c, pbSub.Topic),
+		AckDeadline:           time.Second * time.Duration(pbSub.AckDeadlineSeconds),
+		RetainAckedMessages:   pbSub.RetainAckedMessages,
+		RetentionDuration:     rd,
+		Labels:                pbSub.Labels,
+		ExpirationPolicy:      expirationPolicy,
+		EnableMessageOrdering: pbSub.EnableMessageOrdering,
+		DeadLetterPolicy:      protoToDeadLetterPolicy(pbSub.DeadLetterPolicy),
+		Filter:                subscriptionFilter(pbSub),
 	}
 	pc := protoToPushConfig(pbSub.PushConfig)
 	if pc != nil {
@@ -403,9 +484,34 @@ func (s *Subscription) Config(ctx context.Context) (SubscriptionConfig, error) {
 	if err != nil {
 		return SubscriptionConfig{}, err
 	}
+	s.setOrdering(cfg.EnableMessageOrdering)
 	return cfg, nil
 }
 
+func (s *Subscription) setOrdering(enabled bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ordering = &enabled
+}
+
+// orderingEnabled reports whether the subscription has EnableMessageOrdering.
+// It gets the subscription's config the first time it is called, or until
+// that succeeds. If it cannot, it returns true, so that ordered messages are
+// not delivered out of order, and the error.
+func (s *Subscription) orderingEnabled(ctx context.Context) (bool, error) {
+	s.mu.Lock()
+	ordering := s.ordering
+	s.mu.Unlock()
+	if ordering != nil {
+		return *ordering, nil
+	}
+	cfg, err := s.Config(ctx)
+	if err != nil {
+		return true, err
+	}
+	return cfg.EnableMessageOrdering, nil
+}
+
 // SubscriptionConfigToUpdate describes how to update a subscription.
 type SubscriptionConfigToUpdate struct {
 	// If non-nil, the push config is changed.
@@ -428,6 +534,10 @@ type SubscriptionConfigToUpdate struct {
 	// This field has beta status. It is not subject to the stability guarantee
 	// and may change.
 	Labels map[string]string
+
+	// If non-nil, DeadLetterPolicy is changed. Use the zero value
+	// &DeadLetterPolicy{} to remove the dead-letter policy.
+	DeadLetterPolicy *DeadLetterPolicy
 }
 
 // Update changes an existing subscription according to the fields set in cfg.
@@ -476,6 +586,10 @@ func (s *Subscription) updateRequest(cfg *SubscriptionConfigToUpdate) *pb.Update
 		psub.Labels = cfg.Labels
 		paths = append(paths, "labels")
 	}
+	if cfg.DeadLetterPolicy != nil {
+		psub.DeadLetterPolicy = cfg.DeadLetterPolicy.toProto()
+		paths = append(paths, "dead_letter_policy")
+	}
 	return &pb.UpdateSubscriptionRequest{
 		Subscription: psub,
 		UpdateMask:   &fmpb.FieldMask{Paths: paths},
@@ -564,6 +678,7 @@ func (c *Client) CreateSubscription(ctx context.Context, id string, cfg Subscrip
 	if err != nil {
 		return nil, err
 	}
+	sub.setOrdering(cfg.EnableMessageOrdering)
 	return sub, nil
 }
 
@@ -587,9 +702,18 @@ var errReceiveInProgress = errors.New("pubsub: Receive already in progress for t
 // process messages synchronously in f, even if that processing is relatively
 // time-consuming; Receive will spawn new goroutines for incoming messages,
 // limited by MaxOutstandingMessages and MaxOutstandingBytes in ReceiveSettings.
+// However, if the subscription has EnableMessageOrdering, messages with the
+// same ordering key are passed to f one at a time, in the order they were
+// received: f is not called with a message until it has returned for the
+// earlier messages with that key. Unless the Subscription was returned by
+// CreateSubscription, or its Config method has been called, Receive gets the
+// subscription's config to find out; if it cannot, it logs the error and
+// assumes that ordering is enabled.
 //
 // The context passed to f will be canceled when ctx is Done or there is a
-// fatal service error.
+// fatal service error. It carries an OpenCensus span for the message, which
+// continues the trace of the message's Publish call if the message has its
+// context, and ends when f returns.
 //
 // Receive will send an ack deadline extension on message receipt, then
 // automatically extend the ack deadline of all fetched Messages up to the
@@ -637,19 +761,128 @@ func (s *Subscription) Receive(ctx context.Context, f func(context.Context, *Mes
 		synchronous:  s.ReceiveSettings.Synchronous,
 	}
 	fc := newFlowController(maxCount, maxBytes)
+	var od *orderedDispatcher // nil if callbacks need not be ordered
+	ordered, err := s.orderingEnabled(ctx)
+	if err != nil {
+		log.Printf("pubsub: cannot get the config of %s, so messages with the same ordering key are passed to the callback one at a time: %v", s.name, err)
+	}
+	if ordered {
+		od = &orderedDispatcher{queues: make(map[string][]func())}
+	}
 
 	// Wait for all goroutines started by Receive to return, so instead of an
 	// obscure goroutine leak we have an obvious blocked call to Receive.
 	group, gctx := errgroup.WithContext(ctx)
 	for i := 0; i < numGoroutines; i++ {
 		group.Go(func() error {
-			return s.receive(gctx, po, fc, f)
+			return s.receive(gctx, po, fc, od, f)
 		})
 	}
 	return group.Wait()
 }
 
-func (s *Subscription) receive(ctx context.Context, po *pullOptions, fc *flowController, f func(context.Context, *Message)) error {
+// ReceiveBatch is like Receive, but calls f with batches of messages rather
+// than one message at a time. A batch is passed to f when it has maxMessages
+// messages, or maxWait after its first message was received, whichever is
+// sooner. Batches are passed to f one at a time, from a single goroutine.
+//
+// As with Receive, each message must be acked or nacked, for example with
+// AckAll or NackAll once the whole batch has been processed. The ack
+// deadlines of the messages in a batch are extended until then, up to
+// ReceiveSettings.MaxExtension. ReceiveSettings.MaxOutstandingMessages and
+// MaxOutstandingBytes bound the messages that are not yet acked or nacked,
+// including the messages of the batch being collected, so they should allow
+// at least a full batch.
+//
+// When ctx is done, the messages of the batch being collected are nacked, and
+// ReceiveBatch returns once the messages passed to f have been acked, nacked
+// or have expired.
+func (s *Subscription) ReceiveBatch(ctx context.Context, maxMessages int, maxWait time.Duration, f func(context.Context, []*Message)) error {
+	if maxMessages < 1 {
+		return errors.New("pubsub: ReceiveBatch: maxMessages must be positive")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	msgs := make(chan *Message)
+	// stop is closed when the context that Receive passes to its callback is
+	// done. Receive then waits for the messages of the batch being collected
+	// to be nacked, even if it is returning an error and ctx is not done.
+	stop := make(chan struct{})
+	var watchOnce sync.Once
+	batchDone := make(chan struct{})
+	go func() {
+		defer close(batchDone)
+		var batch []*Message
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		flush := func() {
+			if timer != nil {
+				timer.Stop()
+				timer, timeout = nil, nil
+			}
+			b := batch
+			batch = nil
+			f(ctx, b)
+		}
+		for {
+			select {
+			case m := <-msgs:
+				batch = append(batch, m)
+				if len(batch) == 1 {
+					timer = time.NewTimer(maxWait)
+					timeout = timer.C
+				}
+				if len(batch) >= maxMessages {
+					flush()
+				}
+			case <-timeout:
+				flush()
+			case <-stop:
+				if timer != nil {
+					timer.Stop()
+				}
+				NackAll(batch)
+				return
+			}
+		}
+	}()
+	err := s.Receive(ctx, func(cctx context.Context, m *Message) {
+		watchOnce.Do(func() {
+			go func() {
+				select {
+				case <-cctx.Done():
+				case <-ctx.Done():
+				}
+				close(stop)
+			}()
+		})
+		select {
+		case msgs <- m:
+		case <-cctx.Done():
+			m.Nack()
+		}
+	})
+	cancel()
+	watchOnce.Do(func() { close(stop) })
+	<-batchDone
+	return err
+}
+
+// AckAll acks each of msgs. See Message.Ack.
+func AckAll(msgs []*Message) {
+	for _, m := range msgs {
+		m.Ack()
+	}
+}
+
+// NackAll nacks each of msgs. See Message.Nack.
+func NackAll(msgs []*Message) {
+	for _, m := range msgs {
+		m.Nack()
+	}
+}
+
+func (s *Subscription) receive(ctx context.Context, po *pullOptions, fc *flowController, od *orderedDispatcher, f func(context.Context, *Message)) error {
 	// Cancel a sub-context when we return, to kick the context-aware callbacks
 	// and the goroutine below.
 	ctx2, cancel := context.WithCancel(ctx)
@@ -723,13 +956,68 @@ func (s *Subscription) receive(ctx context.Context, po *pullOptions, fc *flowCon
 				defer fc.release(msgLen)
 				old(ackID, ack, receiveTime)
 			}
-			wg.Add(1)
-			go func() {
-				defer wg.Done()
-				f(ctx2, msg)
-			}()
+			call := func() { callWithSpan(ctx2, s.name, msg, f) }
+			if od != nil {
+				od.dispatch(msg.OrderingKey, &wg, call)
+			} else {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					call()
+				}()
+			}
+		}
+	}
+}
+
+// orderedDispatcher calls the callbacks for messages with the same ordering
+// key one at a time, in the order they were dispatched.
+type orderedDispatcher struct {
+	mu     sync.Mutex
+	queues map[string][]func() // by ordering key; present while a callback for the key runs
+}
+
+// dispatch calls call in a new goroutine counted by wg. If orderingKey is not
+// empty, it waits for the earlier calls dispatched with the key to return.
+//
+// dispatch must not be called concurrently with wg.Wait.
+func (d *orderedDispatcher) dispatch(orderingKey string, wg *sync.WaitGroup, call func()) {
+	if orderingKey != "" {
+		d.mu.Lock()
+		if q, ok := d.queues[orderingKey]; ok {
+			// The goroutine running the key's callbacks will call this one.
+			d.queues[orderingKey] = append(q, call)
+			d.mu.Unlock()
+			return
 		}
+		d.queues[orderingKey] = nil
+		d.mu.Unlock()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for call != nil {
+			call()
+			call = d.next(orderingKey)
+		}
+	}()
+}
+
+// next returns the next callback queued for the ordering key, or nil if
+// there is none.
+func (d *orderedDispatcher) next(orderingKey string) func() {
+	if orderingKey == "" {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	q := d.queues[orderingKey]
+	if len(q) == 0 {
+		delete(d.queues, orderingKey)
+		return nil
 	}
+	d.queues[orderingKey] = q[1:]
+	return q[0]
 }
 
 type pullOptions struct {
@@ -17,6 +17,8 @@ package pubsub
 import (
 	"context"
 	"fmt"
+	"sort"
+	"sync"
 	"testing"
 	"time"
 
@@ -267,6 +269,408 @@ func testReceive(t *testing.T, synchronous bool) {
 	}
 }
 
+func TestReceiveBatch(t *testing.T) {
+	ctx := context.Background()
+	client, srv := newFake(t)
+	defer client.Close()
+	defer srv.Close()
+
+	topic := mustCreateTopic(t, client, "t")
+	sub, err := client.CreateSubscription(ctx, "s", SubscriptionConfig{Topic: topic})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sub.ReceiveBatch(ctx, 0, time.Second, func(context.Context, []*Message) {}); err == nil {
+		t.Error("maxMessages 0: got no error")
+	}
+
+	const n = 7
+	var ids []string
+	for i := 0; i < n; i++ {
+		ids = append(ids, srv.Publish(topic.name, []byte{byte(i)}, nil))
+	}
+
+	// Nack the first batch, so its messages are redelivered.
+	var (
+		seen   = map[string]bool{}
+		nacked bool
+	)
+	cctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	err = sub.ReceiveBatch(cctx, 3, 100*time.Millisecond, func(_ context.Context, msgs []*Message) {
+		if len(msgs) == 0 || len(msgs) > 3 {
+			t.Errorf("got batch of %d messages", len(msgs))
+		}
+		if !nacked {
+			nacked = true
+			NackAll(msgs)
+			return
+		}
+		for _, m := range msgs {
+			seen[m.ID] = true
+		}
+		AckAll(msgs)
+		if len(seen) == n {
+			cancel()
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != n {
+		t.Fatalf("acked %d messages, want %d", len(seen), n)
+	}
+	for _, id := range ids {
+		if m := srv.Message(id); m.Acks == 0 {
+			t.Errorf("message %s was not acked", id)
+		}
+	}
+}
+
+func TestReceiveBatchNacksPartialBatch(t *testing.T) {
+	ctx := context.Background()
+	client, srv := newFake(t)
+	defer client.Close()
+	defer srv.Close()
+
+	topic := mustCreateTopic(t, client, "t")
+	sub, err := client.CreateSubscription(ctx, "s", SubscriptionConfig{Topic: topic})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := srv.Publish(topic.name, []byte("m"), nil)
+
+	// The batch never fills or times out before ctx is done, so its message is
+	// nacked and f is not called.
+	cctx, cancel := context.WithCancel(ctx)
+	go func() {
+		for srv.Message(id).Deliveries == 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
+		cancel()
+	}()
+	err = sub.ReceiveBatch(cctx, 10, time.Hour, func(context.Context, []*Message) {
+		t.Error("f was called")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := srv.Message(id); m.Acks != 0 {
+		t.Errorf("got %d acks, want 0", m.Acks)
+	}
+}
+
+func TestReceiveOrdered(t *testing.T) {
+	ctx := context.Background()
+	client, srv := newFake(t)
+	defer client.Close()
+	defer srv.Close()
+
+	topic := mustCreateTopic(t, client, "t")
+	topic.EnableMessageOrdering = true
+	topic.PublishSettings.CountThreshold = 4
+	sub, err := client.CreateSubscription(ctx, "s", SubscriptionConfig{
+		Topic:                 topic,
+		EnableMessageOrdering: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := sub.Config(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.EnableMessageOrdering {
+		t.Error("EnableMessageOrdering not set in config")
+	}
+
+	const nKeys, nPerKey = 3, 10
+	var results []*PublishResult
+	for i := 0; i < nPerKey; i++ {
+		for k := 0; k < nKeys; k++ {
+			results = append(results, topic.Publish(ctx, &Message{
+				Data:        []byte{byte(i)},
+				OrderingKey: fmt.Sprintf("key%d", k),
+			}))
+		}
+	}
+	for _, r := range results {
+		if _, err := r.Get(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	topic.Stop()
+
+	var mu sync.Mutex
+	got := map[string][]byte{}
+	running := map[string]bool{}
+	msgs, err := pullN(ctx, sub, nKeys*nPerKey, func(_ context.Context, m *Message) {
+		mu.Lock()
+		if running[m.OrderingKey] {
+			t.Errorf("concurrent callbacks for key %s", m.OrderingKey)
+		}
+		running[m.OrderingKey] = true
+		got[m.OrderingKey] = append(got[m.OrderingKey], m.Data[0])
+		mu.Unlock()
+		time.Sleep(time.Millisecond)
+		mu.Lock()
+		running[m.OrderingKey] = false
+		mu.Unlock()
+		m.Ack()
+	})
+	if c := status.Convert(err); err != nil && c.Code() != codes.Canceled {
+		t.Fatalf("Pull: %v", err)
+	}
+	if len(msgs) != nKeys*nPerKey {
+		t.Fatalf("got %d messages, want %d", len(msgs), nKeys*nPerKey)
+	}
+	for key, data := range got {
+		for i, d := range data {
+			if int(d) != i {
+				t.Errorf("key %s: message %d has data %d", key, i, d)
+				break
+			}
+		}
+	}
+}
+
+func TestReceiveUnorderedSubscription(t *testing.T) {
+	ctx := context.Background()
+	client, srv := newFake(t)
+	defer client.Close()
+	defer srv.Close()
+
+	topic := mustCreateTopic(t, client, "t")
+	topic.EnableMessageOrdering = true
+	topic.PublishSettings.CountThreshold = 2
+	sub, err := client.CreateSubscription(ctx, "s", SubscriptionConfig{Topic: topic})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var results []*PublishResult
+	for i := 0; i < 2; i++ {
+		results = append(results, topic.Publish(ctx, &Message{Data: []byte{byte(i)}, OrderingKey: "k"}))
+	}
+	for _, r := range results {
+		if _, err := r.Get(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	topic.Stop()
+
+	// Without ordering on the subscription, callbacks for the same key run
+	// concurrently: each waits for the other to start.
+	var started sync.WaitGroup
+	started.Add(2)
+	allStarted := make(chan struct{})
+	go func() {
+		started.Wait()
+		close(allStarted)
+	}()
+	_, err = pullN(ctx, sub, 2, func(_ context.Context, m *Message) {
+		started.Done()
+		select {
+		case <-allStarted:
+		case <-time.After(10 * time.Second):
+			t.Error("callbacks for the same ordering key did not run concurrently")
+		}
+		m.Ack()
+	})
+	if c := status.Convert(err); err != nil && c.Code() != codes.Canceled {
+		t.Fatalf("Pull: %v", err)
+	}
+}
+
+func TestSubscriptionOrderingEnabled(t *testing.T) {
+	ctx := context.Background()
+	client, srv := newFake(t)
+	defer client.Close()
+	defer srv.Close()
+
+	topic := mustCreateTopic(t, client, "t")
+	sub, err := client.CreateSubscription(ctx, "s", SubscriptionConfig{Topic: topic, EnableMessageOrdering: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sub.ordering == nil || !*sub.ordering {
+		t.Error("CreateSubscription did not record that ordering is enabled")
+	}
+
+	// A reference gets the config once.
+	ref := client.Subscription("s")
+	if ordered, err := ref.orderingEnabled(ctx); !ordered || err != nil {
+		t.Errorf("got (%t, %v), want (true, nil)", ordered, err)
+	}
+	if ref.ordering == nil {
+		t.Error("orderingEnabled did not record the config")
+	}
+
+	// If the config cannot be read, ordering is assumed, and not recorded.
+	missing := client.Subscription("missing")
+	if ordered, err := missing.orderingEnabled(ctx); !ordered || err == nil {
+		t.Errorf("missing subscription: got (%t, %v), want (true, error)", ordered, err)
+	}
+	if missing.ordering != nil {
+		t.Error("orderingEnabled recorded a failure")
+	}
+}
+
+func TestDeadLetterPolicy(t *testing.T) {
+	ctx := context.Background()
+	client, srv := newFake(t)
+	defer client.Close()
+	defer srv.Close()
+
+	topic := mustCreateTopic(t, client, "t")
+	dlTopic := mustCreateTopic(t, client, "dead-letter")
+	dlSub, err := client.CreateSubscription(ctx, "dead-letter", SubscriptionConfig{Topic: dlTopic})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dlp := &DeadLetterPolicy{DeadLetterTopic: dlTopic.name, MaxDeliveryAttempts: 5}
+	sub, err := client.CreateSubscription(ctx, "s", SubscriptionConfig{
+		Topic:            topic,
+		DeadLetterPolicy: dlp,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := sub.Config(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !testutil.Equal(cfg.DeadLetterPolicy, dlp) {
+		t.Errorf("got DeadLetterPolicy %+v, want %+v", cfg.DeadLetterPolicy, dlp)
+	}
+
+	srv.Publish(topic.name, []byte("d"), nil)
+	var attempts []int
+	_, err = pullN(ctx, sub, 5, func(_ context.Context, m *Message) {
+		if m.DeliveryAttempt == nil {
+			t.Error("DeliveryAttempt is nil")
+		} else {
+			attempts = append(attempts, *m.DeliveryAttempt)
+		}
+		m.Nack()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{1, 2, 3, 4, 5}; !testutil.Equal(attempts, want) {
+		t.Errorf("got delivery attempts %v, want %v", attempts, want)
+	}
+	msgs, err := pullN(ctx, dlSub, 1, func(_ context.Context, m *Message) {
+		if m.DeliveryAttempt != nil {
+			t.Errorf("got DeliveryAttempt %d, want nil", *m.DeliveryAttempt)
+		}
+		m.Ack()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msgs[0].Data) != "d" {
+		t.Errorf("dead lettered message has data %q, want %q", msgs[0].Data, "d")
+	}
+
+	cfg, err = sub.Update(ctx, SubscriptionConfigToUpdate{DeadLetterPolicy: &DeadLetterPolicy{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.DeadLetterPolicy != nil {
+		t.Errorf("got DeadLetterPolicy %+v after removing it", cfg.DeadLetterPolicy)
+	}
+}
+
+func TestSubscriptionFilter(t *testing.T) {
+	ctx := context.Background()
+	client, srv := newFake(t)
+	defer client.Close()
+	defer srv.Close()
+
+	topic := mustCreateTopic(t, client, "t")
+	const filter = `attributes.type = "order" AND hasPrefix(attributes.region, "eu")`
+	sub, err := client.CreateSubscription(ctx, "s", SubscriptionConfig{Topic: topic, Filter: filter})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := sub.Config(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Filter != filter {
+		t.Errorf("got Filter %q, want %q", cfg.Filter, filter)
+	}
+	_, err = client.CreateSubscription(ctx, "bad", SubscriptionConfig{Topic: topic, Filter: "attributes.type ="})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("bad filter: got %v, want InvalidArgument", err)
+	}
+
+	srv.Publish(topic.name, []byte("us"), map[string]string{"type": "order", "region": "us-east1"})
+	srv.Publish(topic.name, []byte("refund"), map[string]string{"type": "refund", "region": "eu-west1"})
+	srv.Publish(topic.name, []byte("eu"), map[string]string{"type": "order", "region": "eu-west1"})
+	msgs, err := pullN(ctx, sub, 1, func(_ context.Context, m *Message) { m.Ack() })
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range msgs {
+		if string(m.Data) != "eu" {
+			t.Errorf("received message %q that does not match the filter", m.Data)
+		}
+	}
+}
+
+func TestSeekToSnapshot(t *testing.T) {
+	ctx := context.Background()
+	client, srv := newFake(t)
+	defer client.Close()
+	defer srv.Close()
+
+	topic := mustCreateTopic(t, client, "t")
+	sub, err := client.CreateSubscription(ctx, "s", SubscriptionConfig{Topic: topic})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Publish(topic.name, []byte("m1"), nil)
+	srv.Publish(topic.name, []byte("m2"), nil)
+	snap, err := sub.CreateSnapshot(ctx, "snap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snap.ID() != "snap" || snap.Topic.String() != topic.String() {
+		t.Errorf("got snapshot %s of topic %s", snap.ID(), snap.Topic)
+	}
+	it := client.Snapshots(ctx)
+	if sc, err := it.Next(); err != nil || sc.ID() != "snap" {
+		t.Errorf("Snapshots: got %v, %v", sc, err)
+	}
+
+	receive := func() []string {
+		t.Helper()
+		msgs, err := pullN(ctx, sub, 2, func(_ context.Context, m *Message) { m.Ack() })
+		if err != nil {
+			t.Fatal(err)
+		}
+		var data []string
+		for _, m := range msgs {
+			data = append(data, string(m.Data))
+		}
+		sort.Strings(data)
+		return data
+	}
+	if got := receive(); !testutil.Equal(got, []string{"m1", "m2"}) {
+		t.Fatalf("got %v, want [m1 m2]", got)
+	}
+	if err := sub.SeekToSnapshot(ctx, snap.Snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if got := receive(); !testutil.Equal(got, []string{"m1", "m2"}) {
+		t.Errorf("after seek, got %v, want [m1 m2]", got)
+	}
+	if err := snap.Delete(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func (t1 *Topic) Equal(t2 *Topic) bool {
 	if t1 == nil && t2 == nil {
 		return true
@@ -29,6 +29,7 @@ import (
 	gax "github.com/googleapis/gax-go/v2"
 	"go.opencensus.io/stats"
 	"go.opencensus.io/tag"
+	"go.opencensus.io/trace"
 	"google.golang.org/api/support/bundler"
 	pb "google.golang.org/genproto/googleapis/pubsub/v1"
 	fmpb "google.golang.org/genproto/protobuf/field_mask"
@@ -50,6 +51,13 @@ const (
 // ErrOversizedMessage indicates that a message's size exceeds MaxPublishRequestBytes.
 var ErrOversizedMessage = bundler.ErrOversizedItem
 
+// Errors returned by Publish when a topic's FlowControlSettings have
+// LimitExceededBehavior FlowControlSignalError and a limit is exceeded.
+var (
+	ErrFlowControllerMaxOutstandingMessages = errors.New("pubsub: MaxOutstandingMessages flow controller limit exceeded")
+	ErrFlowControllerMaxOutstandingBytes    = errors.New("pubsub: MaxOutstandingBytes flow controller limit exceeded")
+)
+
 // Topic is a reference to a PubSub topic.
 //
 // The methods of Topic are safe for use by multiple goroutines.
@@ -62,9 +70,26 @@ type Topic struct {
 	// first call to Publish. The default is DefaultPublishSettings.
 	PublishSettings PublishSettings
 
+	// EnableMessageOrdering enables publishing messages with ordering keys.
+	// Messages with the same ordering key are published one bundle at a time,
+	// in the order that Publish was called. It must be set before the first
+	// call to Publish.
+	EnableMessageOrdering bool
+
+	// SchemaSettings, if non-nil, makes Publish reject messages whose data
+	// does not conform to the schema, and record the schema and encoding in
+	// the attributes of the messages it publishes. It must be set before the
+	// first call to Publish.
+	SchemaSettings *SchemaSettings
+
 	mu      sync.RWMutex
 	stopped bool
-	bundler *bundler.Bundler
+	bundler *bundler.Bundler // for messages without ordering keys
+	flow    *flowController  // nil if publishing is not flow controlled
+
+	orderMu     sync.Mutex
+	keyBundlers map[string]*keyBundler // by ordering key; only keys with unhandled messages
+	paused      map[string]bool        // ordering keys whose publishing failed
 }
 
 // PublishSettings control the bundling of published messages.
@@ -93,6 +118,63 @@ type PublishSettings struct {
 	//
 	// Defaults to DefaultPublishSettings.BufferedByteLimit.
 	BufferedByteLimit int
+
+	// FlowControlSettings limit the number and size of messages that have
+	// been passed to Publish but whose results are not yet ready.
+	FlowControlSettings FlowControlSettings
+
+	// Compression, if not NoCompression, compresses the data of messages
+	// larger than CompressionThreshold bytes, unless that does not make it
+	// smaller. The bundle thresholds and limits apply to the compressed size.
+	// Compressed messages have a reserved attribute naming the codec;
+	// Subscription.Receive decompresses their data and removes the attribute.
+	// Other subscribers must do the same.
+	//
+	// Messages are not compressed if the topic has SchemaSettings, since
+	// their data must conform to the schema.
+	Compression Compression
+
+	// The size in bytes above which message data is compressed.
+	CompressionThreshold int
+}
+
+// LimitExceededBehavior is what Publish does when a message would exceed the
+// limits of a topic's FlowControlSettings.
+type LimitExceededBehavior int
+
+const (
+	// FlowControlIgnore disables flow control. This is the default.
+	FlowControlIgnore LimitExceededBehavior = iota
+
+	// FlowControlBlock makes Publish block until the message is within the
+	// limits, or the context passed to Publish is done. In the latter case,
+	// the message is not published and the result has the context's error.
+	FlowControlBlock
+
+	// FlowControlSignalError makes Publish fail the message immediately, with
+	// ErrFlowControllerMaxOutstandingMessages or
+	// ErrFlowControllerMaxOutstandingBytes.
+	FlowControlSignalError
+)
+
+// FlowControlSettings control the number and size of messages that a topic
+// keeps outstanding. A message is outstanding from the call to Publish until
+// its PublishResult is ready.
+type FlowControlSettings struct {
+	// The maximum number of outstanding messages. If less than 1, the number
+	// is not limited.
+	MaxOutstandingMessages int
+
+	// The maximum total size of outstanding messages, in bytes. If less than
+	// 1, the size is not limited. A message larger than the limit is allowed
+	// when no other messages are outstanding.
+	//
+	// With FlowControlBlock, BufferedByteLimit is raised to this value if it
+	// is smaller, so that Publish blocks rather than returning ErrOverflow.
+	MaxOutstandingBytes int
+
+	// What Publish does when a message would exceed a limit.
+	LimitExceededBehavior LimitExceededBehavior
 }
 
 // DefaultPublishSettings holds the default values for topics' PublishSettings.
@@ -374,10 +456,26 @@ func (t *Topic) Subscriptions(ctx context.Context) *SubscriptionIterator {
 	}
 }
 
-var errTopicStopped = errors.New("pubsub: Stop has been called for this topic")
+var (
+	errTopicStopped          = errors.New("pubsub: Stop has been called for this topic")
+	errTopicOrderingDisabled = errors.New("pubsub: Topic.EnableMessageOrdering is false, but an OrderingKey was set in Message")
+)
+
+// ErrPublishingPaused is the error of the results of messages published with
+// an ordering key after an earlier message with the key failed to be
+// published. Call Topic.ResumePublish to publish with the key again.
+type ErrPublishingPaused struct {
+	OrderingKey string
+}
+
+func (e ErrPublishingPaused) Error() string {
+	return fmt.Sprintf("pubsub: publishing for ordering key %q is paused after an earlier error; call Topic.ResumePublish to resume", e.OrderingKey)
+}
 
 // Publish publishes msg to the topic asynchronously. Messages are batched and
-// sent according to the topic's PublishSettings. Publish never blocks.
+// sent according to the topic's PublishSettings. Publish does not block,
+// unless the topic's FlowControlSettings have LimitExceededBehavior
+// FlowControlBlock; then it may wait until ctx is done.
 //
 // Publish returns a non-nil PublishResult which will be ready when the
 // message has been sent (or has failed to be sent) to the server.
@@ -385,7 +483,32 @@ var errTopicStopped = errors.New("pubsub: Stop has been called for this topic")
 // Publish creates goroutines for batching and sending messages. These goroutines
 // need to be stopped by calling t.Stop(). Once stopped, future calls to Publish
 // will immediately return a PublishResult with an error.
+//
+// If msg has an OrderingKey, t.EnableMessageOrdering must be true. Messages
+// with the same ordering key are sent in the order of the calls to Publish.
+// If one of them fails to be sent, publishing with that key is paused: the
+// results of the key's later messages have an ErrPublishingPaused error until
+// t.ResumePublish is called.
+//
+// Publish starts an OpenCensus span for msg, which ends when the result is
+// ready. If the span is sampled, its context is added to the attributes of
+// the message that is sent, but not to those of msg, so that
+// Subscription.Receive can continue the trace.
 func (t *Topic) Publish(ctx context.Context, msg *Message) *PublishResult {
+	r := &PublishResult{ready: make(chan struct{})}
+	var err error
+	// The data of messages with a schema must conform to it, so they are not
+	// compressed.
+	if t.SchemaSettings != nil {
+		if msg, err = t.SchemaSettings.apply(msg); err != nil {
+			r.set("", err)
+			return r
+		}
+	} else if msg, err = compressMessage(&t.PublishSettings, msg); err != nil {
+		r.set("", err)
+		return r
+	}
+	r.span, msg = startPublishSpan(ctx, t.name, msg)
 	// Use a PublishRequest with only the Messages field to calculate the size
 	// of an individual message. This accurately calculates the size of the
 	// encoded proto message by accounting for the length of an individual
@@ -394,30 +517,166 @@ func (t *Topic) Publish(ctx context.Context, msg *Message) *PublishResult {
 	msg.size = proto.Size(&pb.PublishRequest{
 		Messages: []*pb.PubsubMessage{
 			{
-				Data:       msg.Data,
-				Attributes: msg.Attributes,
+				Data:        msg.Data,
+				Attributes:  msg.Attributes,
+				OrderingKey: msg.OrderingKey,
 			},
 		},
 	})
-	r := &PublishResult{ready: make(chan struct{})}
+	if msg.OrderingKey != "" && !t.EnableMessageOrdering {
+		r.set("", errTopicOrderingDisabled)
+		return r
+	}
 	t.initBundler()
+	// Acquire before taking the lock, so that a blocked Publish does not
+	// hold up Stop.
+	if err := t.acquireFlowControl(ctx, msg.size); err != nil {
+		r.set("", err)
+		return r
+	}
 	t.mu.RLock()
 	defer t.mu.RUnlock()
 	// TODO(aboulhosn) [from bcmills] consider changing the semantics of bundler to perform this logic so we don't have to do it here
 	if t.stopped {
+		t.releaseFlowControl(msg.size)
 		r.set("", errTopicStopped)
 		return r
 	}
 
+	b := t.bundler
+	var kb *keyBundler
+	if msg.OrderingKey != "" {
+		if kb, err = t.addToKey(msg.OrderingKey); err != nil {
+			t.releaseFlowControl(msg.size)
+			r.set("", err)
+			return r
+		}
+		b = kb.Bundler
+	}
 	// TODO(jba) [from bcmills] consider using a shared channel per bundle
 	// (requires Bundler API changes; would reduce allocations)
-	err := t.bundler.Add(&bundledMessage{msg, r}, msg.size)
+	err = b.Add(&bundledMessage{msg, r, msg.size}, msg.size)
 	if err != nil {
+		t.releaseFlowControl(msg.size)
 		r.set("", err)
+		if kb != nil {
+			// Later messages with the key must not be published before this one.
+			t.pause(msg.OrderingKey)
+			t.keyDone(msg.OrderingKey, kb, 1)
+		}
 	}
 	return r
 }
 
+// acquireFlowControl waits until a message of size bytes is within the
+// limits of t.PublishSettings.FlowControlSettings, or returns an error,
+// according to their LimitExceededBehavior. The time spent waiting is
+// recorded in PublishFlowControlLatency.
+func (t *Topic) acquireFlowControl(ctx context.Context, size int) error {
+	t.mu.RLock()
+	fc := t.flow
+	t.mu.RUnlock()
+	if fc == nil {
+		return nil
+	}
+	if t.PublishSettings.FlowControlSettings.LimitExceededBehavior == FlowControlSignalError {
+		return fc.tryAcquireErr(size)
+	}
+	start := time.Now()
+	err := fc.acquire(ctx, size)
+	sctx, terr := tag.New(ctx, tag.Upsert(keyTopic, t.name))
+	if terr != nil {
+		log.Printf("pubsub: cannot create context with tag in acquireFlowControl: %v", terr)
+	}
+	stats.Record(sctx, PublishFlowControlLatency.M(float64(time.Since(start))/float64(time.Millisecond)))
+	return err
+}
+
+// releaseFlowControl notes that a message of size bytes is no longer
+// outstanding.
+func (t *Topic) releaseFlowControl(size int) {
+	if t.flow != nil {
+		t.flow.release(size)
+	}
+}
+
+// ResumePublish resumes publishing messages with the ordering key after
+// publishing was paused because a message with the key failed to be
+// published.
+func (t *Topic) ResumePublish(orderingKey string) {
+	t.orderMu.Lock()
+	defer t.orderMu.Unlock()
+	delete(t.paused, orderingKey)
+}
+
+func (t *Topic) pause(orderingKey string) {
+	t.orderMu.Lock()
+	defer t.orderMu.Unlock()
+	if t.paused == nil {
+		t.paused = make(map[string]bool)
+	}
+	t.paused[orderingKey] = true
+}
+
+func (t *Topic) isPaused(orderingKey string) bool {
+	t.orderMu.Lock()
+	defer t.orderMu.Unlock()
+	return t.paused[orderingKey]
+}
+
+// A keyBundler is the bundler for messages with an ordering key. It handles
+// one bundle at a time, so that the key's messages are published in order.
+type keyBundler struct {
+	*bundler.Bundler
+	pending int // messages added to the bundler and not yet handled; guarded by Topic.orderMu
+}
+
+// addToKey returns the bundler for a message with the ordering key, which the
+// caller will add the message to, creating the bundler if the key has none.
+func (t *Topic) addToKey(orderingKey string) (*keyBundler, error) {
+	t.orderMu.Lock()
+	defer t.orderMu.Unlock()
+	if t.paused[orderingKey] {
+		return nil, ErrPublishingPaused{OrderingKey: orderingKey}
+	}
+	kb := t.keyBundlers[orderingKey]
+	if kb == nil {
+		kb = &keyBundler{}
+		kb.Bundler = t.newBundler(func(ctx context.Context, bms []*bundledMessage) {
+			defer t.keyDone(orderingKey, kb, len(bms))
+			// Fail the bundles that were waiting when publishing was paused.
+			if t.isPaused(orderingKey) {
+				for _, bm := range bms {
+					t.releaseFlowControl(bm.size)
+					bm.res.set("", ErrPublishingPaused{OrderingKey: orderingKey})
+				}
+				return
+			}
+			t.publishMessageBundle(ctx, bms)
+		})
+		kb.HandlerLimit = 1
+		if t.keyBundlers == nil {
+			t.keyBundlers = make(map[string]*keyBundler)
+		}
+		t.keyBundlers[orderingKey] = kb
+	}
+	kb.pending++
+	return kb, nil
+}
+
+// keyDone notes that n messages added to kb have been handled or could not be
+// added. Once kb has no pending messages it is dropped, so that the topic
+// does not keep a bundler for every ordering key it has published with; the
+// key's next message gets a new bundler.
+func (t *Topic) keyDone(orderingKey string, kb *keyBundler, n int) {
+	t.orderMu.Lock()
+	defer t.orderMu.Unlock()
+	kb.pending -= n
+	if kb.pending == 0 && t.keyBundlers[orderingKey] == kb {
+		delete(t.keyBundlers, orderingKey)
+	}
+}
+
 // Stop sends all remaining published messages and stop goroutines created for handling
 // publishing. Returns once all outstanding messages have been sent or have
 // failed to be sent.
@@ -430,6 +689,15 @@ func (t *Topic) Stop() {
 		return
 	}
 	t.bundler.Flush()
+	t.orderMu.Lock()
+	var bs []*keyBundler
+	for _, kb := range t.keyBundlers {
+		bs = append(bs, kb)
+	}
+	t.orderMu.Unlock()
+	for _, kb := range bs {
+		kb.Flush()
+	}
 }
 
 // A PublishResult holds the result from a call to Publish.
@@ -437,6 +705,7 @@ type PublishResult struct {
 	ready    chan struct{}
 	serverID string
 	err      error
+	span     *trace.Span // ended when the result is set; nil if there is none
 }
 
 // Ready returns a channel that is closed when the result is ready.
@@ -463,12 +732,16 @@ func (r *PublishResult) Get(ctx context.Context) (serverID string, err error) {
 func (r *PublishResult) set(sid string, err error) {
 	r.serverID = sid
 	r.err = err
+	if r.span != nil {
+		endPublishSpan(r.span, sid, err)
+	}
 	close(r.ready)
 }
 
 type bundledMessage struct {
-	msg *Message
-	res *PublishResult
+	msg  *Message
+	res  *PublishResult
+	size int // for flow control, since msg is released before res is set
 }
 
 func (t *Topic) initBundler() {
@@ -484,9 +757,18 @@ func (t *Topic) initBundler() {
 	if t.stopped || t.bundler != nil {
 		return
 	}
+	fcs := t.PublishSettings.FlowControlSettings
+	if fcs.LimitExceededBehavior != FlowControlIgnore && (fcs.MaxOutstandingMessages > 0 || fcs.MaxOutstandingBytes > 0) {
+		t.flow = newFlowController(fcs.MaxOutstandingMessages, fcs.MaxOutstandingBytes)
+	}
+	t.bundler = t.newBundler(t.publishMessageBundle)
+}
 
+// newBundler returns a bundler configured by t.PublishSettings that calls
+// handle with each bundle.
+func (t *Topic) newBundler(handle func(context.Context, []*bundledMessage)) *bundler.Bundler {
 	timeout := t.PublishSettings.Timeout
-	t.bundler = bundler.NewBundler(&bundledMessage{}, func(items interface{}) {
+	b := bundler.NewBundler(&bundledMessage{}, func(items interface{}) {
 		// TODO(jba): use a context detached from the one passed to NewClient.
 		ctx := context.TODO()
 		if timeout != 0 {
@@ -494,30 +776,35 @@ func (t *Topic) initBundler() {
 			ctx, cancel = context.WithTimeout(ctx, timeout)
 			defer cancel()
 		}
-		t.publishMessageBundle(ctx, items.([]*bundledMessage))
+		handle(ctx, items.([]*bundledMessage))
 	})
-	t.bundler.DelayThreshold = t.PublishSettings.DelayThreshold
-	t.bundler.BundleCountThreshold = t.PublishSettings.CountThreshold
-	if t.bundler.BundleCountThreshold > MaxPublishRequestCount {
-		t.bundler.BundleCountThreshold = MaxPublishRequestCount
+	b.DelayThreshold = t.PublishSettings.DelayThreshold
+	b.BundleCountThreshold = t.PublishSettings.CountThreshold
+	if b.BundleCountThreshold > MaxPublishRequestCount {
+		b.BundleCountThreshold = MaxPublishRequestCount
 	}
-	t.bundler.BundleByteThreshold = t.PublishSettings.ByteThreshold
+	b.BundleByteThreshold = t.PublishSettings.ByteThreshold
 
 	bufferedByteLimit := DefaultPublishSettings.BufferedByteLimit
 	if t.PublishSettings.BufferedByteLimit > 0 {
 		bufferedByteLimit = t.PublishSettings.BufferedByteLimit
 	}
-	t.bundler.BufferedByteLimit = bufferedByteLimit
+	fcs := t.PublishSettings.FlowControlSettings
+	if fcs.LimitExceededBehavior == FlowControlBlock && fcs.MaxOutstandingBytes > bufferedByteLimit {
+		bufferedByteLimit = fcs.MaxOutstandingBytes
+	}
+	b.BufferedByteLimit = bufferedByteLimit
 
 	// Set the bundler's max size per payload, accounting for topic name's overhead.
-	t.bundler.BundleByteLimit = MaxPublishRequestBytes - calcFieldSizeString(t.name)
+	b.BundleByteLimit = MaxPublishRequestBytes - calcFieldSizeString(t.name)
 	// Unless overridden, allow many goroutines per CPU to call the Publish RPC concurrently.
 	// The default value was determined via extensive load testing (see the loadtest subdirectory).
 	if t.PublishSettings.NumGoroutines > 0 {
-		t.bundler.HandlerLimit = t.PublishSettings.NumGoroutines
+		b.HandlerLimit = t.PublishSettings.NumGoroutines
 	} else {
-		t.bundler.HandlerLimit = 25 * runtime.GOMAXPROCS(0)
+		b.HandlerLimit = 25 * runtime.GOMAXPROCS(0)
 	}
+	return b
 }
 
 func (t *Topic) publishMessageBundle(ctx context.Context, bms []*bundledMessage) {
@@ -528,8 +815,9 @@ func (t *Topic) publishMessageBundle(ctx context.Context, bms []*bundledMessage)
 	pbMsgs := make([]*pb.PubsubMessage, len(bms))
 	for i, bm := range bms {
 		pbMsgs[i] = &pb.PubsubMessage{
-			Data:       bm.msg.Data,
-			Attributes: bm.msg.Attributes,
+			Data:        bm.msg.Data,
+			Attributes:  bm.msg.Attributes,
+			OrderingKey: bm.msg.OrderingKey,
 		}
 		bm.msg = nil // release bm.msg for GC
 	}
@@ -544,11 +832,16 @@ func (t *Topic) publishMessageBundle(ctx context.Context, bms []*bundledMessage)
 		// using same stats.Record() call as success case.
 		ctx, _ = tag.New(ctx, tag.Upsert(keyStatus, "ERROR"),
 			tag.Upsert(keyError, err.Error()))
+		// The messages of a bundle from a key bundler share an ordering key.
+		if key := pbMsgs[0].OrderingKey; key != "" {
+			t.pause(key)
+		}
 	}
 	stats.Record(ctx,
 		PublishLatency.M(float64(end.Sub(start)/time.Millisecond)),
 		PublishedMessages.M(int64(len(bms))))
 	for i, bm := range bms {
+		t.releaseFlowControl(bm.size)
 		if err != nil {
 			bm.res.set("", err)
 		} else {
@@ -18,10 +18,12 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/smyte/google-cloud-go/internal/testutil"
+	"go.opencensus.io/stats/view"
 	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
 	"google.golang.org/api/support/bundler"
@@ -188,6 +190,154 @@ func TestPublishBufferedByteLimit(t *testing.T) {
 	}
 }
 
+func TestPublishFlowControlBlock(t *testing.T) {
+	ctx := context.Background()
+	client, srv := newFake(t)
+	defer client.Close()
+	defer srv.Close()
+
+	if err := view.Register(PublishFlowControlLatencyView); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(PublishFlowControlLatencyView)
+
+	topic := mustCreateTopic(t, client, "t")
+	defer topic.Stop()
+	topic.PublishSettings.DelayThreshold = 200 * time.Millisecond
+	topic.PublishSettings.FlowControlSettings = FlowControlSettings{
+		MaxOutstandingMessages: 1,
+		LimitExceededBehavior:  FlowControlBlock,
+	}
+
+	r1 := topic.Publish(ctx, &Message{Data: []byte("1")})
+	// The first message is not sent before the delay threshold, so a second
+	// Publish blocks until its context is done.
+	cctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err := topic.Publish(cctx, &Message{Data: []byte("2")}).Get(ctx); err != context.DeadlineExceeded {
+		t.Errorf("got %v, want context.DeadlineExceeded", err)
+	}
+	// Without a deadline, it blocks until the first message is published.
+	r3 := topic.Publish(ctx, &Message{Data: []byte("3")})
+	select {
+	case <-r1.Ready():
+	default:
+		t.Error("Publish returned before the outstanding message was published")
+	}
+	for _, r := range []*PublishResult{r1, r3} {
+		if _, err := r.Get(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rows, err := view.RetrieveData(PublishFlowControlLatencyView.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) == 0 {
+		t.Error("no flow control latency recorded")
+	}
+}
+
+func TestPublishFlowControlSignalError(t *testing.T) {
+	ctx := context.Background()
+	client, srv := newFake(t)
+	defer client.Close()
+	defer srv.Close()
+
+	for i, test := range []struct {
+		fcs     FlowControlSettings
+		wantErr error
+	}{
+		{FlowControlSettings{MaxOutstandingMessages: 1, LimitExceededBehavior: FlowControlSignalError}, ErrFlowControllerMaxOutstandingMessages},
+		{FlowControlSettings{MaxOutstandingBytes: 100, LimitExceededBehavior: FlowControlSignalError}, ErrFlowControllerMaxOutstandingBytes},
+		{FlowControlSettings{MaxOutstandingMessages: 1, LimitExceededBehavior: FlowControlIgnore}, nil},
+	} {
+		topic := mustCreateTopic(t, client, fmt.Sprintf("t%d", i))
+		topic.PublishSettings.DelayThreshold = time.Hour
+		topic.PublishSettings.FlowControlSettings = test.fcs
+		r1 := topic.Publish(ctx, &Message{Data: bytes.Repeat([]byte{'A'}, 60)})
+		r2 := topic.Publish(ctx, &Message{Data: bytes.Repeat([]byte{'B'}, 60)})
+		select {
+		case <-r2.Ready():
+			if _, err := r2.Get(ctx); err != test.wantErr {
+				t.Errorf("%+v: got %v, want %v", test.fcs, err, test.wantErr)
+			}
+		default:
+			if test.wantErr != nil {
+				t.Errorf("%+v: second message was accepted", test.fcs)
+			}
+		}
+		topic.Stop()
+		if _, err := r1.Get(ctx); err != nil {
+			t.Errorf("%+v: %v", test.fcs, err)
+		}
+	}
+}
+
+func TestPublishOrderingKeyRequiresOrdering(t *testing.T) {
+	ctx := context.Background()
+	c := &Client{projectID: "projid"}
+	topic := c.Topic("t")
+	r := topic.Publish(ctx, &Message{OrderingKey: "k"})
+	if _, err := r.Get(ctx); err != errTopicOrderingDisabled {
+		t.Errorf("got %v, want errTopicOrderingDisabled", err)
+	}
+}
+
+func TestPublishOrderingPaused(t *testing.T) {
+	ctx := context.Background()
+	client, srv := newFake(t)
+	defer client.Close()
+	defer srv.Close()
+
+	// Publishing to a missing topic fails, which pauses the ordering key.
+	topic := client.Topic("t")
+	topic.EnableMessageOrdering = true
+	defer topic.Stop()
+	if _, err := topic.Publish(ctx, &Message{Data: []byte("1"), OrderingKey: "k"}).Get(ctx); status.Code(err) != codes.NotFound {
+		t.Fatalf("got %v, want NotFound", err)
+	}
+	_, err := topic.Publish(ctx, &Message{Data: []byte("2"), OrderingKey: "k"}).Get(ctx)
+	if want := (ErrPublishingPaused{OrderingKey: "k"}); err != want {
+		t.Errorf("got %v, want %v", err, want)
+	}
+
+	// Other keys are not affected.
+	mustCreateTopic(t, client, "t")
+	if _, err := topic.Publish(ctx, &Message{Data: []byte("3"), OrderingKey: "other"}).Get(ctx); err != nil {
+		t.Errorf("publish with another key: %v", err)
+	}
+	topic.ResumePublish("k")
+	if _, err := topic.Publish(ctx, &Message{Data: []byte("4"), OrderingKey: "k"}).Get(ctx); err != nil {
+		t.Errorf("publish after ResumePublish: %v", err)
+	}
+}
+
+func TestPublishOrderingDropsBundlers(t *testing.T) {
+	ctx := context.Background()
+	client, srv := newFake(t)
+	defer client.Close()
+	defer srv.Close()
+
+	topic := mustCreateTopic(t, client, "t")
+	topic.EnableMessageOrdering = true
+	var results []*PublishResult
+	for i := 0; i < 10; i++ {
+		results = append(results, topic.Publish(ctx, &Message{Data: []byte("x"), OrderingKey: fmt.Sprint(i % 3)}))
+	}
+	for _, r := range results {
+		if _, err := r.Get(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	topic.Stop()
+	topic.orderMu.Lock()
+	defer topic.orderMu.Unlock()
+	if n := len(topic.keyBundlers); n != 0 {
+		t.Errorf("got %d bundlers after publishing, want 0", n)
+	}
+}
+
 func TestUpdateTopic_Label(t *testing.T) {
 	ctx := context.Background()
 	client, srv := newFake(t)
@@ -289,3 +439,115 @@ func mustCreateTopicWithConfig(t *testing.T, c *Client, id string, tc *TopicConf
 	}
 	return topic
 }
+
+func TestPublishCompression(t *testing.T) {
+	ctx := context.Background()
+	client, srv := newFake(t)
+	defer client.Close()
+	defer srv.Close()
+
+	big := bytes.Repeat([]byte(`{"key": "value"}`), 1000)
+	for _, c := range []Compression{Gzip, Zstd} {
+		topic := mustCreateTopic(t, client, "t-"+c.String())
+		topic.PublishSettings.Compression = c
+		topic.PublishSettings.CompressionThreshold = 100
+		sub, err := client.CreateSubscription(ctx, "s-"+c.String(), SubscriptionConfig{Topic: topic})
+		if err != nil {
+			t.Fatal(err)
+		}
+		attrs := map[string]string{"k": "v"}
+		msg := &Message{Data: big, Attributes: attrs}
+		bigID, err := topic.Publish(ctx, msg).Get(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(msg.Data, big) || len(attrs) != 1 {
+			t.Errorf("%v: Publish modified the message", c)
+		}
+		smallID, err := topic.Publish(ctx, &Message{Data: []byte("small")}).Get(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		topic.Stop()
+
+		// The server has the compressed data.
+		sm := srv.Message(bigID)
+		if len(sm.Data) >= len(big) || sm.Attributes[compressionAttribute] != c.String() {
+			t.Errorf("%v: server has %d bytes with attributes %v", c, len(sm.Data), sm.Attributes)
+		}
+		if sm := srv.Message(smallID); string(sm.Data) != "small" || len(sm.Attributes) != 0 {
+			t.Errorf("%v: small message was compressed", c)
+		}
+
+		msgs, err := pullN(ctx, sub, 2, func(_ context.Context, m *Message) { m.Ack() })
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range msgs {
+			if m.ID != bigID {
+				continue
+			}
+			if !bytes.Equal(m.Data, big) {
+				t.Errorf("%v: received data was not decompressed", c)
+			}
+			if want := map[string]string{"k": "v"}; !testutil.Equal(m.Attributes, want) {
+				t.Errorf("%v: got attributes %v, want %v", c, m.Attributes, want)
+			}
+		}
+	}
+}
+
+func TestDecompressMessageError(t *testing.T) {
+	m := &Message{Data: []byte("not gzip"), Attributes: map[string]string{compressionAttribute: "gzip"}}
+	decompressMessage(m)
+	if string(m.Data) != "not gzip" || m.Attributes[compressionAttribute] != "gzip" {
+		t.Errorf("got %q with attributes %v, want the message unchanged", m.Data, m.Attributes)
+	}
+}
+
+func TestDecompressLimit(t *testing.T) {
+	for _, c := range []Compression{Gzip, Zstd} {
+		data, err := c.compress(make([]byte, maxDecompressedBytes+1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := &Message{Data: data, Attributes: map[string]string{compressionAttribute: c.String()}}
+		decompressMessage(m)
+		if !bytes.Equal(m.Data, data) || m.Attributes[compressionAttribute] != c.String() {
+			t.Errorf("%v: got %d bytes with attributes %v, want the message unchanged", c, len(m.Data), m.Attributes)
+		}
+		if _, err := decompress(c.String(), data); err != errDecompressedTooLarge {
+			t.Errorf("%v: got %v, want errDecompressedTooLarge", c, err)
+		}
+	}
+}
+
+func TestPublishCompressionWithSchema(t *testing.T) {
+	ctx := context.Background()
+	client, srv := newFake(t)
+	defer client.Close()
+	defer srv.Close()
+
+	s, err := client.RegisterSchema("orders", SchemaAvro, testAvroSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic := mustCreateTopic(t, client, "t")
+	topic.PublishSettings.Compression = Gzip
+	topic.PublishSettings.CompressionThreshold = 100
+	topic.SchemaSettings = &SchemaSettings{Schema: s, Encoding: EncodingJSON}
+	note := strings.Repeat("gift ", 1000)
+	data, err := s.Encode(testOrder{Item: "widget", Quantity: 3, Note: &note}, EncodingJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := topic.Publish(ctx, &Message{Data: data}).Get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic.Stop()
+	sm := srv.Message(id)
+	if !bytes.Equal(sm.Data, data) || sm.Attributes[compressionAttribute] != "" {
+		t.Errorf("got %d bytes with attributes %v, want the data uncompressed", len(sm.Data), sm.Attributes)
+	}
+}
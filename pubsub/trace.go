@@ -18,13 +18,17 @@ import (
 	"context"
 	"log"
 	"sync"
+	"time"
 
+	"github.com/smyte/google-cloud-go/internal/tracecontext"
 	"go.opencensus.io/plugin/ocgrpc"
 	"go.opencensus.io/stats"
 	"go.opencensus.io/stats/view"
 	"go.opencensus.io/tag"
+	"go.opencensus.io/trace"
 	"google.golang.org/api/option"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
 )
 
 func openCensusOptions() []option.ClientOption {
@@ -58,6 +62,11 @@ var (
 	// It is EXPERIMENTAL and subject to change or removal without notice.
 	PublishLatency = stats.Float64(statsPrefix+"publish_roundtrip_latency", "The latency in milliseconds per publish batch", stats.UnitMilliseconds)
 
+	// PublishFlowControlLatency is a measure of the number of milliseconds that Publish
+	// waited for a message to be within the limits of the topic's FlowControlSettings.
+	// It is EXPERIMENTAL and subject to change or removal without notice.
+	PublishFlowControlLatency = stats.Float64(statsPrefix+"publish_flow_control_latency", "The time in milliseconds that Publish waited for flow control", stats.UnitMilliseconds)
+
 	// PullCount is a measure of the number of messages pulled.
 	// It is EXPERIMENTAL and subject to change or removal without notice.
 	PullCount = stats.Int64(statsPrefix+"pull_count", "Number of PubSub messages pulled", stats.UnitDimensionless)
@@ -104,6 +113,10 @@ var (
 	// It is EXPERIMENTAL and subject to change or removal without notice.
 	PublishLatencyView *view.View
 
+	// PublishFlowControlLatencyView is a distribution of PublishFlowControlLatency.
+	// It is EXPERIMENTAL and subject to change or removal without notice.
+	PublishFlowControlLatencyView *view.View
+
 	// PullCountView is a cumulative sum of PullCount.
 	// It is EXPERIMENTAL and subject to change or removal without notice.
 	PullCountView *view.View
@@ -144,6 +157,7 @@ var (
 func init() {
 	PublishedMessagesView = createCountView(stats.Measure(PublishedMessages), keyTopic, keyStatus, keyError)
 	PublishLatencyView = createDistView(PublishLatency, keyTopic, keyStatus, keyError)
+	PublishFlowControlLatencyView = createDistView(PublishFlowControlLatency, keyTopic)
 	PullCountView = createCountView(PullCount, keySubscription)
 	AckCountView = createCountView(AckCount, keySubscription)
 	NackCountView = createCountView(NackCount, keySubscription)
@@ -157,6 +171,7 @@ func init() {
 	DefaultPublishViews = []*view.View{
 		PublishedMessagesView,
 		PublishLatencyView,
+		PublishFlowControlLatencyView,
 	}
 
 	DefaultSubscribeViews = []*view.View{
@@ -215,3 +230,103 @@ func withSubscriptionKey(ctx context.Context, subName string) context.Context {
 func recordStat(ctx context.Context, m *stats.Int64Measure, n int64) {
 	stats.Record(ctx, m.M(n))
 }
+
+// traceparentAttribute is the message attribute that carries the context of
+// the span that published the message, as a W3C Trace Context traceparent.
+const traceparentAttribute = "googclient_traceparent"
+
+// maxAttributes is the maximum number of attributes of a message accepted by
+// the service.
+const maxAttributes = 100
+
+const (
+	publishSpanName = "github.com/smyte/google-cloud-go/pubsub.Topic.Publish"
+	receiveSpanName = "github.com/smyte/google-cloud-go/pubsub.Subscription.Receive"
+)
+
+// startPublishSpan starts a span for publishing msg to topic, as a child of
+// the span in ctx. If the span is sampled, it returns a copy of msg with the
+// span's context recorded in its attributes; otherwise, or if msg has no room
+// for another attribute, it returns msg. msg is not modified.
+func startPublishSpan(ctx context.Context, topic string, msg *Message) (*trace.Span, *Message) {
+	_, span := trace.StartSpan(ctx, publishSpanName, trace.WithSpanKind(trace.SpanKindClient))
+	span.AddAttributes(trace.StringAttribute("topic", topic))
+	sc := span.SpanContext()
+	if !sc.IsSampled() || len(msg.Attributes) >= maxAttributes {
+		return span, msg
+	}
+	attrs := make(map[string]string, len(msg.Attributes)+1)
+	for k, v := range msg.Attributes {
+		attrs[k] = v
+	}
+	attrs[traceparentAttribute] = tracecontext.EncodeTraceparent(sc.TraceID, sc.SpanID, byte(sc.TraceOptions))
+	return span, &Message{
+		Data:        msg.Data,
+		Attributes:  attrs,
+		OrderingKey: msg.OrderingKey,
+	}
+}
+
+// endPublishSpan ends a span started by startPublishSpan with the result of
+// publishing.
+func endPublishSpan(span *trace.Span, serverID string, err error) {
+	if err != nil {
+		span.SetStatus(trace.Status{Code: int32(status.Code(err)), Message: err.Error()})
+	} else {
+		span.AddAttributes(trace.StringAttribute("message_id", serverID))
+	}
+	span.End()
+}
+
+// callWithSpan calls f with msg in a span for receiving msg from sub. If msg
+// carries the context of the span that published it, the span is a child of
+// that span, linked to the span in ctx; otherwise it is a child of the span in
+// ctx. The attribute that carries the context is removed from msg before f
+// is called. The span ends when f returns. If msg is acked or nacked before
+// then, the span has an annotation saying which.
+func callWithSpan(ctx context.Context, sub string, msg *Message, f func(context.Context, *Message)) {
+	var span *trace.Span
+	traceparent, hasTraceparent := msg.Attributes[traceparentAttribute]
+	if hasTraceparent {
+		attrs := make(map[string]string, len(msg.Attributes)-1)
+		for k, v := range msg.Attributes {
+			if k != traceparentAttribute {
+				attrs[k] = v
+			}
+		}
+		msg.Attributes = attrs
+	}
+	if tid, sid, opts, ok := tracecontext.DecodeTraceparent(traceparent); ok {
+		parent := trace.SpanContext{TraceID: tid, SpanID: sid, TraceOptions: trace.TraceOptions(opts)}
+		local := trace.FromContext(ctx)
+		ctx, span = trace.StartSpanWithRemoteParent(ctx, receiveSpanName, parent, trace.WithSpanKind(trace.SpanKindServer))
+		if local != nil {
+			lsc := local.SpanContext()
+			span.AddLink(trace.Link{TraceID: lsc.TraceID, SpanID: lsc.SpanID, Type: trace.LinkTypeParent})
+		}
+	} else {
+		ctx, span = trace.StartSpan(ctx, receiveSpanName, trace.WithSpanKind(trace.SpanKindServer))
+	}
+	span.AddAttributes(trace.StringAttribute("subscription", sub), trace.StringAttribute("message_id", msg.ID))
+
+	var mu sync.Mutex
+	returned := false // whether f has returned and the span has ended
+	old := msg.doneFunc
+	msg.doneFunc = func(ackID string, ack bool, receiveTime time.Time) {
+		mu.Lock()
+		if !returned {
+			if ack {
+				span.Annotate(nil, "Acked")
+			} else {
+				span.Annotate(nil, "Nacked")
+			}
+		}
+		mu.Unlock()
+		old(ackID, ack, receiveTime)
+	}
+	f(ctx, msg)
+	mu.Lock()
+	returned = true
+	mu.Unlock()
+	span.End()
+}
@@ -0,0 +1,174 @@
+// Copyright 2019 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/smyte/google-cloud-go/internal/tracecontext"
+	"go.opencensus.io/trace"
+)
+
+type spanRecorder struct {
+	mu    sync.Mutex
+	spans []*trace.SpanData
+}
+
+func (r *spanRecorder) ExportSpan(s *trace.SpanData) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = append(r.spans, s)
+}
+
+func (r *spanRecorder) count(name string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := 0
+	for _, s := range r.spans {
+		if s.Name == name {
+			n++
+		}
+	}
+	return n
+}
+
+func (r *spanRecorder) find(name string) *trace.SpanData {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, s := range r.spans {
+		if s.Name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+func TestTracePropagation(t *testing.T) {
+	ctx := context.Background()
+	client, srv := newFake(t)
+	defer client.Close()
+	defer srv.Close()
+
+	rec := &spanRecorder{}
+	trace.RegisterExporter(rec)
+	defer trace.UnregisterExporter(rec)
+
+	topic := mustCreateTopic(t, client, "t")
+	defer topic.Stop()
+	sub, err := client.CreateSubscription(ctx, "s", SubscriptionConfig{Topic: topic})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pctx, parent := trace.StartSpan(ctx, "parent", trace.WithSampler(trace.AlwaysSample()))
+	attrs := map[string]string{"k": "v"}
+	msg := &Message{Data: []byte("m"), Attributes: attrs}
+	id, err := topic.Publish(pctx, msg).Get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parent.End()
+	if len(msg.Attributes) != 1 || len(attrs) != 1 {
+		t.Errorf("Publish modified the caller's attributes: %v", msg.Attributes)
+	}
+	pub := rec.find(publishSpanName)
+	if pub == nil {
+		t.Fatal("no publish span")
+	}
+	if pub.TraceID != parent.SpanContext().TraceID || pub.ParentSpanID != parent.SpanContext().SpanID {
+		t.Errorf("publish span is not a child of the parent span")
+	}
+	if got := pub.Attributes["message_id"]; got != id {
+		t.Errorf("publish span message_id: got %v, want %q", got, id)
+	}
+
+	// The receiving context has its own unsampled span, which the receive
+	// span links to.
+	rctx, local := trace.StartSpan(ctx, "local", trace.WithSampler(trace.NeverSample()))
+	msgs, err := pullN(rctx, sub, 1, func(_ context.Context, m *Message) { m.Ack() })
+	if err != nil {
+		t.Fatal(err)
+	}
+	local.End()
+	if got := msgs[0].Attributes; len(got) != 1 || got["k"] != "v" {
+		t.Errorf("callback got attributes %v, want %v", got, attrs)
+	}
+	recv := rec.find(receiveSpanName)
+	if recv == nil {
+		t.Fatal("no receive span")
+	}
+	if recv.TraceID != pub.TraceID || recv.ParentSpanID != pub.SpanID || !recv.HasRemoteParent {
+		t.Errorf("receive span is not a child of the publish span")
+	}
+	if len(recv.Links) != 1 || recv.Links[0].SpanID != local.SpanContext().SpanID {
+		t.Errorf("got links %v, want a link to the local span", recv.Links)
+	}
+	if len(recv.Annotations) != 1 || recv.Annotations[0].Message != "Acked" {
+		t.Errorf("got annotations %v, want Acked", recv.Annotations)
+	}
+
+	// The receive span ends when the callback returns, even if the message
+	// has not been acked yet.
+	if _, err := topic.Publish(pctx, &Message{Data: []byte("m2")}).Get(ctx); err != nil {
+		t.Fatal(err)
+	}
+	ended := make(chan bool, 1)
+	_, err = pullN(ctx, sub, 1, func(_ context.Context, m *Message) {
+		go func() {
+			defer m.Ack()
+			for start := time.Now(); time.Since(start) < 10*time.Second; time.Sleep(10 * time.Millisecond) {
+				if rec.count(receiveSpanName) == 2 {
+					ended <- true
+					return
+				}
+			}
+			ended <- false
+		}()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !<-ended {
+		t.Error("receive span did not end when the callback returned")
+	}
+}
+
+func TestPublishSpanAttributes(t *testing.T) {
+	ctx, parent := trace.StartSpan(context.Background(), "parent", trace.WithSampler(trace.AlwaysSample()))
+	defer parent.End()
+
+	span, got := startPublishSpan(ctx, "t", &Message{Data: []byte("m")})
+	span.End()
+	tid, sid, _, ok := tracecontext.DecodeTraceparent(got.Attributes[traceparentAttribute])
+	if !ok || tid != span.SpanContext().TraceID || sid != span.SpanContext().SpanID {
+		t.Errorf("got traceparent %q, want the publish span's context", got.Attributes[traceparentAttribute])
+	}
+
+	// A message with the most attributes allowed is published as it is.
+	attrs := map[string]string{}
+	for i := 0; i < maxAttributes; i++ {
+		attrs[fmt.Sprint(i)] = "v"
+	}
+	msg := &Message{Data: []byte("m"), Attributes: attrs}
+	span, got = startPublishSpan(ctx, "t", msg)
+	span.End()
+	if got != msg || len(msg.Attributes) != maxAttributes {
+		t.Errorf("got %d attributes, want the message's %d", len(got.Attributes), maxAttributes)
+	}
+}